@@ -3,11 +3,17 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	sdk "github.com/slicervm/sdk"
 
@@ -15,18 +21,24 @@ import (
 	"github.com/gaarutyunov/slicer/pkg/certmanager"
 	"github.com/gaarutyunov/slicer/pkg/crossplane"
 	xprunner "github.com/gaarutyunov/slicer/pkg/crossplane/runner"
+	"github.com/gaarutyunov/slicer/pkg/discovery"
+	"github.com/gaarutyunov/slicer/pkg/dns"
+	"github.com/gaarutyunov/slicer/pkg/export"
 	"github.com/gaarutyunov/slicer/pkg/gitea"
 	"github.com/gaarutyunov/slicer/pkg/grafana"
 	"github.com/gaarutyunov/slicer/pkg/k3s"
 	"github.com/gaarutyunov/slicer/pkg/openfaas"
+	"github.com/gaarutyunov/slicer/pkg/pki"
 	"github.com/gaarutyunov/slicer/pkg/postgres"
+	"github.com/gaarutyunov/slicer/pkg/registry"
 	"github.com/gaarutyunov/slicer/pkg/runner"
 	"github.com/gaarutyunov/slicer/pkg/rustfs"
+	"github.com/gaarutyunov/slicer/pkg/vmspec"
 	"github.com/magefile/mage/mg"
 )
 
-// loadSSHKey reads an SSH public key from SSH_KEY_PATH env var or default location
-func loadSSHKey() string {
+// sshKeyPath returns the SSH public key path from SSH_KEY_PATH env var or default location
+func sshKeyPath() string {
 	keyPath := os.Getenv("SSH_KEY_PATH")
 	if keyPath == "" {
 		home, err := os.UserHomeDir()
@@ -34,6 +46,12 @@ func loadSSHKey() string {
 			keyPath = home + "/.ssh/id_ed25519.pub"
 		}
 	}
+	return keyPath
+}
+
+// loadSSHKey reads an SSH public key from SSH_KEY_PATH env var or default location
+func loadSSHKey() string {
+	keyPath := sshKeyPath()
 	if keyPath != "" {
 		if keyData, err := os.ReadFile(keyPath); err == nil {
 			return strings.TrimSpace(string(keyData))
@@ -52,6 +70,92 @@ func hasTag(tags []string, tag string) bool {
 	return false
 }
 
+// confirm asks a yes/no question on stdin; CONFIRM=true answers yes without prompting
+func confirm(question string) bool {
+	if os.Getenv("CONFIRM") == "true" {
+		return true
+	}
+
+	fmt.Printf("%s [y/N]: ", question)
+	reader := bufio.NewReader(os.Stdin)
+	answer, _ := reader.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// confirmDataVolumeDelete warns before deleting a VM that carries a data volume
+func confirmDataVolumeDelete(nodes []sdk.SlicerNode, hostname, dataDir string) error {
+	for _, node := range nodes {
+		if node.Hostname != hostname || !hasTag(node.Tags, vmspec.DataVolumeTag) {
+			continue
+		}
+
+		fmt.Printf("WARNING: %s has a data volume holding %s\n", hostname, dataDir)
+		fmt.Printf("Deleting the VM may permanently destroy that data. Use replace to recreate it instead.\n")
+		if !confirm(fmt.Sprintf("Delete %s?", hostname)) {
+			return fmt.Errorf("aborted deleting %s", hostname)
+		}
+	}
+	return nil
+}
+
+// discoverEndpoint finds the single VM running a service; hostnameEnv names an
+// env var that selects the VM by hostname when more than one is running
+func discoverEndpoint(ctx context.Context, service, hostnameEnv string) (*discovery.Endpoint, error) {
+	resolver, err := discovery.NewResolverFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resolver: %w", err)
+	}
+
+	return resolver.Select(ctx, service, discovery.Selector{Hostname: os.Getenv(hostnameEnv)})
+}
+
+// stackResolver returns the stack DNS server when a DNS VM is running, so new
+// VMs resolve <service>.<stack>.slicer names; otherwise the zero Resolver
+func stackResolver(ctx context.Context) dns.Resolver {
+	endpoint, err := discoverEndpoint(ctx, "dns", "DNS_VM")
+	if err != nil {
+		if !errors.Is(err, discovery.ErrNotFound) {
+			fmt.Fprintf(os.Stderr, "Warning: not using stack DNS: %v\n", err)
+		}
+		return dns.Resolver{}
+	}
+	return dns.Resolver{Server: endpoint.Host, Zone: dns.DefaultConfig().Zone()}
+}
+
+// stableHost returns the DNS name of a discovered endpoint when stack DNS is
+// available and its IP otherwise. A VM picked by hostnameEnv gets its own
+// hostname record rather than the shared service name.
+func stableHost(resolver dns.Resolver, endpoint *discovery.Endpoint, hostnameEnv string) string {
+	if !resolver.Enabled() {
+		return endpoint.Host
+	}
+	if os.Getenv(hostnameEnv) != "" {
+		return resolver.Name(endpoint.Hostname)
+	}
+	return resolver.Name(endpoint.Service)
+}
+
+// syncDNS refreshes the stack DNS records after VMs are created or deleted
+func syncDNS(ctx context.Context, resolver dns.Resolver) {
+	if !resolver.Enabled() {
+		return
+	}
+
+	deployer, err := dns.NewDeployerFromEnv(dns.DefaultConfig())
+	if err != nil {
+		fmt.Printf("Warning: failed to create DNS deployer: %v\n", err)
+		return
+	}
+
+	records, err := deployer.Sync(ctx)
+	if err != nil {
+		fmt.Printf("Warning: failed to sync DNS records, run 'mage dns:sync': %v\n", err)
+		return
+	}
+	fmt.Printf("DNS records synced (%d)\n", len(records))
+}
+
 // printNodeList prints nodes filtered by tag
 func printNodeList(nodes []sdk.SlicerNode, tag, label string) {
 	var filtered []sdk.SlicerNode
@@ -73,10 +177,161 @@ func printNodeList(nodes []sdk.SlicerNode, tag, label string) {
 	}
 }
 
+// Discover prints the endpoints of every service running in the stack
+func Discover(ctx context.Context) error {
+	resolver, err := discovery.NewResolverFromEnv()
+	if err != nil {
+		return fmt.Errorf("failed to create resolver: %w", err)
+	}
+
+	endpoints, err := resolver.All(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to discover endpoints: %w", err)
+	}
+
+	if len(endpoints) == 0 {
+		fmt.Println("No service endpoints found")
+		return nil
+	}
+
+	fmt.Printf("Endpoints (%d):\n", len(endpoints))
+	for _, e := range endpoints {
+		fmt.Printf("  - %s %s (%s) credentials=%s\n", e.Service, e.URL(), e.Hostname, e.Credentials)
+	}
+	return nil
+}
+
+// Export targets write the stack's VMs in formats other tooling reads
+type Export mg.Namespace
+
+// Env prints export lines for the Gitea stack endpoints, e.g. mage export:env > .env
+// Uses stack DNS names when a DNS VM is running; POSTGRES_VM, RUSTFS_VM and GITEA_VM select VMs
+func (Export) Env(ctx context.Context) error {
+	resolver := stackResolver(ctx)
+
+	var vars []export.Var
+	if endpoint, err := discoverEndpoint(ctx, "postgres", "POSTGRES_VM"); err == nil {
+		vars = append(vars,
+			export.Var{Name: "GITEA_DB_HOST", Value: stableHost(resolver, endpoint, "POSTGRES_VM")},
+			export.Var{Name: "GITEA_DB_PORT", Value: fmt.Sprintf("%d", endpoint.Port)},
+		)
+	} else {
+		fmt.Printf("# GITEA_DB_HOST not set: %v\n", err)
+	}
+
+	if endpoint, err := discoverEndpoint(ctx, "rustfs", "RUSTFS_VM"); err == nil {
+		vars = append(vars, export.Var{
+			Name:  "GITEA_S3_ENDPOINT",
+			Value: fmt.Sprintf("%s:%d", stableHost(resolver, endpoint, "RUSTFS_VM"), endpoint.Port),
+		})
+		if endpoint.TLS() {
+			vars = append(vars, export.Var{Name: "GITEA_S3_USE_SSL", Value: "true"})
+		}
+	} else {
+		fmt.Printf("# GITEA_S3_ENDPOINT not set: %v\n", err)
+	}
+
+	if endpoint, err := discoverEndpoint(ctx, "gitea", "GITEA_VM"); err == nil {
+		vars = append(vars, export.Var{
+			Name:  "GITEA_URL",
+			Value: fmt.Sprintf("%s://%s:%d", endpoint.Scheme, stableHost(resolver, endpoint, "GITEA_VM"), endpoint.Port),
+		})
+	} else {
+		fmt.Printf("# GITEA_URL not set: %v\n", err)
+	}
+
+	fmt.Print(export.Env(vars))
+	return nil
+}
+
+// SSHConfig prints ssh_config Host blocks for every VM, e.g. mage export:sshConfig >> ~/.ssh/config
+// The private key is SSH_KEY_PATH (default: ~/.ssh/id_ed25519.pub) without the .pub suffix
+// Host keys are pinned in SLICER_KNOWN_HOSTS (default: ~/.slicer/known_hosts), see knownHosts
+func (Export) SSHConfig(ctx context.Context) error {
+	hosts, err := exportHosts(ctx)
+	if err != nil {
+		return err
+	}
+	known, err := syncKnownHosts(hosts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(export.SSHConfig(hosts, export.DefaultUser, identityFile(), known.Path))
+	return nil
+}
+
+// Ansible prints an INI inventory grouped by service tag, e.g. mage export:ansible > inventory.ini
+// Host keys are pinned like export:sshConfig does
+func (Export) Ansible(ctx context.Context) error {
+	hosts, err := exportHosts(ctx)
+	if err != nil {
+		return err
+	}
+	known, err := syncKnownHosts(hosts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(export.Ansible(hosts, export.DefaultUser, identityFile(), known.Path))
+	return nil
+}
+
+// knownHosts returns the known_hosts file exported access pins host keys in
+func knownHosts() (export.KnownHosts, error) {
+	known := export.KnownHosts{Path: os.Getenv("SLICER_KNOWN_HOSTS")}
+	if known.Path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return known, fmt.Errorf("failed to find home directory (or set SLICER_KNOWN_HOSTS): %w", err)
+		}
+		known.Path = filepath.Join(home, ".slicer", "known_hosts")
+	}
+	return known, nil
+}
+
+// syncKnownHosts removes the known_hosts entries of VMs recreated since the
+// last export
+func syncKnownHosts(hosts []export.Host) (export.KnownHosts, error) {
+	known, err := knownHosts()
+	if err != nil {
+		return known, err
+	}
+	if err := known.Sync(hosts); err != nil {
+		return known, fmt.Errorf("failed to update %s: %w", known.Path, err)
+	}
+	return known, nil
+}
+
+// exportHosts lists every VM for the export targets
+func exportHosts(ctx context.Context) ([]export.Host, error) {
+	resolver, err := discovery.NewResolverFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resolver: %w", err)
+	}
+
+	nodes, err := resolver.Nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return export.Hosts(nodes), nil
+}
+
+// identityFile returns the private key matching the key loadSSHKey imports,
+// or "" when that key does not exist
+func identityFile() string {
+	if loadSSHKey() == "" {
+		return ""
+	}
+	return strings.TrimSuffix(sshKeyPath(), ".pub")
+}
+
 type Buildkit mg.Namespace
 
 // Deploy creates a new BuildKit VM
 // SSH_KEY_PATH env var specifies an additional SSH public key file (default: ~/.ssh/id_ed25519.pub)
+// The playground CA is trusted when the RustFS VM serves https, for S3 cache exports
+// Builds can push to the Gitea registry when a Gitea VM is running, see registryAuth
 func (Buildkit) Deploy(ctx context.Context) error {
 	config := buildkit.DefaultConfig()
 
@@ -88,6 +343,24 @@ func (Buildkit) Deploy(ctx context.Context) error {
 		config.SSHKeys = append(config.SSHKeys, key)
 	}
 
+	config.DNS = stackResolver(ctx)
+
+	// The S3 cache is optional, so a missing RustFS VM is not an error
+	var cacheURL string
+	if endpoint, err := discoverEndpoint(ctx, "rustfs", "RUSTFS_VM"); err == nil {
+		cacheURL = fmt.Sprintf("%s://%s:%d", endpoint.Scheme, stableHost(config.DNS, endpoint, "RUSTFS_VM"), endpoint.Port)
+		if endpoint.TLS() {
+			config.CACert = playgroundCA()
+		}
+	}
+
+	// The registry is optional too, BuildKit can run without Gitea
+	auth, err := registryAuth(ctx, "buildkit")
+	if err != nil {
+		fmt.Printf("Skipping registry config: %v\n", err)
+	}
+	config.Registry = auth
+
 	deployer, err := buildkit.NewDeployerFromEnv(config)
 	if err != nil {
 		return fmt.Errorf("failed to create deployer: %w", err)
@@ -95,13 +368,24 @@ func (Buildkit) Deploy(ctx context.Context) error {
 
 	resp, err := deployer.Deploy(ctx)
 	if err != nil {
+		revokeRegistryToken(ctx, auth.TokenName)
 		return fmt.Errorf("failed to deploy buildkit: %w", err)
 	}
+	syncDNS(ctx, config.DNS)
 
 	fmt.Printf("BuildKit VM deployed:\n")
 	fmt.Printf("  Hostname: %s\n", resp.Hostname)
 	fmt.Printf("  IP: %s\n", resp.IP)
 	fmt.Printf("  Created: %s\n", resp.CreatedAt)
+	if cacheURL != "" {
+		fmt.Printf("\nS3 cache on RustFS (create the bucket and a key with 'mage rustfs:createUser'):\n")
+		fmt.Printf("  --export-cache type=s3,endpoint_url=%s,bucket=buildkit-cache,region=%s,use_path_style=true,mode=max\n", cacheURL, rustfs.Region)
+		fmt.Printf("  --import-cache type=s3,endpoint_url=%s,bucket=buildkit-cache,region=%s,use_path_style=true\n", cacheURL, rustfs.Region)
+	}
+	if auth.Enabled() {
+		fmt.Printf("\nRegistry %s (user %s, insecure: %t):\n", auth.Host, auth.User, auth.Insecure)
+		fmt.Printf("  --output type=image,name=%s/<owner>/<image>:<tag>,push=true\n", auth.Host)
+	}
 
 	return nil
 }
@@ -133,11 +417,14 @@ func (Buildkit) Delete(ctx context.Context, hostname string) error {
 		return fmt.Errorf("failed to create deployer: %w", err)
 	}
 
+	tokenName := registryTokenName(ctx, hostname, deployer.RegistryTokenName)
+
 	if err := deployer.Delete(ctx, hostname); err != nil {
 		return fmt.Errorf("failed to delete buildkit VM %s: %w", hostname, err)
 	}
 
 	fmt.Printf("BuildKit VM %s deleted\n", hostname)
+	revokeRegistryToken(ctx, tokenName)
 	return nil
 }
 
@@ -172,6 +459,9 @@ func (Buildkit) YAML() error {
 	}
 
 	config := buildkit.DefaultConfig()
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid VM configuration: %w", err)
+	}
 	fmt.Println(buildkit.GenerateYAML(config, githubUser))
 	return nil
 }
@@ -192,6 +482,8 @@ func (Openfaas) Deploy(ctx context.Context) error {
 		config.SSHKeys = append(config.SSHKeys, key)
 	}
 
+	config.DNS = stackResolver(ctx)
+
 	deployer, err := openfaas.NewDeployerFromEnv(config)
 	if err != nil {
 		return fmt.Errorf("failed to create deployer: %w", err)
@@ -201,6 +493,7 @@ func (Openfaas) Deploy(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to deploy openfaas: %w", err)
 	}
+	syncDNS(ctx, config.DNS)
 
 	fmt.Printf("OpenFaaS Edge VM deployed:\n")
 	fmt.Printf("  Hostname: %s\n", resp.Hostname)
@@ -280,6 +573,9 @@ func (Openfaas) YAML() error {
 	}
 
 	config := openfaas.DefaultConfig()
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid VM configuration: %w", err)
+	}
 	fmt.Println(openfaas.GenerateYAML(config, githubUser))
 	return nil
 }
@@ -287,8 +583,13 @@ func (Openfaas) YAML() error {
 // RustFS targets
 type Rustfs mg.Namespace
 
-// Deploy creates a new RustFS VM
+// Deploy creates a new RustFS VM, or an erasure-coded cluster of RUSTFS_NODES VMs
 // SSH_KEY_PATH env var specifies an additional SSH public key file (default: ~/.ssh/id_ed25519.pub)
+// RUSTFS_NODES sets the number of VMs (default: 1, a cluster needs at least 4)
+// RUSTFS_DRIVES sets the number of data directories per VM (default: 1)
+// RUSTFS_TLS=true serves https with a certificate from the playground CA, or with
+// RUSTFS_TLS_CERT and RUSTFS_TLS_KEY (PEM files) when both are set
+// RUSTFS_MIRROR_TO mirrors continuously to a RustFS VM or S3 URL, see rustfs:mirror
 func (Rustfs) Deploy(ctx context.Context) error {
 	config := rustfs.DefaultConfig()
 
@@ -300,15 +601,51 @@ func (Rustfs) Deploy(ctx context.Context) error {
 		config.SSHKeys = append(config.SSHKeys, key)
 	}
 
+	if v := os.Getenv("RUSTFS_NODES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid RUSTFS_NODES %q: %w", v, err)
+		}
+		config.Nodes = n
+	}
+	if v := os.Getenv("RUSTFS_DRIVES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid RUSTFS_DRIVES %q: %w", v, err)
+		}
+		config.Drives = n
+	}
+	tls, err := rustfsTLSConfig()
+	if err != nil {
+		return err
+	}
+	config.TLS = tls
+	if target := os.Getenv("RUSTFS_MIRROR_TO"); target != "" {
+		config.Mirror, err = rustfsMirrorConfig(ctx, target, true)
+		if err != nil {
+			return err
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid VM configuration: %w", err)
+	}
+
+	config.DNS = stackResolver(ctx)
+
 	deployer, err := rustfs.NewDeployerFromEnv(config)
 	if err != nil {
 		return fmt.Errorf("failed to create deployer: %w", err)
 	}
 
+	if config.Cluster() {
+		return deployRustfsCluster(ctx, deployer, config)
+	}
+
 	resp, err := deployer.Deploy(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to deploy rustfs: %w", err)
 	}
+	syncDNS(ctx, config.DNS)
 
 	fmt.Printf("RustFS VM deployed:\n")
 	fmt.Printf("  Hostname: %s\n", resp.Hostname)
@@ -316,8 +653,40 @@ func (Rustfs) Deploy(ctx context.Context) error {
 	fmt.Printf("  Created: %s\n", resp.CreatedAt)
 	fmt.Printf("\nNext steps:\n")
 	fmt.Printf("  1. SSH: ssh ubuntu@%s\n", resp.IP)
-	fmt.Printf("  2. API endpoint: http://%s:9000\n", resp.IP)
-	fmt.Printf("  3. Console: http://%s:9001\n", resp.IP)
+	fmt.Printf("  2. API endpoint: %s://%s:9000\n", config.TLS.Scheme(), resp.IP)
+	fmt.Printf("  3. Console: %s://%s:9001\n", config.TLS.Scheme(), resp.IP)
+	fmt.Printf("\nCredentials (save these - password is randomly generated):\n")
+	fmt.Printf("  Access Key: %s\n", resp.Credentials.User)
+	fmt.Printf("  Secret Key: %s\n", resp.Credentials.Password)
+	if config.Mirror.Enabled() {
+		fmt.Printf("\nMirroring to %s (%s), see 'mage rustfs:status'\n", config.Mirror.Target(), config.Mirror.Schedule)
+	}
+
+	return nil
+}
+
+// deployRustfsCluster creates the cluster VMs and waits for quorum
+func deployRustfsCluster(ctx context.Context, deployer *rustfs.Deployer, config rustfs.Config) error {
+	fmt.Printf("Deploying RustFS cluster: %d nodes, %d drives each, %d parity drives\n",
+		config.Nodes, config.Drives, config.Parity())
+
+	resp, err := deployer.DeployCluster(ctx, os.Stdout)
+	syncDNS(ctx, config.DNS)
+	if err != nil {
+		return fmt.Errorf("failed to deploy rustfs cluster: %w", err)
+	}
+
+	endpoint := discovery.HostIP(resp.Nodes[0].IP)
+	if config.DNS.Enabled() {
+		endpoint = config.DNS.Name("rustfs")
+	}
+
+	fmt.Printf("\nRustFS cluster deployed:\n")
+	for _, node := range resp.Nodes {
+		fmt.Printf("  - %s (%s)\n", node.Hostname, node.IP)
+	}
+	fmt.Printf("\nEndpoint: %s://%s:%d (any member serves the whole cluster)\n", config.TLS.Scheme(), endpoint, rustfs.DefaultPort)
+	fmt.Printf("Each object survives losing up to %d drives, one VM holds %d\n", resp.Parity, config.Drives)
 	fmt.Printf("\nCredentials (save these - password is randomly generated):\n")
 	fmt.Printf("  Access Key: %s\n", resp.Credentials.User)
 	fmt.Printf("  Secret Key: %s\n", resp.Credentials.Password)
@@ -325,6 +694,60 @@ func (Rustfs) Deploy(ctx context.Context) error {
 	return nil
 }
 
+// rustfsTLSConfig builds the RustFS TLS config from env vars
+func rustfsTLSConfig() (rustfs.TLSConfig, error) {
+	var tls rustfs.TLSConfig
+	if os.Getenv("RUSTFS_TLS") != "true" {
+		return tls, nil
+	}
+
+	// The playground CA is loaded even for a provided certificate, since
+	// consumers trust it when they find a RustFS VM serving https
+	ca, err := pki.LoadOrCreate(pki.DefaultDir())
+	if err != nil {
+		return tls, fmt.Errorf("failed to load playground CA: %w", err)
+	}
+	tls.CA = ca
+
+	certFile, keyFile := os.Getenv("RUSTFS_TLS_CERT"), os.Getenv("RUSTFS_TLS_KEY")
+	if certFile == "" && keyFile == "" {
+		return tls, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return tls, fmt.Errorf("set both RUSTFS_TLS_CERT and RUSTFS_TLS_KEY, or neither to issue a certificate")
+	}
+	cert := &pki.Certificate{}
+	if cert.CertPEM, err = os.ReadFile(certFile); err != nil {
+		return tls, fmt.Errorf("failed to read RUSTFS_TLS_CERT: %w", err)
+	}
+	if cert.KeyPEM, err = os.ReadFile(keyFile); err != nil {
+		return tls, fmt.Errorf("failed to read RUSTFS_TLS_KEY: %w", err)
+	}
+	tls.Cert = cert
+	return tls, nil
+}
+
+// playgroundCA returns the playground CA certificate PEM, or "" when no CA
+// was created yet
+func playgroundCA() string {
+	ca, err := pki.Load(pki.DefaultDir())
+	if err != nil {
+		return ""
+	}
+	return string(ca.CertPEM())
+}
+
+// envBool returns true or false for an env var set to either, and def otherwise
+func envBool(name string, def bool) bool {
+	switch os.Getenv(name) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return def
+}
+
 // List shows all RustFS VMs (filtered by "rustfs" tag)
 func (Rustfs) List(ctx context.Context) error {
 	config := rustfs.DefaultConfig()
@@ -352,9 +775,18 @@ func (Rustfs) Delete(ctx context.Context, hostname string) error {
 		return fmt.Errorf("failed to create deployer: %w", err)
 	}
 
+	nodes, err := deployer.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list rustfs nodes: %w", err)
+	}
+	if err := confirmDataVolumeDelete(nodes, hostname, config.DataDir); err != nil {
+		return err
+	}
+
 	if err := deployer.Delete(ctx, hostname); err != nil {
 		return fmt.Errorf("failed to delete rustfs VM %s: %w", hostname, err)
 	}
+	syncDNS(ctx, stackResolver(ctx))
 
 	fmt.Printf("RustFS VM %s deleted\n", hostname)
 	return nil
@@ -378,69 +810,512 @@ func (Rustfs) Logs(ctx context.Context, hostname string) error {
 	return nil
 }
 
-// Userdata prints the RustFS userdata script
-func (Rustfs) Userdata() {
-	fmt.Println(rustfs.Userdata())
+// CreateBucket creates a bucket on the RustFS VM (RUSTFS_VM selects one)
+// Usage: mage rustfs:createBucket <bucket>
+func (Rustfs) CreateBucket(ctx context.Context, bucket string) error {
+	client, err := rustfsAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+	if err := client.CreateBucket(ctx, bucket); err != nil {
+		return err
+	}
+	fmt.Printf("Bucket %s ready on %s\n", bucket, client.Endpoint)
+	return nil
 }
 
-// YAML generates a Slicer config YAML for RustFS
-func (Rustfs) YAML() error {
-	githubUser := os.Getenv("GITHUB_USER")
-	if githubUser == "" {
-		return fmt.Errorf("GITHUB_USER environment variable is required")
+// ListBuckets lists the buckets on the RustFS VM (RUSTFS_VM selects one)
+func (Rustfs) ListBuckets(ctx context.Context) error {
+	client, err := rustfsAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+	buckets, err := client.ListBuckets(ctx)
+	if err != nil {
+		return err
 	}
 
-	config := rustfs.DefaultConfig()
-	fmt.Println(rustfs.GenerateYAML(config, githubUser))
+	if len(buckets) == 0 {
+		fmt.Printf("No buckets on %s\n", client.Endpoint)
+		return nil
+	}
+	fmt.Printf("Buckets on %s:\n", client.Endpoint)
+	for _, b := range buckets {
+		fmt.Printf("  - %s (created %s)\n", b.Name, b.CreationDate.Format(time.RFC3339))
+	}
 	return nil
 }
 
-// PostgreSQL targets
-type Postgres mg.Namespace
+// DeleteBucket deletes an empty bucket on the RustFS VM (asks first)
+// Usage: mage rustfs:deleteBucket <bucket>
+func (Rustfs) DeleteBucket(ctx context.Context, bucket string) error {
+	client, err := rustfsAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+	if !confirm(fmt.Sprintf("Delete bucket %s on %s?", bucket, client.Endpoint)) {
+		return fmt.Errorf("aborted deleting bucket %s", bucket)
+	}
+	if err := client.DeleteBucket(ctx, bucket); err != nil {
+		return err
+	}
+	fmt.Printf("Bucket %s deleted\n", bucket)
+	return nil
+}
 
-// Deploy creates a new PostgreSQL VM
-// SSH_KEY_PATH env var specifies an additional SSH public key file (default: ~/.ssh/id_ed25519.pub)
-// POSTGRES_DB, POSTGRES_USER, POSTGRES_PASSWORD env vars configure the database (optional)
-func (Postgres) Deploy(ctx context.Context) error {
-	config := postgres.DefaultConfig()
+// CreateUser creates a RustFS user whose key can only use one bucket
+// Usage: mage rustfs:createUser <user> <bucket>
+// The bucket and its <bucket>-readwrite policy are created when missing. RUSTFS_SECRET_KEY sets the
+// secret key, otherwise one is generated. An existing user gets the new secret key.
+func (Rustfs) CreateUser(ctx context.Context, user, bucket string) error {
+	client, err := rustfsAdminClient(ctx)
+	if err != nil {
+		return err
+	}
 
-	if gh := os.Getenv("GITHUB_USER"); gh != "" {
-		config.GitHubUser = gh
+	secretKey := os.Getenv("RUSTFS_SECRET_KEY")
+	if secretKey == "" {
+		secretKey, err = rustfs.GeneratePassword(40)
+		if err != nil {
+			return err
+		}
 	}
 
-	if key := loadSSHKey(); key != "" {
-		config.SSHKeys = append(config.SSHKeys, key)
+	if err := client.CreateScopedUser(ctx, user, secretKey, bucket); err != nil {
+		return err
 	}
 
-	// PostgreSQL specific configuration
-	if db := os.Getenv("POSTGRES_DB"); db != "" {
-		config.DBName = db
+	fmt.Printf("RustFS user created on %s:\n", client.Endpoint)
+	fmt.Printf("  Access Key: %s\n", user)
+	fmt.Printf("  Secret Key: %s\n", secretKey)
+	fmt.Printf("  Policy: %s (bucket %s only)\n", rustfs.BucketPolicyName(bucket), bucket)
+	return nil
+}
+
+// AttachPolicy sets the policies of a RustFS user, replacing the ones attached before
+// Usage: mage rustfs:attachPolicy <user> <policy>
+// Several policies are comma separated, e.g. readwrite or gitea-readwrite,diagnostics
+func (Rustfs) AttachPolicy(ctx context.Context, user, policy string) error {
+	client, err := rustfsAdminClient(ctx)
+	if err != nil {
+		return err
 	}
-	if user := os.Getenv("POSTGRES_USER"); user != "" {
-		config.DBUser = user
+	if err := client.AttachPolicy(ctx, user, strings.Split(policy, ",")...); err != nil {
+		return err
 	}
-	if pass := os.Getenv("POSTGRES_PASSWORD"); pass != "" {
-		config.DBPass = pass
+	fmt.Printf("Policy %s attached to %s\n", policy, user)
+	return nil
+}
+
+// Policies reconciles bucket versioning, expiry and quotas with their declaration
+// Usage: mage rustfs:policies <apply|diff>
+// diff only shows the drift, apply also fixes it and creates missing buckets. RUSTFS_POLICIES
+// points at a YAML file, otherwise the defaults in rustfs.DefaultBucketPolicies apply.
+func (Rustfs) Policies(ctx context.Context, action string) error {
+	if action != "apply" && action != "diff" {
+		return fmt.Errorf("unknown action %q, use apply or diff", action)
 	}
 
-	deployer, err := postgres.NewDeployerFromEnv(config)
-	if err != nil {
-		return fmt.Errorf("failed to create deployer: %w", err)
+	policies := rustfs.DefaultBucketPolicies()
+	if path := os.Getenv("RUSTFS_POLICIES"); path != "" {
+		var err error
+		if policies, err = rustfs.LoadBucketPolicies(path); err != nil {
+			return err
+		}
 	}
 
-	resp, err := deployer.Deploy(ctx)
+	client, err := rustfsAdminClient(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to deploy postgres: %w", err)
+		return err
 	}
 
+	fmt.Printf("Bucket policies on %s:\n", client.Endpoint)
+	drifted := 0
+	for _, spec := range policies.Buckets {
+		var drift []rustfs.Drift
+		if action == "apply" {
+			drift, err = client.ApplyBucket(ctx, spec)
+		} else {
+			var state *rustfs.BucketState
+			if state, err = client.BucketState(ctx, spec.Name); err == nil {
+				drift, err = spec.Diff(*state)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(drift) == 0 {
+			fmt.Printf("  %s: in sync\n", spec.Name)
+			continue
+		}
+		drifted++
+		for _, d := range drift {
+			fmt.Printf("  %s\n", d)
+		}
+	}
+
+	switch {
+	case drifted == 0:
+		fmt.Println("All buckets match their policies")
+	case action == "apply":
+		fmt.Printf("Reconciled %d bucket(s)\n", drifted)
+	default:
+		fmt.Printf("%d bucket(s) drifted, run 'mage rustfs:policies apply' to fix them\n", drifted)
+	}
+	return nil
+}
+
+// Mirror syncs buckets from one RustFS VM to another RustFS VM or an S3 target
+// Usage: mage rustfs:mirror <src> <dst>
+// dst is a RustFS hostname, or an http(s)://host:port URL with RUSTFS_MIRROR_ACCESS_KEY and
+// RUSTFS_MIRROR_SECRET_KEY. RUSTFS_MIRROR_BUCKETS limits the buckets (comma-separated, default: all).
+// Objects deleted on src are deleted on dst. RUSTFS_MIRROR_CONTINUOUS=true keeps syncing on
+// RUSTFS_MIRROR_SCHEDULE (systemd OnCalendar, default: every 5 minutes) after the first run.
+func (Rustfs) Mirror(ctx context.Context, src, dst string) error {
+	mirror, err := rustfsMirrorConfig(ctx, dst, envBool("RUSTFS_MIRROR_CONTINUOUS", false))
+	if err != nil {
+		return err
+	}
+
+	deployer, err := rustfs.NewDeployerFromEnv(rustfs.DefaultConfig())
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	fmt.Printf("Mirroring %s to %s...\n", src, mirror.Target())
+	if err := deployer.Mirror(ctx, src, mirror); err != nil {
+		return err
+	}
+
+	fmt.Printf("Mirrored %s to %s\n", src, mirror.Target())
+	if mirror.Schedule != "" {
+		fmt.Printf("Continuous mirroring on %s, check it with 'mage rustfs:status'\n", mirror.Schedule)
+	}
+	return nil
+}
+
+// StopMirror stops continuous mirroring from a RustFS VM
+// Usage: mage rustfs:stopMirror <hostname>
+func (Rustfs) StopMirror(ctx context.Context, hostname string) error {
+	deployer, err := rustfs.NewDeployerFromEnv(rustfs.DefaultConfig())
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+	if err := deployer.StopMirror(ctx, hostname); err != nil {
+		return err
+	}
+	fmt.Printf("Mirroring from %s stopped, the target keeps its copy\n", hostname)
+	return nil
+}
+
+// Status shows every RustFS VM with its mirror target, last run and lag
+func (Rustfs) Status(ctx context.Context) error {
+	deployer, err := rustfs.NewDeployerFromEnv(rustfs.DefaultConfig())
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	nodes, err := deployer.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list rustfs nodes: %w", err)
+	}
+
+	var found bool
+	now := time.Now()
+	for _, node := range nodes {
+		if !hasTag(node.Tags, "rustfs") {
+			continue
+		}
+		found = true
+
+		var traits []string
+		if hasTag(node.Tags, rustfs.TLSTag) {
+			traits = append(traits, "https")
+		}
+		if hasTag(node.Tags, rustfs.ClusterTag) {
+			traits = append(traits, "cluster member")
+		}
+		fmt.Printf("%s (%s) %s\n", node.Hostname, node.IP, strings.Join(traits, ", "))
+
+		status, err := deployer.MirrorStatus(ctx, node.Hostname)
+		if err != nil {
+			fmt.Printf("  Mirror: %v\n", err)
+			continue
+		}
+		if status == nil {
+			fmt.Printf("  Mirror: none\n")
+			continue
+		}
+
+		buckets := "all buckets"
+		if len(status.Buckets) > 0 {
+			buckets = strings.Join(status.Buckets, ", ")
+		}
+		mode := "on demand"
+		if status.Continuous {
+			mode = "continuous, " + status.Schedule
+		} else if status.Schedule != "" {
+			mode = "stopped"
+		}
+		fmt.Printf("  Mirror: %s to %s (%s)\n", buckets, status.Target, mode)
+		fmt.Printf("  Last run: %s, %s in %s\n", status.LastRun.Local().Format(time.RFC3339), status.LastResult, status.Duration)
+		if lag := status.Lag(now); lag >= 0 {
+			fmt.Printf("  Lag: %s (synced up to %s)\n", lag, status.LastSynced.Local().Format(time.RFC3339))
+		} else {
+			fmt.Printf("  Lag: unknown, no run has succeeded yet\n")
+		}
+	}
+
+	if !found {
+		fmt.Println("No RustFS VMs found")
+	}
+	return nil
+}
+
+// rustfsMirrorConfig builds a mirror config for a RustFS hostname or an S3 URL
+// target, see Rustfs.Mirror for the env vars
+func rustfsMirrorConfig(ctx context.Context, target string, continuous bool) (rustfs.MirrorConfig, error) {
+	mirror := rustfs.MirrorConfig{}
+
+	if strings.Contains(target, "://") {
+		var err error
+		mirror.Endpoint, mirror.UseSSL, err = rustfs.ParseMirrorURL(target)
+		if err != nil {
+			return mirror, err
+		}
+		mirror.AccessKey = os.Getenv("RUSTFS_MIRROR_ACCESS_KEY")
+		mirror.SecretKey = os.Getenv("RUSTFS_MIRROR_SECRET_KEY")
+		if mirror.AccessKey == "" || mirror.SecretKey == "" {
+			return mirror, fmt.Errorf("RUSTFS_MIRROR_ACCESS_KEY and RUSTFS_MIRROR_SECRET_KEY are required for %s", target)
+		}
+	} else {
+		resolver, err := discovery.NewResolverFromEnv()
+		if err != nil {
+			return mirror, fmt.Errorf("failed to create resolver: %w", err)
+		}
+		endpoints, err := resolver.FindAll(ctx, "rustfs", discovery.Selector{Hostname: target})
+		if err != nil {
+			return mirror, err
+		}
+		if len(endpoints) == 0 {
+			return mirror, fmt.Errorf("no rustfs VM named %s, use a hostname or an http(s)://host:port URL", target)
+		}
+
+		deployer, err := rustfs.NewDeployerFromEnv(rustfs.DefaultConfig())
+		if err != nil {
+			return mirror, fmt.Errorf("failed to create deployer: %w", err)
+		}
+		creds, err := deployer.AdminCredentials(ctx, target)
+		if err != nil {
+			return mirror, err
+		}
+		mirror.Endpoint = endpoints[0].Address()
+		mirror.UseSSL = endpoints[0].TLS()
+		mirror.AccessKey, mirror.SecretKey = creds.User, creds.Password
+	}
+	if mirror.UseSSL {
+		mirror.CACert = playgroundCA()
+	}
+
+	if buckets := os.Getenv("RUSTFS_MIRROR_BUCKETS"); buckets != "" {
+		for _, b := range strings.Split(buckets, ",") {
+			mirror.Buckets = append(mirror.Buckets, strings.TrimSpace(b))
+		}
+	}
+	if continuous {
+		mirror.Schedule = os.Getenv("RUSTFS_MIRROR_SCHEDULE")
+		if mirror.Schedule == "" {
+			mirror.Schedule = rustfs.DefaultMirrorSchedule
+		}
+	}
+	return mirror, mirror.Validate()
+}
+
+// rustfsAdminClient returns a client for the RustFS VM using the root
+// credentials stored on it
+func rustfsAdminClient(ctx context.Context) (*rustfs.Client, error) {
+	endpoint, err := discoverEndpoint(ctx, "rustfs", "RUSTFS_VM")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find rustfs VM (deploy one with 'mage rustfs:deploy'): %w", err)
+	}
+
+	deployer, err := rustfs.NewDeployerFromEnv(rustfs.DefaultConfig())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create deployer: %w", err)
+	}
+	creds, err := deployer.AdminCredentials(ctx, endpoint.Hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	client := rustfs.NewClient(endpoint.Address(), creds.User, creds.Password, endpoint.TLS())
+	if ca := playgroundCA(); endpoint.TLS() && ca != "" {
+		if err := client.TrustCA([]byte(ca)); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// Userdata prints the RustFS userdata script
+func (Rustfs) Userdata() {
+	fmt.Println(rustfs.Userdata())
+}
+
+// YAML generates a Slicer config YAML for RustFS
+func (Rustfs) YAML() error {
+	githubUser := os.Getenv("GITHUB_USER")
+	if githubUser == "" {
+		return fmt.Errorf("GITHUB_USER environment variable is required")
+	}
+
+	config := rustfs.DefaultConfig()
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid VM configuration: %w", err)
+	}
+	fmt.Println(rustfs.GenerateYAML(config, githubUser))
+	return nil
+}
+
+// PostgreSQL targets
+type Postgres mg.Namespace
+
+// Deploy creates a new PostgreSQL VM
+// SSH_KEY_PATH env var specifies an additional SSH public key file (default: ~/.ssh/id_ed25519.pub)
+// POSTGRES_DB, POSTGRES_USER, POSTGRES_PASSWORD env vars configure the database (optional)
+// POSTGRES_BACKUP=true enables WAL-G backups to RustFS, see postgresBackupConfig for its env vars
+// POSTGRES_STANDBYS sets the number of streaming replication standbys (default: 0)
+// POSTGRES_PROFILE selects the tuning profile: oltp, web or mixed (default: mixed)
+// POSTGRES_TLS=true serves TLS with a certificate from the playground CA, see postgresTLSConfig
+// POSTGRES_VERSION selects the major version from the PGDG repository (default: 16)
+// POSTGRES_PGBOUNCER=true runs PgBouncer on POSTGRES_PGBOUNCER_PORT (default: 6432), with
+// POSTGRES_POOL_MODE (session, transaction or statement; default: transaction) and POSTGRES_POOL_SIZE
+// server connections per database and user (default: 20)
+func (Postgres) Deploy(ctx context.Context) error {
+	config := postgres.DefaultConfig()
+
+	if gh := os.Getenv("GITHUB_USER"); gh != "" {
+		config.GitHubUser = gh
+	}
+
+	if key := loadSSHKey(); key != "" {
+		config.SSHKeys = append(config.SSHKeys, key)
+	}
+
+	// PostgreSQL specific configuration
+	if db := os.Getenv("POSTGRES_DB"); db != "" {
+		config.DBName = db
+	}
+	if user := os.Getenv("POSTGRES_USER"); user != "" {
+		config.DBUser = user
+	}
+	if pass := os.Getenv("POSTGRES_PASSWORD"); pass != "" {
+		config.DBPass = pass
+	}
+	if standbys := os.Getenv("POSTGRES_STANDBYS"); standbys != "" {
+		n, err := strconv.Atoi(standbys)
+		if err != nil {
+			return fmt.Errorf("invalid POSTGRES_STANDBYS %q: %w", standbys, err)
+		}
+		if n < 0 {
+			return fmt.Errorf("invalid POSTGRES_STANDBYS %q: must not be negative", standbys)
+		}
+		config.Standbys = n
+	}
+	if profile := os.Getenv("POSTGRES_PROFILE"); profile != "" {
+		config.Profile = postgres.Profile(profile)
+	}
+	if version := os.Getenv("POSTGRES_VERSION"); version != "" {
+		v, err := postgresVersion(version)
+		if err != nil {
+			return err
+		}
+		config.Version = v
+	}
+	if os.Getenv("POSTGRES_PGBOUNCER") == "true" {
+		config.PgBouncer.Port = postgres.DefaultPgBouncerPort
+		if port := os.Getenv("POSTGRES_PGBOUNCER_PORT"); port != "" {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return fmt.Errorf("invalid POSTGRES_PGBOUNCER_PORT %q: %w", port, err)
+			}
+			config.PgBouncer.Port = p
+		}
+		if mode := os.Getenv("POSTGRES_POOL_MODE"); mode != "" {
+			config.PgBouncer.PoolMode = postgres.PoolMode(mode)
+		}
+		if size := os.Getenv("POSTGRES_POOL_SIZE"); size != "" {
+			s, err := strconv.Atoi(size)
+			if err != nil {
+				return fmt.Errorf("invalid POSTGRES_POOL_SIZE %q: %w", size, err)
+			}
+			config.PgBouncer.PoolSize = s
+		}
+	}
+
+	config.DNS = stackResolver(ctx)
+
+	if os.Getenv("POSTGRES_BACKUP") == "true" {
+		backup, err := postgresBackupConfig(ctx, config.DNS)
+		if err != nil {
+			return err
+		}
+		config.Backup = backup
+	}
+
+	tls, err := postgresTLSConfig()
+	if err != nil {
+		return err
+	}
+	config.TLS = tls
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	resp, err := deployer.Deploy(ctx)
+	if err != nil {
+		if resp == nil {
+			return fmt.Errorf("failed to deploy postgres: %w", err)
+		}
+		// The primary is usable, print its credentials before failing
+		syncDNS(ctx, config.DNS)
+		fmt.Printf("PostgreSQL primary %s (%s) deployed, password: %s\n", resp.Hostname, resp.IP, resp.Credentials.DBPass)
+		for _, standby := range resp.Standbys {
+			fmt.Printf("  Standby: %s (%s)\n", standby.Hostname, standby.IP)
+		}
+		return fmt.Errorf("failed to deploy postgres standbys, add them with 'mage postgres:addStandby %s': %w", resp.Hostname, err)
+	}
+	syncDNS(ctx, config.DNS)
+
 	fmt.Printf("PostgreSQL VM deployed:\n")
 	fmt.Printf("  Hostname: %s\n", resp.Hostname)
 	fmt.Printf("  IP: %s\n", resp.IP)
 	fmt.Printf("  Created: %s\n", resp.CreatedAt)
+	fmt.Printf("  Version: PostgreSQL %d\n", config.Version)
+	fmt.Printf("  Tuning: %s profile for %d vCPU, %d GB RAM\n", config.Profile, config.VCPU, config.RAMGB)
+	if config.PgBouncer.Enabled() {
+		fmt.Printf("  PgBouncer: port %d, %s pooling, %d server connections per database and user\n",
+			config.PgBouncer.Port, config.PgBouncer.PoolMode, config.PgBouncer.PoolSize)
+	}
+	for _, standby := range resp.Standbys {
+		fmt.Printf("  Standby: %s (%s)\n", standby.Hostname, standby.IP)
+	}
 	fmt.Printf("\nCredentials (save these - password is randomly generated):\n")
 	fmt.Printf("  Database: %s\n", resp.Credentials.DBName)
 	fmt.Printf("  Username: %s\n", resp.Credentials.DBUser)
 	fmt.Printf("  Password: %s\n", resp.Credentials.DBPass)
+	fmt.Printf("  Replication user: %s (password in %s on the VM)\n", resp.Replication.DBUser, postgres.ReplicationPasswordFile)
+	if config.TLS.Enabled() {
+		fmt.Printf("\nTLS: hostssl only, CA in %s\n", pki.DefaultDir())
+	}
+	if config.Backup.Enabled() {
+		fmt.Printf("\nBackups:\n")
+		fmt.Printf("  Bucket: s3://%s/%s on %s\n", config.Backup.Bucket, resp.Hostname, config.Backup.Endpoint)
+		fmt.Printf("  Schedule: %s, keeping %d full backups\n", config.Backup.Schedule, config.Backup.Retain)
+	}
 	fmt.Printf("\nNext steps:\n")
 	fmt.Printf("  1. SSH: ssh ubuntu@%s\n", resp.IP)
 	fmt.Printf("  2. Connect: psql -h %s -U %s -d %s\n", resp.IP, resp.Credentials.DBUser, resp.Credentials.DBName)
@@ -448,6 +1323,80 @@ func (Postgres) Deploy(ctx context.Context) error {
 	return nil
 }
 
+// postgresTLSConfig loads the playground CA, creating it on first use, when
+// POSTGRES_TLS=true. POSTGRES_ALLOW_CIDRS is a comma-separated list of client
+// networks for pg_hba (default: the VM's own subnet).
+func postgresTLSConfig() (postgres.TLSConfig, error) {
+	var tls postgres.TLSConfig
+	if os.Getenv("POSTGRES_TLS") != "true" {
+		return tls, nil
+	}
+
+	ca, err := pki.LoadOrCreate(pki.DefaultDir())
+	if err != nil {
+		return tls, fmt.Errorf("failed to load playground CA: %w", err)
+	}
+	tls.CA = ca
+
+	if cidrs := os.Getenv("POSTGRES_ALLOW_CIDRS"); cidrs != "" {
+		for _, cidr := range strings.Split(cidrs, ",") {
+			tls.AllowCIDRs = append(tls.AllowCIDRs, strings.TrimSpace(cidr))
+		}
+	}
+	return tls, tls.Validate()
+}
+
+// postgresBackupConfig builds the WAL-G backup config from env vars, finding the
+// RustFS endpoint the same way Gitea.Deploy does
+// Required env vars: POSTGRES_BACKUP_ACCESS_KEY, POSTGRES_BACKUP_SECRET_KEY (RustFS keys)
+// Optional env vars: POSTGRES_BACKUP_ENDPOINT (auto-detected from rustfs VM), POSTGRES_BACKUP_BUCKET,
+// POSTGRES_BACKUP_SCHEDULE (systemd OnCalendar), POSTGRES_BACKUP_RETAIN, POSTGRES_BACKUP_USE_SSL
+// (default: true when the discovered RustFS VM serves https)
+func postgresBackupConfig(ctx context.Context, resolver dns.Resolver) (postgres.BackupConfig, error) {
+	backup := postgres.DefaultBackupConfig()
+
+	endpoint := os.Getenv("POSTGRES_BACKUP_ENDPOINT")
+	if endpoint == "" {
+		rustfsEndpoint, err := discoverEndpoint(ctx, "rustfs", "RUSTFS_VM")
+		if err != nil {
+			return backup, fmt.Errorf("failed to find rustfs VM (deploy one with 'mage rustfs:deploy' or set POSTGRES_BACKUP_ENDPOINT): %w", err)
+		}
+		endpoint = fmt.Sprintf("%s:%d", stableHost(resolver, rustfsEndpoint, "RUSTFS_VM"), rustfsEndpoint.Port)
+		fmt.Printf("Auto-detected RustFS endpoint: %s\n", endpoint)
+		backup.UseSSL = rustfsEndpoint.TLS()
+	}
+	backup.Endpoint = endpoint
+
+	backup.AccessKey = os.Getenv("POSTGRES_BACKUP_ACCESS_KEY")
+	if backup.AccessKey == "" {
+		return backup, fmt.Errorf("POSTGRES_BACKUP_ACCESS_KEY environment variable is required")
+	}
+	backup.SecretKey = os.Getenv("POSTGRES_BACKUP_SECRET_KEY")
+	if backup.SecretKey == "" {
+		return backup, fmt.Errorf("POSTGRES_BACKUP_SECRET_KEY environment variable is required")
+	}
+
+	if bucket := os.Getenv("POSTGRES_BACKUP_BUCKET"); bucket != "" {
+		backup.Bucket = bucket
+	}
+	if schedule := os.Getenv("POSTGRES_BACKUP_SCHEDULE"); schedule != "" {
+		backup.Schedule = schedule
+	}
+	if retain := os.Getenv("POSTGRES_BACKUP_RETAIN"); retain != "" {
+		n, err := strconv.Atoi(retain)
+		if err != nil {
+			return backup, fmt.Errorf("invalid POSTGRES_BACKUP_RETAIN %q: %w", retain, err)
+		}
+		backup.Retain = n
+	}
+	backup.UseSSL = envBool("POSTGRES_BACKUP_USE_SSL", backup.UseSSL)
+	if backup.UseSSL {
+		backup.CACert = playgroundCA()
+	}
+
+	return backup, backup.Validate()
+}
+
 // List shows all PostgreSQL VMs (filtered by "postgres" tag)
 func (Postgres) List(ctx context.Context) error {
 	config := postgres.DefaultConfig()
@@ -462,7 +1411,8 @@ func (Postgres) List(ctx context.Context) error {
 		return fmt.Errorf("failed to list postgres nodes: %w", err)
 	}
 
-	printNodeList(nodes, "postgres", "PostgreSQL")
+	printNodeList(nodes, postgres.PrimaryTag, "PostgreSQL")
+	printNodeList(nodes, postgres.StandbyTag, "PostgreSQL standby")
 	return nil
 }
 
@@ -475,12 +1425,754 @@ func (Postgres) Delete(ctx context.Context, hostname string) error {
 		return fmt.Errorf("failed to create deployer: %w", err)
 	}
 
-	if err := deployer.Delete(ctx, hostname); err != nil {
-		return fmt.Errorf("failed to delete postgres VM %s: %w", hostname, err)
+	nodes, err := deployer.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list postgres nodes: %w", err)
+	}
+	if err := confirmDataVolumeDelete(nodes, hostname, config.DataDir); err != nil {
+		return err
+	}
+
+	if err := deployer.Delete(ctx, hostname); err != nil {
+		return fmt.Errorf("failed to delete postgres VM %s: %w", hostname, err)
+	}
+	syncDNS(ctx, stackResolver(ctx))
+
+	fmt.Printf("PostgreSQL VM %s deleted\n", hostname)
+	return nil
+}
+
+// Replace recreates a PostgreSQL VM on its persistent data volume, keeping the database and IP
+// The volume is the root disk, so only the size can change, not the OS image.
+// POSTGRES_VCPU and POSTGRES_RAM_GB resize the new VM (default: the host group's size)
+// POSTGRES_DISK_IMAGE names the disk to re-attach (default: the VM's data-disk tag, required
+// the first time a VM is replaced)
+func (Postgres) Replace(ctx context.Context, hostname string) error {
+	config := postgres.DefaultConfig()
+
+	if gh := os.Getenv("GITHUB_USER"); gh != "" {
+		config.GitHubUser = gh
+	}
+
+	if key := loadSSHKey(); key != "" {
+		config.SSHKeys = append(config.SSHKeys, key)
+	}
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	opts := postgres.ReplaceOptions{DiskImage: os.Getenv("POSTGRES_DISK_IMAGE")}
+	if vcpu := os.Getenv("POSTGRES_VCPU"); vcpu != "" {
+		if opts.VCPU, err = strconv.Atoi(vcpu); err != nil {
+			return fmt.Errorf("invalid POSTGRES_VCPU %q: %w", vcpu, err)
+		}
+	}
+	if ram := os.Getenv("POSTGRES_RAM_GB"); ram != "" {
+		if opts.RAMGB, err = strconv.Atoi(ram); err != nil {
+			return fmt.Errorf("invalid POSTGRES_RAM_GB %q: %w", ram, err)
+		}
+	}
+
+	resp, err := deployer.Replace(ctx, hostname, opts)
+	if err != nil {
+		return fmt.Errorf("failed to replace postgres VM %s: %w", hostname, err)
+	}
+
+	fmt.Printf("PostgreSQL VM replaced:\n")
+	fmt.Printf("  Hostname: %s\n", resp.Hostname)
+	fmt.Printf("  IP: %s\n", resp.IP)
+	fmt.Printf("  Created: %s\n", resp.CreatedAt)
+	fmt.Printf("\nData volume re-attached, existing credentials are unchanged\n")
+
+	// The VM has a new host key on the same IP
+	if known, err := knownHosts(); err == nil {
+		err = known.Forget(hostname, discovery.HostIP(resp.IP))
+		if err != nil {
+			fmt.Printf("Warning: failed to forget the old host key: %v\n", err)
+		}
+	}
+
+	return nil
+}
+
+// AddStandby creates a streaming replication standby of a running PostgreSQL primary
+// Usage: mage postgres:addStandby <primary>
+// POSTGRES_PROFILE should match the primary's, standbys need at least its max_connections
+func (Postgres) AddStandby(ctx context.Context, primary string) error {
+	config := postgres.DefaultConfig()
+
+	if profile := os.Getenv("POSTGRES_PROFILE"); profile != "" {
+		config.Profile = postgres.Profile(profile)
+	}
+
+	if gh := os.Getenv("GITHUB_USER"); gh != "" {
+		config.GitHubUser = gh
+	}
+
+	if key := loadSSHKey(); key != "" {
+		config.SSHKeys = append(config.SSHKeys, key)
+	}
+
+	config.DNS = stackResolver(ctx)
+
+	if os.Getenv("POSTGRES_BACKUP") == "true" {
+		backup, err := postgresBackupConfig(ctx, config.DNS)
+		if err != nil {
+			return err
+		}
+		config.Backup = backup
+	}
+
+	tls, err := postgresTLSConfig()
+	if err != nil {
+		return err
+	}
+	config.TLS = tls
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	resp, err := deployer.AddStandby(ctx, primary)
+	if err != nil {
+		return fmt.Errorf("failed to add standby to %s: %w", primary, err)
+	}
+	syncDNS(ctx, config.DNS)
+
+	fmt.Printf("PostgreSQL standby of %s deployed:\n", primary)
+	fmt.Printf("  Hostname: %s\n", resp.Hostname)
+	fmt.Printf("  IP: %s\n", resp.IP)
+	fmt.Printf("  Created: %s\n", resp.CreatedAt)
+	fmt.Printf("\nCheck replication with: mage postgres:status\n")
+	return nil
+}
+
+// Status shows the role of each PostgreSQL VM and replication lag of its standbys
+func (Postgres) Status(ctx context.Context) error {
+	config := postgres.DefaultConfig()
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	members, err := deployer.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get postgres status: %w", err)
+	}
+
+	if len(members) == 0 {
+		fmt.Println("No PostgreSQL VMs found")
+		return nil
+	}
+
+	fmt.Printf("PostgreSQL VMs (%d):\n", len(members))
+	for _, m := range members {
+		switch m.Role {
+		case postgres.RolePrimary:
+			fmt.Printf("  - %s (%s) primary, %d standbys\n", m.Hostname, m.IP, len(m.Replicas))
+			for _, r := range m.Replicas {
+				fmt.Printf("      %s (%s) %s/%s lag=%d bytes replay_lag=%s\n",
+					r.Name, r.ClientAddr, r.State, r.SyncState, r.LagBytes, r.ReplayLag)
+			}
+		case postgres.RoleStandby:
+			fmt.Printf("  - %s (%s) standby of %s, last replay %s ago\n", m.Hostname, m.IP, m.Upstream, m.ReplayDelay)
+		default:
+			fmt.Printf("  - %s (%s) %s\n", m.Hostname, m.IP, m.Role)
+		}
+		if m.Error != nil {
+			fmt.Printf("      error: %v\n", m.Error)
+		}
+	}
+	return nil
+}
+
+// Failover promotes a standby to primary, stops the old primary and repoints other standbys and Gitea
+// Usage: mage postgres:failover <standby>
+func (Postgres) Failover(ctx context.Context, standby string) error {
+	config := postgres.DefaultConfig()
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	if !confirm(fmt.Sprintf("Promote %s? Its current primary will be stopped and disabled", standby)) {
+		return fmt.Errorf("aborted failover to %s", standby)
+	}
+
+	result, err := deployer.Failover(ctx, standby)
+	if err != nil {
+		return fmt.Errorf("failed to fail over to %s: %w", standby, err)
+	}
+
+	fmt.Printf("%s promoted to primary (%s)\n", result.Primary, result.PrimaryIP)
+	switch {
+	case result.Fenced:
+		fmt.Printf("Old primary %s stopped and disabled\n", result.OldPrimary)
+	case result.OldPrimary != "":
+		fmt.Printf("Warning: old primary %s was not reachable, make sure it stays down\n", result.OldPrimary)
+	}
+	for _, hostname := range result.Repointed {
+		fmt.Printf("Standby %s now follows %s\n", hostname, result.Primary)
+	}
+
+	// The "postgres" and "pgbouncer" names follow the promoted VM once
+	// records are synced, dependents get its hostname record
+	syncDNS(ctx, stackResolver(ctx))
+	if err := repointGitea(ctx, result.Primary, result.PrimaryIP); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nAdd a standby to the new primary with: mage postgres:addStandby %s\n", result.Primary)
+	return nil
+}
+
+// Upgrade migrates a PostgreSQL primary to a new VM running a newer major version
+// Usage: mage postgres:upgrade <hostname> <version>
+// The source is made read-only, dumped and loaded into the new VM, and row counts are compared.
+// Gitea is repointed to the new VM, and the old VM is deleted once confirmed (CONFIRM=true skips
+// the prompt). POSTGRES_BACKUP and POSTGRES_TLS configure the new VM as on deploy.
+func (Postgres) Upgrade(ctx context.Context, hostname, version string) error {
+	v, err := postgresVersion(version)
+	if err != nil {
+		return err
+	}
+
+	config := postgres.DefaultConfig()
+
+	if gh := os.Getenv("GITHUB_USER"); gh != "" {
+		config.GitHubUser = gh
+	}
+
+	if key := loadSSHKey(); key != "" {
+		config.SSHKeys = append(config.SSHKeys, key)
+	}
+	if profile := os.Getenv("POSTGRES_PROFILE"); profile != "" {
+		config.Profile = postgres.Profile(profile)
+	}
+
+	config.DNS = stackResolver(ctx)
+
+	if os.Getenv("POSTGRES_BACKUP") == "true" {
+		backup, err := postgresBackupConfig(ctx, config.DNS)
+		if err != nil {
+			return err
+		}
+		config.Backup = backup
+	}
+
+	tls, err := postgresTLSConfig()
+	if err != nil {
+		return err
+	}
+	config.TLS = tls
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	result, err := deployer.Upgrade(ctx, hostname, v, os.Stdout)
+	if err != nil {
+		if result != nil && result.Target != nil {
+			fmt.Printf("Warning: %s is still the primary, delete the new VM with: mage postgres:delete %s\n",
+				hostname, result.Target.Hostname)
+		}
+		return fmt.Errorf("failed to upgrade %s: %w", hostname, err)
+	}
+
+	fmt.Printf("PostgreSQL %d -> %d:\n", result.FromVersion, result.ToVersion)
+	fmt.Printf("  Hostname: %s\n", result.Target.Hostname)
+	fmt.Printf("  IP: %s\n", result.Target.IP)
+	fmt.Printf("  Dump: %.1f MiB\n", float64(result.DumpBytes)/(1<<20))
+	fmt.Printf("  Tables verified: %d\n", result.Tables)
+
+	// The target only resolves as "postgres" after cutover
+	syncDNS(ctx, config.DNS)
+	if err := repointGitea(ctx, result.Target.Hostname, discovery.HostIP(result.Target.IP)); err != nil {
+		return err
+	}
+
+	if !confirm(fmt.Sprintf("Delete the old PostgreSQL %d VM %s?", result.FromVersion, hostname)) {
+		fmt.Printf("\n%s is kept read-only, delete it with: mage postgres:delete %s\n", hostname, hostname)
+		return nil
+	}
+	if err := deployer.Delete(ctx, hostname); err != nil {
+		return fmt.Errorf("failed to delete postgres VM %s: %w", hostname, err)
+	}
+	syncDNS(ctx, config.DNS)
+	fmt.Printf("Old VM %s deleted\n", hostname)
+	return nil
+}
+
+// postgresVersion parses and checks a PostgreSQL major version
+func postgresVersion(version string) (int, error) {
+	v, err := strconv.Atoi(version)
+	if err != nil {
+		return 0, fmt.Errorf("invalid postgres version %q: %w", version, err)
+	}
+	if err := postgres.ValidateVersion(v); err != nil {
+		return 0, err
+	}
+	return v, nil
+}
+
+// repointGitea switches every Gitea VM to a new PostgreSQL host, using its
+// hostname record when stack DNS is enabled
+func repointGitea(ctx context.Context, hostname, ip string) error {
+	dbHost := ip
+	if resolver := stackResolver(ctx); resolver.Enabled() {
+		dbHost = resolver.Name(hostname)
+	}
+
+	discoverer, err := discovery.NewResolverFromEnv()
+	if err != nil {
+		return fmt.Errorf("failed to create resolver: %w", err)
+	}
+	giteas, err := discoverer.FindAll(ctx, "gitea", discovery.Selector{})
+	if err != nil {
+		return fmt.Errorf("failed to find gitea VMs: %w", err)
+	}
+
+	giteaDeployer, err := gitea.NewDeployerFromEnv(gitea.DefaultConfig())
+	if err != nil {
+		return fmt.Errorf("failed to create gitea deployer: %w", err)
+	}
+	for _, endpoint := range giteas {
+		if err := giteaDeployer.SetDBHost(ctx, endpoint.Hostname, dbHost); err != nil {
+			return err
+		}
+		fmt.Printf("Gitea %s now uses database host %s\n", endpoint.Hostname, dbHost)
+	}
+	return nil
+}
+
+// Tune recomputes PostgreSQL settings from a running VM's CPUs and memory and applies them
+// Usage: mage postgres:tune <hostname>
+// POSTGRES_PROFILE selects the tuning profile: oltp, web or mixed (default: mixed)
+// Asks before restarting when a changed setting needs it; CONFIRM=true restarts without asking
+func (Postgres) Tune(ctx context.Context, hostname string) error {
+	config := postgres.DefaultConfig()
+
+	if profile := os.Getenv("POSTGRES_PROFILE"); profile != "" {
+		config.Profile = postgres.Profile(profile)
+	}
+	if err := config.Profile.Validate(); err != nil {
+		return err
+	}
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	result, err := deployer.Tune(ctx, hostname)
+	if err != nil {
+		return fmt.Errorf("failed to tune %s: %w", hostname, err)
+	}
+
+	fmt.Printf("Applied %s on %s:\n\n%s\n", postgres.TuningFile, hostname, result.Tuning.Conf())
+
+	if len(result.PendingRestart) == 0 {
+		fmt.Println("All settings applied without a restart")
+		return nil
+	}
+
+	fmt.Printf("Settings waiting for a restart: %s\n", strings.Join(result.PendingRestart, ", "))
+	if !confirm(fmt.Sprintf("Restart PostgreSQL on %s now? Clients will be disconnected", hostname)) {
+		fmt.Printf("Restart later with: ssh ubuntu@%s sudo systemctl restart postgresql\n", hostname)
+		return nil
+	}
+
+	if err := deployer.Restart(ctx, hostname); err != nil {
+		return err
+	}
+	fmt.Printf("PostgreSQL restarted on %s\n", hostname)
+	return nil
+}
+
+// CreateDB creates a database and owner role on a running PostgreSQL VM
+// Usage: mage postgres:createDB <hostname> <db> <user>
+// POSTGRES_PASSWORD env var sets the role password (default: generated); existing roles keep theirs
+func (Postgres) CreateDB(ctx context.Context, hostname, db, user string) error {
+	config := postgres.DefaultConfig()
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	creds, err := deployer.CreateDB(ctx, hostname, db, user, os.Getenv("POSTGRES_PASSWORD"))
+	if err != nil {
+		return fmt.Errorf("failed to create database on %s: %w", hostname, err)
+	}
+
+	fmt.Printf("Database %s created on %s\n", creds.DBName, hostname)
+	printRoleCredentials(creds)
+	return nil
+}
+
+// DropDB drops a database on a running PostgreSQL VM, disconnecting its clients
+// Usage: mage postgres:dropDB <hostname> <db>
+func (Postgres) DropDB(ctx context.Context, hostname, db string) error {
+	config := postgres.DefaultConfig()
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	if !confirm(fmt.Sprintf("Drop database %s on %s? All of its data will be lost", db, hostname)) {
+		return fmt.Errorf("aborted dropping %s", db)
+	}
+
+	if err := deployer.DropDB(ctx, hostname, db); err != nil {
+		return fmt.Errorf("failed to drop database on %s: %w", hostname, err)
+	}
+
+	fmt.Printf("Database %s dropped on %s\n", db, hostname)
+	return nil
+}
+
+// ListDBs shows the databases on a running PostgreSQL VM
+// Usage: mage postgres:listDBs <hostname>
+func (Postgres) ListDBs(ctx context.Context, hostname string) error {
+	config := postgres.DefaultConfig()
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	dbs, err := deployer.ListDBs(ctx, hostname)
+	if err != nil {
+		return fmt.Errorf("failed to list databases on %s: %w", hostname, err)
+	}
+
+	fmt.Printf("Databases on %s (%d):\n", hostname, len(dbs))
+	for _, db := range dbs {
+		fmt.Printf("  - %s owner=%s size=%s\n", db.Name, db.Owner, db.Size)
+	}
+	return nil
+}
+
+// GrantRole gives a role read/write access to an existing database, creating the role if needed
+// Usage: mage postgres:grantRole <hostname> <db> <user>
+// POSTGRES_PASSWORD env var sets the password of a new role (default: generated)
+func (Postgres) GrantRole(ctx context.Context, hostname, db, user string) error {
+	config := postgres.DefaultConfig()
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	creds, err := deployer.GrantRole(ctx, hostname, db, user, os.Getenv("POSTGRES_PASSWORD"))
+	if err != nil {
+		return fmt.Errorf("failed to grant role on %s: %w", hostname, err)
+	}
+
+	fmt.Printf("Role %s granted access to %s on %s\n", creds.DBUser, creds.DBName, hostname)
+	printRoleCredentials(creds)
+	return nil
+}
+
+// printRoleCredentials prints credentials returned by database and role management
+func printRoleCredentials(creds *postgres.Credentials) {
+	fmt.Printf("\nCredentials:\n")
+	fmt.Printf("  Database: %s\n", creds.DBName)
+	fmt.Printf("  Username: %s\n", creds.DBUser)
+	if creds.DBPass != "" {
+		fmt.Printf("  Password: %s (save this - it is not stored anywhere else)\n", creds.DBPass)
+	} else {
+		fmt.Printf("  Password: (existing role, unchanged)\n")
+	}
+}
+
+// Backup takes a WAL-G base backup of a PostgreSQL VM now
+// Usage: mage postgres:backup <hostname>
+func (Postgres) Backup(ctx context.Context, hostname string) error {
+	config := postgres.DefaultConfig()
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	fmt.Printf("Taking base backup of %s...\n", hostname)
+	backup, err := deployer.Backup(ctx, hostname)
+	if err != nil {
+		return fmt.Errorf("failed to back up %s: %w", hostname, err)
+	}
+
+	fmt.Printf("Backup %s finished at %s (%.1f MiB compressed)\n",
+		backup.Name, backup.FinishTime.Format(time.RFC3339), float64(backup.CompressedSize)/(1<<20))
+	return nil
+}
+
+// Backups lists the WAL-G base backups of a PostgreSQL VM
+// Usage: mage postgres:backups <hostname>
+func (Postgres) Backups(ctx context.Context, hostname string) error {
+	config := postgres.DefaultConfig()
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	backups, err := deployer.Backups(ctx, hostname)
+	if err != nil {
+		return fmt.Errorf("failed to list backups of %s: %w", hostname, err)
+	}
+
+	if len(backups) == 0 {
+		fmt.Printf("No backups found for %s\n", hostname)
+		return nil
+	}
+
+	fmt.Printf("Backups of %s (%d):\n", hostname, len(backups))
+	for _, b := range backups {
+		fmt.Printf("  - %s finished %s size=%.1f MiB\n",
+			b.Name, b.FinishTime.Format(time.RFC3339), float64(b.CompressedSize)/(1<<20))
+	}
+	fmt.Printf("\nWAL is archived continuously, restore to any time after the oldest backup\n")
+	return nil
+}
+
+// Restore creates a new PostgreSQL VM from the backups of another, which does not need to be running
+// Usage: mage postgres:restore <hostname> <timestamp>
+// timestamp is RFC 3339 (e.g. 2025-01-02T15:04:05Z) for point-in-time recovery, or "latest"
+// Uses the same backup env vars as POSTGRES_BACKUP=true on deploy
+// POSTGRES_VERSION must match the major version the backups were taken with (default: 16)
+func (Postgres) Restore(ctx context.Context, hostname, timestamp string) error {
+	var target time.Time
+	if timestamp != "latest" {
+		var err error
+		target, err = time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q, use RFC 3339 (e.g. 2025-01-02T15:04:05Z) or latest: %w", timestamp, err)
+		}
+	}
+
+	config := postgres.DefaultConfig()
+
+	if gh := os.Getenv("GITHUB_USER"); gh != "" {
+		config.GitHubUser = gh
+	}
+
+	if key := loadSSHKey(); key != "" {
+		config.SSHKeys = append(config.SSHKeys, key)
+	}
+
+	if version := os.Getenv("POSTGRES_VERSION"); version != "" {
+		v, err := postgresVersion(version)
+		if err != nil {
+			return err
+		}
+		config.Version = v
+	}
+
+	config.DNS = stackResolver(ctx)
+
+	backup, err := postgresBackupConfig(ctx, config.DNS)
+	if err != nil {
+		return err
+	}
+	config.Backup = backup
+
+	tls, err := postgresTLSConfig()
+	if err != nil {
+		return err
+	}
+	config.TLS = tls
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	resp, err := deployer.Restore(ctx, hostname, target)
+	if err != nil {
+		return fmt.Errorf("failed to restore %s: %w", hostname, err)
+	}
+	syncDNS(ctx, config.DNS)
+
+	fmt.Printf("PostgreSQL VM restoring from %s (target: %s):\n", hostname, timestamp)
+	fmt.Printf("  Hostname: %s\n", resp.Hostname)
+	fmt.Printf("  IP: %s\n", resp.IP)
+	fmt.Printf("  Created: %s\n", resp.CreatedAt)
+	fmt.Printf("\nRoles and passwords are the same as on %s\n", hostname)
+	fmt.Printf("Follow progress with: mage postgres:logs %s\n", resp.Hostname)
+
+	return nil
+}
+
+// Dump streams a custom-format pg_dump of a database to a local file or a RustFS object
+// Usage: mage postgres:dump <hostname> <db>
+// POSTGRES_DUMP_TO is a local path (default: <db>-<timestamp>.dump) or s3://<bucket>[/<key>],
+// where the key defaults to <hostname>/<db>-<timestamp>.dump
+// Uploads use the POSTGRES_BACKUP_* env vars for the RustFS endpoint and keys
+func (Postgres) Dump(ctx context.Context, hostname, db string) error {
+	config := postgres.DefaultConfig()
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	name := fmt.Sprintf("%s-%s.dump", db, time.Now().UTC().Format("20060102-150405"))
+	dest := os.Getenv("POSTGRES_DUMP_TO")
+	if dest == "" {
+		dest = name
+	}
+
+	if !strings.HasPrefix(dest, "s3://") {
+		f, err := os.Create(dest)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", dest, err)
+		}
+		defer f.Close()
+
+		progress := newProgressWriter(f, "Dumped")
+		size, err := deployer.Dump(ctx, hostname, db, progress)
+		progress.Done()
+		if err != nil {
+			os.Remove(dest)
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to write %s: %w", dest, err)
+		}
+
+		fmt.Printf("Dumped %s from %s to %s (%.1f MiB)\n", db, hostname, dest, float64(size)/(1<<20))
+		fmt.Printf("Restore with: pg_restore --no-owner -d <db> %s\n", dest)
+		return nil
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(dest, "s3://"), "/")
+	if bucket == "" {
+		return fmt.Errorf("invalid POSTGRES_DUMP_TO %q, use s3://<bucket>[/<key>]", dest)
+	}
+	if key == "" {
+		key = hostname + "/" + name
+	}
+
+	backup, err := postgresBackupConfig(ctx, stackResolver(ctx))
+	if err != nil {
+		return err
+	}
+
+	// The object size must be known up front, so the dump is spooled locally
+	f, err := os.CreateTemp("", "postgres-dump-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	progress := newProgressWriter(f, "Dumped")
+	size, err := deployer.Dump(ctx, hostname, db, progress)
+	progress.Done()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind %s: %w", f.Name(), err)
+	}
+
+	client := rustfs.NewClient(backup.Endpoint, backup.AccessKey, backup.SecretKey, backup.UseSSL)
+	if backup.CACert != "" {
+		if err := client.TrustCA([]byte(backup.CACert)); err != nil {
+			return err
+		}
+	}
+	if err := client.CreateBucket(ctx, bucket); err != nil {
+		return err
+	}
+	fmt.Printf("Uploading to s3://%s/%s...\n", bucket, key)
+	if err := client.PutObject(ctx, bucket, key, f, size); err != nil {
+		return err
+	}
+
+	fmt.Printf("Dumped %s from %s to s3://%s/%s on %s (%.1f MiB)\n", db, hostname, bucket, key, backup.Endpoint, float64(size)/(1<<20))
+	return nil
+}
+
+// Clone copies a database from one PostgreSQL VM to another and compares row counts
+// Usage: mage postgres:clone <source> <dest>
+// POSTGRES_DB selects the database (default: giteadb). An existing copy on dest is replaced
+// after confirmation (CONFIRM=true skips the prompt). A missing owner role is created with
+// a generated password, or POSTGRES_PASSWORD when set.
+func (Postgres) Clone(ctx context.Context, source, dest string) error {
+	config := postgres.DefaultConfig()
+	if db := os.Getenv("POSTGRES_DB"); db != "" {
+		config.DBName = db
+	}
+
+	deployer, err := postgres.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	dbs, err := deployer.ListDBs(ctx, dest)
+	if err != nil {
+		return fmt.Errorf("failed to list databases on %s: %w", dest, err)
+	}
+	replace := false
+	for _, db := range dbs {
+		if db.Name == config.DBName {
+			if !confirm(fmt.Sprintf("Replace database %s on %s (%s)?", db.Name, dest, db.Size)) {
+				return fmt.Errorf("aborted cloning %s", db.Name)
+			}
+			replace = true
+		}
+	}
+
+	result, err := deployer.Clone(ctx, source, dest, config.DBName, os.Getenv("POSTGRES_PASSWORD"), replace, os.Stdout)
+	if err != nil {
+		return fmt.Errorf("failed to clone %s from %s to %s: %w", config.DBName, source, dest, err)
+	}
+
+	fmt.Printf("Cloned %s from %s to %s:\n", result.DBName, source, dest)
+	fmt.Printf("  Dump: %.1f MiB\n", float64(result.DumpBytes)/(1<<20))
+	fmt.Printf("  Tables verified: %d\n", result.Tables)
+	if result.OwnerPass != "" {
+		fmt.Printf("  Owner: %s (created, password: %s)\n", result.Owner, result.OwnerPass)
+	} else {
+		fmt.Printf("  Owner: %s (existing role, password unchanged)\n", result.Owner)
+	}
+	return nil
+}
+
+// progressWriter reports bytes written on a single updating line
+type progressWriter struct {
+	w     io.Writer
+	label string
+	n     int64
+	last  time.Time
+}
+
+func newProgressWriter(w io.Writer, label string) *progressWriter {
+	return &progressWriter{w: w, label: label}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	if time.Since(p.last) > 500*time.Millisecond {
+		fmt.Printf("\r%s %.1f MiB", p.label, float64(p.n)/(1<<20))
+		p.last = time.Now()
 	}
+	return n, err
+}
 
-	fmt.Printf("PostgreSQL VM %s deleted\n", hostname)
-	return nil
+// Done ends the progress line
+func (p *progressWriter) Done() {
+	fmt.Printf("\r%s %.1f MiB\n", p.label, float64(p.n)/(1<<20))
 }
 
 // Logs shows serial console logs for a PostgreSQL VM
@@ -514,6 +2206,9 @@ func (Postgres) YAML() error {
 	}
 
 	config := postgres.DefaultConfig()
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid VM configuration: %w", err)
+	}
 	fmt.Println(postgres.GenerateYAML(config, githubUser))
 	return nil
 }
@@ -521,12 +2216,118 @@ func (Postgres) YAML() error {
 // Gitea targets
 type Gitea mg.Namespace
 
-// Deploy creates a new Gitea VM with snap installation
-// Required env vars: GITEA_DB_PASS, GITEA_S3_ACCESS_KEY, GITEA_S3_SECRET_KEY
+// Deploy creates a new Gitea VM
+// GITEA_INSTALL_METHOD is snap (default) or binary, which installs release GITEA_VERSION under systemd,
+// serves git over SSH on port 22 and moves the VM's sshd to GITEA_HOST_SSH_PORT (default: 2222)
+// Required env vars: GITEA_DB_PASS
+// GITEA_S3_ACCESS_KEY and GITEA_S3_SECRET_KEY default to a new RustFS user limited to GITEA_S3_BUCKET
 // Optional env vars: GITEA_DB_HOST (auto-detected from postgres VM), GITEA_S3_ENDPOINT (auto-detected from rustfs VM)
+// GITEA_DB_POOLER=true connects through PgBouncer on the postgres VM
+// GITEA_ADMIN_USER, GITEA_ADMIN_PASSWORD and GITEA_ADMIN_EMAIL set the admin account, the password
+// is generated when unset. Deploy returns once Gitea serves requests.
 func (Gitea) Deploy(ctx context.Context) error {
+	if os.Getenv("GITEA_DB_PASS") == "" {
+		return fmt.Errorf("GITEA_DB_PASS environment variable is required")
+	}
+	config, err := giteaConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	resp, err := deployGitea(ctx, config)
+	if err != nil {
+		return err
+	}
+	printGitea(config, resp)
+	return nil
+}
+
+// deployGitea creates a Gitea VM and waits until it serves requests
+func deployGitea(ctx context.Context, config gitea.Config) (*gitea.DeployResponse, error) {
+	deployer, err := gitea.NewDeployerFromEnv(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	fmt.Println("Waiting for Gitea to install and migrate the database...")
+	resp, err := deployer.Deploy(ctx)
+	if err != nil {
+		if resp != nil {
+			return resp, fmt.Errorf("failed to deploy gitea on %s (check 'mage gitea:logs %s'): %w", resp.Hostname, resp.Hostname, err)
+		}
+		return nil, fmt.Errorf("failed to deploy gitea: %w", err)
+	}
+	syncDNS(ctx, config.DNS)
+	return resp, nil
+}
+
+// printGitea shows a deployed Gitea VM with its database, storage and admin account
+func printGitea(config gitea.Config, resp *gitea.DeployResponse) {
+	// Strip CIDR suffix from IP
+	ip := resp.IP
+	if idx := strings.Index(ip, "/"); idx != -1 {
+		ip = ip[:idx]
+	}
+
+	fmt.Printf("Gitea VM deployed:\n")
+	fmt.Printf("  Hostname: %s\n", resp.Hostname)
+	fmt.Printf("  IP: %s\n", ip)
+	fmt.Printf("  Created: %s\n", resp.CreatedAt)
+	if config.InstallMethod == gitea.InstallBinary {
+		fmt.Printf("  Install: Gitea %s binary\n", config.Version)
+	} else {
+		fmt.Printf("  Install: snap\n")
+	}
+	fmt.Printf("\nDatabase configured:\n")
+	fmt.Printf("  Host: %s\n", config.DBHost)
+	fmt.Printf("  Database: %s\n", config.DBName)
+	fmt.Printf("  User: %s\n", config.DBUser)
+	fmt.Printf("  SSL Mode: %s\n", config.DBSSLMode)
+	fmt.Printf("\nS3 Storage configured:\n")
+	fmt.Printf("  Endpoint: %s\n", config.S3Endpoint)
+	fmt.Printf("  Bucket: %s\n", config.S3Bucket)
+	fmt.Printf("  Access Key: %s\n", config.S3AccessKey)
+	fmt.Printf("  TLS: %t\n", config.S3UseSSL)
+	fmt.Printf("\nAdmin account:\n")
+	fmt.Printf("  Web UI: %s\n", resp.URL)
+	fmt.Printf("  Username: %s\n", resp.Admin.User)
+	fmt.Printf("  Password: %s\n", resp.Admin.Password)
+	if config.Packages {
+		fmt.Printf("\nContainer registry: %s (plain HTTP, packages stored in s3://%s/packages/)\n", strings.TrimPrefix(resp.URL, "http://"), config.S3Bucket)
+	}
+	fmt.Printf("\nNext steps:\n")
+	if config.InstallMethod == gitea.InstallBinary {
+		fmt.Printf("  1. SSH: ssh -p %d ubuntu@%s (port 22 serves git)\n", config.HostSSHPort, ip)
+	} else {
+		fmt.Printf("  1. SSH: ssh ubuntu@%s\n", ip)
+	}
+	fmt.Printf("  2. Deploy a runner: mage runner:deploy\n")
+}
+
+// giteaConfig builds a Gitea config from the environment, finding PostgreSQL and RustFS and
+// creating a RustFS user limited to the Gitea bucket unless keys are given
+func giteaConfig(ctx context.Context) (gitea.Config, error) {
 	config := gitea.DefaultConfig()
 
+	if method := os.Getenv("GITEA_INSTALL_METHOD"); method != "" {
+		config.InstallMethod = method
+	}
+	layout, err := gitea.LayoutFor(config.InstallMethod)
+	if err != nil {
+		return config, err
+	}
+	config.DataDir = layout.Home
+	if version := os.Getenv("GITEA_VERSION"); version != "" {
+		config.Version = version
+	}
+	if port := os.Getenv("GITEA_HOST_SSH_PORT"); port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return config, fmt.Errorf("invalid GITEA_HOST_SSH_PORT %q: %w", port, err)
+		}
+		config.HostSSHPort = p
+	}
+
 	if gh := os.Getenv("GITHUB_USER"); gh != "" {
 		config.GitHubUser = gh
 	}
@@ -535,42 +2336,32 @@ func (Gitea) Deploy(ctx context.Context) error {
 		config.SSHKeys = append(config.SSHKeys, key)
 	}
 
+	// Use stack DNS names instead of IPs when a DNS VM is running
+	config.DNS = stackResolver(ctx)
+
 	// Database host - auto-detect from postgres VM if not specified
 	dbHost := os.Getenv("GITEA_DB_HOST")
 	if dbHost == "" {
-		// Try to find a running postgres VM
-		pgConfig := postgres.DefaultConfig()
-		pgDeployer, err := postgres.NewDeployerFromEnv(pgConfig)
-		if err != nil {
-			return fmt.Errorf("failed to create postgres deployer: %w", err)
-		}
-		nodes, err := pgDeployer.List(ctx)
+		endpoint, err := discoverEndpoint(ctx, "postgres", "POSTGRES_VM")
 		if err != nil {
-			return fmt.Errorf("failed to list postgres nodes: %w", err)
-		}
-		// Find first postgres VM
-		for _, node := range nodes {
-			if hasTag(node.Tags, "postgres") {
-				dbHost = node.IP
-				// Strip CIDR suffix
-				if idx := strings.Index(dbHost, "/"); idx != -1 {
-					dbHost = dbHost[:idx]
-				}
-				fmt.Printf("Auto-detected PostgreSQL host: %s\n", dbHost)
-				break
-			}
-		}
-		if dbHost == "" {
-			return fmt.Errorf("no postgres VM found; deploy one with 'mage postgres:deploy' or set GITEA_DB_HOST")
+			return config, fmt.Errorf("failed to find postgres VM (deploy one with 'mage postgres:deploy' or set GITEA_DB_HOST): %w", err)
 		}
+		dbHost = stableHost(config.DNS, endpoint, "POSTGRES_VM")
+		fmt.Printf("Auto-detected PostgreSQL host: %s\n", dbHost)
 	}
 	config.DBHost = dbHost
 
-	dbPass := os.Getenv("GITEA_DB_PASS")
-	if dbPass == "" {
-		return fmt.Errorf("GITEA_DB_PASS environment variable is required")
+	config.DBPass = os.Getenv("GITEA_DB_PASS")
+
+	// Connect through PgBouncer on the postgres VM
+	if os.Getenv("GITEA_DB_POOLER") == "true" {
+		endpoint, err := discoverEndpoint(ctx, "pgbouncer", "POSTGRES_VM")
+		if err != nil {
+			return config, fmt.Errorf("failed to find pgbouncer (deploy postgres with POSTGRES_PGBOUNCER=true or set GITEA_DB_PORT): %w", err)
+		}
+		config.DBPort = endpoint.Port
+		fmt.Printf("Connecting through PgBouncer on port %d\n", config.DBPort)
 	}
-	config.DBPass = dbPass
 
 	// Optional database config
 	if port := os.Getenv("GITEA_DB_PORT"); port != "" {
@@ -582,97 +2373,121 @@ func (Gitea) Deploy(ctx context.Context) error {
 	if user := os.Getenv("GITEA_DB_USER"); user != "" {
 		config.DBUser = user
 	}
+	if sslMode := os.Getenv("GITEA_DB_SSL_MODE"); sslMode != "" {
+		config.DBSSLMode = sslMode
+	}
+	if strings.HasPrefix(config.DBSSLMode, "verify-") {
+		ca, err := pki.Load(pki.DefaultDir())
+		if err != nil {
+			return config, fmt.Errorf("failed to load playground CA for sslmode %s (deploy postgres with POSTGRES_TLS=true): %w", config.DBSSLMode, err)
+		}
+		config.DBCACert = string(ca.CertPEM())
+	}
 
 	// S3 Storage - auto-detect from rustfs VM if not specified
 	s3Endpoint := os.Getenv("GITEA_S3_ENDPOINT")
 	if s3Endpoint == "" {
-		// Try to find a running rustfs VM
-		rustfsConfig := rustfs.DefaultConfig()
-		rustfsDeployer, err := rustfs.NewDeployerFromEnv(rustfsConfig)
+		endpoint, err := discoverEndpoint(ctx, "rustfs", "RUSTFS_VM")
+		if err != nil {
+			return config, fmt.Errorf("failed to find rustfs VM (deploy one with 'mage rustfs:deploy' or set GITEA_S3_ENDPOINT): %w", err)
+		}
+		s3Endpoint = fmt.Sprintf("%s:%d", stableHost(config.DNS, endpoint, "RUSTFS_VM"), endpoint.Port)
+		fmt.Printf("Auto-detected RustFS endpoint: %s\n", s3Endpoint)
+		config.S3UseSSL = endpoint.TLS()
+	}
+	config.S3Endpoint = s3Endpoint
+
+	// Optional S3 config
+	if bucket := os.Getenv("GITEA_S3_BUCKET"); bucket != "" {
+		config.S3Bucket = bucket
+	}
+	config.S3UseSSL = envBool("GITEA_S3_USE_SSL", config.S3UseSSL)
+	config.Packages = envBool("GITEA_PACKAGES", config.Packages)
+	if config.S3UseSSL {
+		config.S3CACert = playgroundCA()
+	}
+
+	config.S3AccessKey = os.Getenv("GITEA_S3_ACCESS_KEY")
+	config.S3SecretKey = os.Getenv("GITEA_S3_SECRET_KEY")
+	switch {
+	case config.S3AccessKey != "" && config.S3SecretKey != "":
+	case config.S3AccessKey == "" && config.S3SecretKey == "":
+		// Create the bucket and a key that can only use it
+		client, err := rustfsAdminClient(ctx)
 		if err != nil {
-			return fmt.Errorf("failed to create rustfs deployer: %w", err)
+			return config, fmt.Errorf("failed to provision gitea storage (or set GITEA_S3_ACCESS_KEY and GITEA_S3_SECRET_KEY): %w", err)
 		}
-		nodes, err := rustfsDeployer.List(ctx)
+		suffix, err := postgres.GeneratePassword(8)
 		if err != nil {
-			return fmt.Errorf("failed to list rustfs nodes: %w", err)
-		}
-		// Find first rustfs VM
-		for _, node := range nodes {
-			if hasTag(node.Tags, "rustfs") {
-				s3Host := node.IP
-				// Strip CIDR suffix
-				if idx := strings.Index(s3Host, "/"); idx != -1 {
-					s3Host = s3Host[:idx]
-				}
-				s3Endpoint = fmt.Sprintf("%s:9000", s3Host)
-				fmt.Printf("Auto-detected RustFS endpoint: %s\n", s3Endpoint)
-				break
-			}
+			return config, err
+		}
+		config.S3AccessKey = "gitea-" + strings.ToLower(suffix)
+		config.S3SecretKey, err = rustfs.GeneratePassword(40)
+		if err != nil {
+			return config, err
 		}
-		if s3Endpoint == "" {
-			return fmt.Errorf("no rustfs VM found; deploy one with 'mage rustfs:deploy' or set GITEA_S3_ENDPOINT")
+		if err := client.CreateScopedUser(ctx, config.S3AccessKey, config.S3SecretKey, config.S3Bucket); err != nil {
+			return config, fmt.Errorf("failed to provision gitea storage: %w", err)
 		}
+		fmt.Printf("Created bucket %s and RustFS user %s limited to it\n", config.S3Bucket, config.S3AccessKey)
+	default:
+		return config, fmt.Errorf("set both GITEA_S3_ACCESS_KEY and GITEA_S3_SECRET_KEY, or neither to create a scoped key")
 	}
-	config.S3Endpoint = s3Endpoint
 
-	s3AccessKey := os.Getenv("GITEA_S3_ACCESS_KEY")
-	if s3AccessKey == "" {
-		return fmt.Errorf("GITEA_S3_ACCESS_KEY environment variable is required")
+	if user := os.Getenv("GITEA_ADMIN_USER"); user != "" {
+		config.AdminUser = user
 	}
-	config.S3AccessKey = s3AccessKey
+	config.AdminPassword = os.Getenv("GITEA_ADMIN_PASSWORD")
+	config.AdminEmail = os.Getenv("GITEA_ADMIN_EMAIL")
+	return config, nil
+}
 
-	s3SecretKey := os.Getenv("GITEA_S3_SECRET_KEY")
-	if s3SecretKey == "" {
-		return fmt.Errorf("GITEA_S3_SECRET_KEY environment variable is required")
-	}
-	config.S3SecretKey = s3SecretKey
+// List shows all Gitea VMs (filtered by "gitea" tag)
+func (Gitea) List(ctx context.Context) error {
+	config := gitea.DefaultConfig()
 
-	// Optional S3 config
-	if bucket := os.Getenv("GITEA_S3_BUCKET"); bucket != "" {
-		config.S3Bucket = bucket
+	deployer, err := gitea.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
 	}
-	if ssl := os.Getenv("GITEA_S3_USE_SSL"); ssl == "true" {
-		config.S3UseSSL = true
+
+	nodes, err := deployer.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list gitea nodes: %w", err)
 	}
 
+	printNodeList(nodes, "gitea", "Gitea")
+	return nil
+}
+
+// Delete removes a Gitea VM by hostname
+func (Gitea) Delete(ctx context.Context, hostname string) error {
+	config := gitea.DefaultConfig()
+
 	deployer, err := gitea.NewDeployerFromEnv(config)
 	if err != nil {
 		return fmt.Errorf("failed to create deployer: %w", err)
 	}
 
-	resp, err := deployer.Deploy(ctx)
+	nodes, err := deployer.List(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to deploy gitea: %w", err)
+		return fmt.Errorf("failed to list gitea nodes: %w", err)
 	}
-
-	// Strip CIDR suffix from IP
-	ip := resp.IP
-	if idx := strings.Index(ip, "/"); idx != -1 {
-		ip = ip[:idx]
+	if err := confirmDataVolumeDelete(nodes, hostname, config.DataDir); err != nil {
+		return err
 	}
 
-	fmt.Printf("Gitea VM deployed:\n")
-	fmt.Printf("  Hostname: %s\n", resp.Hostname)
-	fmt.Printf("  IP: %s\n", ip)
-	fmt.Printf("  Created: %s\n", resp.CreatedAt)
-	fmt.Printf("\nDatabase configured:\n")
-	fmt.Printf("  Host: %s\n", config.DBHost)
-	fmt.Printf("  Database: %s\n", config.DBName)
-	fmt.Printf("  User: %s\n", config.DBUser)
-	fmt.Printf("\nS3 Storage configured:\n")
-	fmt.Printf("  Endpoint: %s\n", config.S3Endpoint)
-	fmt.Printf("  Bucket: %s\n", config.S3Bucket)
-	fmt.Printf("\nNext steps:\n")
-	fmt.Printf("  1. SSH: ssh ubuntu@%s\n", ip)
-	fmt.Printf("  2. Web UI: http://%s:3000\n", ip)
-	fmt.Printf("  3. Complete setup wizard in browser\n")
-	fmt.Printf("  4. Configure S3 storage in app.ini (see /home/ubuntu/gitea-info.txt)\n")
+	if err := deployer.Delete(ctx, hostname); err != nil {
+		return fmt.Errorf("failed to delete gitea VM %s: %w", hostname, err)
+	}
+	syncDNS(ctx, stackResolver(ctx))
 
+	fmt.Printf("Gitea VM %s deleted\n", hostname)
 	return nil
 }
 
-// List shows all Gitea VMs (filtered by "gitea" tag)
-func (Gitea) List(ctx context.Context) error {
+// Logs shows serial console logs for a Gitea VM
+func (Gitea) Logs(ctx context.Context, hostname string) error {
 	config := gitea.DefaultConfig()
 
 	deployer, err := gitea.NewDeployerFromEnv(config)
@@ -680,47 +2495,313 @@ func (Gitea) List(ctx context.Context) error {
 		return fmt.Errorf("failed to create deployer: %w", err)
 	}
 
-	nodes, err := deployer.List(ctx)
+	logs, err := deployer.Logs(ctx, hostname, 50)
 	if err != nil {
-		return fmt.Errorf("failed to list gitea nodes: %w", err)
+		return fmt.Errorf("failed to get logs for %s: %w", hostname, err)
 	}
 
-	printNodeList(nodes, "gitea", "Gitea")
+	fmt.Println(logs)
 	return nil
 }
 
-// Delete removes a Gitea VM by hostname
-func (Gitea) Delete(ctx context.Context, hostname string) error {
-	config := gitea.DefaultConfig()
+// Backup runs gitea dump on a Gitea VM and uploads the archive to RustFS
+// Usage: mage gitea:backup <hostname>
+// The archive goes to s3://<GITEA_BACKUP_BUCKET>/<hostname>/ (default bucket: gitea-backups), which
+// keeps the newest GITEA_BACKUP_KEEP archives of the VM (default: 7, 0 keeps all).
+// GITEA_BACKUP_SKIP_DB=true leaves the database out and takes a postgres:backup base backup of the
+// postgres VM instead, for PostgreSQL deployed with backups.
+func (Gitea) Backup(ctx context.Context, hostname string) error {
+	keep := gitea.DefaultBackupKeep
+	if v := os.Getenv("GITEA_BACKUP_KEEP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid GITEA_BACKUP_KEEP %q", v)
+		}
+		keep = n
+	}
+	bucket := os.Getenv("GITEA_BACKUP_BUCKET")
+	if bucket == "" {
+		bucket = gitea.DefaultBackupBucket
+	}
+	skipDB := envBool("GITEA_BACKUP_SKIP_DB", false)
+
+	deployer, err := gitea.NewDeployerFromEnv(gitea.DefaultConfig())
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "gitea-backup-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := fmt.Sprintf("gitea-dump-%s.zip", time.Now().UTC().Format("20060102-150405"))
+	local := filepath.Join(dir, name)
+	fmt.Printf("Running gitea dump on %s...\n", hostname)
+	if err := deployer.Dump(ctx, hostname, local, skipDB); err != nil {
+		return err
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", local, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", local, err)
+	}
+
+	if skipDB {
+		endpoint, err := discoverEndpoint(ctx, "postgres", "POSTGRES_VM")
+		if err != nil {
+			return fmt.Errorf("failed to find postgres VM for the database backup: %w", err)
+		}
+		pg, err := postgres.NewDeployerFromEnv(postgres.DefaultConfig())
+		if err != nil {
+			return fmt.Errorf("failed to create deployer: %w", err)
+		}
+		fmt.Printf("Taking base backup of %s...\n", endpoint.Hostname)
+		backup, err := pg.Backup(ctx, endpoint.Hostname)
+		if err != nil {
+			return fmt.Errorf("failed to back up %s: %w", endpoint.Hostname, err)
+		}
+		fmt.Printf("Database backup %s finished at %s\n", backup.Name, backup.FinishTime.Format(time.RFC3339))
+	}
+
+	client, err := rustfsAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+	if err := client.CreateBucket(ctx, bucket); err != nil {
+		return err
+	}
+	key := hostname + "/" + name
+	fmt.Printf("Uploading to s3://%s/%s...\n", bucket, key)
+	if err := client.PutObject(ctx, bucket, key, f, info.Size()); err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %s to s3://%s/%s (%.1f MiB)\n", hostname, bucket, key, float64(info.Size())/(1<<20))
+
+	if keep == 0 {
+		return nil
+	}
+	archives, err := client.ListObjects(ctx, bucket, hostname+"/gitea-dump-")
+	if err != nil {
+		return err
+	}
+	// Keys carry the time, so key order is age order
+	for i := 0; i < len(archives)-keep; i++ {
+		if err := client.DeleteObject(ctx, bucket, archives[i].Key); err != nil {
+			return err
+		}
+		fmt.Printf("Removed old archive %s\n", archives[i].Key)
+	}
+	return nil
+}
+
+// Restore creates a Gitea VM and database from a gitea:backup archive
+// Usage: mage gitea:restore <archive>
+// archive is a local zip or s3://<bucket>/<key> on the RustFS VM, and s3://<bucket>/<hostname>/
+// picks the newest archive of a VM. The database is loaded into a new database GITEA_DB_NAME
+// (default: giteadb_<timestamp>) owned by GITEA_DB_USER (default: the database name) on the
+// postgres VM. An archive without the database uses the existing GITEA_DB_NAME with GITEA_DB_PASS,
+// e.g. one brought back with postgres:restore. The other gitea:deploy variables apply.
+func (Gitea) Restore(ctx context.Context, archive string) error {
+	dir, err := os.MkdirTemp("", "gitea-restore-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := archive
+	if strings.HasPrefix(archive, "s3://") {
+		local = filepath.Join(dir, "gitea-dump.zip")
+		if err := downloadGiteaArchive(ctx, archive, local); err != nil {
+			return err
+		}
+	}
+	dump, err := gitea.OpenArchive(local)
+	if err != nil {
+		return err
+	}
+	defer dump.Close()
+
+	config, err := giteaConfig(ctx)
+	if err != nil {
+		return err
+	}
+	config.Secrets = &dump.Secrets
+
+	if dump.HasDB() {
+		if err := restoreGiteaDB(ctx, dump, &config, filepath.Join(dir, gitea.DBDumpName)); err != nil {
+			return err
+		}
+	} else {
+		if config.DBPass == "" {
+			return fmt.Errorf("the archive has no database, set GITEA_DB_NAME and GITEA_DB_PASS to use a restored one")
+		}
+		fmt.Printf("The archive has no database, using %s on %s\n", config.DBName, config.DBHost)
+	}
+
+	storage := rustfs.NewClient(config.S3Endpoint, config.S3AccessKey, config.S3SecretKey, config.S3UseSSL)
+	if config.S3CACert != "" {
+		if err := storage.TrustCA([]byte(config.S3CACert)); err != nil {
+			return err
+		}
+	}
+	objects := 0
+	err = dump.StorageObjects(func(key string, size int64, r io.Reader) error {
+		objects++
+		return storage.PutObject(ctx, config.S3Bucket, key, r, size)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %d storage objects to bucket %s\n", objects, config.S3Bucket)
+
+	resp, err := deployGitea(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	deployer, err := gitea.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+	fmt.Printf("Restoring repositories and data on %s...\n", resp.Hostname)
+	if err := deployer.RestoreFiles(ctx, resp.Hostname, local); err != nil {
+		return err
+	}
+	if err := gitea.WaitHealthy(ctx, resp.URL, 5*time.Minute); err != nil {
+		return err
+	}
+
+	printGitea(config, resp)
+	fmt.Printf("\nRestored from %s\n", archive)
+	return nil
+}
+
+// downloadGiteaArchive copies s3://<bucket>/<key> from the RustFS VM to local. A key ending in
+// a slash picks the newest archive under it.
+func downloadGiteaArchive(ctx context.Context, src, local string) error {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(src, "s3://"), "/")
+	if bucket == "" {
+		return fmt.Errorf("invalid archive %q, use s3://<bucket>/<key>", src)
+	}
+	client, err := rustfsAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	if key == "" || strings.HasSuffix(key, "/") {
+		archives, err := client.ListObjects(ctx, bucket, key+"gitea-dump-")
+		if err != nil {
+			return err
+		}
+		if len(archives) == 0 {
+			return fmt.Errorf("no archives under %s", src)
+		}
+		key = archives[len(archives)-1].Key
+	}
+
+	fmt.Printf("Downloading s3://%s/%s...\n", bucket, key)
+	body, err := client.GetObject(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := os.Create(local)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", local, err)
+	}
+	defer f.Close()
+	progress := newProgressWriter(f, "Downloaded")
+	_, err = io.Copy(progress, body)
+	progress.Done()
+	if err != nil {
+		return fmt.Errorf("failed to download s3://%s/%s: %w", bucket, key, err)
+	}
+	return f.Close()
+}
 
-	deployer, err := gitea.NewDeployerFromEnv(config)
+// restoreGiteaDB loads the database of an archive into a new database on the postgres VM and
+// points config at it
+func restoreGiteaDB(ctx context.Context, dump *gitea.Archive, config *gitea.Config, sqlPath string) error {
+	endpoint, err := discoverEndpoint(ctx, "postgres", "POSTGRES_VM")
+	if err != nil {
+		return fmt.Errorf("failed to find postgres VM to restore the database into: %w", err)
+	}
+	pg, err := postgres.NewDeployerFromEnv(postgres.DefaultConfig())
 	if err != nil {
 		return fmt.Errorf("failed to create deployer: %w", err)
 	}
 
-	if err := deployer.Delete(ctx, hostname); err != nil {
-		return fmt.Errorf("failed to delete gitea VM %s: %w", hostname, err)
+	dbName := os.Getenv("GITEA_DB_NAME")
+	if dbName == "" {
+		dbName = "giteadb_" + time.Now().UTC().Format("20060102150405")
+	}
+	dbUser := os.Getenv("GITEA_DB_USER")
+	if dbUser == "" {
+		dbUser = dbName
 	}
 
-	fmt.Printf("Gitea VM %s deleted\n", hostname)
-	return nil
-}
+	creds, err := pg.CreateDB(ctx, endpoint.Hostname, dbName, dbUser, config.DBPass)
+	if err != nil {
+		return err
+	}
+	if creds.DBPass != "" {
+		config.DBPass = creds.DBPass
+	} else if config.DBPass == "" {
+		return fmt.Errorf("role %s already exists, set GITEA_DB_PASS to its password", dbUser)
+	}
+	config.DBName, config.DBUser = dbName, dbUser
 
-// Logs shows serial console logs for a Gitea VM
-func (Gitea) Logs(ctx context.Context, hostname string) error {
-	config := gitea.DefaultConfig()
+	f, err := os.Create(sqlPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", sqlPath, err)
+	}
+	err = dump.ExtractDB(f)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("failed to write %s: %w", sqlPath, cerr)
+	}
+	if err != nil {
+		return err
+	}
 
-	deployer, err := gitea.NewDeployerFromEnv(config)
+	fmt.Printf("Loading the database into %s on %s...\n", dbName, endpoint.Hostname)
+	return pg.LoadSQL(ctx, endpoint.Hostname, dbName, dbUser, sqlPath)
+}
+
+// Seed applies a declarative manifest of users, orgs, teams and repos to Gitea
+// GITEA_SEED points at the manifest (default: gitea-seed.yaml). Missing objects are created and
+// differing ones updated, nothing is deleted, so applying the same manifest again changes nothing.
+func (Gitea) Seed(ctx context.Context) error {
+	path := os.Getenv("GITEA_SEED")
+	if path == "" {
+		path = gitea.DefaultSeedFile
+	}
+	seed, err := gitea.LoadSeed(path)
 	if err != nil {
-		return fmt.Errorf("failed to create deployer: %w", err)
+		return err
 	}
 
-	logs, err := deployer.Logs(ctx, hostname, 50)
+	client, err := giteaAdminClient(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get logs for %s: %w", hostname, err)
+		return err
 	}
 
-	fmt.Println(logs)
+	fmt.Printf("Applying %s to %s:\n", path, client.BaseURL)
+	changes, err := client.ApplySeed(ctx, seed, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if changes == 0 {
+		fmt.Println("  Already up to date")
+	} else {
+		fmt.Printf("\n%d change(s) applied\n", changes)
+	}
 	return nil
 }
 
@@ -737,6 +2818,9 @@ func (Gitea) YAML() error {
 	}
 
 	config := gitea.DefaultConfig()
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid VM configuration: %w", err)
+	}
 	fmt.Println(gitea.GenerateYAML(config, githubUser))
 	return nil
 }
@@ -745,8 +2829,10 @@ func (Gitea) YAML() error {
 type Runner mg.Namespace
 
 // Deploy creates a new Gitea Runner VM
-// Required env vars: RUNNER_TOKEN (from Gitea admin/actions/runners)
+// RUNNER_TOKEN defaults to a token fetched with the Gitea admin account, for the scope in RUNNER_SCOPE
+// (empty for the instance, an org name, or owner/repo)
 // Optional env vars: GITEA_URL (auto-detected from gitea VM), RUNNER_NAME, RUNNER_LABELS, RUNNER_VERSION
+// Jobs are logged in to the Gitea registry, see registryAuth
 func (Runner) Deploy(ctx context.Context) error {
 	config := runner.DefaultConfig()
 
@@ -758,45 +2844,32 @@ func (Runner) Deploy(ctx context.Context) error {
 		config.SSHKeys = append(config.SSHKeys, key)
 	}
 
+	// Use stack DNS names instead of IPs when a DNS VM is running
+	config.DNS = stackResolver(ctx)
+
 	// Gitea URL - auto-detect from gitea VM if not specified
 	giteaURL := os.Getenv("GITEA_URL")
 	if giteaURL == "" {
-		// Try to find a running gitea VM
-		giteaConfig := gitea.DefaultConfig()
-		giteaDeployer, err := gitea.NewDeployerFromEnv(giteaConfig)
+		endpoint, err := discoverEndpoint(ctx, "gitea", "GITEA_VM")
 		if err != nil {
-			return fmt.Errorf("failed to create gitea deployer: %w", err)
-		}
-		nodes, err := giteaDeployer.List(ctx)
-		if err != nil {
-			return fmt.Errorf("failed to list gitea nodes: %w", err)
-		}
-		// Find first gitea VM
-		for _, node := range nodes {
-			if hasTag(node.Tags, "gitea") {
-				giteaHost := node.IP
-				// Strip CIDR suffix
-				if idx := strings.Index(giteaHost, "/"); idx != -1 {
-					giteaHost = giteaHost[:idx]
-				}
-				giteaURL = fmt.Sprintf("http://%s:3000", giteaHost)
-				fmt.Printf("Auto-detected Gitea URL: %s\n", giteaURL)
-				break
-			}
-		}
-		if giteaURL == "" {
-			return fmt.Errorf("no gitea VM found; deploy one with 'mage gitea:deploy' or set GITEA_URL")
+			return fmt.Errorf("failed to find gitea VM (deploy one with 'mage gitea:deploy' or set GITEA_URL): %w", err)
 		}
+		giteaURL = fmt.Sprintf("%s://%s:%d", endpoint.Scheme, stableHost(config.DNS, endpoint, "GITEA_VM"), endpoint.Port)
+		fmt.Printf("Auto-detected Gitea URL: %s\n", giteaURL)
 	}
 	config.GiteaURL = giteaURL
 
-	// Runner token is required
-	runnerToken := os.Getenv("RUNNER_TOKEN")
-	if runnerToken == "" {
-		return fmt.Errorf("RUNNER_TOKEN environment variable is required (get it from %s/admin/actions/runners)", giteaURL)
+	runnerToken, err := runnerRegistrationToken(ctx, giteaURL)
+	if err != nil {
+		return err
 	}
 	config.RunnerToken = runnerToken
 
+	// The registry is optional, jobs can run without logging in to one
+	if config.Registry, err = registryAuth(ctx, "runner"); err != nil {
+		fmt.Printf("Skipping registry config: %v\n", err)
+	}
+
 	// Optional config
 	if name := os.Getenv("RUNNER_NAME"); name != "" {
 		config.RunnerName = name
@@ -815,8 +2888,10 @@ func (Runner) Deploy(ctx context.Context) error {
 
 	resp, err := deployer.Deploy(ctx)
 	if err != nil {
+		revokeRegistryToken(ctx, config.Registry.TokenName)
 		return fmt.Errorf("failed to deploy runner: %w", err)
 	}
+	syncDNS(ctx, config.DNS)
 
 	// Strip CIDR suffix from IP
 	ip := resp.IP
@@ -832,6 +2907,9 @@ func (Runner) Deploy(ctx context.Context) error {
 	fmt.Printf("  Gitea URL: %s\n", config.GiteaURL)
 	fmt.Printf("  Labels: %s\n", config.Labels)
 	fmt.Printf("  Version: %s\n", config.Version)
+	if config.Registry.Enabled() {
+		fmt.Printf("  Registry: %s (logged in as %s, $REGISTRY in jobs)\n", config.Registry.Host, config.Registry.User)
+	}
 	fmt.Printf("\nNext steps:\n")
 	fmt.Printf("  1. SSH: ssh ubuntu@%s\n", ip)
 	fmt.Printf("  2. Check status: sudo systemctl status act_runner\n")
@@ -840,6 +2918,123 @@ func (Runner) Deploy(ctx context.Context) error {
 	return nil
 }
 
+// runnerRegistrationToken returns RUNNER_TOKEN, or fetches a token for RUNNER_SCOPE with the
+// Gitea admin account
+func runnerRegistrationToken(ctx context.Context, giteaURL string) (string, error) {
+	if token := os.Getenv("RUNNER_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	client, err := giteaAdminClient(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch a runner token (or set RUNNER_TOKEN from %s/admin/actions/runners): %w", giteaURL, err)
+	}
+	scope := os.Getenv("RUNNER_SCOPE")
+	token, err := client.RegistrationToken(ctx, scope)
+	if err != nil {
+		return "", err
+	}
+	if scope == "" {
+		scope = "instance"
+	}
+	fmt.Printf("Fetched %s runner registration token from %s\n", scope, client.BaseURL)
+	return token, nil
+}
+
+// registryAuth returns the registry BuildKit and runner VMs push images to. By default that is
+// the Gitea registry, with a new write:package access token of the admin account for each VM,
+// named after purpose and revoked when the VM is deleted. REGISTRY_HOST with REGISTRY_USER and REGISTRY_PASSWORD selects another registry,
+// REGISTRY_INSECURE=true talks plain HTTP to it and REGISTRY=false configures none.
+func registryAuth(ctx context.Context, purpose string) (registry.Auth, error) {
+	if !envBool("REGISTRY", true) {
+		return registry.Auth{}, nil
+	}
+	if host := os.Getenv("REGISTRY_HOST"); host != "" {
+		return registry.Auth{
+			Host:     host,
+			User:     os.Getenv("REGISTRY_USER"),
+			Password: os.Getenv("REGISTRY_PASSWORD"),
+			Insecure: envBool("REGISTRY_INSECURE", false),
+		}, nil
+	}
+
+	client, err := giteaAdminClient(ctx)
+	if err != nil {
+		return registry.Auth{}, err
+	}
+	host, insecure := client.Registry()
+	name := fmt.Sprintf("registry-%s-%s", purpose, time.Now().UTC().Format("20060102-150405"))
+	token, err := client.CreateAccessToken(ctx, name, "write:package")
+	if err != nil {
+		return registry.Auth{}, err
+	}
+	fmt.Printf("Created access token %s for the Gitea registry at %s\n", name, host)
+	return registry.Auth{
+		Host:      host,
+		User:      client.User,
+		Password:  token,
+		Insecure:  envBool("REGISTRY_INSECURE", insecure),
+		TokenName: name,
+	}, nil
+}
+
+// registryTokenName reads the name of the access token a VM pushes with, before the VM is
+// deleted. An unreachable VM leaves the token to be revoked by hand.
+func registryTokenName(ctx context.Context, hostname string, read func(context.Context, string) (string, error)) string {
+	name, err := read(ctx, hostname)
+	if err != nil {
+		fmt.Printf("Warning: registry access token unknown, revoke it in Gitea under Settings > Applications: %v\n", err)
+		return ""
+	}
+	return name
+}
+
+// revokeRegistryToken deletes the Gitea access token registryAuth created for a VM
+func revokeRegistryToken(ctx context.Context, name string) {
+	if name == "" {
+		return
+	}
+	client, err := giteaAdminClient(ctx)
+	if err == nil {
+		err = client.DeleteAccessToken(ctx, name)
+	}
+	if err != nil {
+		fmt.Printf("Warning: access token %s left in Gitea, revoke it under Settings > Applications: %v\n", name, err)
+		return
+	}
+	fmt.Printf("Revoked access token %s\n", name)
+}
+
+// giteaAdminClient returns an API client for the Gitea VM, signed in as the admin account
+// gitea:deploy created. GITEA_ADMIN_USER and GITEA_ADMIN_PASSWORD with GITEA_URL select
+// another instance.
+func giteaAdminClient(ctx context.Context) (*gitea.Client, error) {
+	user, password := os.Getenv("GITEA_ADMIN_USER"), os.Getenv("GITEA_ADMIN_PASSWORD")
+	if giteaURL := os.Getenv("GITEA_URL"); giteaURL != "" && user != "" && password != "" {
+		return gitea.NewClient(giteaURL, user, password), nil
+	}
+
+	endpoint, err := discoverEndpoint(ctx, "gitea", "GITEA_VM")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find gitea VM (deploy one with 'mage gitea:deploy'): %w", err)
+	}
+
+	deployer, err := gitea.NewDeployerFromEnv(gitea.DefaultConfig())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create deployer: %w", err)
+	}
+	creds, err := deployer.AdminCredentials(ctx, endpoint.Hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	giteaURL := os.Getenv("GITEA_URL")
+	if giteaURL == "" {
+		giteaURL = endpoint.URL()
+	}
+	return gitea.NewClient(giteaURL, creds.User, creds.Password), nil
+}
+
 // List shows all Runner VMs (filtered by "runner" tag)
 func (Runner) List(ctx context.Context) error {
 	config := runner.DefaultConfig()
@@ -858,7 +3053,8 @@ func (Runner) List(ctx context.Context) error {
 	return nil
 }
 
-// Delete removes a Runner VM by hostname
+// Delete removes a Runner VM by hostname and its registration in Gitea
+// Only the registration named in the VM's runner-info.txt is removed, and only once it is offline.
 func (Runner) Delete(ctx context.Context, hostname string) error {
 	config := runner.DefaultConfig()
 
@@ -867,14 +3063,135 @@ func (Runner) Delete(ctx context.Context, hostname string) error {
 		return fmt.Errorf("failed to create deployer: %w", err)
 	}
 
+	// Read the name this VM registered with before the VM is gone, other
+	// names may belong to runners on other VMs
+	name, nameErr := deployer.RegisteredName(ctx, hostname)
+	tokenName := registryTokenName(ctx, hostname, deployer.RegistryTokenName)
+
 	if err := deployer.Delete(ctx, hostname); err != nil {
 		return fmt.Errorf("failed to delete runner VM %s: %w", hostname, err)
 	}
 
 	fmt.Printf("Runner VM %s deleted\n", hostname)
+	revokeRegistryToken(ctx, tokenName)
+	if nameErr != nil {
+		fmt.Printf("Warning: runner name unknown, remove it with 'mage runner:prune': %v\n", nameErr)
+		return nil
+	}
+	deregisterRunner(ctx, name)
+	return nil
+}
+
+// Prune removes Gitea runners that no VM tagged "runner" backs any more
+// Online runners are kept, they are polling from somewhere. RUNNER_SCOPE selects the org or
+// owner/repo runners instead of the instance ones.
+func (Runner) Prune(ctx context.Context) error {
+	resolver, err := discovery.NewResolverFromEnv()
+	if err != nil {
+		return err
+	}
+	nodes, err := resolver.Nodes(ctx)
+	if err != nil {
+		return err
+	}
+
+	deployer, err := runner.NewDeployerFromEnv(runner.DefaultConfig())
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+	backed := map[string]bool{}
+	for _, node := range nodes {
+		if !hasTag(node.Tags, "runner") {
+			continue
+		}
+		backed[node.Hostname] = true
+		if name, err := deployer.RegisteredName(ctx, node.Hostname); err == nil {
+			backed[name] = true
+		}
+	}
+
+	client, err := giteaAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+	scope := os.Getenv("RUNNER_SCOPE")
+	runners, err := client.ListRunners(ctx, scope)
+	if err != nil {
+		return err
+	}
+
+	var stale []gitea.Runner
+	for _, r := range runners {
+		switch {
+		case backed[r.Name]:
+		case r.Online():
+			fmt.Printf("Keeping %s (id %d): no runner VM, but it is %s\n", r.Name, r.ID, r.Status)
+		default:
+			stale = append(stale, r)
+		}
+	}
+	if len(stale) == 0 {
+		fmt.Printf("No stale runners in %s\n", client.BaseURL)
+		return nil
+	}
+
+	fmt.Printf("Stale runners in %s:\n", client.BaseURL)
+	for _, r := range stale {
+		fmt.Printf("  - %s (id %d)\n", r.Name, r.ID)
+	}
+	if !confirm(fmt.Sprintf("Remove %d runner(s) from Gitea?", len(stale))) {
+		return fmt.Errorf("aborted pruning runners")
+	}
+	for _, r := range stale {
+		if err := client.DeleteRunner(ctx, scope, r.ID); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Removed %d runner(s)\n", len(stale))
 	return nil
 }
 
+// deregisterRunner removes the Gitea runners registered under any of names. The VM is already
+// gone, so failures are reported for runner:prune to clean up rather than returned.
+func deregisterRunner(ctx context.Context, names ...string) {
+	client, err := giteaAdminClient(ctx)
+	if err == nil {
+		// Gitea marks a runner offline about a minute after its last poll
+		var deleted, online []gitea.Runner
+		for attempt := 0; ; attempt++ {
+			var removed []gitea.Runner
+			removed, online, err = client.DeleteRunnersNamed(ctx, os.Getenv("RUNNER_SCOPE"), names...)
+			deleted = append(deleted, removed...)
+			if err != nil || len(online) == 0 || attempt == 12 {
+				break
+			}
+			if attempt == 0 {
+				fmt.Printf("Waiting for Gitea to mark %s offline...\n", strings.Join(names, ", "))
+			}
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-time.After(10 * time.Second):
+			}
+			if err != nil {
+				break
+			}
+		}
+		for _, r := range deleted {
+			fmt.Printf("Runner %s (id %d) removed from Gitea\n", r.Name, r.ID)
+		}
+		for _, r := range online {
+			fmt.Printf("Keeping %s (id %d): it is %s, run 'mage runner:prune' once Gitea marks it offline\n", r.Name, r.ID, r.Status)
+		}
+		if err == nil && len(deleted)+len(online) == 0 {
+			fmt.Printf("No runner named %s registered in Gitea\n", strings.Join(names, " or "))
+		}
+	}
+	if err != nil {
+		fmt.Printf("Warning: runner left registered in Gitea, remove it with 'mage runner:prune': %v\n", err)
+	}
+}
+
 // Logs shows serial console logs for a Runner VM
 func (Runner) Logs(ctx context.Context, hostname string) error {
 	config := runner.DefaultConfig()
@@ -906,10 +3223,163 @@ func (Runner) YAML() error {
 	}
 
 	config := runner.DefaultConfig()
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid VM configuration: %w", err)
+	}
 	fmt.Println(runner.GenerateYAML(config, githubUser))
 	return nil
 }
 
+// Dns targets for the stack CoreDNS server
+type Dns mg.Namespace
+
+// Deploy creates a new CoreDNS VM serving <service>.<stack>.slicer names
+// SLICER_STACK env var sets the stack name (default: playground)
+// Deploy it before other services so their VMs are pointed at it
+func (Dns) Deploy(ctx context.Context) error {
+	config := dns.DefaultConfig()
+
+	if gh := os.Getenv("GITHUB_USER"); gh != "" {
+		config.GitHubUser = gh
+	}
+
+	if key := loadSSHKey(); key != "" {
+		config.SSHKeys = append(config.SSHKeys, key)
+	}
+
+	deployer, err := dns.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	resp, err := deployer.Deploy(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to deploy dns: %w", err)
+	}
+
+	fmt.Printf("DNS VM deployed:\n")
+	fmt.Printf("  Hostname: %s\n", resp.Hostname)
+	fmt.Printf("  IP: %s\n", resp.IP)
+	fmt.Printf("  Zone: %s\n", config.Zone())
+	fmt.Printf("  Created: %s\n", resp.CreatedAt)
+	fmt.Printf("\nNext steps:\n")
+	fmt.Printf("  1. Wait for CoreDNS to install, then run: mage dns:sync\n")
+	fmt.Printf("  2. Query: dig @%s postgres.%s\n", discovery.HostIP(resp.IP), config.Zone())
+
+	return nil
+}
+
+// Sync pushes A records for every Slicer VM to the DNS VMs
+func (Dns) Sync(ctx context.Context) error {
+	config := dns.DefaultConfig()
+
+	deployer, err := dns.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	records, err := deployer.Sync(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to sync dns records: %w", err)
+	}
+
+	fmt.Printf("Records in %s (%d):\n", config.Zone(), len(records))
+	for _, r := range records {
+		fmt.Printf("  - %s %s\n", r.Name, r.IP)
+	}
+	return nil
+}
+
+// List shows all DNS VMs (filtered by "dns" tag)
+func (Dns) List(ctx context.Context) error {
+	config := dns.DefaultConfig()
+
+	deployer, err := dns.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	nodes, err := deployer.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list dns nodes: %w", err)
+	}
+
+	printNodeList(nodes, "dns", "DNS")
+	return nil
+}
+
+// Delete removes a DNS VM by hostname
+func (Dns) Delete(ctx context.Context, hostname string) error {
+	config := dns.DefaultConfig()
+
+	deployer, err := dns.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	if err := deployer.Delete(ctx, hostname); err != nil {
+		return fmt.Errorf("failed to delete dns VM %s: %w", hostname, err)
+	}
+
+	fmt.Printf("DNS VM %s deleted\n", hostname)
+	return nil
+}
+
+// Logs shows serial console logs for a DNS VM
+func (Dns) Logs(ctx context.Context, hostname string) error {
+	config := dns.DefaultConfig()
+
+	deployer, err := dns.NewDeployerFromEnv(config)
+	if err != nil {
+		return fmt.Errorf("failed to create deployer: %w", err)
+	}
+
+	logs, err := deployer.Logs(ctx, hostname, 50)
+	if err != nil {
+		return fmt.Errorf("failed to get logs for %s: %w", hostname, err)
+	}
+
+	fmt.Println(logs)
+	return nil
+}
+
+// Userdata prints the CoreDNS userdata script
+func (Dns) Userdata() {
+	fmt.Println(dns.Userdata())
+}
+
+// YAML generates a Slicer config YAML for the DNS VM
+func (Dns) YAML() error {
+	githubUser := os.Getenv("GITHUB_USER")
+	if githubUser == "" {
+		return fmt.Errorf("GITHUB_USER environment variable is required")
+	}
+
+	config := dns.DefaultConfig()
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid VM configuration: %w", err)
+	}
+	fmt.Println(dns.GenerateYAML(config, githubUser))
+	return nil
+}
+
+// Pki targets manage the playground CA that signs service certificates
+type Pki mg.Namespace
+
+// CA prints the playground CA certificate, creating the CA on first use
+// SLICER_PKI_DIR sets where the CA is kept (default: ~/.slicer/pki)
+func (Pki) CA() error {
+	dir := pki.DefaultDir()
+	ca, err := pki.LoadOrCreate(dir)
+	if err != nil {
+		return fmt.Errorf("failed to load playground CA: %w", err)
+	}
+
+	fmt.Printf("# %s\n", filepath.Join(dir, pki.CACertFile))
+	fmt.Print(string(ca.CertPEM()))
+	return nil
+}
+
 // Crossplane targets for Kubernetes control plane
 type Crossplane mg.Namespace
 
@@ -1826,6 +4296,9 @@ func (K3s) YAMLCP() error {
 	}
 
 	config := k3s.DefaultCPConfig()
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid VM configuration: %w", err)
+	}
 	fmt.Println(k3s.GenerateCPYAML(config, githubUser))
 	return nil
 }
@@ -1838,6 +4311,9 @@ func (K3s) YAMLAgent() error {
 	}
 
 	config := k3s.DefaultAgentConfig()
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid VM configuration: %w", err)
+	}
 	fmt.Println(k3s.GenerateAgentYAML(config, githubUser))
 	return nil
 }
@@ -2234,7 +4710,8 @@ func (K3s) AutoscalerStressTestCleanup(ctx context.Context) error {
 type CrossplaneRunner mg.Namespace
 
 // Deploy creates a new Gitea Runner VM via Crossplane
-// Required env vars: RUNNER_TOKEN (from Gitea admin/actions/runners)
+// RUNNER_TOKEN defaults to a token fetched with the Gitea admin account, for the scope in RUNNER_SCOPE
+// (empty for the instance, an org name, or owner/repo)
 // Optional env vars: GITEA_URL (auto-detected from gitea VM), RUNNER_NAME, RUNNER_LABELS, RUNNER_VERSION
 // Crossplane env vars: KUBECONFIG, CROSSPLANE_NAMESPACE (default: default), CROSSPLANE_PROVIDER_CONFIG (default: default)
 func (CrossplaneRunner) Deploy(ctx context.Context) error {
@@ -2249,42 +4726,24 @@ func (CrossplaneRunner) Deploy(ctx context.Context) error {
 		config.SSHKeys = append(config.SSHKeys, key)
 	}
 
+	// Use stack DNS names instead of IPs when a DNS VM is running
+	config.DNS = stackResolver(ctx)
+
 	// Gitea URL - auto-detect from gitea VM if not specified
 	giteaURL := os.Getenv("GITEA_URL")
 	if giteaURL == "" {
-		// Try to find a running gitea VM
-		giteaConfig := gitea.DefaultConfig()
-		giteaDeployer, err := gitea.NewDeployerFromEnv(giteaConfig)
-		if err != nil {
-			return fmt.Errorf("failed to create gitea deployer: %w", err)
-		}
-		nodes, err := giteaDeployer.List(ctx)
+		endpoint, err := discoverEndpoint(ctx, "gitea", "GITEA_VM")
 		if err != nil {
-			return fmt.Errorf("failed to list gitea nodes: %w", err)
-		}
-		// Find first gitea VM
-		for _, node := range nodes {
-			if hasTag(node.Tags, "gitea") {
-				giteaHost := node.IP
-				// Strip CIDR suffix
-				if idx := strings.Index(giteaHost, "/"); idx != -1 {
-					giteaHost = giteaHost[:idx]
-				}
-				giteaURL = fmt.Sprintf("http://%s:3000", giteaHost)
-				fmt.Printf("Auto-detected Gitea URL: %s\n", giteaURL)
-				break
-			}
-		}
-		if giteaURL == "" {
-			return fmt.Errorf("no gitea VM found; deploy one with 'mage gitea:deploy' or set GITEA_URL")
+			return fmt.Errorf("failed to find gitea VM (deploy one with 'mage gitea:deploy' or set GITEA_URL): %w", err)
 		}
+		giteaURL = fmt.Sprintf("%s://%s:%d", endpoint.Scheme, stableHost(config.DNS, endpoint, "GITEA_VM"), endpoint.Port)
+		fmt.Printf("Auto-detected Gitea URL: %s\n", giteaURL)
 	}
 	config.GiteaURL = giteaURL
 
-	// Runner token is required
-	runnerToken := os.Getenv("RUNNER_TOKEN")
-	if runnerToken == "" {
-		return fmt.Errorf("RUNNER_TOKEN environment variable is required (get it from %s/admin/actions/runners)", giteaURL)
+	runnerToken, err := runnerRegistrationToken(ctx, giteaURL)
+	if err != nil {
+		return err
 	}
 	config.RunnerToken = runnerToken
 
@@ -2411,7 +4870,7 @@ func (CrossplaneRunner) Get(ctx context.Context, name string) error {
 	return nil
 }
 
-// Delete removes a Runner VM created via Crossplane
+// Delete removes a Runner VM created via Crossplane and its registration in Gitea
 func (CrossplaneRunner) Delete(ctx context.Context, name string) error {
 	kubeconfig := os.Getenv("KUBECONFIG")
 	config := xprunner.DefaultConfig()
@@ -2421,11 +4880,26 @@ func (CrossplaneRunner) Delete(ctx context.Context, name string) error {
 		return fmt.Errorf("failed to create deployer: %w", err)
 	}
 
+	// Read the name the runner registered with before the VM is gone
+	var names []string
+	if vm, err := deployer.Get(ctx, name); err == nil && vm.Status.AtProvider.Hostname != "" {
+		if slicer, err := runner.NewDeployerFromEnv(runner.DefaultConfig()); err == nil {
+			if registered, err := slicer.RegisteredName(ctx, vm.Status.AtProvider.Hostname); err == nil {
+				names = append(names, registered)
+			}
+		}
+	}
+
 	if err := deployer.Delete(ctx, name); err != nil {
 		return fmt.Errorf("failed to delete runner VM %s: %w", name, err)
 	}
 
 	fmt.Printf("Crossplane Runner VM %s deleted\n", name)
+	if len(names) == 0 {
+		fmt.Printf("Warning: runner name unknown, remove it with 'mage runner:prune'\n")
+		return nil
+	}
+	deregisterRunner(ctx, names...)
 	return nil
 }
 
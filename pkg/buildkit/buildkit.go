@@ -5,8 +5,13 @@ import (
 	_ "embed"
 	"fmt"
 	"os"
+	"strings"
 
 	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/dns"
+	"github.com/gaarutyunov/slicer/pkg/registry"
+	"github.com/gaarutyunov/slicer/pkg/vmspec"
 )
 
 //go:embed userdata.sh
@@ -27,6 +32,17 @@ type Config struct {
 	SSHKeys     []string
 	GitHubUser  string
 	Tags        []string
+	Image       string
+	Hypervisor  string
+	Storage     string
+	// DNS points the VM at the stack DNS server so configs can use names
+	DNS dns.Resolver
+	// CACert is a PEM CA added to the system roots, so S3 cache exports to a
+	// RustFS VM serving TLS verify
+	CACert string
+	// Registry is written to buildkitd.toml and the docker config of root
+	// and ubuntu, so builds can push with --output type=image,push=true
+	Registry registry.Auth
 }
 
 func DefaultConfig() Config {
@@ -35,15 +51,25 @@ func DefaultConfig() Config {
 		hostGroup = DefaultHostGroup
 	}
 
+	image, hypervisor, storage := vmspec.Default("BUILDKIT")
+
 	return Config{
 		HostGroup:   hostGroup,
 		VCPU:        DefaultVCPU,
 		RAMGB:       DefaultRAMGB,
 		StorageSize: DefaultStorageSize,
+		Image:       image,
+		Hypervisor:  hypervisor,
+		Storage:     storage,
 		Tags:        []string{"buildkit"},
 	}
 }
 
+// Validate checks the image, hypervisor and storage backend combination
+func (c Config) Validate() error {
+	return vmspec.Validate(c.Image, c.Hypervisor, c.Storage, c.StorageSize)
+}
+
 type Deployer struct {
 	client *sdk.SlicerClient
 	config Config
@@ -76,7 +102,7 @@ func (d *Deployer) Deploy(ctx context.Context) (*sdk.SlicerCreateNodeResponse, e
 	req := sdk.SlicerCreateNodeRequest{
 		RamGB:    d.config.RAMGB,
 		CPUs:     d.config.VCPU,
-		Userdata: userdataScript,
+		Userdata: d.config.DNS.Apply(generateUserdata(d.config)),
 	}
 
 	if len(d.config.SSHKeys) > 0 {
@@ -94,6 +120,22 @@ func (d *Deployer) Deploy(ctx context.Context) (*sdk.SlicerCreateNodeResponse, e
 	return d.client.CreateNode(ctx, d.config.HostGroup, req)
 }
 
+// generateUserdata replaces placeholders in the userdata script
+func generateUserdata(config Config) string {
+	return strings.NewReplacer(
+		"{{CA_CERT}}", strings.TrimSpace(config.CACert),
+		"{{REGISTRY_HOST}}", config.Registry.Host,
+		"{{REGISTRY_INSECURE}}", fmt.Sprintf("%t", config.Registry.Insecure),
+		"{{DOCKER_CONFIG}}", config.Registry.DockerConfig(),
+		"{{REGISTRY_TOKEN_NAME}}", config.Registry.TokenName,
+	).Replace(userdataScript)
+}
+
+// RegistryTokenName returns the name of the access token a VM pushes with
+func (d *Deployer) RegistryTokenName(ctx context.Context, hostname string) (string, error) {
+	return registry.ReadTokenName(ctx, d.client, hostname)
+}
+
 func (d *Deployer) Delete(ctx context.Context, hostname string) error {
 	_, err := d.client.DeleteVM(ctx, d.config.HostGroup, hostname)
 	return err
@@ -119,7 +161,7 @@ func GenerateYAML(config Config, githubUser string) string {
 	return fmt.Sprintf(`config:
   host_groups:
   - name: %s
-    storage: image
+    storage: %s
     storage_size: %s
     count: 0
     vcpu: %d
@@ -131,13 +173,13 @@ func GenerateYAML(config Config, githubUser string) string {
 
   github_user: %s
 
-  image: "ghcr.io/openfaasltd/slicer-systemd:5.10.240-x86_64-latest"
+  image: "%s"
 
-  hypervisor: firecracker
+  hypervisor: %s
 
   api:
     port: 8080
     bind_address: "127.0.0.1"
-`, config.HostGroup, config.StorageSize, config.VCPU, config.RAMGB,
-		config.HostGroup, config.HostGroup, githubUser)
+`, config.HostGroup, config.Storage, config.StorageSize, config.VCPU, config.RAMGB,
+		config.HostGroup, config.HostGroup, githubUser, config.Image, config.Hypervisor)
 }
@@ -0,0 +1,39 @@
+package buildkit
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gaarutyunov/slicer/pkg/registry"
+)
+
+func TestGenerateUserdata(t *testing.T) {
+	tests := []struct {
+		name     string
+		registry registry.Auth
+		want     []string
+	}{
+		{name: "no registry", want: []string{`REGISTRY_HOST=""`, `REGISTRY_TOKEN_NAME=""`}},
+		{
+			name:     "gitea registry",
+			registry: registry.Auth{Host: "192.168.137.5:3000", User: "gitea_admin", Password: "token", Insecure: true, TokenName: "registry-buildkit-20260101-120000"},
+			want:     []string{`REGISTRY_HOST="192.168.137.5:3000"`, `REGISTRY_INSECURE="true"`, `REGISTRY_TOKEN_NAME="registry-buildkit-20260101-120000"`, `"auths"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Registry = tt.registry
+			userdata := generateUserdata(config)
+			if m := regexp.MustCompile(`\{\{[A-Z0-9_]+\}\}`).FindAllString(userdata, -1); len(m) > 0 {
+				t.Errorf("placeholders left in userdata: %v", m)
+			}
+			for _, s := range tt.want {
+				if !strings.Contains(userdata, s) {
+					t.Errorf("userdata is missing %s", s)
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,30 @@ set -euxo pipefail
 # BuildKit installation and configuration script
 # This script installs buildkitd, configures the buildkit group, and creates a systemd service
 
+# PEM CA for the S3 cache endpoint (injected by deployer), empty to use the
+# system roots only
+CA_CERT="{{CA_CERT}}"
+if [ -n "$CA_CERT" ]; then
+    echo "$CA_CERT" | sudo tee /usr/local/share/ca-certificates/slicer-playground-ca.crt > /dev/null
+    sudo update-ca-certificates
+fi
+
+# Registry images are pushed to (injected by deployer), empty for none.
+# REGISTRY_INSECURE talks plain HTTP, as the Gitea registry does.
+REGISTRY_HOST="{{REGISTRY_HOST}}"
+REGISTRY_INSECURE="{{REGISTRY_INSECURE}}"
+DOCKER_CONFIG_JSON=$(cat <<'REGISTRY_EOF'
+{{DOCKER_CONFIG}}
+REGISTRY_EOF
+)
+REGISTRY_TOKEN_NAME="{{REGISTRY_TOKEN_NAME}}"
+
+# Remember the access token so deleting the VM can revoke it
+if [ -n "$REGISTRY_TOKEN_NAME" ]; then
+    sudo mkdir -p /etc/slicer
+    echo "$REGISTRY_TOKEN_NAME" | sudo tee /etc/slicer/registry-token-name > /dev/null
+fi
+
 # Install buildkit
 arkade system install buildkitd
 
@@ -13,6 +37,27 @@ sudo groupadd buildkit
 # Add ubuntu user to buildkit group
 sudo usermod -aG buildkit ubuntu
 
+# buildkitd resolves registries itself, buildctl sends the credentials from
+# the docker config of whoever runs it
+sudo mkdir -p /etc/buildkit
+echo "# Written by the slicer buildkit deployer" | sudo tee /etc/buildkit/buildkitd.toml > /dev/null
+if [ -n "$REGISTRY_HOST" ] && [ "$REGISTRY_INSECURE" = "true" ]; then
+    cat <<EOF | sudo tee -a /etc/buildkit/buildkitd.toml > /dev/null
+
+[registry."${REGISTRY_HOST}"]
+  http = true
+  insecure = true
+EOF
+fi
+if [ -n "$REGISTRY_HOST" ]; then
+    for home in /root /home/ubuntu; do
+        sudo mkdir -p "$home/.docker"
+        echo "$DOCKER_CONFIG_JSON" | sudo tee "$home/.docker/config.json" > /dev/null
+        sudo chmod 600 "$home/.docker/config.json"
+    done
+    sudo chown -R ubuntu:ubuntu /home/ubuntu/.docker
+fi
+
 # Systemd service for buildkit (daemonized under systemd)
 cat <<'EOF' | sudo tee /etc/systemd/system/buildkitd.service > /dev/null
 [Unit]
@@ -21,7 +66,7 @@ After=network.target
 
 [Service]
 Type=simple
-ExecStart=/usr/local/bin/buildkitd --addr unix:///run/buildkit/buildkitd.sock --group buildkit
+ExecStart=/usr/local/bin/buildkitd --config /etc/buildkit/buildkitd.toml --addr unix:///run/buildkit/buildkitd.sock --group buildkit
 Restart=always
 User=root
 
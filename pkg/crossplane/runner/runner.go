@@ -13,6 +13,7 @@ import (
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/tools/clientcmd"
 
+	"github.com/gaarutyunov/slicer/pkg/dns"
 	"github.com/gaarutyunov/slicer/pkg/runner"
 )
 
@@ -41,6 +42,7 @@ type Config struct {
 	SSHKeys     []string
 	GitHubUser  string
 	Tags        []string
+	DNS         dns.Resolver // Stack DNS server, lets GiteaURL use a stable name
 
 	// Runner configuration
 	GiteaURL    string
@@ -267,7 +269,7 @@ func generateUserdata(config Config) string {
 	userdata = strings.ReplaceAll(userdata, "{{RUNNER_NAME}}", config.RunnerName)
 	userdata = strings.ReplaceAll(userdata, "{{RUNNER_LABELS}}", config.Labels)
 	userdata = strings.ReplaceAll(userdata, "{{RUNNER_VERSION}}", config.Version)
-	return userdata
+	return config.DNS.Apply(userdata)
 }
 
 // generateID generates a short random ID.
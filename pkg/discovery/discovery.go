@@ -0,0 +1,333 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+var (
+	// ErrNotFound is returned when no VM matches a service lookup
+	ErrNotFound = errors.New("no matching VM found")
+	// ErrAmbiguous is returned when more than one VM matches and no selector narrows it down
+	ErrAmbiguous = errors.New("more than one matching VM found")
+)
+
+// Service describes how a playground service is tagged and reached
+type Service struct {
+	Name   string
+	Tag    string
+	Port   int
+	Scheme string
+	// Credentials tells consumers where the service credentials live,
+	// "vm:<path>" for a file on the VM or "env:<VAR>" for an env var
+	Credentials string
+	// ClusterTag marks VMs that serve the service together, any of them
+	// answers for all
+	ClusterTag string
+	// TLSTag marks VMs that serve the service over https
+	TLSTag string
+	// PortTag is the prefix of a tag that carries the port when it is
+	// configurable, e.g. "pgbouncer-port-6432"
+	PortTag string
+	// RoleTags mark other VMs that can take the service over, such as
+	// standbys that may be promoted
+	RoleTags []string
+	// RoleCheck runs on every VM with Tag or one of RoleTags, which serves
+	// the service only while it exits 0. Slicer cannot retag a VM, so roles
+	// that move are read from the VM.
+	RoleCheck string
+}
+
+// primaryCheck succeeds on a running, writable PostgreSQL primary that is not
+// an upgrade target waiting for cutover
+const primaryCheck = `[ ! -f /etc/postgresql/slicer-migrating ] && [ "$(cd /tmp && sudo -u postgres psql -XAtc "SELECT NOT pg_is_in_recovery() AND current_setting('default_transaction_read_only') = 'off'" 2>/dev/null)" = t ]`
+
+// standbyCheck succeeds on a running PostgreSQL standby
+const standbyCheck = `[ "$(cd /tmp && sudo -u postgres psql -XAtc 'SELECT pg_is_in_recovery()' 2>/dev/null)" = t ]`
+
+// Services lists every service discovery knows about
+var Services = []Service{
+	{Name: "postgres", Tag: "postgres", Port: 5432, Scheme: "postgres", Credentials: "vm:/home/ubuntu/postgres-credentials.txt", RoleTags: []string{"postgres-standby"}, RoleCheck: primaryCheck},
+	{Name: "pgbouncer", Tag: "pgbouncer", Port: 6432, Scheme: "postgres", Credentials: "vm:/home/ubuntu/postgres-credentials.txt", PortTag: "pgbouncer-port-", RoleCheck: primaryCheck},
+	{Name: "postgres-standby", Tag: "postgres-standby", Port: 5432, Scheme: "postgres", Credentials: "none", RoleTags: []string{"postgres"}, RoleCheck: standbyCheck},
+	{Name: "rustfs", Tag: "rustfs", Port: 9000, Scheme: "http", Credentials: "vm:/etc/default/rustfs", ClusterTag: "rustfs-cluster", TLSTag: "rustfs-tls"},
+	{Name: "gitea", Tag: "gitea", Port: 3000, Scheme: "http", Credentials: "vm:/etc/gitea/admin.env"},
+	{Name: "openfaas", Tag: "openfaas", Port: 8080, Scheme: "http", Credentials: "vm:/var/lib/faasd/secrets/basic-auth-password"},
+	{Name: "k3s", Tag: "k3s-cp", Port: 6443, Scheme: "https", Credentials: "vm:/etc/rancher/k3s/k3s.yaml"},
+	// buildkitd listens on a unix socket, buildctl reaches it over SSH
+	{Name: "buildkit", Tag: "buildkit", Port: 22, Scheme: "ssh", Credentials: "none"},
+	// Runners only poll Gitea, SSH is the way in
+	{Name: "runner", Tag: "runner", Port: 22, Scheme: "ssh", Credentials: "vm:/home/ubuntu/runner-info.txt"},
+	{Name: "dns", Tag: "dns", Port: 53, Scheme: "dns", Credentials: "none"},
+}
+
+// Endpoint is a typed address for a service running in a Slicer VM
+type Endpoint struct {
+	Service     string
+	Hostname    string
+	Host        string
+	Port        int
+	Scheme      string
+	Credentials string
+	Tags        []string
+	// Members holds the host of every cluster member when the endpoint
+	// stands for a cluster
+	Members []string
+}
+
+// Address returns host:port
+func (e Endpoint) Address() string {
+	return fmt.Sprintf("%s:%d", e.Host, e.Port)
+}
+
+// URL returns scheme://host:port
+func (e Endpoint) URL() string {
+	return fmt.Sprintf("%s://%s", e.Scheme, e.Address())
+}
+
+// TLS reports whether the endpoint serves https
+func (e Endpoint) TLS() bool {
+	return e.Scheme == "https"
+}
+
+// Selector narrows a lookup when more than one VM carries the service tag
+type Selector struct {
+	// Hostname matches a single VM by name
+	Hostname string
+	// Tags must all be present on the VM in addition to the service tag
+	Tags []string
+}
+
+// Resolver finds service endpoints from Slicer VM tags
+type Resolver struct {
+	client *sdk.SlicerClient
+}
+
+func NewResolver(client *sdk.SlicerClient) *Resolver {
+	return &Resolver{
+		client: client,
+	}
+}
+
+func NewResolverFromEnv() (*Resolver, error) {
+	baseURL := os.Getenv("SLICER_URL")
+	if baseURL == "" {
+		baseURL = "http://127.0.0.1:8080"
+	}
+
+	token := os.Getenv("SLICER_TOKEN")
+
+	client := sdk.NewSlicerClient(baseURL, token, "slicer-discovery/1.0", nil)
+
+	return &Resolver{
+		client: client,
+	}, nil
+}
+
+// Find returns the single endpoint for a service, failing if none or several VMs match
+func (r *Resolver) Find(ctx context.Context, service string) (*Endpoint, error) {
+	return r.Select(ctx, service, Selector{})
+}
+
+// Select returns the single endpoint for a service that matches the selector.
+// Members of one cluster count as a single endpoint.
+func (r *Resolver) Select(ctx context.Context, service string, sel Selector) (*Endpoint, error) {
+	endpoints, err := r.FindAll(ctx, service, sel)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(endpoints) {
+	case 0:
+		return nil, fmt.Errorf("%w for service %s", ErrNotFound, service)
+	case 1:
+		return &endpoints[0], nil
+	default:
+		if endpoint, ok := clusterEndpoint(service, endpoints); ok {
+			return endpoint, nil
+		}
+		hostnames := make([]string, 0, len(endpoints))
+		for _, e := range endpoints {
+			hostnames = append(hostnames, e.Hostname)
+		}
+		return nil, fmt.Errorf("%w for service %s (%s), select one by hostname", ErrAmbiguous, service, strings.Join(hostnames, ", "))
+	}
+}
+
+// clusterEndpoint returns one endpoint for the whole cluster when every match
+// is a member of it, reached through the first member
+func clusterEndpoint(service string, endpoints []Endpoint) (*Endpoint, bool) {
+	svc, ok := Lookup(service)
+	if !ok || svc.ClusterTag == "" {
+		return nil, false
+	}
+
+	members := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		if !hasTag(e.Tags, svc.ClusterTag) {
+			return nil, false
+		}
+		members = append(members, e.Host)
+	}
+
+	endpoint := endpoints[0]
+	endpoint.Members = members
+	return &endpoint, true
+}
+
+// FindAll returns every endpoint for a service that matches the selector
+func (r *Resolver) FindAll(ctx context.Context, service string, sel Selector) ([]Endpoint, error) {
+	svc, ok := Lookup(service)
+	if !ok {
+		return nil, fmt.Errorf("unknown service %q", service)
+	}
+
+	nodes, err := r.Nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []Endpoint
+	for _, node := range nodes {
+		if !sel.matches(node) || !r.Serves(ctx, svc, node) {
+			continue
+		}
+		endpoints = append(endpoints, endpointFor(svc, node))
+	}
+
+	return endpoints, nil
+}
+
+// All returns the endpoints of every known service in the stack
+func (r *Resolver) All(ctx context.Context) ([]Endpoint, error) {
+	nodes, err := r.Nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []Endpoint
+	for _, svc := range Services {
+		for _, node := range nodes {
+			if r.Serves(ctx, svc, node) {
+				endpoints = append(endpoints, endpointFor(svc, node))
+			}
+		}
+	}
+
+	return endpoints, nil
+}
+
+// Serves reports whether a VM serves a service now, running the service's
+// role check when it has one. A VM that cannot be reached serves nothing
+// that needs a check.
+func (r *Resolver) Serves(ctx context.Context, svc Service, node sdk.SlicerNode) bool {
+	if !svc.Candidate(node.Tags) {
+		return false
+	}
+	if svc.RoleCheck == "" {
+		return true
+	}
+	_, err := vmexec.Run(ctx, r.client, node.Hostname, svc.RoleCheck)
+	return err == nil
+}
+
+// Candidate reports whether a VM with these tags may serve the service
+func (s Service) Candidate(tags []string) bool {
+	if hasTag(tags, s.Tag) {
+		return true
+	}
+	for _, tag := range s.RoleTags {
+		if hasTag(tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Nodes returns every VM known to Slicer
+func (r *Resolver) Nodes(ctx context.Context) ([]sdk.SlicerNode, error) {
+	nodes, err := r.client.ListVMs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VMs: %w", err)
+	}
+	return nodes, nil
+}
+
+// Lookup returns the service definition by name
+func Lookup(name string) (Service, bool) {
+	for _, svc := range Services {
+		if svc.Name == name {
+			return svc, true
+		}
+	}
+	return Service{}, false
+}
+
+// HostIP strips the CIDR suffix Slicer adds to VM addresses
+func HostIP(ip string) string {
+	if idx := strings.Index(ip, "/"); idx != -1 {
+		return ip[:idx]
+	}
+	return ip
+}
+
+func endpointFor(svc Service, node sdk.SlicerNode) Endpoint {
+	scheme := svc.Scheme
+	if svc.TLSTag != "" && hasTag(node.Tags, svc.TLSTag) {
+		scheme = "https"
+	}
+	return Endpoint{
+		Service:     svc.Name,
+		Hostname:    node.Hostname,
+		Host:        HostIP(node.IP),
+		Port:        svc.port(node.Tags),
+		Scheme:      scheme,
+		Credentials: svc.Credentials,
+		Tags:        node.Tags,
+	}
+}
+
+// port returns the port published in a port tag, or the default port
+func (s Service) port(tags []string) int {
+	if s.PortTag == "" {
+		return s.Port
+	}
+	for _, tag := range tags {
+		if rest, ok := strings.CutPrefix(tag, s.PortTag); ok {
+			if port, err := strconv.Atoi(rest); err == nil && port > 0 && port <= 65535 {
+				return port
+			}
+		}
+	}
+	return s.Port
+}
+
+func (s Selector) matches(node sdk.SlicerNode) bool {
+	if s.Hostname != "" && node.Hostname != s.Hostname {
+		return false
+	}
+	for _, tag := range s.Tags {
+		if !hasTag(node.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasTag checks if a tag exists in a list of tags
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package discovery
+
+import "testing"
+
+func TestServicePort(t *testing.T) {
+	pgbouncer, ok := Lookup("pgbouncer")
+	if !ok {
+		t.Fatal("pgbouncer service not found")
+	}
+	tests := []struct {
+		name string
+		svc  Service
+		tags []string
+		want int
+	}{
+		{name: "default", svc: pgbouncer, tags: []string{"pgbouncer"}, want: 6432},
+		{name: "published", svc: pgbouncer, tags: []string{"pgbouncer", "pgbouncer-port-7000"}, want: 7000},
+		{name: "invalid tag ignored", svc: pgbouncer, tags: []string{"pgbouncer-port-x", "pgbouncer-port-70000"}, want: 6432},
+		{name: "no port tag", svc: Service{Port: 5432}, tags: []string{"pgbouncer-port-7000"}, want: 5432},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.svc.port(tt.tags); got != tt.want {
+				t.Errorf("port(%v) = %d, want %d", tt.tags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceCandidate(t *testing.T) {
+	tests := []struct {
+		service string
+		tags    []string
+		want    bool
+	}{
+		{service: "postgres", tags: []string{"postgres"}, want: true},
+		{service: "postgres", tags: []string{"postgres-standby"}, want: true},
+		{service: "postgres-standby", tags: []string{"postgres"}, want: true},
+		{service: "pgbouncer", tags: []string{"postgres"}, want: false},
+		{service: "gitea", tags: []string{"postgres"}, want: false},
+		{service: "gitea", tags: []string{"gitea"}, want: true},
+		{service: "buildkit", tags: []string{"buildkit"}, want: true},
+		{service: "runner", tags: []string{"runner"}, want: true},
+		{service: "runner", tags: []string{"buildkit"}, want: false},
+	}
+	for _, tt := range tests {
+		svc, ok := Lookup(tt.service)
+		if !ok {
+			t.Fatalf("service %s not found", tt.service)
+		}
+		if got := svc.Candidate(tt.tags); got != tt.want {
+			t.Errorf("%s.Candidate(%v) = %t, want %t", tt.service, tt.tags, got, tt.want)
+		}
+	}
+}
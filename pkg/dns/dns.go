@@ -0,0 +1,317 @@
+package dns
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/discovery"
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+	"github.com/gaarutyunov/slicer/pkg/vmspec"
+)
+
+//go:embed userdata.sh
+var userdataTemplate string
+
+const (
+	DefaultHostGroup   = "api"
+	DefaultVCPU        = 1
+	DefaultRAMGB       = 1
+	DefaultStorageSize = "10G"
+	DefaultStack       = "playground"
+	DefaultDomain      = "slicer"
+	DefaultUpstream    = "1.1.1.1 8.8.8.8"
+	DefaultVersion     = "1.12.1"
+	// HostsPath is the file CoreDNS serves the stack zone from
+	HostsPath = "/etc/coredns/hosts"
+)
+
+type Config struct {
+	HostGroup   string
+	VCPU        int
+	RAMGB       int
+	StorageSize string
+	SSHKeys     []string
+	GitHubUser  string
+	Tags        []string
+	Image       string
+	Hypervisor  string
+	Storage     string
+	// DNS specific
+	Stack    string // Stack name, names are served as <name>.<stack>.<domain>
+	Domain   string // Parent domain for every stack
+	Upstream string // Space separated resolvers for names outside the zone
+	Version  string // CoreDNS version
+}
+
+func DefaultConfig() Config {
+	hostGroup := os.Getenv("SLICER_HOST_GROUP")
+	if hostGroup == "" {
+		hostGroup = DefaultHostGroup
+	}
+
+	stack := os.Getenv("SLICER_STACK")
+	if stack == "" {
+		stack = DefaultStack
+	}
+
+	image, hypervisor, storage := vmspec.Default("DNS")
+
+	return Config{
+		HostGroup:   hostGroup,
+		VCPU:        DefaultVCPU,
+		RAMGB:       DefaultRAMGB,
+		StorageSize: DefaultStorageSize,
+		Image:       image,
+		Hypervisor:  hypervisor,
+		Storage:     storage,
+		Tags:        []string{"dns"},
+		Stack:       stack,
+		Domain:      DefaultDomain,
+		Upstream:    DefaultUpstream,
+		Version:     DefaultVersion,
+	}
+}
+
+// Zone returns the DNS zone served for the stack, e.g. playground.slicer
+func (c Config) Zone() string {
+	return c.Stack + "." + c.Domain
+}
+
+// Validate checks the image, hypervisor and storage backend combination
+func (c Config) Validate() error {
+	return vmspec.Validate(c.Image, c.Hypervisor, c.Storage, c.StorageSize)
+}
+
+// Record is an A record in the stack zone
+type Record struct {
+	Name string
+	IP   string
+}
+
+// Resolver points a VM at the stack DNS server for names in Zone. The zero
+// value leaves the VM's resolver untouched.
+type Resolver struct {
+	Server string
+	Zone   string
+}
+
+// Enabled reports whether a stack DNS server is configured
+func (r Resolver) Enabled() bool {
+	return r.Server != "" && r.Zone != ""
+}
+
+// Name returns the fully qualified name of a service or VM hostname in the zone
+func (r Resolver) Name(name string) string {
+	return name + "." + r.Zone
+}
+
+// Apply inserts the resolver configuration after the userdata shebang, so the
+// VM resolves stack names before the service is configured. Only the stack
+// zone is routed to the server, everything else uses the default resolver.
+func (r Resolver) Apply(userdata string) string {
+	if !r.Enabled() {
+		return userdata
+	}
+
+	snippet := fmt.Sprintf(`
+# Resolve %[2]s names through the stack DNS server
+mkdir -p /etc/systemd/resolved.conf.d
+cat <<'EOF' > /etc/systemd/resolved.conf.d/slicer-stack.conf
+[Resolve]
+DNS=%[1]s
+Domains=~%[2]s
+EOF
+systemctl restart systemd-resolved || true
+`, r.Server, r.Zone)
+
+	if strings.HasPrefix(userdata, "#!") {
+		if idx := strings.Index(userdata, "\n"); idx != -1 {
+			return userdata[:idx+1] + snippet + userdata[idx+1:]
+		}
+	}
+	return "#!/usr/bin/env bash\n" + snippet + userdata
+}
+
+type Deployer struct {
+	client *sdk.SlicerClient
+	config Config
+}
+
+func NewDeployer(client *sdk.SlicerClient, config Config) *Deployer {
+	return &Deployer{
+		client: client,
+		config: config,
+	}
+}
+
+func NewDeployerFromEnv(config Config) (*Deployer, error) {
+	baseURL := os.Getenv("SLICER_URL")
+	if baseURL == "" {
+		baseURL = "http://127.0.0.1:8080"
+	}
+
+	token := os.Getenv("SLICER_TOKEN")
+
+	client := sdk.NewSlicerClient(baseURL, token, "slicer-dns/1.0", nil)
+
+	return &Deployer{
+		client: client,
+		config: config,
+	}, nil
+}
+
+func (d *Deployer) Deploy(ctx context.Context) (*sdk.SlicerCreateNodeResponse, error) {
+	req := sdk.SlicerCreateNodeRequest{
+		RamGB:    d.config.RAMGB,
+		CPUs:     d.config.VCPU,
+		Userdata: generateUserdata(d.config),
+	}
+
+	if len(d.config.SSHKeys) > 0 {
+		req.SSHKeys = d.config.SSHKeys
+	}
+
+	if d.config.GitHubUser != "" {
+		req.ImportUser = d.config.GitHubUser
+	}
+
+	if len(d.config.Tags) > 0 {
+		req.Tags = d.config.Tags
+	}
+
+	return d.client.CreateNode(ctx, d.config.HostGroup, req)
+}
+
+// generateUserdata replaces placeholders in the userdata template
+func generateUserdata(config Config) string {
+	userdata := userdataTemplate
+	userdata = strings.ReplaceAll(userdata, "{{COREDNS_VERSION}}", config.Version)
+	userdata = strings.ReplaceAll(userdata, "{{DNS_ZONE}}", config.Zone())
+	userdata = strings.ReplaceAll(userdata, "{{DNS_UPSTREAM}}", config.Upstream)
+	return userdata
+}
+
+// Sync renders records for every Slicer VM and pushes the hosts file to each
+// DNS VM. CoreDNS reloads it within 10 seconds.
+func (d *Deployer) Sync(ctx context.Context) ([]Record, error) {
+	nodes, err := d.client.ListVMs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VMs: %w", err)
+	}
+
+	resolver := discovery.NewResolver(d.client)
+	records := Records(nodes, d.config.Zone(), func(svc discovery.Service, node sdk.SlicerNode) bool {
+		return resolver.Serves(ctx, svc, node)
+	})
+	hosts := []byte(GenerateHosts(records))
+
+	for _, node := range nodes {
+		if !hasTag(node.Tags, "dns") {
+			continue
+		}
+		if err := vmexec.WriteFile(ctx, d.client, node.Hostname, HostsPath, hosts, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	return records, nil
+}
+
+func (d *Deployer) Delete(ctx context.Context, hostname string) error {
+	_, err := d.client.DeleteVM(ctx, d.config.HostGroup, hostname)
+	return err
+}
+
+func (d *Deployer) List(ctx context.Context) ([]sdk.SlicerNode, error) {
+	return d.client.GetHostGroupNodes(ctx, d.config.HostGroup)
+}
+
+func (d *Deployer) Logs(ctx context.Context, hostname string, lines int) (string, error) {
+	resp, err := d.client.GetVMLogs(ctx, hostname, lines)
+	if err != nil {
+		return "", err
+	}
+	return resp.Content, nil
+}
+
+// Records returns a record for every VM hostname plus a service name record
+// for each VM that serves a known service. Several VMs serving the same
+// service share the name and are answered round-robin.
+func Records(nodes []sdk.SlicerNode, zone string, serves func(discovery.Service, sdk.SlicerNode) bool) []Record {
+	var records []Record
+	for _, node := range nodes {
+		ip := discovery.HostIP(node.IP)
+		if ip == "" {
+			continue
+		}
+
+		records = append(records, Record{Name: node.Hostname + "." + zone, IP: ip})
+		for _, svc := range discovery.Services {
+			if serves(svc, node) {
+				records = append(records, Record{Name: svc.Name + "." + zone, IP: ip})
+			}
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Name < records[j].Name
+	})
+	return records
+}
+
+// GenerateHosts renders records in the hosts file format CoreDNS reads
+func GenerateHosts(records []Record) string {
+	var b strings.Builder
+	b.WriteString("# Managed by mage dns:sync, changes are overwritten\n")
+	for _, r := range records {
+		fmt.Fprintf(&b, "%s %s\n", r.IP, r.Name)
+	}
+	return b.String()
+}
+
+// hasTag checks if a tag exists in a list of tags
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func Userdata() string {
+	return userdataTemplate
+}
+
+func GenerateYAML(config Config, githubUser string) string {
+	return fmt.Sprintf(`config:
+  host_groups:
+  - name: %s
+    storage: %s
+    storage_size: %s
+    count: 0
+    vcpu: %d
+    ram_gb: %d
+    network:
+      bridge: br%s0
+      tap_prefix: %stap
+      gateway: 192.168.143.1/24
+
+  github_user: %s
+
+  image: "%s"
+
+  hypervisor: %s
+
+  api:
+    port: 8080
+    bind_address: "127.0.0.1"
+`, config.HostGroup, config.Storage, config.StorageSize, config.VCPU, config.RAMGB,
+		config.HostGroup, config.HostGroup, githubUser, config.Image, config.Hypervisor)
+}
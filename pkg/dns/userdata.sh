@@ -0,0 +1,66 @@
+#!/usr/bin/env bash
+set -euxo pipefail
+
+# CoreDNS installation script
+# Serves the stack zone from a hosts file that 'mage dns:sync' keeps up to date
+# with Slicer VM tags, and forwards every other name upstream
+
+COREDNS_VERSION="{{COREDNS_VERSION}}"
+DNS_ZONE="{{DNS_ZONE}}"
+DNS_UPSTREAM="{{DNS_UPSTREAM}}"
+
+# Install CoreDNS
+curl -sSL "https://github.com/coredns/coredns/releases/download/v${COREDNS_VERSION}/coredns_${COREDNS_VERSION}_linux_amd64.tgz" \
+  | sudo tar -xz -C /usr/local/bin coredns
+
+sudo useradd --system --no-create-home --shell /usr/sbin/nologin coredns || true
+
+sudo mkdir -p /etc/coredns
+sudo touch /etc/coredns/hosts
+
+cat <<EOF | sudo tee /etc/coredns/Corefile > /dev/null
+${DNS_ZONE} {
+    hosts /etc/coredns/hosts {
+        reload 10s
+    }
+    errors
+    log
+}
+
+. {
+    forward . ${DNS_UPSTREAM}
+    cache 30
+    errors
+}
+EOF
+
+# Free port 53 from the systemd-resolved stub listener
+sudo mkdir -p /etc/systemd/resolved.conf.d
+cat <<'EOF' | sudo tee /etc/systemd/resolved.conf.d/coredns.conf > /dev/null
+[Resolve]
+DNSStubListener=no
+EOF
+sudo ln -sf /run/systemd/resolve/resolv.conf /etc/resolv.conf
+sudo systemctl restart systemd-resolved
+
+cat <<'EOF' | sudo tee /etc/systemd/system/coredns.service > /dev/null
+[Unit]
+Description=CoreDNS
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+User=coredns
+AmbientCapabilities=CAP_NET_BIND_SERVICE
+ExecStart=/usr/local/bin/coredns -conf /etc/coredns/Corefile
+Restart=always
+
+[Install]
+WantedBy=multi-user.target
+EOF
+
+sudo systemctl daemon-reload
+sudo systemctl enable --now coredns
+
+echo "CoreDNS ${COREDNS_VERSION} serving ${DNS_ZONE}"
@@ -0,0 +1,122 @@
+package export
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/discovery"
+)
+
+// DefaultUser is the login user on Slicer images
+const DefaultUser = "ubuntu"
+
+// Host is a VM as seen by external tooling
+type Host struct {
+	Hostname  string
+	IP        string
+	Tags      []string
+	CreatedAt time.Time
+}
+
+// Var is an environment variable to export
+type Var struct {
+	Name  string
+	Value string
+}
+
+// Hosts converts Slicer nodes to hosts sorted by hostname, skipping VMs
+// without an IP
+func Hosts(nodes []sdk.SlicerNode) []Host {
+	hosts := make([]Host, 0, len(nodes))
+	for _, node := range nodes {
+		ip := discovery.HostIP(node.IP)
+		if ip == "" {
+			continue
+		}
+		hosts = append(hosts, Host{Hostname: node.Hostname, IP: ip, Tags: node.Tags, CreatedAt: node.CreatedAt})
+	}
+
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Hostname < hosts[j].Hostname
+	})
+	return hosts
+}
+
+// Env renders variables as export lines that can be sourced by a shell
+func Env(vars []Var) string {
+	var b strings.Builder
+	for _, v := range vars {
+		fmt.Fprintf(&b, "export %s=%s\n", v.Name, shellQuote(v.Value))
+	}
+	return b.String()
+}
+
+// SSHConfig renders a Host block per VM. identityFile is the private key and
+// is left out when empty. Host keys are pinned in knownHosts, see KnownHosts.
+func SSHConfig(hosts []Host, user, identityFile, knownHosts string) string {
+	var b strings.Builder
+	for i, h := range hosts {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "Host %s\n", h.Hostname)
+		fmt.Fprintf(&b, "  HostName %s\n", h.IP)
+		fmt.Fprintf(&b, "  User %s\n", user)
+		if identityFile != "" {
+			fmt.Fprintf(&b, "  IdentityFile %s\n", identityFile)
+			b.WriteString("  IdentitiesOnly yes\n")
+		}
+		// New VMs are trusted on first use, KnownHosts.Sync forgets recreated ones
+		b.WriteString("  StrictHostKeyChecking accept-new\n")
+		fmt.Fprintf(&b, "  UserKnownHostsFile %s\n", knownHosts)
+	}
+	return b.String()
+}
+
+// Ansible renders an INI inventory with one group per tag. Dashes in tags
+// become underscores because Ansible rejects them in group names. Host keys
+// are pinned in knownHosts.
+func Ansible(hosts []Host, user, identityFile, knownHosts string) string {
+	groups := map[string][]Host{}
+	for _, h := range hosts {
+		if len(h.Tags) == 0 {
+			groups["ungrouped"] = append(groups["ungrouped"], h)
+		}
+		for _, tag := range h.Tags {
+			group := strings.ReplaceAll(tag, "-", "_")
+			groups[group] = append(groups[group], h)
+		}
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "[%s]\n", name)
+		for _, h := range groups[name] {
+			fmt.Fprintf(&b, "%s ansible_host=%s\n", h.Hostname, h.IP)
+		}
+		b.WriteString("\n")
+	}
+
+	b.WriteString("[all:vars]\n")
+	fmt.Fprintf(&b, "ansible_user=%s\n", user)
+	if identityFile != "" {
+		fmt.Fprintf(&b, "ansible_ssh_private_key_file=%s\n", identityFile)
+	}
+	fmt.Fprintf(&b, "ansible_ssh_common_args='-o StrictHostKeyChecking=accept-new -o UserKnownHostsFile=%s'\n", knownHosts)
+	return b.String()
+}
+
+// shellQuote wraps a value in single quotes for POSIX shells
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,155 @@
+package export
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// KnownHosts is the known_hosts file exported SSH access pins VM host keys
+// in. VMs get fresh host keys when they are recreated, often on the same IP,
+// so their old entries are removed instead of accepting any key.
+type KnownHosts struct {
+	Path string
+}
+
+// statePath records which VM each entry belongs to, "<ip> <hostname> <created>"
+func (k KnownHosts) statePath() string {
+	return k.Path + ".vms"
+}
+
+// Sync removes the entries of VMs that were recreated or deleted since the
+// last sync, and of VMs it has not seen before, whose IP may have belonged to
+// another VM. It then records the current VMs.
+func (k KnownHosts) Sync(hosts []Host) error {
+	if err := os.MkdirAll(filepath.Dir(k.Path), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(k.Path), err)
+	}
+
+	seen, err := k.readState()
+	if err != nil {
+		return err
+	}
+
+	current := map[string]string{}
+	for _, h := range hosts {
+		current[h.IP] = stateLine(h)
+	}
+
+	var stale []string
+	for ip, line := range seen {
+		if current[ip] != line {
+			stale = append(stale, strings.Fields(line)[:2]...)
+		}
+	}
+	for ip, line := range current {
+		if seen[ip] != line {
+			stale = append(stale, strings.Fields(line)[:2]...)
+		}
+	}
+	if err := k.Forget(stale...); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	for _, h := range hosts {
+		b.WriteString(stateLine(h) + "\n")
+	}
+	if err := os.WriteFile(k.statePath(), []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", k.statePath(), err)
+	}
+	return nil
+}
+
+func stateLine(h Host) string {
+	return fmt.Sprintf("%s %s %s", h.IP, h.Hostname, h.CreatedAt.UTC().Format(time.RFC3339Nano))
+}
+
+func (k KnownHosts) readState() (map[string]string, error) {
+	seen := map[string]string{}
+	data, err := os.ReadFile(k.statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return seen, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", k.statePath(), err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 {
+			seen[fields[0]] = line
+		}
+	}
+	return seen, nil
+}
+
+// Forget removes every entry for the given hostnames or IPs, hashed or not,
+// like ssh-keygen -R
+func (k KnownHosts) Forget(names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(k.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", k.Path, err)
+	}
+
+	var b strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !matchesAny(line, names) {
+			b.WriteString(line + "\n")
+		}
+	}
+	if err := os.WriteFile(k.Path, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", k.Path, err)
+	}
+	return nil
+}
+
+// matchesAny reports whether a known_hosts line is for one of names. Comments
+// and marker lines such as @cert-authority are kept.
+func matchesAny(line string, names []string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "@") {
+		return false
+	}
+	for _, pattern := range strings.Split(fields[0], ",") {
+		for _, name := range names {
+			if matchesHost(pattern, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesHost compares a host pattern with a name, including hashed patterns
+// of the form |1|<salt>|<hmac-sha1 of the name>
+func matchesHost(pattern, name string) bool {
+	hashed, ok := strings.CutPrefix(pattern, "|1|")
+	if !ok {
+		return pattern == name
+	}
+	salt64, sum64, ok := strings.Cut(hashed, "|")
+	if !ok {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)) == sum64
+}
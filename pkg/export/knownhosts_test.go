@@ -0,0 +1,86 @@
+package export
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hashedEntry is 192.168.137.5 hashed by ssh-keygen -H
+const hashedEntry = "|1|BVg3yQKnRz07WEaS/+5rPWAFAYA=|Vvf0LbD3vO+frMCQt9fXF/s21TE= ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIExample"
+
+func TestKnownHostsForget(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	content := strings.Join([]string{
+		"# comment",
+		hashedEntry,
+		"192.168.137.6 ssh-ed25519 AAAAkeep",
+		"pg-1,192.168.137.7 ssh-ed25519 AAAAdrop",
+		"@cert-authority 192.168.137.5 ssh-ed25519 AAAAca",
+	}, "\n") + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (KnownHosts{Path: path}).Forget("192.168.137.5", "pg-1"); err != nil {
+		t.Fatalf("Forget() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# comment\n192.168.137.6 ssh-ed25519 AAAAkeep\n@cert-authority 192.168.137.5 ssh-ed25519 AAAAca\n"
+	if string(data) != want {
+		t.Errorf("known_hosts = %q, want %q", data, want)
+	}
+}
+
+func TestKnownHostsSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slicer", "known_hosts")
+	known := KnownHosts{Path: path}
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	pg := Host{Hostname: "pg-1", IP: "192.168.137.5", CreatedAt: created}
+	gitea := Host{Hostname: "gitea-1", IP: "192.168.137.6", CreatedAt: created}
+
+	if err := known.Sync([]Host{pg, gitea}); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	// ssh adds the keys on first connect
+	if err := os.WriteFile(path, []byte(hashedEntry+"\n192.168.137.6 ssh-ed25519 AAAAgitea\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unchanged VMs keep their keys
+	if err := known.Sync([]Host{pg, gitea}); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if data, _ := os.ReadFile(path); strings.Count(string(data), "\n") != 2 {
+		t.Fatalf("known_hosts = %q, want both entries kept", data)
+	}
+
+	// pg-1 is recreated on the same IP
+	pg.CreatedAt = created.Add(time.Hour)
+	if err := known.Sync([]Host{pg, gitea}); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "192.168.137.6 ssh-ed25519 AAAAgitea\n" {
+		t.Errorf("known_hosts = %q, want only the gitea entry", data)
+	}
+}
+
+func TestSSHConfigPinsHostKeys(t *testing.T) {
+	config := SSHConfig([]Host{{Hostname: "pg-1", IP: "192.168.137.5"}}, DefaultUser, "", "/home/u/.slicer/known_hosts")
+	if strings.Contains(config, "/dev/null") || !strings.Contains(config, "UserKnownHostsFile /home/u/.slicer/known_hosts\n") {
+		t.Errorf("SSHConfig() does not pin host keys:\n%s", config)
+	}
+	inventory := Ansible([]Host{{Hostname: "pg-1", IP: "192.168.137.5"}}, DefaultUser, "", "/home/u/.slicer/known_hosts")
+	if strings.Contains(inventory, "/dev/null") || !strings.Contains(inventory, "UserKnownHostsFile=/home/u/.slicer/known_hosts'") {
+		t.Errorf("Ansible() does not pin host keys:\n%s", inventory)
+	}
+}
@@ -0,0 +1,231 @@
+package gitea
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+const (
+	DefaultBackupBucket = "gitea-backups"
+	// DefaultBackupKeep is the number of archives kept per VM
+	DefaultBackupKeep = 7
+	// DBDumpName is the SQL dump of the database in an archive
+	DBDumpName = "gitea-db.sql"
+)
+
+// storageDirs are the archive directories gitea dump fills from S3 storage.
+// Each is also the prefix of its objects in the bucket.
+var storageDirs = []string{"attachments", "lfs", "avatars", "repo-avatars", "packages", "actions_log", "actions_artifacts"}
+
+// Dump runs gitea dump on a VM and copies the zip archive to localPath. It
+// holds the repositories, data, S3 objects, app.ini and, unless skipDB is
+// set, an SQL dump of the database.
+func (d *Deployer) Dump(ctx context.Context, hostname, localPath string, skipDB bool) error {
+	layout, err := d.layout(ctx, hostname)
+	if err != nil {
+		return err
+	}
+	remote := fmt.Sprintf("%s/gitea-dump-%s.zip", layout.DumpDir, time.Now().UTC().Format("20060102-150405"))
+	flags := "--skip-log"
+	if skipDB {
+		flags += " --skip-db"
+	}
+	script := fmt.Sprintf(`set -e
+mkdir -p %[1]s
+%[5]s
+cd %[1]s
+%[6]s dump --config %[2]s --type zip --tempdir %[1]s --file %[3]s %[4]s > /dev/null
+chmod 644 %[3]s`, layout.DumpDir, layout.AppINI, remote, flags, layout.Chown(layout.DumpDir), layout.CLI())
+
+	defer func() {
+		vmexec.Run(context.WithoutCancel(ctx), d.client, hostname, "rm -f "+remote)
+	}()
+	if _, err := vmexec.Run(ctx, d.client, hostname, script); err != nil {
+		return fmt.Errorf("failed to run gitea dump on %s: %w", hostname, err)
+	}
+	if err := d.client.CpFromVM(ctx, hostname, remote, localPath, 0, 0); err != nil {
+		return fmt.Errorf("failed to copy %s from %s: %w", remote, hostname, err)
+	}
+	return nil
+}
+
+// RestoreFiles copies the repositories and data of an archive into a Gitea
+// VM and regenerates the git hooks and SSH keys, which point at the old
+// instance. The database and S3 objects are restored separately.
+func (d *Deployer) RestoreFiles(ctx context.Context, hostname, archivePath string) error {
+	layout, err := d.layout(ctx, hostname)
+	if err != nil {
+		return err
+	}
+	remote := layout.DumpDir + "/restore.zip"
+	if _, err := vmexec.Run(ctx, d.client, hostname, "mkdir -p "+layout.DumpDir); err != nil {
+		return fmt.Errorf("failed to prepare %s on %s: %w", layout.DumpDir, hostname, err)
+	}
+	if err := d.client.CpToVM(ctx, hostname, archivePath, remote, 0, 0); err != nil {
+		return fmt.Errorf("failed to copy archive to %s: %w", hostname, err)
+	}
+
+	script := fmt.Sprintf(`set -euo pipefail
+command -v unzip > /dev/null || (apt-get update -qq && DEBIAN_FRONTEND=noninteractive apt-get install -y -qq unzip)
+TMP=%[1]s/restore
+rm -rf "$TMP" && mkdir -p "$TMP"
+unzip -q %[2]s -d "$TMP"
+rm -f %[2]s
+
+%[7]s
+if [ -d "$TMP/repos" ]; then
+    mkdir -p %[3]s
+    cp -a "$TMP/repos/." %[3]s/
+fi
+if [ -d "$TMP/data" ]; then
+    for dir in "$TMP"/data/*; do
+        name=$(basename "$dir")
+        case " %[4]s " in *" $name "*) continue ;; esac
+        mkdir -p "%[5]s/$name"
+        cp -a "$dir/." "%[5]s/$name/"
+    done
+fi
+rm -rf "$TMP"
+%[8]s
+
+%[9]s admin regenerate hooks --config %[6]s
+%[9]s admin regenerate keys --config %[6]s
+%[10]s`, layout.DumpDir, remote, layout.RepoRoot, strings.Join(storageDirs, " "), layout.DataPath, layout.AppINI,
+		layout.Service("stop"), layout.Chown(layout.DataPath), layout.CLI(), layout.Service("start"))
+
+	if _, err := vmexec.Run(ctx, d.client, hostname, script); err != nil {
+		return fmt.Errorf("failed to restore files on %s: %w", hostname, err)
+	}
+	return nil
+}
+
+// Archive is a gitea dump zip on the local disk
+type Archive struct {
+	// Secrets come from the app.ini in the archive, any it lacks are
+	// generated
+	Secrets Secrets
+	zip     *zip.ReadCloser
+}
+
+// OpenArchive opens a gitea dump zip and reads its secrets
+func OpenArchive(localPath string) (*Archive, error) {
+	r, err := zip.OpenReader(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", localPath, err)
+	}
+
+	a := &Archive{zip: r}
+	if a.Secrets, err = generateSecrets(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	ini := a.file("app.ini")
+	if ini == nil {
+		r.Close()
+		return nil, fmt.Errorf("%s is not a gitea dump, it has no app.ini", localPath)
+	}
+	if err := a.readSecrets(ini); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Close closes the archive
+func (a *Archive) Close() error {
+	return a.zip.Close()
+}
+
+// HasDB reports whether the archive holds an SQL dump of the database
+func (a *Archive) HasDB() bool {
+	return a.file(DBDumpName) != nil
+}
+
+// ExtractDB writes the SQL dump of the database to w
+func (a *Archive) ExtractDB(w io.Writer) error {
+	f := a.file(DBDumpName)
+	if f == nil {
+		return fmt.Errorf("archive has no %s", DBDumpName)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", DBDumpName, err)
+	}
+	defer r.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("failed to extract %s: %w", DBDumpName, err)
+	}
+	return nil
+}
+
+// StorageObjects calls fn with the bucket key, size and contents of every
+// S3 object in the archive
+func (a *Archive) StorageObjects(fn func(key string, size int64, r io.Reader) error) error {
+	for _, f := range a.zip.File {
+		key, ok := strings.CutPrefix(f.Name, "data/")
+		if !ok || f.FileInfo().IsDir() {
+			continue
+		}
+		if dir, rest, ok := strings.Cut(key, "/"); !ok || rest == "" || !slices.Contains(storageDirs, dir) {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", f.Name, err)
+		}
+		err = fn(key, int64(f.UncompressedSize64), r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Archive) file(name string) *zip.File {
+	for _, f := range a.zip.File {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// readSecrets takes the secrets set in an app.ini over the generated ones
+func (a *Archive) readSecrets(ini *zip.File) error {
+	r, err := ini.Open()
+	if err != nil {
+		return fmt.Errorf("failed to read app.ini: %w", err)
+	}
+	defer r.Close()
+
+	keys := map[string]*string{
+		"SECRET_KEY":     &a.Secrets.SecretKey,
+		"INTERNAL_TOKEN": &a.Secrets.InternalToken,
+		"JWT_SECRET":     &a.Secrets.JWTSecret,
+		"LFS_JWT_SECRET": &a.Secrets.LFSJWTSecret,
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), "`\"")
+		if dst := keys[strings.TrimSpace(key)]; dst != nil && value != "" {
+			*dst = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read app.ini: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package gitea
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+// apiPrefix is where Gitea serves its REST API
+const apiPrefix = "/api/v1"
+
+// Client talks to the Gitea REST API as a user, with basic auth
+type Client struct {
+	BaseURL  string // scheme://host:port
+	User     string
+	Password string
+	http     *http.Client
+}
+
+// NewClient creates a client for the Gitea instance at baseURL
+func NewClient(baseURL, user, password string) *Client {
+	return &Client{
+		BaseURL:  strings.TrimSuffix(baseURL, "/"),
+		User:     user,
+		Password: password,
+		http:     &http.Client{},
+	}
+}
+
+// APIError is a non-2xx response from the API
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("gitea returned %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the API
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// do sends in as JSON when set and decodes the response into out when set
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+apiPrefix+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.SetBasicAuth(c.User, c.Password)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		var msg struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &msg) != nil || msg.Message == "" {
+			msg.Message = strings.TrimSpace(string(data))
+		}
+		return &APIError{StatusCode: res.StatusCode, Message: msg.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// scopePath returns the API path of a runner scope: "" for the instance, an
+// org name, or owner/repo
+func scopePath(scope string) string {
+	if scope == "" {
+		return "/admin"
+	}
+	if owner, repo, ok := strings.Cut(scope, "/"); ok {
+		return "/repos/" + url.PathEscape(owner) + "/" + url.PathEscape(repo)
+	}
+	return "/orgs/" + url.PathEscape(scope)
+}
+
+// RegistrationToken returns a runner registration token for a scope: "" for
+// the whole instance, an org name, or owner/repo
+func (c *Client) RegistrationToken(ctx context.Context, scope string) (string, error) {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	// The instance token predates the actions prefix the other scopes use
+	path := scopePath(scope) + "/actions/runners/registration-token"
+	if scope == "" {
+		path = "/admin/runners/registration-token"
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return "", fmt.Errorf("failed to get runner registration token: %w", err)
+	}
+	if resp.Token == "" {
+		return "", fmt.Errorf("gitea returned an empty runner registration token")
+	}
+	return resp.Token, nil
+}
+
+// AdminCredentials reads the admin account userdata created from a Gitea VM
+func (d *Deployer) AdminCredentials(ctx context.Context, hostname string) (*Credentials, error) {
+	out, err := vmexec.Run(ctx, d.client, hostname, "cat "+AdminFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s on %s: %w", AdminFile, hostname, err)
+	}
+
+	creds := &Credentials{}
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "GITEA_ADMIN_USER":
+			creds.User = value
+		case "GITEA_ADMIN_PASSWORD":
+			creds.Password = value
+		case "GITEA_ADMIN_EMAIL":
+			creds.Email = value
+		}
+	}
+	if creds.User == "" || creds.Password == "" {
+		return nil, fmt.Errorf("no admin credentials in %s on %s", AdminFile, hostname)
+	}
+	return creds, nil
+}
+
+// CreateAccessToken creates an access token for the client user and returns
+// it, Gitea only shows a token once. Scopes are e.g. write:package.
+func (c *Client) CreateAccessToken(ctx context.Context, name string, scopes ...string) (string, error) {
+	var resp struct {
+		SHA1 string `json:"sha1"`
+	}
+	body := map[string]any{"name": name, "scopes": scopes}
+	if err := c.do(ctx, http.MethodPost, "/users/"+url.PathEscape(c.User)+"/tokens", body, &resp); err != nil {
+		return "", fmt.Errorf("failed to create access token %s: %w", name, err)
+	}
+	return resp.SHA1, nil
+}
+
+// DeleteAccessToken revokes an access token of the signed-in user by name
+func (c *Client) DeleteAccessToken(ctx context.Context, name string) error {
+	path := "/users/" + url.PathEscape(c.User) + "/tokens/" + url.PathEscape(name)
+	if err := c.do(ctx, http.MethodDelete, path, nil, nil); err != nil {
+		return fmt.Errorf("failed to delete access token %s: %w", name, err)
+	}
+	return nil
+}
+
+// Registry returns the host:port of the container registry Gitea serves
+// with its web UI, and whether it is plain HTTP
+func (c *Client) Registry() (host string, insecure bool) {
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return strings.TrimPrefix(c.BaseURL, "http://"), true
+	}
+	return u.Host, u.Scheme != "https"
+}
@@ -6,8 +6,14 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/discovery"
+	"github.com/gaarutyunov/slicer/pkg/dns"
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+	"github.com/gaarutyunov/slicer/pkg/vmspec"
 )
 
 //go:embed userdata.sh
@@ -18,8 +24,21 @@ const (
 	DefaultVCPU        = 2
 	DefaultRAMGB       = 4
 	DefaultStorageSize = "25G"
+	DefaultDataDir     = "/var/snap/gitea/common"
 	DefaultHTTPPort    = 3000
-	DefaultSSHPort     = 2222
+	// DefaultSSHPort is where the binary install moves the VM's sshd, so
+	// Gitea can serve git on 22
+	DefaultSSHPort = 2222
+	// DefaultVersion is the release the binary install downloads
+	DefaultVersion = "1.24.6"
+	// AppINIPath is where the snap reads its configuration
+	AppINIPath = "/var/snap/gitea/common/conf/app.ini"
+	// AppDataPath holds data that is not in S3 storage, such as sessions
+	// and indexes, and RepoRoot the git repositories. app.ini sets both to
+	// the defaults of the snap's work directory, see Layout for the binary
+	// install.
+	AppDataPath = "/var/snap/gitea/common/data"
+	RepoRoot    = AppDataPath + "/gitea-repositories"
 )
 
 type Config struct {
@@ -30,18 +49,50 @@ type Config struct {
 	SSHKeys     []string
 	GitHubUser  string
 	Tags        []string
+	Image       string
+	Hypervisor  string
+	Storage     string
+	// DNS points the VM at the stack DNS server so configs can use names
+	DNS dns.Resolver
+	// InstallMethod is InstallSnap or InstallBinary, Version and HostSSHPort
+	// only apply to the binary
+	InstallMethod string
+	Version       string
+	HostSSHPort   int
+	// Data volume: DataDir holds repositories and app data, Persistent keeps
+	// the VM disk after deletion so the data survives VM replacement
+	DataDir    string
+	Persistent bool
 	// Database connection (external PostgreSQL)
 	DBHost string
 	DBPort int
 	DBName string
 	DBUser string
 	DBPass string
+	// DBSSLMode is the libpq sslmode, verify-full needs DBCACert, the PEM CA
+	// that signed the PostgreSQL server certificate
+	DBSSLMode string
+	DBCACert  string
 	// S3 Storage (RustFS/MinIO)
 	S3Endpoint  string
 	S3AccessKey string
 	S3SecretKey string
 	S3Bucket    string
 	S3UseSSL    bool
+	// S3CACert is the PEM CA the S3 endpoint's certificate is verified
+	// against, e.g. the playground CA of a RustFS VM serving TLS
+	S3CACert string
+	// Admin account created on first boot, the password is generated when
+	// empty and the email defaults to <user>@gitea.local
+	AdminUser     string
+	AdminPassword string
+	AdminEmail    string
+	// Secrets are generated when nil, a restore passes the ones of the
+	// backed up instance
+	Secrets *Secrets
+	// Packages enables the package registries, including the OCI registry,
+	// with blobs under packages/ in the S3 bucket
+	Packages bool
 }
 
 func DefaultConfig() Config {
@@ -50,28 +101,89 @@ func DefaultConfig() Config {
 		hostGroup = DefaultHostGroup
 	}
 
+	image, hypervisor, storage := vmspec.Default("GITEA")
+
 	return Config{
-		HostGroup:   hostGroup,
-		VCPU:        DefaultVCPU,
-		RAMGB:       DefaultRAMGB,
-		StorageSize: DefaultStorageSize,
-		Tags:        []string{"gitea"},
-		DBPort:      5432,
-		DBName:      "giteadb",
-		DBUser:      "gitea",
-		S3Bucket:    "gitea",
-		S3UseSSL:    false,
+		HostGroup:     hostGroup,
+		VCPU:          DefaultVCPU,
+		RAMGB:         DefaultRAMGB,
+		StorageSize:   DefaultStorageSize,
+		Image:         image,
+		Hypervisor:    hypervisor,
+		Storage:       storage,
+		InstallMethod: InstallSnap,
+		Version:       DefaultVersion,
+		HostSSHPort:   DefaultSSHPort,
+		DataDir:       DefaultDataDir,
+		Persistent:    vmspec.SupportsPersistentDisk(storage),
+		Tags:          []string{"gitea"},
+		DBPort:        5432,
+		DBName:        "giteadb",
+		DBUser:        "gitea",
+		DBSSLMode:     "disable",
+		S3Bucket:      "gitea",
+		S3UseSSL:      false,
+		AdminUser:     DefaultAdminUser,
+		Packages:      true,
 	}
 }
 
+// Validate checks the image, hypervisor and storage backend combination
+func (c Config) Validate() error {
+	if err := vmspec.Validate(c.Image, c.Hypervisor, c.Storage, c.StorageSize); err != nil {
+		return err
+	}
+	if err := vmspec.ValidateDataVolume(c.Storage, c.Persistent); err != nil {
+		return err
+	}
+	if err := c.validateInstall(); err != nil {
+		return err
+	}
+	return c.validateSSLMode()
+}
+
+func (c Config) validateInstall() error {
+	if _, err := LayoutFor(c.InstallMethod); err != nil {
+		return err
+	}
+	if c.InstallMethod == InstallBinary {
+		if c.Version == "" {
+			return fmt.Errorf("the binary install needs a gitea version")
+		}
+		if c.HostSSHPort <= 0 || c.HostSSHPort > 65535 {
+			return fmt.Errorf("host ssh port %d is out of range 1-65535", c.HostSSHPort)
+		}
+		if c.HostSSHPort == 22 {
+			return fmt.Errorf("host ssh port must not be 22, gitea serves git there")
+		}
+	}
+	return nil
+}
+
+func (c Config) validateSSLMode() error {
+	switch c.DBSSLMode {
+	case "", "disable", "require":
+		return nil
+	case "verify-ca", "verify-full":
+		if c.DBCACert == "" {
+			return fmt.Errorf("database sslmode %s needs the CA certificate", c.DBSSLMode)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported database sslmode %q, use disable, require, verify-ca or verify-full", c.DBSSLMode)
+}
+
 type Deployer struct {
 	client *sdk.SlicerClient
+	// api creates persistent VMs, which the SDK cannot size
+	api    vmspec.API
 	config Config
 }
 
 func NewDeployer(client *sdk.SlicerClient, config Config) *Deployer {
 	return &Deployer{
 		client: client,
+		api:    vmspec.APIFromEnv("slicer-gitea/1.0"),
 		config: config,
 	}
 }
@@ -88,18 +200,39 @@ func NewDeployerFromEnv(config Config) (*Deployer, error) {
 
 	return &Deployer{
 		client: client,
+		api:    vmspec.APIFromEnv("slicer-gitea/1.0"),
 		config: config,
 	}, nil
 }
 
-func (d *Deployer) Deploy(ctx context.Context) (*sdk.SlicerCreateNodeResponse, error) {
+// Deploy creates a Gitea VM that installs itself without the web wizard and
+// waits until it serves requests
+func (d *Deployer) Deploy(ctx context.Context) (*DeployResponse, error) {
+	if err := d.config.validateSSLMode(); err != nil {
+		return nil, err
+	}
+	if err := d.config.validateInstall(); err != nil {
+		return nil, err
+	}
+
+	admin, err := d.admin()
+	if err != nil {
+		return nil, err
+	}
+	var secrets Secrets
+	if d.config.Secrets != nil {
+		secrets = *d.config.Secrets
+	} else if secrets, err = generateSecrets(); err != nil {
+		return nil, err
+	}
+
 	// Generate userdata with database config
-	userdata := generateUserdata(d.config)
+	userdata := installUserdata(generateUserdata(d.config), admin, secrets)
 
 	req := sdk.SlicerCreateNodeRequest{
 		RamGB:    d.config.RAMGB,
 		CPUs:     d.config.VCPU,
-		Userdata: userdata,
+		Userdata: d.config.DNS.Apply(userdata),
 	}
 
 	if len(d.config.SSHKeys) > 0 {
@@ -114,17 +247,54 @@ func (d *Deployer) Deploy(ctx context.Context) (*sdk.SlicerCreateNodeResponse, e
 		req.Tags = d.config.Tags
 	}
 
-	return d.client.CreateNode(ctx, d.config.HostGroup, req)
+	var resp *sdk.SlicerCreateNodeResponse
+	if d.config.Persistent {
+		if err := vmspec.ValidateDataVolume(d.config.Storage, d.config.Persistent); err != nil {
+			return nil, err
+		}
+		resp, err = d.api.CreateVM(ctx, d.config.HostGroup, vmspec.PersistentVMRequest(req, "", ""))
+	} else {
+		resp, err = d.client.CreateNode(ctx, d.config.HostGroup, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DeployResponse{
+		SlicerCreateNodeResponse: resp,
+		URL:                      fmt.Sprintf("http://%s:%d", discovery.HostIP(resp.IP), DefaultHTTPPort),
+		Admin:                    admin,
+	}
+	// Installing Gitea and migrating the database take a few minutes
+	if err := WaitHealthy(ctx, result.URL, 15*time.Minute); err != nil {
+		return result, err
+	}
+	return result, nil
 }
 
 // generateUserdata replaces placeholders in the userdata template
 func generateUserdata(config Config) string {
+	layout, _ := LayoutFor(config.InstallMethod)
 	userdata := userdataTemplate
+	userdata = strings.ReplaceAll(userdata, "{{INSTALL_METHOD}}", layout.Method)
+	userdata = strings.ReplaceAll(userdata, "{{GITEA_VERSION}}", config.Version)
+	userdata = strings.ReplaceAll(userdata, "{{HOST_SSH_PORT}}", fmt.Sprintf("%d", config.HostSSHPort))
+	userdata = strings.ReplaceAll(userdata, "{{GITEA_HOME}}", layout.Home)
+	userdata = strings.ReplaceAll(userdata, "{{APP_INI}}", layout.AppINI)
+	userdata = strings.ReplaceAll(userdata, "{{APP_DATA_PATH}}", layout.DataPath)
+	userdata = strings.ReplaceAll(userdata, "{{REPO_ROOT}}", layout.RepoRoot)
+	userdata = strings.ReplaceAll(userdata, "{{GITEA_CLI}}", layout.CLI())
 	userdata = strings.ReplaceAll(userdata, "{{DB_HOST}}", config.DBHost)
 	userdata = strings.ReplaceAll(userdata, "{{DB_PORT}}", fmt.Sprintf("%d", config.DBPort))
 	userdata = strings.ReplaceAll(userdata, "{{DB_NAME}}", config.DBName)
 	userdata = strings.ReplaceAll(userdata, "{{DB_USER}}", config.DBUser)
 	userdata = strings.ReplaceAll(userdata, "{{DB_PASS}}", config.DBPass)
+	sslMode := config.DBSSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	userdata = strings.ReplaceAll(userdata, "{{DB_SSL_MODE}}", sslMode)
+	userdata = strings.ReplaceAll(userdata, "{{DB_CA_CERT}}", strings.TrimSpace(config.DBCACert))
 	// S3 storage
 	userdata = strings.ReplaceAll(userdata, "{{S3_ENDPOINT}}", config.S3Endpoint)
 	userdata = strings.ReplaceAll(userdata, "{{S3_ACCESS_KEY}}", config.S3AccessKey)
@@ -135,9 +305,27 @@ func generateUserdata(config Config) string {
 		s3UseSSL = "true"
 	}
 	userdata = strings.ReplaceAll(userdata, "{{S3_USE_SSL}}", s3UseSSL)
+	userdata = strings.ReplaceAll(userdata, "{{S3_CA_CERT}}", strings.TrimSpace(config.S3CACert))
+	userdata = strings.ReplaceAll(userdata, "{{PACKAGES_ENABLED}}", fmt.Sprintf("%t", config.Packages))
 	return userdata
 }
 
+// SetDBHost points a running Gitea at another PostgreSQL host and restarts
+// it, e.g. after a PostgreSQL failover. The port is kept, standbys and
+// upgrade targets run PgBouncer on the port of their source.
+func (d *Deployer) SetDBHost(ctx context.Context, hostname, dbHost string) error {
+	layout, err := d.layout(ctx, hostname)
+	if err != nil {
+		return err
+	}
+	script := fmt.Sprintf(`sed -i -E '/^\[database\]/,/^\[/ s|^HOST[[:space:]]*=[[:space:]]*[^:[:space:]]*|HOST = %s|' %s
+%s`, dbHost, layout.AppINI, layout.Service("restart"))
+	if _, err := vmexec.Run(ctx, d.client, hostname, script); err != nil {
+		return fmt.Errorf("failed to set database host on %s: %w", hostname, err)
+	}
+	return nil
+}
+
 func (d *Deployer) Delete(ctx context.Context, hostname string) error {
 	_, err := d.client.DeleteVM(ctx, d.config.HostGroup, hostname)
 	return err
@@ -163,7 +351,7 @@ func GenerateYAML(config Config, githubUser string) string {
 	return fmt.Sprintf(`config:
   host_groups:
   - name: %s
-    storage: image
+    storage: %s
     storage_size: %s
     count: 0
     vcpu: %d
@@ -175,13 +363,13 @@ func GenerateYAML(config Config, githubUser string) string {
 
   github_user: %s
 
-  image: "ghcr.io/openfaasltd/slicer-systemd:5.10.240-x86_64-latest"
+  image: "%s"
 
-  hypervisor: firecracker
+  hypervisor: %s
 
   api:
     port: 8080
     bind_address: "127.0.0.1"
-`, config.HostGroup, config.StorageSize, config.VCPU, config.RAMGB,
-		config.HostGroup, config.HostGroup, githubUser)
+`, config.HostGroup, config.Storage, config.StorageSize, config.VCPU, config.RAMGB,
+		config.HostGroup, config.HostGroup, githubUser, config.Image, config.Hypervisor)
 }
@@ -0,0 +1,24 @@
+package gitea
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestUserdataPlaceholders(t *testing.T) {
+	for _, method := range []string{InstallSnap, InstallBinary} {
+		t.Run(method, func(t *testing.T) {
+			config := DefaultConfig()
+			config.InstallMethod = method
+			config.DBHost = "postgres.playground.slicer"
+			config.DBPass = "p"
+			config.S3Endpoint = "rustfs.playground.slicer:9000"
+
+			admin := Credentials{User: DefaultAdminUser, Password: "p", Email: "admin@gitea.local"}
+			userdata := installUserdata(generateUserdata(config), admin, Secrets{SecretKey: "s", InternalToken: "i", JWTSecret: "j", LFSJWTSecret: "l"})
+			if m := regexp.MustCompile(`\{\{[A-Z0-9_]+\}\}`).FindAllString(userdata, -1); len(m) > 0 {
+				t.Errorf("placeholders left in userdata: %v", m)
+			}
+		})
+	}
+}
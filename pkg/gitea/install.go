@@ -0,0 +1,136 @@
+package gitea
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	sdk "github.com/slicervm/sdk"
+)
+
+const (
+	// DefaultAdminUser is created by userdata, "admin" is reserved by Gitea
+	DefaultAdminUser = "gitea_admin"
+	// AdminFile keeps the admin credentials on the VM, readable by root only
+	AdminFile = "/etc/gitea/admin.env"
+)
+
+// Credentials is the Gitea admin account
+type Credentials struct {
+	User     string
+	Password string
+	Email    string
+}
+
+// DeployResponse contains VM info, the web URL and the admin credentials
+type DeployResponse struct {
+	*sdk.SlicerCreateNodeResponse
+	URL   string
+	Admin Credentials
+}
+
+// Secrets are the app.ini secrets the web wizard would otherwise generate.
+// SECRET_KEY encrypts data in the database, so a restore must keep it.
+type Secrets struct {
+	SecretKey     string
+	InternalToken string
+	JWTSecret     string
+	LFSJWTSecret  string
+}
+
+// generateSecret returns n random bytes as unpadded URL-safe base64, the
+// encoding Gitea expects for JWT secrets
+func generateSecret(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func generateSecrets() (Secrets, error) {
+	var s Secrets
+	for _, f := range []struct {
+		dst *string
+		n   int
+	}{
+		{&s.SecretKey, 48},
+		{&s.InternalToken, 80},
+		{&s.JWTSecret, 32},
+		{&s.LFSJWTSecret, 32},
+	} {
+		v, err := generateSecret(f.n)
+		if err != nil {
+			return s, err
+		}
+		*f.dst = v
+	}
+	return s, nil
+}
+
+// admin returns the configured admin account, generating a password and
+// email when they are unset
+func (d *Deployer) admin() (Credentials, error) {
+	creds := Credentials{User: d.config.AdminUser, Password: d.config.AdminPassword, Email: d.config.AdminEmail}
+	if creds.User == "" {
+		creds.User = DefaultAdminUser
+	}
+	if creds.Email == "" {
+		creds.Email = creds.User + "@gitea.local"
+	}
+	if creds.Password == "" {
+		password, err := generateSecret(18)
+		if err != nil {
+			return creds, err
+		}
+		creds.Password = password
+	}
+	return creds, nil
+}
+
+// installUserdata fills the admin account and app.ini secrets into userdata
+func installUserdata(userdata string, admin Credentials, s Secrets) string {
+	return strings.NewReplacer(
+		"{{ADMIN_USER}}", admin.User,
+		"{{ADMIN_PASSWORD}}", admin.Password,
+		"{{ADMIN_EMAIL}}", admin.Email,
+		"{{SECRET_KEY}}", s.SecretKey,
+		"{{INTERNAL_TOKEN}}", s.InternalToken,
+		"{{JWT_SECRET}}", s.JWTSecret,
+		"{{LFS_JWT_SECRET}}", s.LFSJWTSecret,
+	).Replace(userdata)
+}
+
+// WaitHealthy waits until Gitea answers its health check, which it does once
+// userdata has migrated the database and started the web server
+func WaitHealthy(ctx context.Context, baseURL string, timeout time.Duration) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	deadline := time.Now().Add(timeout)
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/api/healthz", nil)
+		if err != nil {
+			return fmt.Errorf("failed to create health check: %w", err)
+		}
+		res, err := client.Do(req)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return nil
+			}
+			err = fmt.Errorf("health check returned %s", res.Status)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for gitea at %s: %w", baseURL, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package gitea
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+// Install methods
+const (
+	// InstallSnap installs the strictly confined snap, which runs as root
+	InstallSnap = "snap"
+	// InstallBinary installs a pinned release as a systemd service run by
+	// the git user, with git SSH on port 22
+	InstallBinary = "binary"
+)
+
+// Layout is where an install method puts Gitea on the VM
+type Layout struct {
+	Method string
+	// Home is the data volume, everything below is inside it apart from
+	// AppINI of the binary install
+	Home     string
+	Binary   string
+	AppINI   string
+	DataPath string // APP_DATA_PATH
+	RepoRoot string
+	// DumpDir holds archives, the snap can only write under its common
+	// directory
+	DumpDir string
+	// User runs the gitea CLI and owns the files, empty for root
+	User string
+}
+
+var layouts = map[string]Layout{
+	InstallSnap: {
+		Method:   InstallSnap,
+		Home:     DefaultDataDir,
+		Binary:   "/snap/bin/gitea",
+		AppINI:   AppINIPath,
+		DataPath: AppDataPath,
+		RepoRoot: RepoRoot,
+		DumpDir:  DefaultDataDir + "/backups",
+	},
+	InstallBinary: {
+		Method:   InstallBinary,
+		Home:     "/var/lib/gitea",
+		Binary:   "/usr/local/bin/gitea",
+		AppINI:   "/etc/gitea/app.ini",
+		DataPath: "/var/lib/gitea/data",
+		RepoRoot: "/var/lib/gitea/data/gitea-repositories",
+		DumpDir:  "/var/lib/gitea/backups",
+		User:     "git",
+	},
+}
+
+// LayoutFor returns the layout of an install method, "" is the snap
+func LayoutFor(method string) (Layout, error) {
+	if method == "" {
+		method = InstallSnap
+	}
+	l, ok := layouts[method]
+	if !ok {
+		return l, fmt.Errorf("unknown install method %q, use %s or %s", method, InstallSnap, InstallBinary)
+	}
+	return l, nil
+}
+
+// CLI returns the command that runs gitea subcommands as the right user
+func (l Layout) CLI() string {
+	if l.User == "" {
+		return l.Binary
+	}
+	return fmt.Sprintf("sudo -u %s -H %s", l.User, l.Binary)
+}
+
+// Service returns the command that stops, starts or restarts Gitea
+func (l Layout) Service(action string) string {
+	if l.Method == InstallSnap {
+		return "snap " + action + " gitea"
+	}
+	return "systemctl " + action + " gitea"
+}
+
+// Chown returns the command that hands paths to the Gitea user, a no-op for
+// the snap
+func (l Layout) Chown(paths ...string) string {
+	if l.User == "" {
+		return "true"
+	}
+	return fmt.Sprintf("chown -R %[1]s:%[1]s %s", l.User, strings.Join(paths, " "))
+}
+
+// layout finds the install method of a running VM. VMs deployed before the
+// binary install have the snap.
+func (d *Deployer) layout(ctx context.Context, hostname string) (Layout, error) {
+	binary := layouts[InstallBinary].Binary
+	out, err := vmexec.Run(ctx, d.client, hostname, fmt.Sprintf("if [ -x %s ]; then echo %s; else echo %s; fi", binary, InstallBinary, InstallSnap))
+	if err != nil {
+		return Layout{}, fmt.Errorf("failed to find the gitea install on %s: %w", hostname, err)
+	}
+	return LayoutFor(strings.TrimSpace(out))
+}
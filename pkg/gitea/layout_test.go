@@ -0,0 +1,67 @@
+package gitea
+
+import "testing"
+
+func TestLayoutFor(t *testing.T) {
+	tests := []struct {
+		method  string
+		want    string
+		cli     string
+		chown   string
+		service string
+		wantErr bool
+	}{
+		{method: "", want: InstallSnap, cli: "/snap/bin/gitea", chown: "true", service: "snap restart gitea"},
+		{method: InstallSnap, want: InstallSnap, cli: "/snap/bin/gitea", chown: "true", service: "snap restart gitea"},
+		{method: InstallBinary, want: InstallBinary, cli: "sudo -u git -H /usr/local/bin/gitea", chown: "chown -R git:git /var/lib/gitea /etc/gitea", service: "systemctl restart gitea"},
+		{method: "docker", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			l, err := LayoutFor(tt.method)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LayoutFor(%q) error = %v, wantErr %v", tt.method, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if l.Method != tt.want {
+				t.Errorf("Method = %q, want %q", l.Method, tt.want)
+			}
+			if got := l.CLI(); got != tt.cli {
+				t.Errorf("CLI() = %q, want %q", got, tt.cli)
+			}
+			if got := l.Chown("/var/lib/gitea", "/etc/gitea"); got != tt.chown {
+				t.Errorf("Chown() = %q, want %q", got, tt.chown)
+			}
+			if got := l.Service("restart"); got != tt.service {
+				t.Errorf("Service() = %q, want %q", got, tt.service)
+			}
+		})
+	}
+}
+
+func TestValidateInstall(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		version string
+		port    int
+		wantErr bool
+	}{
+		{name: "snap ignores the ssh port", method: InstallSnap, port: 22},
+		{name: "binary", method: InstallBinary, version: "1.22.0", port: 2222},
+		{name: "binary without version", method: InstallBinary, port: 2222, wantErr: true},
+		{name: "binary on port 22", method: InstallBinary, version: "1.22.0", port: 22, wantErr: true},
+		{name: "binary out of range", method: InstallBinary, version: "1.22.0", port: 70000, wantErr: true},
+		{name: "unknown method", method: "docker", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{InstallMethod: tt.method, Version: tt.version, HostSSHPort: tt.port}
+			if err := config.validateInstall(); (err != nil) != tt.wantErr {
+				t.Errorf("validateInstall() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package gitea
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// teamUnits are the repository units a team is granted its permission on
+var teamUnits = []string{
+	"repo.code", "repo.issues", "repo.pulls", "repo.releases", "repo.wiki",
+	"repo.projects", "repo.packages", "repo.actions",
+}
+
+// User is a Gitea account
+type User struct {
+	ID    int64  `json:"id"`
+	Login string `json:"login"`
+	Email string `json:"email"`
+}
+
+// Org is a Gitea organization
+type Org struct {
+	Name        string `json:"username"`
+	FullName    string `json:"full_name"`
+	Description string `json:"description"`
+	Visibility  string `json:"visibility"`
+}
+
+// Team is a team of an organization
+type Team struct {
+	ID         int64    `json:"id,omitempty"`
+	Name       string   `json:"name"`
+	Permission string   `json:"permission"`
+	AllRepos   bool     `json:"includes_all_repositories"`
+	Units      []string `json:"units,omitempty"`
+}
+
+// listAll fetches every page of a list endpoint
+func listAll[T any](ctx context.Context, c *Client, path string) ([]T, error) {
+	const limit = 50
+	var items []T
+	for page := 1; ; page++ {
+		var resp []T
+		if err := c.do(ctx, http.MethodGet, fmt.Sprintf("%s?page=%d&limit=%d", path, page, limit), nil, &resp); err != nil {
+			return nil, err
+		}
+		items = append(items, resp...)
+		if len(resp) < limit {
+			return items, nil
+		}
+	}
+}
+
+// GetUser returns a user, IsNotFound reports a missing one
+func (c *Client) GetUser(ctx context.Context, name string) (*User, error) {
+	var u User
+	if err := c.do(ctx, http.MethodGet, "/users/"+url.PathEscape(name), nil, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// CreateUser creates a local account. Users given a generated password must
+// change it on first login.
+func (c *Client) CreateUser(ctx context.Context, name, email, password string, mustChange bool) error {
+	body := map[string]any{
+		"username":             name,
+		"email":                email,
+		"password":             password,
+		"must_change_password": mustChange,
+	}
+	if err := c.do(ctx, http.MethodPost, "/admin/users", body, nil); err != nil {
+		return fmt.Errorf("failed to create user %s: %w", name, err)
+	}
+	return nil
+}
+
+// EditUserEmail changes the email of a local account
+func (c *Client) EditUserEmail(ctx context.Context, name, email string) error {
+	body := map[string]any{
+		"login_name": name,
+		"source_id":  0,
+		"email":      email,
+	}
+	if err := c.do(ctx, http.MethodPatch, "/admin/users/"+url.PathEscape(name), body, nil); err != nil {
+		return fmt.Errorf("failed to update user %s: %w", name, err)
+	}
+	return nil
+}
+
+// GetOrg returns an organization, IsNotFound reports a missing one
+func (c *Client) GetOrg(ctx context.Context, name string) (*Org, error) {
+	var o Org
+	if err := c.do(ctx, http.MethodGet, "/orgs/"+url.PathEscape(name), nil, &o); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// CreateOrg creates an organization owned by the client user
+func (c *Client) CreateOrg(ctx context.Context, o Org) error {
+	if err := c.do(ctx, http.MethodPost, "/orgs", o, nil); err != nil {
+		return fmt.Errorf("failed to create org %s: %w", o.Name, err)
+	}
+	return nil
+}
+
+// EditOrg updates the name, description and visibility of an organization
+func (c *Client) EditOrg(ctx context.Context, o Org) error {
+	if err := c.do(ctx, http.MethodPatch, "/orgs/"+url.PathEscape(o.Name), o, nil); err != nil {
+		return fmt.Errorf("failed to update org %s: %w", o.Name, err)
+	}
+	return nil
+}
+
+// SetSecret creates or replaces an Actions secret under an org or repo path
+// such as /orgs/acme or /repos/acme/app
+func (c *Client) SetSecret(ctx context.Context, scopePath, name, value string) error {
+	path := scopePath + "/actions/secrets/" + url.PathEscape(name)
+	if err := c.do(ctx, http.MethodPut, path, map[string]string{"data": value}, nil); err != nil {
+		return fmt.Errorf("failed to set secret %s on %s: %w", name, scopePath, err)
+	}
+	return nil
+}
+
+// ListTeams returns the teams of an organization
+func (c *Client) ListTeams(ctx context.Context, org string) ([]Team, error) {
+	teams, err := listAll[Team](ctx, c, "/orgs/"+url.PathEscape(org)+"/teams")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list teams of %s: %w", org, err)
+	}
+	return teams, nil
+}
+
+// CreateTeam creates a team with its permission on every repository unit
+func (c *Client) CreateTeam(ctx context.Context, org string, t Team) (Team, error) {
+	t.Units = teamUnits
+	var created Team
+	if err := c.do(ctx, http.MethodPost, "/orgs/"+url.PathEscape(org)+"/teams", t, &created); err != nil {
+		return created, fmt.Errorf("failed to create team %s/%s: %w", org, t.Name, err)
+	}
+	return created, nil
+}
+
+// EditTeam updates the permission and repository scope of a team
+func (c *Client) EditTeam(ctx context.Context, t Team) error {
+	t.Units = teamUnits
+	if err := c.do(ctx, http.MethodPatch, fmt.Sprintf("/teams/%d", t.ID), t, nil); err != nil {
+		return fmt.Errorf("failed to update team %s: %w", t.Name, err)
+	}
+	return nil
+}
+
+// TeamMembers returns the logins of the members of a team
+func (c *Client) TeamMembers(ctx context.Context, id int64) ([]string, error) {
+	users, err := listAll[User](ctx, c, fmt.Sprintf("/teams/%d/members", id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list members of team %d: %w", id, err)
+	}
+	logins := make([]string, len(users))
+	for i, u := range users {
+		logins[i] = u.Login
+	}
+	return logins, nil
+}
+
+// AddTeamMember adds a user to a team
+func (c *Client) AddTeamMember(ctx context.Context, id int64, user string) error {
+	if err := c.do(ctx, http.MethodPut, fmt.Sprintf("/teams/%d/members/%s", id, url.PathEscape(user)), nil, nil); err != nil {
+		return fmt.Errorf("failed to add %s to team %d: %w", user, id, err)
+	}
+	return nil
+}
+
+// TeamRepos returns the names of the repositories of a team
+func (c *Client) TeamRepos(ctx context.Context, id int64) ([]string, error) {
+	repos, err := listAll[Repo](ctx, c, fmt.Sprintf("/teams/%d/repos", id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repos of team %d: %w", id, err)
+	}
+	names := make([]string, len(repos))
+	for i, r := range repos {
+		names[i] = r.Name
+	}
+	return names, nil
+}
+
+// AddTeamRepo gives a team access to a repository of its organization
+func (c *Client) AddTeamRepo(ctx context.Context, id int64, org, repo string) error {
+	path := fmt.Sprintf("/teams/%d/repos/%s/%s", id, url.PathEscape(org), url.PathEscape(repo))
+	if err := c.do(ctx, http.MethodPut, path, nil, nil); err != nil {
+		return fmt.Errorf("failed to add %s/%s to team %d: %w", org, repo, id, err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package gitea
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+)
+
+// Repo is a Gitea repository
+type Repo struct {
+	Name          string `json:"name"`
+	Description   string `json:"description"`
+	Private       bool   `json:"private"`
+	DefaultBranch string `json:"default_branch,omitempty"`
+	Empty         bool   `json:"empty,omitempty"`
+}
+
+// DeployKey is an SSH key with access to one repository
+type DeployKey struct {
+	ID       int64  `json:"id,omitempty"`
+	Title    string `json:"title"`
+	Key      string `json:"key"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+// Webhook is a repository webhook
+type Webhook struct {
+	ID           int64         `json:"id,omitempty"`
+	Type         string        `json:"type"`
+	Config       WebhookConfig `json:"config"`
+	Events       []string      `json:"events"`
+	BranchFilter string        `json:"branch_filter"`
+	Active       bool          `json:"active"`
+}
+
+// WebhookConfig is the delivery settings of a webhook, Gitea never returns
+// the secret
+type WebhookConfig struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Secret      string `json:"secret,omitempty"`
+}
+
+// BranchProtection is a protection rule, RuleName is a branch or glob
+type BranchProtection struct {
+	RuleName            string   `json:"rule_name"`
+	RequiredApprovals   int      `json:"required_approvals"`
+	EnablePush          bool     `json:"enable_push"`
+	EnableStatusCheck   bool     `json:"enable_status_check"`
+	StatusCheckContexts []string `json:"status_check_contexts"`
+}
+
+func repoPath(owner, name string) string {
+	return "/repos/" + url.PathEscape(owner) + "/" + url.PathEscape(name)
+}
+
+// GetRepo returns a repository, IsNotFound reports a missing one
+func (c *Client) GetRepo(ctx context.Context, owner, name string) (Repo, error) {
+	var r Repo
+	err := c.do(ctx, http.MethodGet, repoPath(owner, name), nil, &r)
+	return r, err
+}
+
+// CreateRepo creates an empty repository owned by a user or an organization
+func (c *Client) CreateRepo(ctx context.Context, owner string, r Repo) (Repo, error) {
+	var created Repo
+	if err := c.do(ctx, http.MethodPost, "/admin/users/"+url.PathEscape(owner)+"/repos", r, &created); err != nil {
+		return created, fmt.Errorf("failed to create repo %s/%s: %w", owner, r.Name, err)
+	}
+	return created, nil
+}
+
+// EditRepo updates the description, visibility and default branch of a
+// repository
+func (c *Client) EditRepo(ctx context.Context, owner string, r Repo) error {
+	body := map[string]any{"description": r.Description, "private": r.Private}
+	if r.DefaultBranch != "" {
+		body["default_branch"] = r.DefaultBranch
+	}
+	if err := c.do(ctx, http.MethodPatch, repoPath(owner, r.Name), body, nil); err != nil {
+		return fmt.Errorf("failed to update repo %s/%s: %w", owner, r.Name, err)
+	}
+	return nil
+}
+
+// PushMirror pushes the branches and tags of a local repository into a
+// Gitea repository over HTTP. The credentials are passed to git through its
+// environment rather than the URL, so they stay out of the process list.
+func (c *Client) PushMirror(ctx context.Context, owner, name, localPath string) error {
+	remote := fmt.Sprintf("%s/%s/%s.git", c.BaseURL, url.PathEscape(owner), url.PathEscape(name))
+	auth := base64.StdEncoding.EncodeToString([]byte(c.User + ":" + c.Password))
+
+	cmd := exec.CommandContext(ctx, "git", "-C", localPath, "push", "--quiet", remote,
+		"refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*")
+	cmd.Env = append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to push %s to %s/%s: %w: %s", localPath, owner, name, err, out)
+	}
+	return nil
+}
+
+// ListDeployKeys returns the deploy keys of a repository
+func (c *Client) ListDeployKeys(ctx context.Context, owner, name string) ([]DeployKey, error) {
+	keys, err := listAll[DeployKey](ctx, c, repoPath(owner, name)+"/keys")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deploy keys of %s/%s: %w", owner, name, err)
+	}
+	return keys, nil
+}
+
+// AddDeployKey adds a deploy key to a repository
+func (c *Client) AddDeployKey(ctx context.Context, owner, name string, k DeployKey) error {
+	if err := c.do(ctx, http.MethodPost, repoPath(owner, name)+"/keys", k, nil); err != nil {
+		return fmt.Errorf("failed to add deploy key %s to %s/%s: %w", k.Title, owner, name, err)
+	}
+	return nil
+}
+
+// DeleteDeployKey removes a deploy key from a repository
+func (c *Client) DeleteDeployKey(ctx context.Context, owner, name string, id int64) error {
+	if err := c.do(ctx, http.MethodDelete, fmt.Sprintf("%s/keys/%d", repoPath(owner, name), id), nil, nil); err != nil {
+		return fmt.Errorf("failed to delete deploy key %d of %s/%s: %w", id, owner, name, err)
+	}
+	return nil
+}
+
+// ListWebhooks returns the webhooks of a repository
+func (c *Client) ListWebhooks(ctx context.Context, owner, name string) ([]Webhook, error) {
+	hooks, err := listAll[Webhook](ctx, c, repoPath(owner, name)+"/hooks")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhooks of %s/%s: %w", owner, name, err)
+	}
+	return hooks, nil
+}
+
+// CreateWebhook adds a webhook to a repository
+func (c *Client) CreateWebhook(ctx context.Context, owner, name string, h Webhook) error {
+	if err := c.do(ctx, http.MethodPost, repoPath(owner, name)+"/hooks", h, nil); err != nil {
+		return fmt.Errorf("failed to create webhook %s on %s/%s: %w", h.Config.URL, owner, name, err)
+	}
+	return nil
+}
+
+// EditWebhook replaces the settings of a webhook, its type cannot change
+func (c *Client) EditWebhook(ctx context.Context, owner, name string, id int64, h Webhook) error {
+	path := fmt.Sprintf("%s/hooks/%d", repoPath(owner, name), id)
+	if err := c.do(ctx, http.MethodPatch, path, h, nil); err != nil {
+		return fmt.Errorf("failed to update webhook %s on %s/%s: %w", h.Config.URL, owner, name, err)
+	}
+	return nil
+}
+
+// ListBranchProtections returns the branch protection rules of a repository
+func (c *Client) ListBranchProtections(ctx context.Context, owner, name string) ([]BranchProtection, error) {
+	var rules []BranchProtection
+	if err := c.do(ctx, http.MethodGet, repoPath(owner, name)+"/branch_protections", nil, &rules); err != nil {
+		return nil, fmt.Errorf("failed to list branch protections of %s/%s: %w", owner, name, err)
+	}
+	return rules, nil
+}
+
+// CreateBranchProtection adds a branch protection rule to a repository
+func (c *Client) CreateBranchProtection(ctx context.Context, owner, name string, b BranchProtection) error {
+	if err := c.do(ctx, http.MethodPost, repoPath(owner, name)+"/branch_protections", b, nil); err != nil {
+		return fmt.Errorf("failed to protect %s on %s/%s: %w", b.RuleName, owner, name, err)
+	}
+	return nil
+}
+
+// EditBranchProtection updates the branch protection rule named b.RuleName
+func (c *Client) EditBranchProtection(ctx context.Context, owner, name string, b BranchProtection) error {
+	path := repoPath(owner, name) + "/branch_protections/" + url.PathEscape(b.RuleName)
+	if err := c.do(ctx, http.MethodPatch, path, b, nil); err != nil {
+		return fmt.Errorf("failed to update protection of %s on %s/%s: %w", b.RuleName, owner, name, err)
+	}
+	return nil
+}
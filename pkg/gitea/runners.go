@@ -0,0 +1,75 @@
+package gitea
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Runner is an Actions runner registered with Gitea
+type Runner struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"` // offline, idle or active
+	Busy   bool   `json:"busy"`
+}
+
+// Online reports whether the runner is polling Gitea for jobs
+func (r Runner) Online() bool {
+	return r.Status != "offline"
+}
+
+// ListRunners returns the runners of a scope: "" for the whole instance, an
+// org name, or owner/repo
+func (c *Client) ListRunners(ctx context.Context, scope string) ([]Runner, error) {
+	const limit = 50
+	var runners []Runner
+	for page := 1; ; page++ {
+		var resp struct {
+			Runners []Runner `json:"runners"`
+		}
+		path := fmt.Sprintf("%s/actions/runners?page=%d&limit=%d", scopePath(scope), page, limit)
+		if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+			return nil, fmt.Errorf("failed to list runners: %w", err)
+		}
+		runners = append(runners, resp.Runners...)
+		if len(resp.Runners) < limit {
+			return runners, nil
+		}
+	}
+}
+
+// DeleteRunner removes a runner registration from a scope
+func (c *Client) DeleteRunner(ctx context.Context, scope string, id int64) error {
+	path := fmt.Sprintf("%s/actions/runners/%d", scopePath(scope), id)
+	if err := c.do(ctx, http.MethodDelete, path, nil, nil); err != nil {
+		return fmt.Errorf("failed to delete runner %d: %w", id, err)
+	}
+	return nil
+}
+
+// DeleteRunnersNamed removes the offline runners of a scope registered under
+// one of names. Online runners are kept, as another machine is polling with
+// that name, and returned separately.
+func (c *Client) DeleteRunnersNamed(ctx context.Context, scope string, names ...string) (deleted, online []Runner, err error) {
+	runners, err := c.ListRunners(ctx, scope)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, r := range runners {
+		if !slices.Contains(names, r.Name) {
+			continue
+		}
+		if r.Online() {
+			online = append(online, r)
+			continue
+		}
+		if err := c.DeleteRunner(ctx, scope, r.ID); err != nil {
+			return deleted, online, err
+		}
+		deleted = append(deleted, r)
+	}
+	return deleted, online, nil
+}
@@ -0,0 +1,529 @@
+package gitea
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultSeedFile is the manifest gitea:seed applies
+const DefaultSeedFile = "gitea-seed.yaml"
+
+// Seed declares the users, organizations and repositories of an instance.
+// Applying it creates what is missing and updates what differs, it never
+// deletes anything.
+type Seed struct {
+	Users []SeedUser `json:"users,omitempty"`
+	Orgs  []SeedOrg  `json:"orgs,omitempty"`
+	Repos []SeedRepo `json:"repos,omitempty"`
+}
+
+// SeedUser is a local account, created with Password or a generated one. An
+// existing user only has its email updated.
+type SeedUser struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password,omitempty"`
+}
+
+// SeedOrg is an organization with its teams and Actions secrets
+type SeedOrg struct {
+	Name        string `json:"name"`
+	FullName    string `json:"fullName,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Visibility is public, limited or private
+	Visibility string            `json:"visibility,omitempty"`
+	Teams      []SeedTeam        `json:"teams,omitempty"`
+	Secrets    map[string]string `json:"secrets,omitempty"`
+}
+
+// SeedTeam is a team whose members get Permission on its repos
+type SeedTeam struct {
+	Name string `json:"name"`
+	// Permission is read, write or admin
+	Permission string   `json:"permission"`
+	Members    []string `json:"members,omitempty"`
+	// Repos are repositories of the org, empty with AllRepos for every one
+	Repos    []string `json:"repos,omitempty"`
+	AllRepos bool     `json:"allRepos,omitempty"`
+}
+
+// SeedRepo is a repository owned by a user or an organization
+type SeedRepo struct {
+	Owner         string `json:"owner"`
+	Name          string `json:"name"`
+	Description   string `json:"description,omitempty"`
+	Private       bool   `json:"private,omitempty"`
+	DefaultBranch string `json:"defaultBranch,omitempty"`
+	// Mirror is a local repository, relative to the manifest, pushed into
+	// the repository while it is empty
+	Mirror            string                 `json:"mirror,omitempty"`
+	DeployKeys        []SeedDeployKey        `json:"deployKeys,omitempty"`
+	Secrets           map[string]string      `json:"secrets,omitempty"`
+	Webhooks          []SeedWebhook          `json:"webhooks,omitempty"`
+	BranchProtections []SeedBranchProtection `json:"branchProtections,omitempty"`
+}
+
+// FullName returns owner/name
+func (r SeedRepo) FullName() string {
+	return r.Owner + "/" + r.Name
+}
+
+// SeedDeployKey is an SSH key with access to one repository
+type SeedDeployKey struct {
+	Title    string `json:"title"`
+	Key      string `json:"key"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+// SeedWebhook is matched by URL. Gitea does not return secrets, so Secret is
+// only sent when the webhook is created or another field changed.
+type SeedWebhook struct {
+	URL string `json:"url"`
+	// Type is gitea, slack, discord, ... (default: gitea)
+	Type        string   `json:"type,omitempty"`
+	Events      []string `json:"events,omitempty"`
+	ContentType string   `json:"contentType,omitempty"`
+	Secret      string   `json:"secret,omitempty"`
+	Branches    string   `json:"branches,omitempty"`
+	Disabled    bool     `json:"disabled,omitempty"`
+}
+
+// SeedBranchProtection protects the branches matching Branch
+type SeedBranchProtection struct {
+	Branch            string   `json:"branch"`
+	RequiredApprovals int      `json:"requiredApprovals,omitempty"`
+	AllowPush         bool     `json:"allowPush,omitempty"`
+	StatusChecks      []string `json:"statusChecks,omitempty"`
+}
+
+// LoadSeed reads a seed manifest. ${VAR} in passwords and secrets is
+// replaced from the environment, so the file can be committed.
+func LoadSeed(path string) (Seed, error) {
+	var s Seed
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return s, fmt.Errorf("failed to read seed: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(data, &s); err != nil {
+		return s, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for i := range s.Users {
+		s.Users[i].Password = os.ExpandEnv(s.Users[i].Password)
+	}
+	for i := range s.Orgs {
+		expandSecrets(s.Orgs[i].Secrets)
+	}
+	for i := range s.Repos {
+		if m := s.Repos[i].Mirror; m != "" && !filepath.IsAbs(m) {
+			s.Repos[i].Mirror = filepath.Join(filepath.Dir(path), m)
+		}
+		expandSecrets(s.Repos[i].Secrets)
+		for j := range s.Repos[i].Webhooks {
+			s.Repos[i].Webhooks[j].Secret = os.ExpandEnv(s.Repos[i].Webhooks[j].Secret)
+		}
+	}
+	return s, s.Validate()
+}
+
+func expandSecrets(secrets map[string]string) {
+	for name, value := range secrets {
+		secrets[name] = os.ExpandEnv(value)
+	}
+}
+
+// Validate checks names and references within the manifest
+func (s Seed) Validate() error {
+	for _, u := range s.Users {
+		if u.Name == "" || u.Email == "" {
+			return fmt.Errorf("users need a name and an email")
+		}
+	}
+	for _, o := range s.Orgs {
+		if o.Name == "" {
+			return fmt.Errorf("orgs need a name")
+		}
+		switch o.Visibility {
+		case "", "public", "limited", "private":
+		default:
+			return fmt.Errorf("org %s: visibility must be public, limited or private", o.Name)
+		}
+		for _, t := range o.Teams {
+			switch t.Permission {
+			case "read", "write", "admin":
+			default:
+				return fmt.Errorf("org %s team %s: permission must be read, write or admin", o.Name, t.Name)
+			}
+		}
+	}
+	for _, r := range s.Repos {
+		if r.Owner == "" || r.Name == "" {
+			return fmt.Errorf("repos need an owner and a name")
+		}
+		for _, k := range r.DeployKeys {
+			if k.Title == "" || k.Key == "" {
+				return fmt.Errorf("repo %s: deploy keys need a title and a key", r.FullName())
+			}
+		}
+		for _, h := range r.Webhooks {
+			if h.URL == "" {
+				return fmt.Errorf("repo %s: webhooks need a url", r.FullName())
+			}
+		}
+		for _, b := range r.BranchProtections {
+			if b.Branch == "" {
+				return fmt.Errorf("repo %s: branch protections need a branch", r.FullName())
+			}
+		}
+	}
+	return nil
+}
+
+// seeder applies a manifest and reports each change
+type seeder struct {
+	client  *Client
+	w       io.Writer
+	changes int
+}
+
+func (s *seeder) changed(format string, args ...any) {
+	s.changes++
+	fmt.Fprintf(s.w, "  "+format+"\n", args...)
+}
+
+// ApplySeed reconciles the instance with a manifest in order: users, orgs
+// and repos, then teams, which may reference the repos. It returns the
+// number of changes, 0 when the instance already matched.
+func (c *Client) ApplySeed(ctx context.Context, seed Seed, w io.Writer) (int, error) {
+	s := &seeder{client: c, w: w}
+	for _, u := range seed.Users {
+		if err := s.user(ctx, u); err != nil {
+			return s.changes, err
+		}
+	}
+	for _, o := range seed.Orgs {
+		if err := s.org(ctx, o); err != nil {
+			return s.changes, err
+		}
+	}
+	for _, r := range seed.Repos {
+		if err := s.repo(ctx, r); err != nil {
+			return s.changes, err
+		}
+	}
+	for _, o := range seed.Orgs {
+		for _, t := range o.Teams {
+			if err := s.team(ctx, o.Name, t); err != nil {
+				return s.changes, err
+			}
+		}
+	}
+	return s.changes, nil
+}
+
+func (s *seeder) user(ctx context.Context, u SeedUser) error {
+	existing, err := s.client.GetUser(ctx, u.Name)
+	if err == nil {
+		if strings.EqualFold(existing.Email, u.Email) {
+			return nil
+		}
+		if err := s.client.EditUserEmail(ctx, u.Name, u.Email); err != nil {
+			return err
+		}
+		s.changed("updated email of user %s", u.Name)
+		return nil
+	}
+	if !IsNotFound(err) {
+		return err
+	}
+
+	password := u.Password
+	if password == "" {
+		if password, err = generateSecret(18); err != nil {
+			return err
+		}
+	}
+	if err := s.client.CreateUser(ctx, u.Name, u.Email, password, u.Password == ""); err != nil {
+		return err
+	}
+	if u.Password == "" {
+		s.changed("created user %s with password %s", u.Name, password)
+	} else {
+		s.changed("created user %s", u.Name)
+	}
+	return nil
+}
+
+func (s *seeder) org(ctx context.Context, o SeedOrg) error {
+	want := Org{Name: o.Name, FullName: o.FullName, Description: o.Description, Visibility: o.Visibility}
+	if want.Visibility == "" {
+		want.Visibility = "public"
+	}
+
+	current, err := s.client.GetOrg(ctx, o.Name)
+	switch {
+	case IsNotFound(err):
+		if err := s.client.CreateOrg(ctx, want); err != nil {
+			return err
+		}
+		s.changed("created org %s", o.Name)
+	case err != nil:
+		return err
+	case current.FullName != want.FullName || current.Description != want.Description || current.Visibility != want.Visibility:
+		if err := s.client.EditOrg(ctx, want); err != nil {
+			return err
+		}
+		s.changed("updated org %s", o.Name)
+	}
+
+	for _, name := range sortedKeys(o.Secrets) {
+		if err := s.client.SetSecret(ctx, "/orgs/"+url.PathEscape(o.Name), name, o.Secrets[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *seeder) team(ctx context.Context, org string, t SeedTeam) error {
+	teams, err := s.client.ListTeams(ctx, org)
+	if err != nil {
+		return err
+	}
+	want := Team{Name: t.Name, Permission: t.Permission, AllRepos: t.AllRepos}
+
+	i := slices.IndexFunc(teams, func(team Team) bool { return team.Name == t.Name })
+	var team Team
+	switch {
+	case i < 0:
+		if team, err = s.client.CreateTeam(ctx, org, want); err != nil {
+			return err
+		}
+		s.changed("created team %s/%s", org, t.Name)
+	case teams[i].Permission != want.Permission || teams[i].AllRepos != want.AllRepos:
+		team = teams[i]
+		want.ID = team.ID
+		if err := s.client.EditTeam(ctx, want); err != nil {
+			return err
+		}
+		s.changed("updated team %s/%s", org, t.Name)
+	default:
+		team = teams[i]
+	}
+
+	members, err := s.client.TeamMembers(ctx, team.ID)
+	if err != nil {
+		return err
+	}
+	for _, m := range t.Members {
+		if slices.Contains(members, m) {
+			continue
+		}
+		if err := s.client.AddTeamMember(ctx, team.ID, m); err != nil {
+			return err
+		}
+		s.changed("added %s to team %s/%s", m, org, t.Name)
+	}
+
+	if t.AllRepos {
+		return nil
+	}
+	repos, err := s.client.TeamRepos(ctx, team.ID)
+	if err != nil {
+		return err
+	}
+	for _, r := range t.Repos {
+		if slices.Contains(repos, r) {
+			continue
+		}
+		if err := s.client.AddTeamRepo(ctx, team.ID, org, r); err != nil {
+			return err
+		}
+		s.changed("added repo %s/%s to team %s", org, r, t.Name)
+	}
+	return nil
+}
+
+func (s *seeder) repo(ctx context.Context, r SeedRepo) error {
+	want := Repo{Name: r.Name, Description: r.Description, Private: r.Private, DefaultBranch: r.DefaultBranch}
+
+	current, err := s.client.GetRepo(ctx, r.Owner, r.Name)
+	switch {
+	case IsNotFound(err):
+		if current, err = s.client.CreateRepo(ctx, r.Owner, want); err != nil {
+			return err
+		}
+		s.changed("created repo %s", r.FullName())
+	case err != nil:
+		return err
+	case current.Description != want.Description || current.Private != want.Private ||
+		(want.DefaultBranch != "" && !current.Empty && current.DefaultBranch != want.DefaultBranch):
+		if err := s.client.EditRepo(ctx, r.Owner, want); err != nil {
+			return err
+		}
+		s.changed("updated repo %s", r.FullName())
+	}
+
+	if r.Mirror != "" && current.Empty {
+		if err := s.client.PushMirror(ctx, r.Owner, r.Name, r.Mirror); err != nil {
+			return err
+		}
+		s.changed("pushed %s to %s", r.Mirror, r.FullName())
+		if r.DefaultBranch != "" {
+			if err := s.client.EditRepo(ctx, r.Owner, want); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, k := range r.DeployKeys {
+		if err := s.deployKey(ctx, r, k); err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedKeys(r.Secrets) {
+		if err := s.client.SetSecret(ctx, repoPath(r.Owner, r.Name), name, r.Secrets[name]); err != nil {
+			return err
+		}
+	}
+	for _, h := range r.Webhooks {
+		if err := s.webhook(ctx, r, h); err != nil {
+			return err
+		}
+	}
+	for _, b := range r.BranchProtections {
+		if err := s.branchProtection(ctx, r, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *seeder) deployKey(ctx context.Context, r SeedRepo, k SeedDeployKey) error {
+	keys, err := s.client.ListDeployKeys(ctx, r.Owner, r.Name)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if sameKey(key.Key, k.Key) {
+			if key.Title == k.Title && key.ReadOnly == k.ReadOnly {
+				return nil
+			}
+			// Deploy keys cannot be edited
+			if err := s.client.DeleteDeployKey(ctx, r.Owner, r.Name, key.ID); err != nil {
+				return err
+			}
+		}
+	}
+	if err := s.client.AddDeployKey(ctx, r.Owner, r.Name, DeployKey{Title: k.Title, Key: k.Key, ReadOnly: k.ReadOnly}); err != nil {
+		return err
+	}
+	s.changed("set deploy key %s on %s", k.Title, r.FullName())
+	return nil
+}
+
+func (s *seeder) webhook(ctx context.Context, r SeedRepo, h SeedWebhook) error {
+	want := Webhook{
+		Type:   h.Type,
+		Config: WebhookConfig{URL: h.URL, ContentType: h.ContentType, Secret: h.Secret},
+		Events: h.Events, BranchFilter: h.Branches, Active: !h.Disabled,
+	}
+	if want.Type == "" {
+		want.Type = "gitea"
+	}
+	if want.Config.ContentType == "" {
+		want.Config.ContentType = "json"
+	}
+	if len(want.Events) == 0 {
+		want.Events = []string{"push"}
+	}
+	if want.BranchFilter == "" {
+		want.BranchFilter = "*"
+	}
+
+	hooks, err := s.client.ListWebhooks(ctx, r.Owner, r.Name)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		if hook.Config.URL != h.URL {
+			continue
+		}
+		if hook.Type == want.Type && hook.Config.ContentType == want.Config.ContentType && hook.Active == want.Active &&
+			hook.BranchFilter == want.BranchFilter && sameSet(hook.Events, want.Events) {
+			return nil
+		}
+		if err := s.client.EditWebhook(ctx, r.Owner, r.Name, hook.ID, want); err != nil {
+			return err
+		}
+		s.changed("updated webhook %s on %s", h.URL, r.FullName())
+		return nil
+	}
+	if err := s.client.CreateWebhook(ctx, r.Owner, r.Name, want); err != nil {
+		return err
+	}
+	s.changed("created webhook %s on %s", h.URL, r.FullName())
+	return nil
+}
+
+func (s *seeder) branchProtection(ctx context.Context, r SeedRepo, b SeedBranchProtection) error {
+	want := BranchProtection{
+		RuleName: b.Branch, RequiredApprovals: b.RequiredApprovals, EnablePush: b.AllowPush,
+		EnableStatusCheck: len(b.StatusChecks) > 0, StatusCheckContexts: b.StatusChecks,
+	}
+
+	rules, err := s.client.ListBranchProtections(ctx, r.Owner, r.Name)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.RuleName != b.Branch {
+			continue
+		}
+		if rule.RequiredApprovals == want.RequiredApprovals && rule.EnablePush == want.EnablePush &&
+			rule.EnableStatusCheck == want.EnableStatusCheck && sameSet(rule.StatusCheckContexts, want.StatusCheckContexts) {
+			return nil
+		}
+		if err := s.client.EditBranchProtection(ctx, r.Owner, r.Name, want); err != nil {
+			return err
+		}
+		s.changed("updated branch protection %s on %s", b.Branch, r.FullName())
+		return nil
+	}
+	if err := s.client.CreateBranchProtection(ctx, r.Owner, r.Name, want); err != nil {
+		return err
+	}
+	s.changed("protected branch %s on %s", b.Branch, r.FullName())
+	return nil
+}
+
+// sameKey compares the type and key of two authorized_keys lines, ignoring
+// comments
+func sameKey(a, b string) bool {
+	fa, fb := strings.Fields(a), strings.Fields(b)
+	return len(fa) >= 2 && len(fb) >= 2 && fa[0] == fb[0] && fa[1] == fb[1]
+}
+
+// sameSet reports whether a and b hold the same strings in any order
+func sameSet(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,399 @@
+package gitea
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSeedValidate(t *testing.T) {
+	repo := SeedRepo{Owner: "platform", Name: "api"}
+	tests := []struct {
+		name    string
+		seed    Seed
+		wantErr bool
+	}{
+		{name: "empty", seed: Seed{}},
+		{
+			name: "complete",
+			seed: Seed{
+				Users: []SeedUser{{Name: "alice", Email: "alice@example.com"}},
+				Orgs:  []SeedOrg{{Name: "platform", Visibility: "private", Teams: []SeedTeam{{Name: "devs", Permission: "write"}}}},
+				Repos: []SeedRepo{{
+					Owner:             "platform",
+					Name:              "api",
+					DeployKeys:        []SeedDeployKey{{Title: "ci", Key: "ssh-ed25519 AAAA"}},
+					Webhooks:          []SeedWebhook{{URL: "http://hooks.example.com"}},
+					BranchProtections: []SeedBranchProtection{{Branch: "main"}},
+				}},
+			},
+		},
+		{name: "user without email", seed: Seed{Users: []SeedUser{{Name: "alice"}}}, wantErr: true},
+		{name: "org without name", seed: Seed{Orgs: []SeedOrg{{}}}, wantErr: true},
+		{name: "unknown visibility", seed: Seed{Orgs: []SeedOrg{{Name: "platform", Visibility: "internal"}}}, wantErr: true},
+		{name: "team without permission", seed: Seed{Orgs: []SeedOrg{{Name: "platform", Teams: []SeedTeam{{Name: "devs"}}}}}, wantErr: true},
+		{name: "repo without owner", seed: Seed{Repos: []SeedRepo{{Name: "api"}}}, wantErr: true},
+		{name: "deploy key without key", seed: Seed{Repos: []SeedRepo{{Owner: repo.Owner, Name: repo.Name, DeployKeys: []SeedDeployKey{{Title: "ci"}}}}}, wantErr: true},
+		{name: "webhook without url", seed: Seed{Repos: []SeedRepo{{Owner: repo.Owner, Name: repo.Name, Webhooks: []SeedWebhook{{}}}}}, wantErr: true},
+		{name: "branch protection without branch", seed: Seed{Repos: []SeedRepo{{Owner: repo.Owner, Name: repo.Name, BranchProtections: []SeedBranchProtection{{}}}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.seed.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadSeed(t *testing.T) {
+	t.Setenv("SEED_PASSWORD", "pw")
+	t.Setenv("SEED_TOKEN", "tok")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "seed.yaml")
+	manifest := `users:
+  - name: alice
+    email: alice@example.com
+    password: ${SEED_PASSWORD}
+repos:
+  - owner: alice
+    name: api
+    mirror: ./api
+    secrets:
+      TOKEN: ${SEED_TOKEN}
+    webhooks:
+      - url: http://hooks.example.com
+        secret: ${SEED_TOKEN}
+`
+	if err := os.WriteFile(path, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := LoadSeed(path)
+	if err != nil {
+		t.Fatalf("LoadSeed() error = %v", err)
+	}
+	if got := s.Users[0].Password; got != "pw" {
+		t.Errorf("password = %q, want it expanded", got)
+	}
+	if got := s.Repos[0].Secrets["TOKEN"]; got != "tok" {
+		t.Errorf("secret = %q, want it expanded", got)
+	}
+	if got := s.Repos[0].Webhooks[0].Secret; got != "tok" {
+		t.Errorf("webhook secret = %q, want it expanded", got)
+	}
+	if got := s.Repos[0].Mirror; got != filepath.Join(dir, "api") {
+		t.Errorf("mirror = %q, want it relative to the manifest", got)
+	}
+
+	if err := os.WriteFile(path, []byte("repo:\n  - owner: alice\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSeed(path); err == nil {
+		t.Error("LoadSeed() accepted an unknown field")
+	}
+}
+
+func TestApplySeedTwice(t *testing.T) {
+	server := httptest.NewServer(newFakeGitea(t))
+	defer server.Close()
+	client := NewClient(server.URL, "admin", "p")
+
+	seed := Seed{
+		Users: []SeedUser{{Name: "alice", Email: "alice@example.com", Password: "pw"}},
+		Orgs: []SeedOrg{{
+			Name:       "platform",
+			Visibility: "private",
+			Secrets:    map[string]string{"REGISTRY_TOKEN": "tok"},
+			Teams:      []SeedTeam{{Name: "devs", Permission: "write", Members: []string{"alice"}, Repos: []string{"app"}}},
+		}},
+		Repos: []SeedRepo{{
+			Owner:             "platform",
+			Name:              "app",
+			Private:           true,
+			DefaultBranch:     "main",
+			DeployKeys:        []SeedDeployKey{{Title: "argocd", Key: "ssh-ed25519 AAAA argocd", ReadOnly: true}},
+			Secrets:           map[string]string{"KUBECONFIG": "kc"},
+			Webhooks:          []SeedWebhook{{URL: "https://ci.example.com/hook", Events: []string{"push", "pull_request"}, Secret: "s"}},
+			BranchProtections: []SeedBranchProtection{{Branch: "main", RequiredApprovals: 1, StatusChecks: []string{"ci/build"}}},
+		}},
+	}
+
+	changes, err := client.ApplySeed(context.Background(), seed, io.Discard)
+	if err != nil {
+		t.Fatalf("first ApplySeed() error = %v", err)
+	}
+	if changes == 0 {
+		t.Fatal("first ApplySeed() made no changes")
+	}
+
+	var out strings.Builder
+	changes, err = client.ApplySeed(context.Background(), seed, &out)
+	if err != nil {
+		t.Fatalf("second ApplySeed() error = %v", err)
+	}
+	if changes != 0 {
+		t.Errorf("second ApplySeed() made %d changes:\n%s", changes, out.String())
+	}
+
+	seed.Users[0].Email = "alice@example.org"
+	changes, err = client.ApplySeed(context.Background(), seed, io.Discard)
+	if err != nil {
+		t.Fatalf("ApplySeed() with a new email error = %v", err)
+	}
+	if changes != 1 {
+		t.Errorf("ApplySeed() with a new email made %d changes, want 1", changes)
+	}
+	u, err := client.GetUser(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "alice@example.org" {
+		t.Errorf("email = %q, want it updated", u.Email)
+	}
+}
+
+// fakeGitea keeps the objects ApplySeed manages in memory and serves the API
+// endpoints it calls
+type fakeGitea struct {
+	mu        sync.Mutex
+	nextID    int64
+	users     map[string]User
+	orgs      map[string]Org
+	repos     map[string]Repo
+	keys      map[string][]DeployKey
+	hooks     map[string][]Webhook
+	rules     map[string][]BranchProtection
+	teams     map[string][]Team
+	members   map[string][]User
+	teamRepos map[string][]Repo
+}
+
+func newFakeGitea(t *testing.T) http.Handler {
+	f := &fakeGitea{
+		users:     map[string]User{},
+		orgs:      map[string]Org{},
+		repos:     map[string]Repo{},
+		keys:      map[string][]DeployKey{},
+		hooks:     map[string][]Webhook{},
+		rules:     map[string][]BranchProtection{},
+		teams:     map[string][]Team{},
+		members:   map[string][]User{},
+		teamRepos: map[string][]Repo{},
+	}
+
+	mux := http.NewServeMux()
+	handle := func(pattern string, h func(r *http.Request) (int, any)) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			f.mu.Lock()
+			status, out := h(r)
+			f.mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			if out != nil {
+				json.NewEncoder(w).Encode(out)
+			}
+		})
+	}
+	decode := func(r *http.Request, v any) {
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+			t.Errorf("%s %s: failed to decode body: %v", r.Method, r.URL.Path, err)
+		}
+	}
+	notFound := map[string]string{"message": "not found"}
+	repoKey := func(r *http.Request) string { return r.PathValue("owner") + "/" + r.PathValue("repo") }
+
+	handle("GET /api/v1/users/{name}", func(r *http.Request) (int, any) {
+		if u, ok := f.users[r.PathValue("name")]; ok {
+			return http.StatusOK, u
+		}
+		return http.StatusNotFound, notFound
+	})
+	handle("POST /api/v1/admin/users", func(r *http.Request) (int, any) {
+		var body struct{ Username, Email string }
+		decode(r, &body)
+		f.nextID++
+		f.users[body.Username] = User{ID: f.nextID, Login: body.Username, Email: body.Email}
+		return http.StatusCreated, nil
+	})
+	handle("PATCH /api/v1/admin/users/{name}", func(r *http.Request) (int, any) {
+		var body struct{ Email string }
+		decode(r, &body)
+		u := f.users[r.PathValue("name")]
+		u.Email = body.Email
+		f.users[u.Login] = u
+		return http.StatusOK, u
+	})
+
+	handle("GET /api/v1/orgs/{org}", func(r *http.Request) (int, any) {
+		if o, ok := f.orgs[r.PathValue("org")]; ok {
+			return http.StatusOK, o
+		}
+		return http.StatusNotFound, notFound
+	})
+	handle("POST /api/v1/orgs", func(r *http.Request) (int, any) {
+		var o Org
+		decode(r, &o)
+		f.orgs[o.Name] = o
+		return http.StatusCreated, o
+	})
+	handle("PATCH /api/v1/orgs/{org}", func(r *http.Request) (int, any) {
+		var o Org
+		decode(r, &o)
+		f.orgs[r.PathValue("org")] = o
+		return http.StatusOK, o
+	})
+	handle("PUT /api/v1/orgs/{org}/actions/secrets/{name}", func(r *http.Request) (int, any) {
+		return http.StatusNoContent, nil
+	})
+
+	handle("GET /api/v1/orgs/{org}/teams", func(r *http.Request) (int, any) {
+		return http.StatusOK, f.teams[r.PathValue("org")]
+	})
+	handle("POST /api/v1/orgs/{org}/teams", func(r *http.Request) (int, any) {
+		var team Team
+		decode(r, &team)
+		f.nextID++
+		team.ID = f.nextID
+		f.teams[r.PathValue("org")] = append(f.teams[r.PathValue("org")], team)
+		return http.StatusCreated, team
+	})
+	handle("PATCH /api/v1/teams/{id}", func(r *http.Request) (int, any) {
+		var team Team
+		decode(r, &team)
+		for org, teams := range f.teams {
+			for i := range teams {
+				if strconv.FormatInt(teams[i].ID, 10) == r.PathValue("id") {
+					f.teams[org][i] = team
+				}
+			}
+		}
+		return http.StatusOK, team
+	})
+	handle("GET /api/v1/teams/{id}/members", func(r *http.Request) (int, any) {
+		return http.StatusOK, f.members[r.PathValue("id")]
+	})
+	handle("PUT /api/v1/teams/{id}/members/{user}", func(r *http.Request) (int, any) {
+		u, ok := f.users[r.PathValue("user")]
+		if !ok {
+			return http.StatusNotFound, notFound
+		}
+		f.members[r.PathValue("id")] = append(f.members[r.PathValue("id")], u)
+		return http.StatusNoContent, nil
+	})
+	handle("GET /api/v1/teams/{id}/repos", func(r *http.Request) (int, any) {
+		return http.StatusOK, f.teamRepos[r.PathValue("id")]
+	})
+	handle("PUT /api/v1/teams/{id}/repos/{owner}/{repo}", func(r *http.Request) (int, any) {
+		repo, ok := f.repos[repoKey(r)]
+		if !ok {
+			return http.StatusNotFound, notFound
+		}
+		f.teamRepos[r.PathValue("id")] = append(f.teamRepos[r.PathValue("id")], repo)
+		return http.StatusNoContent, nil
+	})
+
+	handle("GET /api/v1/repos/{owner}/{repo}", func(r *http.Request) (int, any) {
+		if repo, ok := f.repos[repoKey(r)]; ok {
+			return http.StatusOK, repo
+		}
+		return http.StatusNotFound, notFound
+	})
+	handle("POST /api/v1/admin/users/{owner}/repos", func(r *http.Request) (int, any) {
+		var repo Repo
+		decode(r, &repo)
+		repo.Empty = true
+		f.repos[r.PathValue("owner")+"/"+repo.Name] = repo
+		return http.StatusCreated, repo
+	})
+	handle("PATCH /api/v1/repos/{owner}/{repo}", func(r *http.Request) (int, any) {
+		repo := f.repos[repoKey(r)]
+		decode(r, &repo)
+		f.repos[repoKey(r)] = repo
+		return http.StatusOK, repo
+	})
+	handle("PUT /api/v1/repos/{owner}/{repo}/actions/secrets/{name}", func(r *http.Request) (int, any) {
+		return http.StatusNoContent, nil
+	})
+
+	handle("GET /api/v1/repos/{owner}/{repo}/keys", func(r *http.Request) (int, any) {
+		return http.StatusOK, f.keys[repoKey(r)]
+	})
+	handle("POST /api/v1/repos/{owner}/{repo}/keys", func(r *http.Request) (int, any) {
+		var k DeployKey
+		decode(r, &k)
+		f.nextID++
+		k.ID = f.nextID
+		f.keys[repoKey(r)] = append(f.keys[repoKey(r)], k)
+		return http.StatusCreated, k
+	})
+	handle("DELETE /api/v1/repos/{owner}/{repo}/keys/{id}", func(r *http.Request) (int, any) {
+		f.keys[repoKey(r)] = slices.DeleteFunc(f.keys[repoKey(r)], func(k DeployKey) bool {
+			return strconv.FormatInt(k.ID, 10) == r.PathValue("id")
+		})
+		return http.StatusNoContent, nil
+	})
+
+	handle("GET /api/v1/repos/{owner}/{repo}/hooks", func(r *http.Request) (int, any) {
+		return http.StatusOK, f.hooks[repoKey(r)]
+	})
+	handle("POST /api/v1/repos/{owner}/{repo}/hooks", func(r *http.Request) (int, any) {
+		var h Webhook
+		decode(r, &h)
+		f.nextID++
+		h.ID = f.nextID
+		h.Config.Secret = ""
+		f.hooks[repoKey(r)] = append(f.hooks[repoKey(r)], h)
+		return http.StatusCreated, h
+	})
+	handle("PATCH /api/v1/repos/{owner}/{repo}/hooks/{id}", func(r *http.Request) (int, any) {
+		var h Webhook
+		decode(r, &h)
+		h.Config.Secret = ""
+		hooks := f.hooks[repoKey(r)]
+		for i := range hooks {
+			if strconv.FormatInt(hooks[i].ID, 10) == r.PathValue("id") {
+				h.ID = hooks[i].ID
+				hooks[i] = h
+			}
+		}
+		return http.StatusOK, h
+	})
+
+	handle("GET /api/v1/repos/{owner}/{repo}/branch_protections", func(r *http.Request) (int, any) {
+		return http.StatusOK, f.rules[repoKey(r)]
+	})
+	handle("POST /api/v1/repos/{owner}/{repo}/branch_protections", func(r *http.Request) (int, any) {
+		var b BranchProtection
+		decode(r, &b)
+		f.rules[repoKey(r)] = append(f.rules[repoKey(r)], b)
+		return http.StatusCreated, b
+	})
+	handle("PATCH /api/v1/repos/{owner}/{repo}/branch_protections/{name}", func(r *http.Request) (int, any) {
+		var b BranchProtection
+		decode(r, &b)
+		rules := f.rules[repoKey(r)]
+		for i := range rules {
+			if rules[i].RuleName == r.PathValue("name") {
+				rules[i] = b
+			}
+		}
+		return http.StatusOK, b
+	})
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotImplemented)
+	})
+	return mux
+}
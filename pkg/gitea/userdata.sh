@@ -1,15 +1,30 @@
 #!/usr/bin/env bash
 set -euxo pipefail
 
-# Gitea installation via snap
+# Gitea installation via snap, or a pinned release binary run by systemd
 # Note: Gitea snap is strictly confined, some features may be limited
 
+# Install method and paths (injected by deployer). The binary install serves
+# git over SSH on 22 and moves the VM's sshd to HOST_SSH_PORT.
+INSTALL_METHOD="{{INSTALL_METHOD}}"
+GITEA_VERSION="{{GITEA_VERSION}}"
+HOST_SSH_PORT="{{HOST_SSH_PORT}}"
+GITEA_HOME="{{GITEA_HOME}}"
+GITEA_APP_INI="{{APP_INI}}"
+GITEA_DATA_PATH="{{APP_DATA_PATH}}"
+GITEA_REPO_ROOT="{{REPO_ROOT}}"
+GITEA_CLI="{{GITEA_CLI}}"
+GITEA_CONF_DIR=$(dirname "${GITEA_APP_INI}")
+
 # Database configuration (injected by deployer)
 DB_HOST="{{DB_HOST}}"
 DB_PORT="{{DB_PORT}}"
 DB_NAME="{{DB_NAME}}"
 DB_USER="{{DB_USER}}"
 DB_PASS="{{DB_PASS}}"
+# libpq sslmode and the PEM CA for verify-ca/verify-full, empty otherwise
+DB_SSL_MODE="{{DB_SSL_MODE}}"
+DB_CA_CERT="{{DB_CA_CERT}}"
 
 # S3 Storage configuration (injected by deployer)
 S3_ENDPOINT="{{S3_ENDPOINT}}"
@@ -17,51 +32,179 @@ S3_ACCESS_KEY="{{S3_ACCESS_KEY}}"
 S3_SECRET_KEY="{{S3_SECRET_KEY}}"
 S3_BUCKET="{{S3_BUCKET}}"
 S3_USE_SSL="{{S3_USE_SSL}}"
+# PEM CA the S3 endpoint's certificate is verified against, empty to use the
+# system roots only
+S3_CA_CERT="{{S3_CA_CERT}}"
+# Package registries, the OCI registry serves on the web port
+PACKAGES_ENABLED="{{PACKAGES_ENABLED}}"
+
+# Admin account and app.ini secrets (generated by deployer)
+ADMIN_USER="{{ADMIN_USER}}"
+ADMIN_PASSWORD="{{ADMIN_PASSWORD}}"
+ADMIN_EMAIL="{{ADMIN_EMAIL}}"
+SECRET_KEY="{{SECRET_KEY}}"
+INTERNAL_TOKEN="{{INTERNAL_TOKEN}}"
+JWT_SECRET="{{JWT_SECRET}}"
+LFS_JWT_SECRET="{{LFS_JWT_SECRET}}"
 
-# Install snapd if not present
 export DEBIAN_FRONTEND=noninteractive
-if ! command -v snap &> /dev/null; then
-    sudo -E apt-get update
-    sudo -E apt-get install -y snapd
+
+# Gitea verifies the S3 endpoint against the system roots, which the snap
+# shares with the host
+if [ -n "$S3_CA_CERT" ]; then
+    echo "$S3_CA_CERT" | sudo tee /usr/local/share/ca-certificates/slicer-playground-ca.crt > /dev/null
+    sudo update-ca-certificates
 fi
 
-# Start snapd and wait for socket to be available
-sudo systemctl enable snapd.socket
-sudo systemctl start snapd.socket
-sudo systemctl enable snapd
-sudo systemctl start snapd
-
-# Wait for snapd socket to be ready
-echo "Waiting for snapd socket..."
-for i in {1..30}; do
-    if [ -S /run/snapd.socket ]; then
-        echo "snapd socket ready"
-        break
+install_snap() {
+    # Install snapd if not present
+    if ! command -v snap &> /dev/null; then
+        sudo -E apt-get update
+        sudo -E apt-get install -y snapd
+    fi
+
+    # Start snapd and wait for socket to be available
+    sudo systemctl enable snapd.socket
+    sudo systemctl start snapd.socket
+    sudo systemctl enable snapd
+    sudo systemctl start snapd
+
+    # Wait for snapd socket to be ready
+    echo "Waiting for snapd socket..."
+    for i in {1..30}; do
+        if [ -S /run/snapd.socket ]; then
+            echo "snapd socket ready"
+            break
+        fi
+        sleep 1
+    done
+
+    # Install Gitea via snap
+    sudo snap install gitea
+
+    # Wait for snap to initialize and create config directory
+    sleep 5
+}
+
+install_binary() {
+    sudo -E apt-get update
+    sudo -E apt-get install -y git curl
+
+    local arch
+    case $(uname -m) in
+        x86_64) arch="amd64" ;;
+        aarch64) arch="arm64" ;;
+        *) echo "unsupported architecture $(uname -m)"; exit 1 ;;
+    esac
+    local url="https://dl.gitea.com/gitea/${GITEA_VERSION}/gitea-${GITEA_VERSION}-linux-${arch}"
+    curl -fsSL -o /tmp/gitea "${url}"
+    echo "$(curl -fsSL "${url}.sha256" | awk '{print $1}')  /tmp/gitea" | sha256sum -c -
+    sudo install -m 0755 /tmp/gitea /usr/local/bin/gitea
+    rm -f /tmp/gitea
+
+    if ! id git &> /dev/null; then
+        sudo adduser --system --shell /bin/bash --gecos 'Git Version Control' \
+            --group --disabled-password --home /home/git git
+    fi
+    sudo mkdir -p "${GITEA_HOME}/custom" "${GITEA_DATA_PATH}" "${GITEA_HOME}/log" "${GITEA_CONF_DIR}"
+    sudo chown -R git:git "${GITEA_HOME}"
+    sudo chmod 750 "${GITEA_HOME}"
+    sudo chown root:git "${GITEA_CONF_DIR}"
+    sudo chmod 750 "${GITEA_CONF_DIR}"
+
+    # Gitea serves git over SSH on 22, the VM's sshd moves aside. Newer
+    # Ubuntu releases start sshd from ssh.socket, which sets the port itself.
+    echo "Port ${HOST_SSH_PORT}" | sudo tee /etc/ssh/sshd_config.d/10-slicer-port.conf > /dev/null
+    if systemctl is-enabled --quiet ssh.socket 2> /dev/null; then
+        sudo mkdir -p /etc/systemd/system/ssh.socket.d
+        printf '[Socket]\nListenStream=\nListenStream=%s\n' "${HOST_SSH_PORT}" | \
+            sudo tee /etc/systemd/system/ssh.socket.d/10-slicer-port.conf > /dev/null
+        sudo systemctl daemon-reload
+        sudo systemctl restart ssh.socket
+    else
+        sudo systemctl restart ssh
     fi
-    sleep 1
-done
 
-# Install Gitea via snap
-sudo snap install gitea
+    cat <<EOF | sudo tee /etc/systemd/system/gitea.service > /dev/null
+[Unit]
+Description=Gitea
+After=network.target
 
-# Wait for snap to initialize and create config directory
-sleep 5
+[Service]
+Type=simple
+User=git
+Group=git
+WorkingDirectory=${GITEA_HOME}
+ExecStart=/usr/local/bin/gitea web --config ${GITEA_APP_INI}
+Environment=USER=git HOME=/home/git GITEA_WORK_DIR=${GITEA_HOME}
+AmbientCapabilities=CAP_NET_BIND_SERVICE
+CapabilityBoundingSet=CAP_NET_BIND_SERVICE
+Restart=always
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+EOF
+    sudo systemctl daemon-reload
+}
+
+if [ "${INSTALL_METHOD}" = "binary" ]; then
+    install_binary
+    RUN_USER_LINE="RUN_USER = git"
+    WORK_PATH_LINE="WORK_PATH = ${GITEA_HOME}"
+    # Gitea's own SSH server takes port 22
+    SSH_SERVER_LINES="START_SSH_SERVER = true
+SSH_LISTEN_PORT = 22"
+else
+    install_snap
+    # RUN_USER is omitted - let snap handle the user
+    RUN_USER_LINE=""
+    WORK_PATH_LINE=""
+    SSH_SERVER_LINES=""
+fi
+
+gitea_service() {
+    if [ "${INSTALL_METHOD}" = "binary" ]; then
+        sudo systemctl "$1" gitea
+    else
+        sudo snap "$1" gitea
+    fi
+}
 
 # Get Gitea IP
 GITEA_IP=$(hostname -I | awk '{print $1}')
 
-# Gitea snap config path
-GITEA_CONF_DIR="/var/snap/gitea/common/conf"
-GITEA_APP_INI="${GITEA_CONF_DIR}/app.ini"
-
 # Ensure config directory exists
 sudo mkdir -p "${GITEA_CONF_DIR}"
 
-# Create app.ini with database and storage pre-configured
-# Note: RUN_USER is omitted - let snap handle the user
-cat <<EOF | sudo tee "${GITEA_APP_INI}"
+# Gitea passes query parameters in the database name through to libpq, which
+# is how it finds the CA. The snap can only read files under its common dir.
+DB_NAME_PARAMS="${DB_NAME}"
+if [ -n "$DB_CA_CERT" ]; then
+    echo "$DB_CA_CERT" | sudo tee "${GITEA_CONF_DIR}/postgres-ca.crt" > /dev/null
+    sudo chmod 644 "${GITEA_CONF_DIR}/postgres-ca.crt"
+    DB_NAME_PARAMS="${DB_NAME}?sslrootcert=${GITEA_CONF_DIR}/postgres-ca.crt"
+fi
+
+# A data volume kept from an earlier VM has an app.ini already. Keep its
+# secrets, SECRET_KEY encrypts data in the database.
+ini_value() {
+    sudo sed -n -E "s/^$1[[:space:]]*=[[:space:]]*//p" "${GITEA_APP_INI}" 2>/dev/null | head -n 1
+}
+if sudo test -f "${GITEA_APP_INI}"; then
+    EXISTING=$(ini_value SECRET_KEY); SECRET_KEY="${EXISTING:-$SECRET_KEY}"
+    EXISTING=$(ini_value INTERNAL_TOKEN); INTERNAL_TOKEN="${EXISTING:-$INTERNAL_TOKEN}"
+    EXISTING=$(ini_value JWT_SECRET); JWT_SECRET="${EXISTING:-$JWT_SECRET}"
+    EXISTING=$(ini_value LFS_JWT_SECRET); LFS_JWT_SECRET="${EXISTING:-$LFS_JWT_SECRET}"
+fi
+
+# Create app.ini with database and storage pre-configured, locked so the web
+# wizard never runs
+cat <<EOF | sudo tee "${GITEA_APP_INI}" > /dev/null
 APP_NAME = Gitea
 RUN_MODE = prod
+${RUN_USER_LINE}
+${WORK_PATH_LINE}
 
 [server]
 DOMAIN = ${GITEA_IP}
@@ -69,15 +212,21 @@ HTTP_PORT = 3000
 ROOT_URL = http://${GITEA_IP}:3000/
 DISABLE_SSH = false
 SSH_PORT = 22
+${SSH_SERVER_LINES}
 LFS_START_SERVER = true
+LFS_JWT_SECRET = ${LFS_JWT_SECRET}
+APP_DATA_PATH = ${GITEA_DATA_PATH}
+
+[repository]
+ROOT = ${GITEA_REPO_ROOT}
 
 [database]
 DB_TYPE = postgres
 HOST = ${DB_HOST}:${DB_PORT}
-NAME = ${DB_NAME}
+NAME = ${DB_NAME_PARAMS}
 USER = ${DB_USER}
 PASSWD = ${DB_PASS}
-SSL_MODE = disable
+SSL_MODE = ${DB_SSL_MODE}
 
 [storage]
 STORAGE_TYPE = minio
@@ -87,8 +236,19 @@ MINIO_SECRET_ACCESS_KEY = ${S3_SECRET_KEY}
 MINIO_BUCKET = ${S3_BUCKET}
 MINIO_USE_SSL = ${S3_USE_SSL}
 
+[packages]
+ENABLED = ${PACKAGES_ENABLED}
+
 [security]
-INSTALL_LOCK = false
+INSTALL_LOCK = true
+SECRET_KEY = ${SECRET_KEY}
+INTERNAL_TOKEN = ${INTERNAL_TOKEN}
+
+[oauth2]
+JWT_SECRET = ${JWT_SECRET}
+
+[service]
+DISABLE_REGISTRATION = true
 
 [log]
 MODE = console
@@ -96,9 +256,37 @@ LEVEL = info
 EOF
 
 sudo chmod 640 "${GITEA_APP_INI}"
+if [ "${INSTALL_METHOD}" = "binary" ]; then
+    sudo chown root:git "${GITEA_APP_INI}"
+fi
 
-# Restart Gitea to pick up config
-sudo snap restart gitea
+# Migrate the database and create the admin account before the web server
+# starts, an existing account gets the configured password
+if [ "${INSTALL_METHOD}" = "snap" ]; then
+    gitea_service stop
+fi
+sudo ${GITEA_CLI} migrate --config "${GITEA_APP_INI}"
+if sudo ${GITEA_CLI} admin user list --admin --config "${GITEA_APP_INI}" | awk 'NR > 1 {print $2}' | grep -qx "${ADMIN_USER}"; then
+    sudo ${GITEA_CLI} admin user change-password --config "${GITEA_APP_INI}" \
+        --username "${ADMIN_USER}" --password "${ADMIN_PASSWORD}" --must-change-password=false
+else
+    sudo ${GITEA_CLI} admin user create --config "${GITEA_APP_INI}" --admin \
+        --username "${ADMIN_USER}" --password "${ADMIN_PASSWORD}" --email "${ADMIN_EMAIL}" \
+        --must-change-password=false
+fi
+if [ "${INSTALL_METHOD}" = "binary" ]; then
+    sudo systemctl enable gitea
+fi
+gitea_service start
+
+# Later targets read the admin account over exec
+sudo mkdir -p /etc/gitea
+cat <<EOF | sudo tee /etc/gitea/admin.env > /dev/null
+GITEA_ADMIN_USER=${ADMIN_USER}
+GITEA_ADMIN_PASSWORD=${ADMIN_PASSWORD}
+GITEA_ADMIN_EMAIL=${ADMIN_EMAIL}
+EOF
+sudo chmod 600 /etc/gitea/admin.env
 
 # Save connection info
 cat <<EOF | sudo tee /home/ubuntu/gitea-info.txt
@@ -106,6 +294,7 @@ Gitea Instance
 ==============
 Web UI: http://${GITEA_IP}:3000
 SSH: ssh://git@${GITEA_IP}:22
+Install: ${INSTALL_METHOD}
 
 Database Configuration (pre-configured):
   Type: PostgreSQL
@@ -113,7 +302,7 @@ Database Configuration (pre-configured):
   Database: ${DB_NAME}
   Username: ${DB_USER}
   Password: ${DB_PASS}
-  SSL Mode: disable
+  SSL Mode: ${DB_SSL_MODE}
 
 S3 Storage Configuration (pre-configured):
   Endpoint: ${S3_ENDPOINT}
@@ -122,19 +311,19 @@ S3 Storage Configuration (pre-configured):
   Bucket: ${S3_BUCKET}
   Use SSL: ${S3_USE_SSL}
 
-Config file: ${GITEA_APP_INI}
+Admin Account:
+  Username: ${ADMIN_USER}
+  Password: ${ADMIN_PASSWORD}
 
-First-time Setup:
-  1. Open http://${GITEA_IP}:3000 in your browser
-  2. Database is pre-configured - just verify the settings
-  3. Create your admin account
-  4. Complete the setup wizard
+Container Registry: ${GITEA_IP}:3000 (packages enabled: ${PACKAGES_ENABLED})
+
+Config file: ${GITEA_APP_INI}
 EOF
 
 sudo chown ubuntu:ubuntu /home/ubuntu/gitea-info.txt
 sudo chmod 600 /home/ubuntu/gitea-info.txt
 
 echo "Gitea installation complete!"
-echo "Database and S3 storage pre-configured"
+echo "Database, S3 storage and admin account ${ADMIN_USER} configured"
 echo "Access the web UI at http://${GITEA_IP}:3000"
 echo "Configuration saved to /home/ubuntu/gitea-info.txt"
@@ -8,6 +8,8 @@ import (
 	"strings"
 
 	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/vmspec"
 )
 
 //go:embed userdata_cp.sh
@@ -38,6 +40,9 @@ type CPConfig struct {
 	SSHKeys     []string
 	GitHubUser  string
 	Tags        []string
+	Image       string
+	Hypervisor  string
+	Storage     string
 	Count       int
 	CIDR        string
 }
@@ -51,6 +56,9 @@ type AgentConfig struct {
 	SSHKeys     []string
 	GitHubUser  string
 	Tags        []string
+	Image       string
+	Hypervisor  string
+	Storage     string
 	CIDR        string
 	APIPort     int
 	TapPrefix   string
@@ -65,11 +73,16 @@ func DefaultCPConfig() CPConfig {
 		hostGroup = DefaultCPHostGroup
 	}
 
+	image, hypervisor, storage := vmspec.Default("K3S_CP")
+
 	return CPConfig{
 		HostGroup:   hostGroup,
 		VCPU:        DefaultCPVCPU,
 		RAMGB:       DefaultCPRAMGB,
 		StorageSize: DefaultStorageSize,
+		Image:       image,
+		Hypervisor:  hypervisor,
+		Storage:     storage,
 		Tags:        []string{"k3s", "k3s-cp"},
 		Count:       DefaultCPCount,
 		CIDR:        DefaultCPCIDR,
@@ -82,11 +95,16 @@ func DefaultAgentConfig() AgentConfig {
 		hostGroup = DefaultAgentHostGroup
 	}
 
+	image, hypervisor, storage := vmspec.Default("K3S_AGENT")
+
 	return AgentConfig{
 		HostGroup:   hostGroup,
 		VCPU:        DefaultAgentVCPU,
 		RAMGB:       DefaultAgentRAMGB,
 		StorageSize: DefaultStorageSize,
+		Image:       image,
+		Hypervisor:  hypervisor,
+		Storage:     storage,
 		Tags:        []string{"k3s", "k3s-agent"},
 		CIDR:        DefaultAgentCIDR,
 		APIPort:     8081,
@@ -94,6 +112,16 @@ func DefaultAgentConfig() AgentConfig {
 	}
 }
 
+// Validate checks the image, hypervisor and storage backend combination
+func (c CPConfig) Validate() error {
+	return vmspec.Validate(c.Image, c.Hypervisor, c.Storage, c.StorageSize)
+}
+
+// Validate checks the image, hypervisor and storage backend combination
+func (c AgentConfig) Validate() error {
+	return vmspec.Validate(c.Image, c.Hypervisor, c.Storage, c.StorageSize)
+}
+
 // CPDeployer handles control plane node deployment
 type CPDeployer struct {
 	client *sdk.SlicerClient
@@ -253,7 +281,7 @@ func GenerateCPYAML(config CPConfig, githubUser string) string {
 	return fmt.Sprintf(`config:
   host_groups:
   - name: %s
-    storage: image
+    storage: %s
     storage_size: %s
     count: %d
     vcpu: %d
@@ -265,22 +293,23 @@ func GenerateCPYAML(config CPConfig, githubUser string) string {
 
   github_user: %s
 
-  image: "ghcr.io/openfaasltd/slicer-systemd:5.10.240-x86_64-latest"
+  image: "%s"
 
-  hypervisor: firecracker
+  hypervisor: %s
 
   api:
     port: 8080
     bind_address: "127.0.0.1"
-`, config.HostGroup, config.StorageSize, config.Count, config.VCPU, config.RAMGB,
-		config.HostGroup, config.HostGroup, gatewayFromCIDR(config.CIDR), githubUser)
+`, config.HostGroup, config.Storage, config.StorageSize, config.Count, config.VCPU, config.RAMGB,
+		config.HostGroup, config.HostGroup, gatewayFromCIDR(config.CIDR), githubUser,
+		config.Image, config.Hypervisor)
 }
 
 func GenerateAgentYAML(config AgentConfig, githubUser string) string {
 	return fmt.Sprintf(`config:
   host_groups:
   - name: %s
-    storage: image
+    storage: %s
     storage_size: %s
     count: 0
     vcpu: %d
@@ -292,9 +321,9 @@ func GenerateAgentYAML(config AgentConfig, githubUser string) string {
 
   github_user: %s
 
-  image: "ghcr.io/openfaasltd/slicer-systemd:5.10.240-x86_64-latest"
+  image: "%s"
 
-  hypervisor: firecracker
+  hypervisor: %s
 
   api:
     port: %d
@@ -303,9 +332,9 @@ func GenerateAgentYAML(config AgentConfig, githubUser string) string {
   ssh:
     port: 0
     find_keys: false
-`, config.HostGroup, config.StorageSize, config.VCPU, config.RAMGB,
+`, config.HostGroup, config.Storage, config.StorageSize, config.VCPU, config.RAMGB,
 		config.HostGroup, config.TapPrefix, gatewayFromCIDR(config.CIDR),
-		githubUser, config.APIPort)
+		githubUser, config.Image, config.Hypervisor, config.APIPort)
 }
 
 // gatewayFromCIDR converts CIDR like 192.168.137.0/24 to gateway format 192.168.137.1/24
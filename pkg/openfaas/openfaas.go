@@ -7,6 +7,9 @@ import (
 	"os"
 
 	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/dns"
+	"github.com/gaarutyunov/slicer/pkg/vmspec"
 )
 
 //go:embed userdata.sh
@@ -27,6 +30,11 @@ type Config struct {
 	SSHKeys     []string
 	GitHubUser  string
 	Tags        []string
+	Image       string
+	Hypervisor  string
+	Storage     string
+	// DNS points the VM at the stack DNS server so configs can use names
+	DNS dns.Resolver
 }
 
 func DefaultConfig() Config {
@@ -35,15 +43,25 @@ func DefaultConfig() Config {
 		hostGroup = DefaultHostGroup
 	}
 
+	image, hypervisor, storage := vmspec.Default("OPENFAAS")
+
 	return Config{
 		HostGroup:   hostGroup,
 		VCPU:        DefaultVCPU,
 		RAMGB:       DefaultRAMGB,
 		StorageSize: DefaultStorageSize,
+		Image:       image,
+		Hypervisor:  hypervisor,
+		Storage:     storage,
 		Tags:        []string{"openfaas"},
 	}
 }
 
+// Validate checks the image, hypervisor and storage backend combination
+func (c Config) Validate() error {
+	return vmspec.Validate(c.Image, c.Hypervisor, c.Storage, c.StorageSize)
+}
+
 type Deployer struct {
 	client *sdk.SlicerClient
 	config Config
@@ -76,7 +94,7 @@ func (d *Deployer) Deploy(ctx context.Context) (*sdk.SlicerCreateNodeResponse, e
 	req := sdk.SlicerCreateNodeRequest{
 		RamGB:    d.config.RAMGB,
 		CPUs:     d.config.VCPU,
-		Userdata: userdataScript,
+		Userdata: d.config.DNS.Apply(userdataScript),
 	}
 
 	if len(d.config.SSHKeys) > 0 {
@@ -119,7 +137,7 @@ func GenerateYAML(config Config, githubUser string) string {
 	return fmt.Sprintf(`config:
   host_groups:
   - name: %s
-    storage: image
+    storage: %s
     storage_size: %s
     count: 0
     vcpu: %d
@@ -131,13 +149,13 @@ func GenerateYAML(config Config, githubUser string) string {
 
   github_user: %s
 
-  image: "ghcr.io/openfaasltd/slicer-systemd:5.10.240-x86_64-latest"
+  image: "%s"
 
-  hypervisor: firecracker
+  hypervisor: %s
 
   api:
     port: 8080
     bind_address: "127.0.0.1"
-`, config.HostGroup, config.StorageSize, config.VCPU, config.RAMGB,
-		config.HostGroup, config.HostGroup, githubUser)
+`, config.HostGroup, config.Storage, config.StorageSize, config.VCPU, config.RAMGB,
+		config.HostGroup, config.HostGroup, githubUser, config.Image, config.Hypervisor)
 }
@@ -0,0 +1,250 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+// identifierPattern limits database and role names to unquoted PostgreSQL
+// identifiers, so they can be interpolated into SQL safely
+var identifierPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// hbaEnvFile records the pg_hba connection type and networks userdata used
+const hbaEnvFile = "/etc/postgresql/hba.env"
+
+// psqlCommand runs psql as the postgres superuser with unaligned,
+// tuples-only output, stopping on the first error
+const psqlCommand = "cd /tmp && sudo -u postgres psql -X -A -t -v ON_ERROR_STOP=1"
+
+// Database describes a database on a running instance
+type Database struct {
+	Name  string
+	Owner string
+	Size  string
+}
+
+// CreateDB creates a database owned by dbUser on a running instance and allows
+// remote password logins for it. The role is created with password, or a
+// generated one when empty, and added to PgBouncer when it runs. An existing
+// role keeps its password and the returned DBPass is empty.
+func (d *Deployer) CreateDB(ctx context.Context, hostname, dbName, dbUser, password string) (*Credentials, error) {
+	if err := validIdentifier("database", dbName); err != nil {
+		return nil, err
+	}
+
+	exists, err := d.databaseExists(ctx, hostname, dbName)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("database %s already exists on %s", dbName, hostname)
+	}
+
+	password, err = d.ensureRole(ctx, hostname, dbUser, password)
+	if err != nil {
+		return nil, err
+	}
+
+	sql := fmt.Sprintf("CREATE DATABASE %s WITH OWNER %s TEMPLATE template0 ENCODING UTF8 LC_COLLATE 'en_US.UTF-8' LC_CTYPE 'en_US.UTF-8';\n"+
+		"GRANT ALL PRIVILEGES ON DATABASE %s TO %s;", dbName, dbUser, dbName, dbUser)
+	if _, err := d.psql(ctx, hostname, "postgres", sql); err != nil {
+		return nil, fmt.Errorf("failed to create database %s: %w", dbName, err)
+	}
+
+	if err := d.allowHost(ctx, hostname, dbName, dbUser); err != nil {
+		return nil, err
+	}
+	if password != "" {
+		if err := d.addPoolUser(ctx, hostname, dbUser, password); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Credentials{
+		DBName: dbName,
+		DBUser: dbUser,
+		DBPass: password,
+	}, nil
+}
+
+// DropDB terminates connections to a database and drops it, along with its
+// pg_hba entries. Roles are left in place since they may own other databases.
+func (d *Deployer) DropDB(ctx context.Context, hostname, dbName string) error {
+	if err := validIdentifier("database", dbName); err != nil {
+		return err
+	}
+
+	exists, err := d.databaseExists(ctx, hostname, dbName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("database %s not found on %s", dbName, hostname)
+	}
+
+	if _, err := d.psql(ctx, hostname, "postgres", fmt.Sprintf("DROP DATABASE %s WITH (FORCE);", dbName)); err != nil {
+		return fmt.Errorf("failed to drop database %s: %w", dbName, err)
+	}
+
+	script := fmt.Sprintf(`HBA=$(%s -c 'SHOW hba_file')
+sed -i -E '/^(local|host|hostssl)[[:space:]]+%s[[:space:]]/d' "$HBA"
+systemctl reload postgresql`, psqlCommand, dbName)
+	if _, err := vmexec.Run(ctx, d.client, hostname, script); err != nil {
+		return fmt.Errorf("failed to remove pg_hba entries for %s: %w", dbName, err)
+	}
+
+	return nil
+}
+
+// ListDBs returns the non-template databases on a running instance
+func (d *Deployer) ListDBs(ctx context.Context, hostname string) ([]Database, error) {
+	out, err := d.psql(ctx, hostname, "postgres", `SELECT datname, pg_get_userbyid(datdba), pg_size_pretty(pg_database_size(datname))
+FROM pg_database WHERE NOT datistemplate ORDER BY datname;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+
+	var dbs []Database
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) != 3 {
+			continue
+		}
+		dbs = append(dbs, Database{Name: fields[0], Owner: fields[1], Size: fields[2]})
+	}
+	return dbs, nil
+}
+
+// GrantRole gives dbUser read/write access to an existing database, creating
+// the role when it does not exist. Credentials follow the same rules as CreateDB.
+func (d *Deployer) GrantRole(ctx context.Context, hostname, dbName, dbUser, password string) (*Credentials, error) {
+	if err := validIdentifier("database", dbName); err != nil {
+		return nil, err
+	}
+
+	exists, err := d.databaseExists(ctx, hostname, dbName)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("database %s not found on %s", dbName, hostname)
+	}
+
+	password, err = d.ensureRole(ctx, hostname, dbUser, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := d.psql(ctx, hostname, "postgres", fmt.Sprintf("GRANT CONNECT, TEMPORARY ON DATABASE %s TO %s;", dbName, dbUser)); err != nil {
+		return nil, fmt.Errorf("failed to grant access to %s: %w", dbName, err)
+	}
+
+	// Schema and table privileges are per database. Default privileges only
+	// apply to objects created by the role they are set for, which is the
+	// database owner that runs the application's migrations, not the
+	// postgres role psql connects as.
+	sql := fmt.Sprintf(`GRANT USAGE, CREATE ON SCHEMA public TO %[1]s;
+GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO %[1]s;
+GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO %[1]s;
+SELECT format('ALTER DEFAULT PRIVILEGES FOR ROLE %%I IN SCHEMA public GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO %%I', pg_get_userbyid(datdba), '%[1]s'),
+  format('ALTER DEFAULT PRIVILEGES FOR ROLE %%I IN SCHEMA public GRANT USAGE, SELECT ON SEQUENCES TO %%I', pg_get_userbyid(datdba), '%[1]s')
+FROM pg_database WHERE datname = current_database()
+\gexec`, dbUser)
+	if _, err := d.psql(ctx, hostname, dbName, sql); err != nil {
+		return nil, fmt.Errorf("failed to grant schema privileges on %s: %w", dbName, err)
+	}
+
+	if err := d.allowHost(ctx, hostname, dbName, dbUser); err != nil {
+		return nil, err
+	}
+	if password != "" {
+		if err := d.addPoolUser(ctx, hostname, dbUser, password); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Credentials{
+		DBName: dbName,
+		DBUser: dbUser,
+		DBPass: password,
+	}, nil
+}
+
+// ensureRole creates a login role when missing and returns its password, or
+// "" when the role already existed
+func (d *Deployer) ensureRole(ctx context.Context, hostname, dbUser, password string) (string, error) {
+	if err := validIdentifier("role", dbUser); err != nil {
+		return "", err
+	}
+
+	out, err := d.psql(ctx, hostname, "postgres", fmt.Sprintf("SELECT 1 FROM pg_roles WHERE rolname = '%s';", dbUser))
+	if err != nil {
+		return "", fmt.Errorf("failed to look up role %s: %w", dbUser, err)
+	}
+	if strings.TrimSpace(out) == "1" {
+		return "", nil
+	}
+
+	if password == "" {
+		password, err = GeneratePassword(24)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate password: %w", err)
+		}
+	}
+
+	sql := fmt.Sprintf("CREATE ROLE %s WITH LOGIN PASSWORD '%s';", dbUser, strings.ReplaceAll(password, "'", "''"))
+	if _, err := d.psql(ctx, hostname, "postgres", sql); err != nil {
+		return "", fmt.Errorf("failed to create role %s: %w", dbUser, err)
+	}
+	return password, nil
+}
+
+func (d *Deployer) databaseExists(ctx context.Context, hostname, dbName string) (bool, error) {
+	out, err := d.psql(ctx, hostname, "postgres", fmt.Sprintf("SELECT 1 FROM pg_database WHERE datname = '%s';", dbName))
+	if err != nil {
+		return false, fmt.Errorf("failed to look up database %s: %w", dbName, err)
+	}
+	return strings.TrimSpace(out) == "1", nil
+}
+
+// allowHost adds local and remote scram-sha-256 pg_hba entries for a
+// database and role, matching the ones userdata creates, then reloads.
+// Remote entries use the connection type and networks userdata recorded in
+// hbaEnvFile, so instances with TLS only get hostssl entries.
+func (d *Deployer) allowHost(ctx context.Context, hostname, dbName, dbUser string) error {
+	script := fmt.Sprintf(`HBA=$(%[1]s -c 'SHOW hba_file')
+HBA_TYPE=host
+HBA_CIDRS=0.0.0.0/0
+if [ -f %[4]s ]; then . %[4]s; fi
+lines=("local   %[2]s    %[3]s    scram-sha-256")
+for cidr in $HBA_CIDRS; do
+  lines+=("${HBA_TYPE}    %[2]s    %[3]s    ${cidr}    scram-sha-256")
+done
+for line in "${lines[@]}"; do
+  grep -qxF "$line" "$HBA" || echo "$line" >> "$HBA"
+done
+systemctl reload postgresql`, psqlCommand, dbName, dbUser, hbaEnvFile)
+
+	if _, err := vmexec.Run(ctx, d.client, hostname, script); err != nil {
+		return fmt.Errorf("failed to update pg_hba for %s: %w", dbName, err)
+	}
+	return nil
+}
+
+// psql runs SQL as the postgres superuser against a database on the VM and
+// returns unaligned, tuples-only output
+func (d *Deployer) psql(ctx context.Context, hostname, dbName, sql string) (string, error) {
+	script := fmt.Sprintf("%s -d %s <<'SQL'\n%s\nSQL", psqlCommand, dbName, sql)
+	return vmexec.Run(ctx, d.client, hostname, script)
+}
+
+func validIdentifier(kind, name string) error {
+	if !identifierPattern.MatchString(name) {
+		return fmt.Errorf("invalid %s name %q: use lowercase letters, digits and underscores", kind, name)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+const (
+	DefaultBackupBucket   = "postgres-backups"
+	DefaultBackupSchedule = "daily"
+	DefaultBackupRetain   = 7
+	DefaultWALGVersion    = "3.0.5"
+)
+
+// BackupConfig enables WAL archiving and scheduled base backups to an S3
+// bucket with WAL-G. Each instance writes under its hostname in the bucket.
+type BackupConfig struct {
+	Endpoint  string // S3 endpoint host:port, backups are disabled when empty
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	Schedule  string // systemd OnCalendar expression for base backups
+	Retain    int    // Number of full backups to keep
+	Version   string // WAL-G version
+	// CACert is the PEM CA the endpoint's certificate is verified against,
+	// e.g. the playground CA of a RustFS VM serving TLS
+	CACert string
+}
+
+func DefaultBackupConfig() BackupConfig {
+	return BackupConfig{
+		Bucket:   DefaultBackupBucket,
+		Schedule: DefaultBackupSchedule,
+		Retain:   DefaultBackupRetain,
+		Version:  DefaultWALGVersion,
+	}
+}
+
+// Enabled reports whether backups are configured
+func (b BackupConfig) Enabled() bool {
+	return b.Endpoint != ""
+}
+
+// Validate checks that an enabled backup config is complete
+func (b BackupConfig) Validate() error {
+	if !b.Enabled() {
+		return nil
+	}
+	if b.AccessKey == "" || b.SecretKey == "" {
+		return fmt.Errorf("backup access key and secret key are required")
+	}
+	if b.Bucket == "" {
+		return fmt.Errorf("backup bucket is required")
+	}
+	if b.Retain < 1 {
+		return fmt.Errorf("backup retention must keep at least one full backup")
+	}
+	return nil
+}
+
+// Backup is a base backup stored in the bucket
+type Backup struct {
+	Name             string    `json:"backup_name"`
+	Time             time.Time `json:"time"`
+	StartTime        time.Time `json:"start_time"`
+	FinishTime       time.Time `json:"finish_time"`
+	WALFileName      string    `json:"wal_file_name"`
+	CompressedSize   int64     `json:"compressed_size"`
+	UncompressedSize int64     `json:"uncompressed_size"`
+}
+
+// Backup takes a base backup now and returns the newest backup afterwards
+func (d *Deployer) Backup(ctx context.Context, hostname string) (*Backup, error) {
+	if _, err := vmexec.Run(ctx, d.client, hostname, "systemctl start wal-g-backup.service"); err != nil {
+		return nil, fmt.Errorf("failed to run base backup on %s (was it deployed with backups enabled?): %w", hostname, err)
+	}
+
+	backups, err := d.Backups(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("base backup on %s finished but none is listed", hostname)
+	}
+	return &backups[len(backups)-1], nil
+}
+
+// Backups lists the base backups of an instance, oldest first
+func (d *Deployer) Backups(ctx context.Context, hostname string) ([]Backup, error) {
+	out, err := vmexec.Run(ctx, d.client, hostname,
+		"sudo -u postgres /usr/local/bin/wal-g-env /etc/wal-g/env backup-list --json --detail")
+	if err != nil {
+		// WAL-G reports an empty bucket prefix as an error
+		if strings.Contains(err.Error(), "No backups found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list backups on %s: %w", hostname, err)
+	}
+
+	if strings.TrimSpace(out) == "" {
+		return nil, nil
+	}
+
+	var backups []Backup
+	if err := json.Unmarshal([]byte(out), &backups); err != nil {
+		return nil, fmt.Errorf("failed to parse backup list: %w", err)
+	}
+	return backups, nil
+}
+
+// Restore creates a new VM from the backups of sourceHostname, replaying WAL
+// up to target, or to the end of the archive when target is zero. The new VM
+// keeps the roles and passwords of the source and archives under its own
+// hostname. The source VM does not need to be running.
+func (d *Deployer) Restore(ctx context.Context, sourceHostname string, target time.Time) (*sdk.SlicerCreateNodeResponse, error) {
+	if !d.config.Backup.Enabled() {
+		return nil, fmt.Errorf("backups are not configured, the restored VM needs the bucket to read from")
+	}
+	if err := d.config.Backup.Validate(); err != nil {
+		return nil, err
+	}
+
+	targetTime := ""
+	if !target.IsZero() {
+		targetTime = target.UTC().Format(time.RFC3339)
+	}
+
+	userdata := generateUserdata(d.config.dbName(), d.config.dbUser(), "")
+	userdata = backupUserdata(userdata, d.config.Backup, sourceHostname, targetTime)
+	// The replication role comes from the backup, its password is not known here
+	userdata = replicationUserdata(userdata, d.config.replicationUser(), "", "")
+	userdata = migrateUserdata(userdata, "")
+	userdata = pgbouncerUserdata(userdata, pgbouncerSetup{})
+	userdata, err := tuningUserdata(userdata, d.config)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.create(ctx, userdata, d.config.Tags)
+}
+
+// backupUserdata replaces the backup and restore placeholders in userdata
+func backupUserdata(userdata string, backup BackupConfig, restoreFrom, restoreTargetTime string) string {
+	scheme := "http"
+	if backup.UseSSL {
+		scheme = "https"
+	}
+
+	userdata = strings.ReplaceAll(userdata, "{{BACKUP_S3_ENDPOINT}}", backup.Endpoint)
+	userdata = strings.ReplaceAll(userdata, "{{BACKUP_S3_SCHEME}}", scheme)
+	userdata = strings.ReplaceAll(userdata, "{{BACKUP_S3_BUCKET}}", backup.Bucket)
+	userdata = strings.ReplaceAll(userdata, "{{BACKUP_S3_ACCESS_KEY}}", backup.AccessKey)
+	userdata = strings.ReplaceAll(userdata, "{{BACKUP_S3_SECRET_KEY}}", backup.SecretKey)
+	userdata = strings.ReplaceAll(userdata, "{{BACKUP_S3_CA_CERT}}", strings.TrimSpace(backup.CACert))
+	userdata = strings.ReplaceAll(userdata, "{{BACKUP_SCHEDULE}}", backup.Schedule)
+	userdata = strings.ReplaceAll(userdata, "{{BACKUP_RETAIN}}", fmt.Sprintf("%d", backup.Retain))
+	userdata = strings.ReplaceAll(userdata, "{{WALG_VERSION}}", backup.Version)
+	userdata = strings.ReplaceAll(userdata, "{{RESTORE_FROM}}", restoreFrom)
+	userdata = strings.ReplaceAll(userdata, "{{RESTORE_TARGET_TIME}}", restoreTargetTime)
+	return userdata
+}
@@ -0,0 +1,208 @@
+package postgres
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+// CloneResult describes a database copied between instances
+type CloneResult struct {
+	DBName    string
+	Owner     string
+	DumpBytes int64
+	// Tables is the number of tables whose row counts were compared
+	Tables int
+	// OwnerPass is set when the owner role was created on the destination
+	OwnerPass string
+}
+
+// Dump streams a custom-format pg_dump of a database to w over the exec
+// endpoint and returns the number of bytes written. Restore it with
+// pg_restore. Exec output is text, so the dump travels base64-encoded.
+func (d *Deployer) Dump(ctx context.Context, hostname, dbName string, w io.Writer) (int64, error) {
+	if err := validIdentifier("database", dbName); err != nil {
+		return 0, err
+	}
+	exists, err := d.databaseExists(ctx, hostname, dbName)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, fmt.Errorf("database %s not found on %s", dbName, hostname)
+	}
+
+	pr, pw := io.Pipe()
+	type copied struct {
+		n   int64
+		err error
+	}
+	done := make(chan copied, 1)
+	go func() {
+		n, err := io.Copy(w, base64.NewDecoder(base64.StdEncoding, pr))
+		pr.CloseWithError(err)
+		done <- copied{n, err}
+	}()
+
+	script := fmt.Sprintf("set -o pipefail\ncd /tmp && sudo -u postgres pg_dump -Fc %s | base64 -w 76", dbName)
+	streamErr := vmexec.Stream(ctx, d.client, hostname, script, pw)
+	pw.CloseWithError(streamErr)
+
+	result := <-done
+	if streamErr != nil {
+		return result.n, fmt.Errorf("failed to dump %s on %s: %w", dbName, hostname, streamErr)
+	}
+	if result.err != nil {
+		return result.n, fmt.Errorf("failed to decode dump of %s: %w", dbName, result.err)
+	}
+	return result.n, nil
+}
+
+// LoadSQL runs a plain SQL file from the local disk against a database as
+// role, so the objects it creates belong to the role
+func (d *Deployer) LoadSQL(ctx context.Context, hostname, dbName, role, localPath string) error {
+	if err := validIdentifier("database", dbName); err != nil {
+		return err
+	}
+	if err := validIdentifier("role", role); err != nil {
+		return err
+	}
+
+	remote := fmt.Sprintf("/tmp/load-%s.sql", dbName)
+	if err := d.client.CpToVM(ctx, hostname, localPath, remote, 0, 0); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", localPath, hostname, err)
+	}
+	script := fmt.Sprintf("chmod 644 %[1]s && %[2]s -d %[3]s -c 'SET ROLE %[4]s' -f %[1]s > /dev/null; rc=$?; rm -f %[1]s; exit $rc",
+		remote, psqlCommand, dbName, role)
+	if _, err := vmexec.Run(ctx, d.client, hostname, script); err != nil {
+		return fmt.Errorf("failed to load %s into %s on %s: %w", localPath, dbName, hostname, err)
+	}
+	return nil
+}
+
+// Clone copies a database from one instance to another, replacing it on the
+// destination when replace is set. The existing database is only dropped once
+// the dump is on the destination. The owner role is created on the
+// destination with password, or a generated one, when missing. Row counts of
+// every table are taken in the dump's snapshot and compared afterwards, so
+// writes to the source during the clone do not count as differences.
+func (d *Deployer) Clone(ctx context.Context, source, dest, dbName, password string, replace bool, w io.Writer) (*CloneResult, error) {
+	if err := validIdentifier("database", dbName); err != nil {
+		return nil, err
+	}
+
+	dbs, err := d.ListDBs(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	result := &CloneResult{DBName: dbName}
+	for _, db := range dbs {
+		if db.Name == dbName {
+			result.Owner = db.Owner
+		}
+	}
+	if result.Owner == "" {
+		return nil, fmt.Errorf("database %s not found on %s", dbName, source)
+	}
+
+	exists, err := d.databaseExists(ctx, dest, dbName)
+	if err != nil {
+		return nil, err
+	}
+	if exists && !replace {
+		return nil, fmt.Errorf("database %s already exists on %s", dbName, dest)
+	}
+
+	dumpPath := fmt.Sprintf("/tmp/clone-%s.dump", dbName)
+	fmt.Fprintf(w, "Dumping %s on %s...\n", dbName, source)
+	out, err := vmexec.Run(ctx, d.client, source, snapshotDumpScript(dbName, dumpPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump %s on %s: %w", dbName, source, err)
+	}
+	want, err := parseRowCounts(out)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if _, err := vmexec.Run(ctx, d.client, source, "rm -f "+dumpPath); err != nil {
+			fmt.Fprintf(w, "Warning: failed to remove %s on %s: %v\n", dumpPath, source, err)
+		}
+	}()
+
+	result.DumpBytes, err = d.copyBetween(ctx, source, dumpPath, dest, dumpPath)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(w, "Copied %.1f MiB dump to %s\n", float64(result.DumpBytes)/(1<<20), dest)
+
+	if exists {
+		fmt.Fprintf(w, "Dropping %s on %s...\n", dbName, dest)
+		if err := d.DropDB(ctx, dest, dbName); err != nil {
+			return nil, err
+		}
+	}
+
+	creds, err := d.CreateDB(ctx, dest, dbName, result.Owner, password)
+	if err != nil {
+		return nil, err
+	}
+	result.OwnerPass = creds.DBPass
+
+	// Objects are restored as the owner, so grants to roles missing on the
+	// destination are skipped
+	fmt.Fprintf(w, "Restoring %s on %s...\n", dbName, dest)
+	if _, err := vmexec.Run(ctx, d.client, dest,
+		fmt.Sprintf("chmod 644 %[1]s && cd /tmp && sudo -u postgres pg_restore --no-owner --no-acl --role=%[2]s -d %[3]s %[1]s; rc=$?; rm -f %[1]s; exit $rc",
+			dumpPath, result.Owner, dbName)); err != nil {
+		return result, fmt.Errorf("failed to restore %s on %s: %w", dbName, dest, err)
+	}
+
+	fmt.Fprintf(w, "Comparing row counts...\n")
+	got, err := d.rowCounts(ctx, dest, dbName)
+	if err != nil {
+		return result, err
+	}
+	for table, count := range want {
+		if got[table] != count {
+			return result, fmt.Errorf("row counts differ after clone: %s had %d rows in the dump of %s, %d on %s", table, count, source, got[table], dest)
+		}
+	}
+	result.Tables = len(want)
+	return result, nil
+}
+
+// snapshotDumpScript dumps a database to path and prints the row count of
+// every table, both from one snapshot. A psql session holds the snapshot open
+// through a fifo while pg_dump and the counting session import it.
+func snapshotDumpScript(dbName, path string) string {
+	return fmt.Sprintf(`set -eo pipefail
+cd /tmp
+dir=$(mktemp -d)
+trap 'exec 3>&- 2>/dev/null || true; rm -rf "$dir"' EXIT
+mkfifo "$dir/in"
+sudo -u postgres psql -X -q -A -t -v ON_ERROR_STOP=1 -d %[1]s < "$dir/in" > "$dir/snapshot" &
+exec 3> "$dir/in"
+echo "BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY; SELECT pg_export_snapshot();" >&3
+for i in $(seq 1 100); do
+  [ -s "$dir/snapshot" ] && break
+  sleep 0.1
+done
+snapshot=$(head -n 1 "$dir/snapshot")
+if [ -z "$snapshot" ]; then
+  echo "failed to export a snapshot of %[1]s" >&2
+  exit 1
+fi
+sudo -u postgres pg_dump -Fc --snapshot="$snapshot" -f %[2]s %[1]s
+%[3]s -d %[1]s <<SQL
+BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY;
+SET TRANSACTION SNAPSHOT '$snapshot';
+%[4]s
+COMMIT;
+SQL
+echo "COMMIT;" >&3
+exec 3>&-
+wait`, dbName, path, psqlCommand, rowCountSQL)
+}
@@ -0,0 +1,34 @@
+package postgres
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRowCounts(t *testing.T) {
+	got, err := parseRowCounts("BEGIN\nSET\npublic.users|3\ngitea.action|0\nCOMMIT\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["public.users"] != 3 || got["gitea.action"] != 0 {
+		t.Errorf("parseRowCounts() = %v", got)
+	}
+
+	if _, err := parseRowCounts("public.users|x\n"); err == nil {
+		t.Error("parseRowCounts() accepted a non-numeric count")
+	}
+}
+
+func TestSnapshotDumpScript(t *testing.T) {
+	script := snapshotDumpScript("gitea", "/tmp/clone-gitea.dump")
+	for _, want := range []string{
+		"pg_export_snapshot()",
+		`pg_dump -Fc --snapshot="$snapshot" -f /tmp/clone-gitea.dump gitea`,
+		"SET TRANSACTION SNAPSHOT '$snapshot';",
+		rowCountSQL,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script is missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+// PoolMode is when PgBouncer returns a server connection to the pool
+type PoolMode string
+
+const (
+	// PoolModeSession keeps a server connection until the client disconnects
+	PoolModeSession PoolMode = "session"
+	// PoolModeTransaction returns the server connection after each transaction
+	PoolModeTransaction PoolMode = "transaction"
+	// PoolModeStatement returns the server connection after each statement
+	PoolModeStatement PoolMode = "statement"
+)
+
+const (
+	DefaultPgBouncerPort = 6432
+	DefaultPoolMode      = PoolModeTransaction
+	DefaultPoolSize      = 20
+	DefaultMaxClientConn = 1000
+	// PgBouncerTag marks primaries that run PgBouncer, for discovery
+	PgBouncerTag = "pgbouncer"
+	// PgBouncerPortTagPrefix followed by the port publishes where PgBouncer
+	// listens, for discovery
+	PgBouncerPortTagPrefix = "pgbouncer-port-"
+	PgBouncerIni           = "/etc/pgbouncer/pgbouncer.ini"
+	// PgBouncerUserlist holds the roles PgBouncer authenticates clients as
+	PgBouncerUserlist = "/etc/pgbouncer/userlist.txt"
+)
+
+// listenPortPattern matches the port in pgbouncer.ini
+var listenPortPattern = regexp.MustCompile(`(?m)^listen_port\s*=\s*(\d+)\s*$`)
+
+// pgbouncerSetup is what a new VM needs to run PgBouncer, the zero value
+// leaves pooling disabled
+type pgbouncerSetup struct {
+	Port     int
+	Ini      string
+	Userlist string
+}
+
+// PgBouncerConfig configures connection pooling on the primary
+type PgBouncerConfig struct {
+	Port     int // Port PgBouncer listens on, pooling is disabled when 0
+	PoolMode PoolMode
+	// PoolSize is the number of server connections per database and role
+	PoolSize      int
+	MaxClientConn int
+}
+
+// DefaultPgBouncerConfig returns pooling settings with PgBouncer disabled
+func DefaultPgBouncerConfig() PgBouncerConfig {
+	return PgBouncerConfig{
+		PoolMode:      DefaultPoolMode,
+		PoolSize:      DefaultPoolSize,
+		MaxClientConn: DefaultMaxClientConn,
+	}
+}
+
+// Enabled reports whether PgBouncer is configured
+func (p PgBouncerConfig) Enabled() bool {
+	return p.Port != 0
+}
+
+// Validate checks the pooling settings when PgBouncer is enabled
+func (p PgBouncerConfig) Validate() error {
+	if !p.Enabled() {
+		return nil
+	}
+	if p.Port < 1 || p.Port > 65535 || p.Port == DefaultPort {
+		return fmt.Errorf("invalid pgbouncer port %d, use a free port other than %d", p.Port, DefaultPort)
+	}
+	switch p.PoolMode {
+	case PoolModeSession, PoolModeTransaction, PoolModeStatement:
+	default:
+		return fmt.Errorf("unknown pgbouncer pool mode %q, use session, transaction or statement", p.PoolMode)
+	}
+	if p.PoolSize < 1 {
+		return fmt.Errorf("pgbouncer pool size must be at least 1")
+	}
+	if p.MaxClientConn < p.PoolSize {
+		return fmt.Errorf("pgbouncer max client connections must be at least the pool size")
+	}
+	return nil
+}
+
+// Ini renders pgbouncer.ini. PgBouncer reaches PostgreSQL over loopback TCP
+// with the client's password, the unix socket would apply peer auth as the
+// postgres OS user. With TLS, clients must use the server certificate
+// PostgreSQL serves.
+func (p PgBouncerConfig) Ini(tls bool) string {
+	var b strings.Builder
+	b.WriteString("[databases]\n")
+	fmt.Fprintf(&b, "* = host=127.0.0.1 port=%d\n\n", DefaultPort)
+	b.WriteString("[pgbouncer]\n")
+	b.WriteString("listen_addr = *\n")
+	fmt.Fprintf(&b, "listen_port = %d\n", p.Port)
+	b.WriteString("unix_socket_dir = /var/run/postgresql\n")
+	b.WriteString("auth_type = scram-sha-256\n")
+	fmt.Fprintf(&b, "auth_file = %s\n", PgBouncerUserlist)
+	fmt.Fprintf(&b, "pool_mode = %s\n", p.PoolMode)
+	fmt.Fprintf(&b, "default_pool_size = %d\n", p.PoolSize)
+	fmt.Fprintf(&b, "max_client_conn = %d\n", p.MaxClientConn)
+	if p.PoolMode != PoolModeSession {
+		// Protocol-level prepared statements, as most drivers use, survive
+		// server connection changes
+		b.WriteString("max_prepared_statements = 100\n")
+	}
+	b.WriteString("ignore_startup_parameters = extra_float_digits\n")
+	b.WriteString("admin_users = postgres\n")
+	b.WriteString("logfile = /var/log/postgresql/pgbouncer.log\n")
+	b.WriteString("pidfile = /var/run/postgresql/pgbouncer.pid\n")
+	if tls {
+		b.WriteString("client_tls_sslmode = require\n")
+		fmt.Fprintf(&b, "client_tls_cert_file = %s/server.crt\n", TLSDir)
+		fmt.Fprintf(&b, "client_tls_key_file = %s/server.key\n", TLSDir)
+		fmt.Fprintf(&b, "client_tls_ca_file = %s/ca.crt\n", TLSDir)
+	}
+	return b.String()
+}
+
+// Userlist renders a PgBouncer auth file for the given roles
+func Userlist(creds ...Credentials) string {
+	var b strings.Builder
+	for _, c := range creds {
+		b.WriteString(userlistLine(c.DBUser, c.DBPass))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// setup renders the PgBouncer files of a new primary
+func (p PgBouncerConfig) setup(tls bool, creds ...Credentials) pgbouncerSetup {
+	if !p.Enabled() {
+		return pgbouncerSetup{}
+	}
+	return pgbouncerSetup{Port: p.Port, Ini: p.Ini(tls), Userlist: Userlist(creds...)}
+}
+
+// pgbouncerSetupOf reads the PgBouncer files of a running VM, so standbys and
+// upgrade targets pool the same way once they become the primary. The zero
+// value is returned when the VM does not run PgBouncer.
+func (d *Deployer) pgbouncerSetupOf(ctx context.Context, hostname string) (pgbouncerSetup, error) {
+	const separator = "--- userlist ---"
+	script := fmt.Sprintf(`[ -f %[1]s ] || exit 0
+cat %[1]s
+echo '%[3]s'
+cat %[2]s`, PgBouncerIni, PgBouncerUserlist, separator)
+	out, err := vmexec.Run(ctx, d.client, hostname, script)
+	if err != nil {
+		return pgbouncerSetup{}, fmt.Errorf("failed to read pgbouncer config on %s: %w", hostname, err)
+	}
+	if strings.TrimSpace(out) == "" {
+		return pgbouncerSetup{}, nil
+	}
+
+	ini, userlist, ok := strings.Cut(out, separator+"\n")
+	if !ok {
+		return pgbouncerSetup{}, fmt.Errorf("failed to read pgbouncer userlist on %s", hostname)
+	}
+	match := listenPortPattern.FindStringSubmatch(ini)
+	if match == nil {
+		return pgbouncerSetup{}, fmt.Errorf("no listen_port in %s on %s", PgBouncerIni, hostname)
+	}
+	port, err := strconv.Atoi(match[1])
+	if err != nil {
+		return pgbouncerSetup{}, fmt.Errorf("failed to parse pgbouncer port %q: %w", match[1], err)
+	}
+	return pgbouncerSetup{Port: port, Ini: ini, Userlist: userlist}, nil
+}
+
+// pgbouncerTags adds the PgBouncer tags, with the port for discovery, when
+// the VM pools connections
+func pgbouncerTags(tags []string, port int) []string {
+	if port == 0 {
+		return tags
+	}
+	return append(append([]string{}, tags...), PgBouncerTag, PgBouncerPortTagPrefix+strconv.Itoa(port))
+}
+
+// addPoolUser adds a role to PgBouncer's auth file when the instance runs
+// PgBouncer, so the role can log in through the pool
+func (d *Deployer) addPoolUser(ctx context.Context, hostname, dbUser, password string) error {
+	script := fmt.Sprintf(`[ -f %[1]s ] || exit 0
+sed -i '/^"%[2]s" /d' %[1]s
+echo %[3]s >> %[1]s
+systemctl reload pgbouncer`, PgBouncerUserlist, dbUser, shellQuote(userlistLine(dbUser, password)))
+	if _, err := vmexec.Run(ctx, d.client, hostname, script); err != nil {
+		return fmt.Errorf("failed to add %s to pgbouncer on %s: %w", dbUser, hostname, err)
+	}
+	return nil
+}
+
+// pgbouncerUserdata replaces the PgBouncer placeholders in userdata, leaving
+// the port empty when pooling is disabled
+func pgbouncerUserdata(userdata string, s pgbouncerSetup) string {
+	port, ini, userlist := "", "", ""
+	if s.Port != 0 {
+		port = strconv.Itoa(s.Port)
+		ini = strings.TrimSuffix(s.Ini, "\n")
+		userlist = strings.TrimSuffix(s.Userlist, "\n")
+	}
+	userdata = strings.ReplaceAll(userdata, "{{PGBOUNCER_PORT}}", port)
+	userdata = strings.ReplaceAll(userdata, "{{PGBOUNCER_INI}}", ini)
+	userdata = strings.ReplaceAll(userdata, "{{PGBOUNCER_USERLIST}}", userlist)
+	return userdata
+}
+
+// userlistLine quotes a role and password the way PgBouncer's auth file expects
+func userlistLine(user, password string) string {
+	return fmt.Sprintf(`"%s" "%s"`, strings.ReplaceAll(user, `"`, `""`), strings.ReplaceAll(password, `"`, `""`))
+}
+
+// shellQuote wraps s in single quotes for bash
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,108 @@
+package postgres
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPgBouncerIni(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  PgBouncerConfig
+		tls     bool
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "transaction pooling",
+			config:  PgBouncerConfig{Port: 6432, PoolMode: PoolModeTransaction, PoolSize: 20, MaxClientConn: 1000},
+			want:    []string{"* = host=127.0.0.1 port=5432\n", "listen_port = 6432\n", "pool_mode = transaction\n", "default_pool_size = 20\n", "max_client_conn = 1000\n", "max_prepared_statements = 100\n"},
+			notWant: []string{"/var/run/postgresql port", "client_tls_sslmode"},
+		},
+		{
+			name:    "session pooling keeps prepared statements on the server",
+			config:  PgBouncerConfig{Port: 7000, PoolMode: PoolModeSession, PoolSize: 5, MaxClientConn: 50},
+			want:    []string{"listen_port = 7000\n", "pool_mode = session\n"},
+			notWant: []string{"max_prepared_statements"},
+		},
+		{
+			name:   "tls",
+			config: PgBouncerConfig{Port: 6432, PoolMode: PoolModeTransaction, PoolSize: 20, MaxClientConn: 1000},
+			tls:    true,
+			want:   []string{"client_tls_sslmode = require\n", "client_tls_cert_file = " + TLSDir + "/server.crt\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ini := tt.config.Ini(tt.tls)
+			for _, s := range tt.want {
+				if !strings.Contains(ini, s) {
+					t.Errorf("Ini() is missing %q:\n%s", s, ini)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(ini, s) {
+					t.Errorf("Ini() contains %q:\n%s", s, ini)
+				}
+			}
+			if m := listenPortPattern.FindStringSubmatch(ini); m == nil || m[1] != strconv.Itoa(tt.config.Port) {
+				t.Errorf("listen_port not found in Ini(), got %v", m)
+			}
+		})
+	}
+}
+
+func TestUserlist(t *testing.T) {
+	got := Userlist(Credentials{DBUser: "gitea", DBPass: "p"}, Credentials{DBUser: `we"ird`, DBPass: `a"b`})
+	want := "\"gitea\" \"p\"\n\"we\"\"ird\" \"a\"\"b\"\n"
+	if got != want {
+		t.Errorf("Userlist() = %q, want %q", got, want)
+	}
+}
+
+func TestPgBouncerUserdata(t *testing.T) {
+	template := "PORT={{PGBOUNCER_PORT}}\n{{PGBOUNCER_INI}}\n{{PGBOUNCER_USERLIST}}\n"
+	tests := []struct {
+		name  string
+		setup pgbouncerSetup
+		want  string
+	}{
+		{
+			name: "disabled",
+			want: "PORT=\n\n\n",
+		},
+		{
+			name:  "enabled",
+			setup: pgbouncerSetup{Port: 6432, Ini: "[pgbouncer]\nlisten_port = 6432\n", Userlist: "\"u\" \"p\"\n"},
+			want:  "PORT=6432\n[pgbouncer]\nlisten_port = 6432\n\"u\" \"p\"\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pgbouncerUserdata(template, tt.setup); got != tt.want {
+				t.Errorf("pgbouncerUserdata() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPgBouncerTags(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []string
+		port int
+		want []string
+	}{
+		{name: "disabled", tags: []string{"postgres"}, want: []string{"postgres"}},
+		{name: "enabled", tags: []string{"postgres"}, port: 7000, want: []string{"postgres", PgBouncerTag, "pgbouncer-port-7000"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pgbouncerTags(tt.tags, tt.port)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("pgbouncerTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
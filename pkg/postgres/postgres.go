@@ -7,9 +7,14 @@ import (
 	"fmt"
 	"math/big"
 	"os"
+	"strconv"
 	"strings"
 
 	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/discovery"
+	"github.com/gaarutyunov/slicer/pkg/dns"
+	"github.com/gaarutyunov/slicer/pkg/vmspec"
 )
 
 //go:embed userdata.sh
@@ -23,6 +28,7 @@ const (
 	DefaultPort        = 5432
 	DefaultDBName      = "giteadb"
 	DefaultDBUser      = "gitea"
+	DefaultDataDir     = "/var/lib/postgresql"
 )
 
 // alphanumeric characters for password generation (no special chars)
@@ -36,10 +42,37 @@ type Config struct {
 	SSHKeys     []string
 	GitHubUser  string
 	Tags        []string
+	Image       string
+	Hypervisor  string
+	Storage     string
+	// DNS points the VM at the stack DNS server so configs can use names
+	DNS dns.Resolver
+	// Data volume: DataDir holds the database files, Persistent keeps the VM
+	// disk after deletion so the data survives VM replacement
+	DataDir    string
+	Persistent bool
 	// PostgreSQL specific
-	DBName string
-	DBUser string
-	DBPass string
+	// Version is the major version installed from the PGDG apt repository
+	Version int
+	DBName  string
+	DBUser  string
+	DBPass  string
+	// Profile selects the workload the settings are computed for, from the CPUs
+	// and memory the VM reports at boot
+	Profile Profile
+	// Backup configures WAL-G archiving, disabled unless Backup.Endpoint is set
+	Backup BackupConfig
+	// Standbys is the number of streaming replicas created with the primary.
+	// ReplicationPass is generated when empty.
+	Standbys        int
+	ReplicationUser string
+	ReplicationPass string
+	// TLS serves connections with a certificate from the playground CA,
+	// disabled unless TLS.CA is set
+	TLS TLSConfig
+	// PgBouncer pools connections on the primary, disabled unless
+	// PgBouncer.Port is set
+	PgBouncer PgBouncerConfig
 }
 
 // Credentials holds the generated PostgreSQL credentials
@@ -53,6 +86,9 @@ type Credentials struct {
 type DeployResponse struct {
 	*sdk.SlicerCreateNodeResponse
 	Credentials Credentials
+	// Replication is the role standbys connect as
+	Replication Credentials
+	Standbys    []*sdk.SlicerCreateNodeResponse
 }
 
 // GeneratePassword creates a cryptographically secure random alphanumeric password
@@ -74,25 +110,104 @@ func DefaultConfig() Config {
 		hostGroup = DefaultHostGroup
 	}
 
+	image, hypervisor, storage := vmspec.Default("POSTGRES")
+
 	return Config{
-		HostGroup:   hostGroup,
-		VCPU:        DefaultVCPU,
-		RAMGB:       DefaultRAMGB,
-		StorageSize: DefaultStorageSize,
-		Tags:        []string{"postgres"},
-		DBName:      DefaultDBName,
-		DBUser:      DefaultDBUser,
+		HostGroup:       hostGroup,
+		VCPU:            DefaultVCPU,
+		RAMGB:           DefaultRAMGB,
+		StorageSize:     DefaultStorageSize,
+		Image:           image,
+		Hypervisor:      hypervisor,
+		Storage:         storage,
+		Tags:            []string{"postgres"},
+		DataDir:         DefaultDataDir,
+		Persistent:      vmspec.SupportsPersistentDisk(storage),
+		DBName:          DefaultDBName,
+		DBUser:          DefaultDBUser,
+		Profile:         DefaultProfile,
+		Version:         DefaultVersion,
+		Backup:          DefaultBackupConfig(),
+		ReplicationUser: DefaultReplicationUser,
+		PgBouncer:       DefaultPgBouncerConfig(),
+	}
+}
+
+// Validate checks the image, hypervisor and storage backend combination
+func (c Config) Validate() error {
+	if err := vmspec.Validate(c.Image, c.Hypervisor, c.Storage, c.StorageSize); err != nil {
+		return err
+	}
+	if err := vmspec.ValidateDataVolume(c.Storage, c.Persistent); err != nil {
+		return err
+	}
+	if err := c.profile().Validate(); err != nil {
+		return err
+	}
+	if err := ValidateVersion(c.version()); err != nil {
+		return err
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return err
+	}
+	if err := c.PgBouncer.Validate(); err != nil {
+		return err
+	}
+	if c.Standbys < 0 {
+		return fmt.Errorf("standbys must not be negative")
+	}
+	if err := validIdentifier("role", c.replicationUser()); err != nil {
+		return err
 	}
+	return c.Backup.Validate()
+}
+
+func (c Config) dbName() string {
+	if c.DBName == "" {
+		return DefaultDBName
+	}
+	return c.DBName
+}
+
+func (c Config) dbUser() string {
+	if c.DBUser == "" {
+		return DefaultDBUser
+	}
+	return c.DBUser
+}
+
+func (c Config) version() int {
+	if c.Version == 0 {
+		return DefaultVersion
+	}
+	return c.Version
+}
+
+func (c Config) profile() Profile {
+	if c.Profile == "" {
+		return DefaultProfile
+	}
+	return c.Profile
+}
+
+func (c Config) replicationUser() string {
+	if c.ReplicationUser == "" {
+		return DefaultReplicationUser
+	}
+	return c.ReplicationUser
 }
 
 type Deployer struct {
 	client *sdk.SlicerClient
+	// api creates persistent VMs, which the SDK cannot size
+	api    vmspec.API
 	config Config
 }
 
 func NewDeployer(client *sdk.SlicerClient, config Config) *Deployer {
 	return &Deployer{
 		client: client,
+		api:    vmspec.APIFromEnv("slicer-postgres/1.0"),
 		config: config,
 	}
 }
@@ -109,6 +224,7 @@ func NewDeployerFromEnv(config Config) (*Deployer, error) {
 
 	return &Deployer{
 		client: client,
+		api:    vmspec.APIFromEnv("slicer-postgres/1.0"),
 		config: config,
 	}, nil
 }
@@ -124,23 +240,101 @@ func (d *Deployer) Deploy(ctx context.Context) (*DeployResponse, error) {
 		}
 	}
 
-	dbName := d.config.DBName
-	if dbName == "" {
-		dbName = DefaultDBName
+	if err := d.config.Backup.Validate(); err != nil {
+		return nil, err
+	}
+	if err := d.config.TLS.Validate(); err != nil {
+		return nil, err
+	}
+	if err := ValidateVersion(d.config.version()); err != nil {
+		return nil, err
+	}
+	if err := d.config.PgBouncer.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Every primary gets a replication role so standbys can be added later
+	replicationPass := d.config.ReplicationPass
+	if replicationPass == "" {
+		var err error
+		replicationPass, err = GeneratePassword(24)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate password: %w", err)
+		}
 	}
 
-	dbUser := d.config.DBUser
-	if dbUser == "" {
-		dbUser = DefaultDBUser
+	dbName := d.config.dbName()
+	dbUser := d.config.dbUser()
+	replicationUser := d.config.replicationUser()
+	if err := validIdentifier("role", replicationUser); err != nil {
+		return nil, err
 	}
 
 	// Generate userdata with credentials
 	userdata := generateUserdata(dbName, dbUser, password)
+	userdata = backupUserdata(userdata, d.config.Backup, "", "")
+	userdata = replicationUserdata(userdata, replicationUser, replicationPass, "")
+	userdata = migrateUserdata(userdata, "")
+	pooler := d.config.PgBouncer.setup(d.config.TLS.Enabled(), Credentials{DBName: dbName, DBUser: dbUser, DBPass: password})
+	userdata = pgbouncerUserdata(userdata, pooler)
+	userdata, err := tuningUserdata(userdata, d.config)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.create(ctx, userdata, pgbouncerTags(d.config.Tags, pooler.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	deployResp := &DeployResponse{
+		SlicerCreateNodeResponse: resp,
+		Credentials: Credentials{
+			DBName: dbName,
+			DBUser: dbUser,
+			DBPass: password,
+		},
+		Replication: Credentials{
+			DBName: "replication",
+			DBUser: replicationUser,
+			DBPass: replicationPass,
+		},
+	}
+
+	// Standbys retry pg_basebackup until the primary has finished installing
+	for i := 0; i < d.config.Standbys; i++ {
+		standby, err := d.createStandby(ctx, discovery.HostIP(resp.IP), replicationPass, pooler)
+		if err != nil {
+			return deployResp, fmt.Errorf("failed to create standby %d of %d: %w", i+1, d.config.Standbys, err)
+		}
+		deployResp.Standbys = append(deployResp.Standbys, standby)
+	}
 
+	return deployResp, nil
+}
+
+// create starts a VM with the given userdata and tags, on a persistent disk
+// when configured, and installs its server certificate when TLS is enabled
+func (d *Deployer) create(ctx context.Context, userdata string, tags []string) (*sdk.SlicerCreateNodeResponse, error) {
+	userdata = strings.ReplaceAll(userdata, "{{POSTGRES_VERSION}}", strconv.Itoa(d.config.version()))
+	resp, err := d.createVM(ctx, tlsUserdata(userdata, d.config.TLS), tags)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.config.TLS.Enabled() {
+		if err := d.installCert(ctx, resp); err != nil {
+			return nil, fmt.Errorf("failed to install server certificate on %s: %w", resp.Hostname, err)
+		}
+	}
+	return resp, nil
+}
+
+func (d *Deployer) createVM(ctx context.Context, userdata string, tags []string) (*sdk.SlicerCreateNodeResponse, error) {
 	req := sdk.SlicerCreateNodeRequest{
 		RamGB:    d.config.RAMGB,
 		CPUs:     d.config.VCPU,
-		Userdata: userdata,
+		Userdata: d.config.DNS.Apply(userdata),
 	}
 
 	if len(d.config.SSHKeys) > 0 {
@@ -151,23 +345,17 @@ func (d *Deployer) Deploy(ctx context.Context) (*DeployResponse, error) {
 		req.ImportUser = d.config.GitHubUser
 	}
 
-	if len(d.config.Tags) > 0 {
-		req.Tags = d.config.Tags
+	if len(tags) > 0 {
+		req.Tags = tags
 	}
 
-	resp, err := d.client.CreateNode(ctx, d.config.HostGroup, req)
-	if err != nil {
-		return nil, err
+	if d.config.Persistent {
+		if err := vmspec.ValidateDataVolume(d.config.Storage, d.config.Persistent); err != nil {
+			return nil, err
+		}
+		return d.api.CreateVM(ctx, d.config.HostGroup, vmspec.PersistentVMRequest(req, "", ""))
 	}
-
-	return &DeployResponse{
-		SlicerCreateNodeResponse: resp,
-		Credentials: Credentials{
-			DBName: dbName,
-			DBUser: dbUser,
-			DBPass: password,
-		},
-	}, nil
+	return d.client.CreateNode(ctx, d.config.HostGroup, req)
 }
 
 // generateUserdata replaces placeholders in the userdata template
@@ -184,6 +372,86 @@ func (d *Deployer) Delete(ctx context.Context, hostname string) error {
 	return err
 }
 
+// ReplaceOptions picks the disk and size of a replaced VM. The data volume is
+// the VM's root disk, so the OS image cannot change, only the size.
+type ReplaceOptions struct {
+	// DiskImage is the disk to re-attach, by default the one recorded in the
+	// VM's data-disk tag. A VM that was never replaced has no such tag.
+	DiskImage string
+	// VCPU and RAMGB size the new VM, zero uses the host group's
+	VCPU  int
+	RAMGB int
+}
+
+// Replace deletes a VM that has a data volume and recreates it on the same
+// disk and IP, optionally with a different size. The disk must be known and
+// kept before the VM is deleted.
+func (d *Deployer) Replace(ctx context.Context, hostname string, opts ReplaceOptions) (*sdk.SlicerCreateNodeResponse, error) {
+	nodes, err := d.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	var node *sdk.SlicerNode
+	for i := range nodes {
+		if nodes[i].Hostname == hostname {
+			node = &nodes[i]
+			break
+		}
+	}
+	if node == nil {
+		return nil, fmt.Errorf("VM %s not found in host group %s", hostname, d.config.HostGroup)
+	}
+
+	// Only VMs created persistent carry the tag, Slicer keeps their disk
+	persistent := false
+	for _, tag := range node.Tags {
+		if tag == vmspec.DataVolumeTag {
+			persistent = true
+		}
+	}
+	if !persistent {
+		return nil, fmt.Errorf("VM %s has no data volume, replacing it would lose its data", hostname)
+	}
+
+	disk := opts.DiskImage
+	if disk == "" {
+		disk = vmspec.DiskOf(node.Tags)
+	}
+	if disk == "" {
+		return nil, fmt.Errorf("VM %s does not record its data disk, name the disk Slicer keeps for it", hostname)
+	}
+
+	ip := node.IP
+	if idx := strings.Index(ip, "/"); idx != -1 {
+		ip = ip[:idx]
+	}
+
+	del, err := d.client.DeleteVM(ctx, d.config.HostGroup, hostname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete VM %s: %w", hostname, err)
+	}
+	if del.DiskRemoved != "" {
+		return nil, fmt.Errorf("slicer removed disk %s while deleting %s, data volume was not kept", del.DiskRemoved, hostname)
+	}
+
+	// PostgreSQL is already installed and enabled on the re-attached disk, so
+	// no userdata is needed
+	req := sdk.SlicerCreateNodeRequest{
+		RamGB:      opts.RAMGB,
+		CPUs:       opts.VCPU,
+		SSHKeys:    d.config.SSHKeys,
+		ImportUser: d.config.GitHubUser,
+		Tags:       node.Tags,
+	}
+
+	resp, err := d.api.CreateVM(ctx, d.config.HostGroup, vmspec.PersistentVMRequest(req, disk, ip))
+	if err != nil {
+		return nil, fmt.Errorf("failed to recreate %s on disk %s: %w", hostname, disk, err)
+	}
+	return resp, nil
+}
+
 func (d *Deployer) List(ctx context.Context) ([]sdk.SlicerNode, error) {
 	return d.client.GetHostGroupNodes(ctx, d.config.HostGroup)
 }
@@ -204,7 +472,7 @@ func GenerateYAML(config Config, githubUser string) string {
 	return fmt.Sprintf(`config:
   host_groups:
   - name: %s
-    storage: image
+    storage: %s
     storage_size: %s
     count: 0
     vcpu: %d
@@ -216,13 +484,13 @@ func GenerateYAML(config Config, githubUser string) string {
 
   github_user: %s
 
-  image: "ghcr.io/openfaasltd/slicer-systemd:5.10.240-x86_64-latest"
+  image: "%s"
 
-  hypervisor: firecracker
+  hypervisor: %s
 
   api:
     port: 8080
     bind_address: "127.0.0.1"
-`, config.HostGroup, config.StorageSize, config.VCPU, config.RAMGB,
-		config.HostGroup, config.HostGroup, githubUser)
+`, config.HostGroup, config.Storage, config.StorageSize, config.VCPU, config.RAMGB,
+		config.HostGroup, config.HostGroup, githubUser, config.Image, config.Hypervisor)
 }
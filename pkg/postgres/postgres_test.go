@@ -0,0 +1,50 @@
+package postgres
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var placeholderPattern = regexp.MustCompile(`\{\{[A-Z0-9_]+\}\}`)
+
+func TestUserdataPlaceholders(t *testing.T) {
+	config := DefaultConfig()
+	config.Backup.Endpoint = "rustfs.playground.slicer:9000"
+	config.Backup.AccessKey = "key"
+	config.Backup.SecretKey = "secret"
+	config.TLS.AllowCIDRs = []string{"192.168.137.0/24"}
+	pooler := PgBouncerConfig{Port: 6432, PoolMode: PoolModeTransaction, PoolSize: 20, MaxClientConn: 1000}.setup(false, Credentials{DBName: "app", DBUser: "app", DBPass: "p"})
+
+	tests := []struct {
+		name                              string
+		restoreFrom, primaryHost, migrate string
+		pooler                            pgbouncerSetup
+	}{
+		{name: "primary", pooler: pooler},
+		{name: "standby", primaryHost: "192.168.137.2", pooler: pooler},
+		{name: "restore", restoreFrom: "postgres-1"},
+		{name: "upgrade target", migrate: "postgres-1", pooler: pooler},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userdata := generateUserdata(config.dbName(), config.dbUser(), "p")
+			userdata = backupUserdata(userdata, config.Backup, tt.restoreFrom, "")
+			userdata = replicationUserdata(userdata, config.replicationUser(), "r", tt.primaryHost)
+			userdata = migrateUserdata(userdata, tt.migrate)
+			userdata = pgbouncerUserdata(userdata, tt.pooler)
+			userdata, err := tuningUserdata(userdata, config)
+			if err != nil {
+				t.Fatalf("tuningUserdata() error = %v", err)
+			}
+			// as in create
+			userdata = strings.ReplaceAll(userdata, "{{POSTGRES_VERSION}}", strconv.Itoa(config.version()))
+			userdata = tlsUserdata(userdata, config.TLS)
+
+			if m := placeholderPattern.FindAllString(userdata, -1); len(m) > 0 {
+				t.Errorf("placeholders left in userdata: %v", m)
+			}
+		})
+	}
+}
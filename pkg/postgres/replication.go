@@ -0,0 +1,350 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/discovery"
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+const (
+	// PrimaryTag marks the VM that was deployed as primary, StandbyTag marks
+	// streaming replicas. Slicer cannot retag a VM, so the current role after a
+	// failover comes from the database, see Status.
+	PrimaryTag             = "postgres"
+	StandbyTag             = "postgres-standby"
+	DefaultReplicationUser = "replicator"
+	// ReplicationPasswordFile holds the replication password on every member
+	// so standbys can be added later
+	ReplicationPasswordFile = "/etc/postgresql/replication-password"
+)
+
+const (
+	RolePrimary = "primary"
+	RoleStandby = "standby"
+	RoleDown    = "down"
+)
+
+// conninfoHostPattern matches the host in a standby's primary_conninfo
+var conninfoHostPattern = regexp.MustCompile(`host=(\S+)`)
+
+// Member is a primary or standby VM and its replication state
+type Member struct {
+	Hostname string
+	IP       string
+	Role     string
+	// Upstream is the host a standby streams from
+	Upstream string
+	// Replicas are the standbys streaming from a primary
+	Replicas []Replica
+	// ReplayDelay is the time since a standby replayed the last transaction
+	ReplayDelay string
+	Error       error
+}
+
+// Replica is a row of pg_stat_replication on the primary
+type Replica struct {
+	Name       string
+	ClientAddr string
+	State      string
+	SyncState  string
+	// LagBytes is how far replay on the standby is behind the primary's WAL
+	LagBytes  int64
+	ReplayLag string
+}
+
+// FailoverResult describes what Failover changed
+type FailoverResult struct {
+	Primary    string
+	PrimaryIP  string
+	OldPrimary string
+	// Fenced is false when the old primary could not be reached to stop it
+	Fenced    bool
+	Repointed []string
+}
+
+// AddStandby creates a streaming replica of a running primary, reading the
+// replication password and PgBouncer setup from the primary
+func (d *Deployer) AddStandby(ctx context.Context, primaryHostname string) (*sdk.SlicerCreateNodeResponse, error) {
+	primary, err := d.primary(ctx, primaryHostname)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := vmexec.Run(ctx, d.client, primaryHostname, "cat "+ReplicationPasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replication password on %s (was it restored from a backup?): %w", primaryHostname, err)
+	}
+
+	// A standby has to run the primary's major version
+	version, err := d.serverVersion(ctx, primaryHostname)
+	if err != nil {
+		return nil, err
+	}
+	pooler, err := d.pgbouncerSetupOf(ctx, primaryHostname)
+	if err != nil {
+		return nil, err
+	}
+
+	standby := *d
+	standby.config.Version = version
+
+	return standby.createStandby(ctx, primary.IP, strings.TrimSpace(out), pooler)
+}
+
+// createStandby starts a VM that clones primaryIP with pg_basebackup and
+// follows it through its own replication slot. It runs the primary's
+// PgBouncer setup so pooling survives a failover.
+func (d *Deployer) createStandby(ctx context.Context, primaryIP, replicationPass string, pooler pgbouncerSetup) (*sdk.SlicerCreateNodeResponse, error) {
+	userdata := generateUserdata(d.config.dbName(), d.config.dbUser(), "")
+	userdata = backupUserdata(userdata, d.config.Backup, "", "")
+	userdata = replicationUserdata(userdata, d.config.replicationUser(), replicationPass, primaryIP)
+	userdata = migrateUserdata(userdata, "")
+	userdata = pgbouncerUserdata(userdata, pooler)
+	userdata, err := tuningUserdata(userdata, d.config)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.create(ctx, userdata, standbyTags(pgbouncerTags(d.config.Tags, pooler.Port)))
+}
+
+// Status returns the primary and standby VMs in the host group with their
+// current role, replication lag on primaries and replay delay on standbys
+func (d *Deployer) Status(ctx context.Context) ([]Member, error) {
+	members, err := d.members(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range members {
+		m := &members[i]
+		switch m.Role {
+		case RolePrimary:
+			m.Replicas, m.Error = d.replicas(ctx, m.Hostname)
+		case RoleStandby:
+			m.ReplayDelay, m.Error = d.replayDelay(ctx, m.Hostname)
+		}
+	}
+	return members, nil
+}
+
+// Failover promotes a standby to primary. The standby's current upstream is
+// stopped and disabled first so it cannot take writes, and the other standbys
+// of that upstream are repointed to the new primary. Clients such as Gitea
+// keep their DB host, so repoint them afterwards.
+func (d *Deployer) Failover(ctx context.Context, hostname string) (*FailoverResult, error) {
+	members, err := d.members(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var target *Member
+	for i := range members {
+		if members[i].Hostname == hostname {
+			target = &members[i]
+		}
+	}
+	if target == nil {
+		return nil, fmt.Errorf("postgres VM %s not found in host group %s", hostname, d.config.HostGroup)
+	}
+	if target.Role != RoleStandby {
+		return nil, fmt.Errorf("%s is not a running standby (role: %s)", hostname, target.Role)
+	}
+
+	result := &FailoverResult{Primary: target.Hostname, PrimaryIP: target.IP}
+
+	for _, m := range members {
+		if m.IP != target.Upstream {
+			continue
+		}
+		result.OldPrimary = m.Hostname
+		if m.Role == RolePrimary {
+			if _, err := vmexec.Run(ctx, d.client, m.Hostname, "systemctl disable --now postgresql"); err != nil {
+				return nil, fmt.Errorf("failed to stop old primary %s: %w", m.Hostname, err)
+			}
+			result.Fenced = true
+		}
+	}
+
+	out, err := d.psql(ctx, hostname, "postgres", "SELECT pg_promote(true, 60);")
+	if err != nil {
+		return nil, fmt.Errorf("failed to promote %s: %w", hostname, err)
+	}
+	if strings.TrimSpace(out) != "t" {
+		return nil, fmt.Errorf("promotion of %s did not finish within 60s", hostname)
+	}
+
+	// Standbys deployed with backups only start scheduled base backups once promoted
+	script := "if [ -f /etc/systemd/system/wal-g-backup.timer ]; then systemctl enable --now wal-g-backup.timer; fi"
+	if _, err := vmexec.Run(ctx, d.client, hostname, script); err != nil {
+		return nil, fmt.Errorf("failed to enable backups on %s: %w", hostname, err)
+	}
+
+	for _, m := range members {
+		if m.Hostname == hostname || m.Role != RoleStandby || m.Upstream != target.Upstream {
+			continue
+		}
+		if err := d.follow(ctx, m.Hostname, hostname, target.IP); err != nil {
+			return result, err
+		}
+		result.Repointed = append(result.Repointed, m.Hostname)
+	}
+
+	return result, nil
+}
+
+// follow points a standby at a new primary, creating its slot there first
+func (d *Deployer) follow(ctx context.Context, standbyHostname, primaryHostname, primaryIP string) error {
+	slot := slotName(standbyHostname)
+	sql := fmt.Sprintf("SELECT pg_create_physical_replication_slot('%[1]s') WHERE NOT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = '%[1]s');", slot)
+	if _, err := d.psql(ctx, primaryHostname, "postgres", sql); err != nil {
+		return fmt.Errorf("failed to create replication slot for %s: %w", standbyHostname, err)
+	}
+
+	// primary_conninfo is reloadable, ALTER SYSTEM cannot run in a DO block
+	sql = fmt.Sprintf(`SELECT format('ALTER SYSTEM SET primary_conninfo = %%L', regexp_replace(current_setting('primary_conninfo'), 'host=\S+', 'host=%s'))
+\gexec
+SELECT pg_reload_conf();`, primaryIP)
+	if _, err := d.psql(ctx, standbyHostname, "postgres", sql); err != nil {
+		return fmt.Errorf("failed to repoint %s to %s: %w", standbyHostname, primaryHostname, err)
+	}
+	return nil
+}
+
+// primary returns a running primary by hostname
+func (d *Deployer) primary(ctx context.Context, hostname string) (*Member, error) {
+	members, err := d.members(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range members {
+		if members[i].Hostname == hostname {
+			if members[i].Role != RolePrimary {
+				return nil, fmt.Errorf("%s is not a running primary (role: %s)", hostname, members[i].Role)
+			}
+			return &members[i], nil
+		}
+	}
+	return nil, fmt.Errorf("postgres VM %s not found in host group %s", hostname, d.config.HostGroup)
+}
+
+// members lists the VMs tagged as primary or standby and asks each for its role
+func (d *Deployer) members(ctx context.Context) ([]Member, error) {
+	nodes, err := d.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	var members []Member
+	for _, node := range nodes {
+		if !hasTag(node.Tags, PrimaryTag) && !hasTag(node.Tags, StandbyTag) {
+			continue
+		}
+
+		m := Member{Hostname: node.Hostname, IP: discovery.HostIP(node.IP), Role: RoleDown}
+		out, err := d.psql(ctx, node.Hostname, "postgres", "SELECT pg_is_in_recovery(), current_setting('primary_conninfo');")
+		if err != nil {
+			m.Error = err
+			members = append(members, m)
+			continue
+		}
+
+		fields := strings.SplitN(strings.TrimSpace(out), "|", 2)
+		if fields[0] == "t" {
+			m.Role = RoleStandby
+			if len(fields) == 2 {
+				if match := conninfoHostPattern.FindStringSubmatch(fields[1]); match != nil {
+					m.Upstream = match[1]
+				}
+			}
+		} else {
+			m.Role = RolePrimary
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+func (d *Deployer) replicas(ctx context.Context, hostname string) ([]Replica, error) {
+	out, err := d.psql(ctx, hostname, "postgres", `SELECT application_name, coalesce(client_addr::text, ''), state, sync_state,
+  coalesce(pg_wal_lsn_diff(pg_current_wal_lsn(), replay_lsn), 0)::bigint, coalesce(replay_lag::text, '')
+FROM pg_stat_replication ORDER BY application_name;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pg_stat_replication: %w", err)
+	}
+
+	var replicas []Replica
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) != 6 {
+			continue
+		}
+		lag, _ := strconv.ParseInt(fields[4], 10, 64)
+		replicas = append(replicas, Replica{
+			Name:       fields[0],
+			ClientAddr: fields[1],
+			State:      fields[2],
+			SyncState:  fields[3],
+			LagBytes:   lag,
+			ReplayLag:  fields[5],
+		})
+	}
+	return replicas, nil
+}
+
+func (d *Deployer) replayDelay(ctx context.Context, hostname string) (string, error) {
+	out, err := d.psql(ctx, hostname, "postgres", "SELECT coalesce(date_trunc('second', now() - pg_last_xact_replay_timestamp())::text, 'never');")
+	if err != nil {
+		return "", fmt.Errorf("failed to read replay delay: %w", err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// replicationUserdata replaces the replication placeholders in userdata,
+// primaryHost is empty for a primary
+func replicationUserdata(userdata, user, password, primaryHost string) string {
+	userdata = strings.ReplaceAll(userdata, "{{REPLICATION_USER}}", user)
+	userdata = strings.ReplaceAll(userdata, "{{REPLICATION_PASSWORD}}", password)
+	userdata = strings.ReplaceAll(userdata, "{{PRIMARY_HOST}}", primaryHost)
+	return userdata
+}
+
+// standbyTags swaps the primary tag for the standby tag. Discovery and DNS
+// resolve "postgres" and "pgbouncer" to whichever member is the primary, the
+// tags only tell which VMs to ask.
+func standbyTags(tags []string) []string {
+	out := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag == PrimaryTag {
+			tag = StandbyTag
+		}
+		out = append(out, tag)
+	}
+	return out
+}
+
+// slotName is the replication slot of a standby, matching userdata
+func slotName(hostname string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, hostname)
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
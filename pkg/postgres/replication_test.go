@@ -0,0 +1,33 @@
+package postgres
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStandbyTags(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []string
+		want []string
+	}{
+		{name: "primary", tags: []string{PrimaryTag}, want: []string{StandbyTag}},
+		{name: "extra tags kept", tags: []string{"team-a", PrimaryTag}, want: []string{"team-a", StandbyTag}},
+		{name: "pgbouncer tags kept", tags: []string{PrimaryTag, PgBouncerTag, "pgbouncer-port-6432"}, want: []string{StandbyTag, PgBouncerTag, "pgbouncer-port-6432"}},
+		{name: "no primary tag", tags: []string{"other"}, want: []string{"other"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := standbyTags(tt.tags)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("standbyTags(%v) = %v, want %v", tt.tags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlotName(t *testing.T) {
+	if got := slotName("postgres-2.local"); got != "postgres_2_local" {
+		t.Errorf("slotName() = %q", got)
+	}
+}
@@ -0,0 +1,100 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/discovery"
+	"github.com/gaarutyunov/slicer/pkg/pki"
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+// TLSDir holds the server certificate, key and CA on the VM
+const TLSDir = "/etc/postgresql/tls"
+
+// TLSConfig turns on TLS with a server certificate from the playground CA and
+// limits pg_hba to hostssl entries from the allowed networks
+type TLSConfig struct {
+	CA *pki.CA // Issues the server certificate, TLS is disabled when nil
+	// AllowCIDRs are the networks clients connect from, the VM's own subnet
+	// when empty
+	AllowCIDRs []string
+}
+
+// Enabled reports whether TLS is configured
+func (t TLSConfig) Enabled() bool {
+	return t.CA != nil
+}
+
+// Validate checks the allowed networks
+func (t TLSConfig) Validate() error {
+	for _, cidr := range t.AllowCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid allowed network %q: %w", cidr, err)
+		}
+	}
+	return nil
+}
+
+// installCert issues a certificate for a new VM and copies it over once the VM
+// accepts commands. Userdata waits for the key before turning on TLS.
+func (d *Deployer) installCert(ctx context.Context, resp *sdk.SlicerCreateNodeResponse) error {
+	cert, err := d.config.TLS.CA.Issue(resp.Hostname, d.certHosts(resp.Hostname, discovery.HostIP(resp.IP)), pki.DefaultValidity)
+	if err != nil {
+		return err
+	}
+
+	if err := vmexec.WaitReady(ctx, d.client, resp.Hostname, 5*time.Minute); err != nil {
+		return err
+	}
+
+	// The key goes last since userdata starts once it exists
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"ca.crt", d.config.TLS.CA.CertPEM()},
+		{"server.crt", cert.CertPEM},
+		{"server.key", cert.KeyPEM},
+	}
+	for _, f := range files {
+		if err := vmexec.WriteFile(ctx, d.client, resp.Hostname, TLSDir+"/"+f.name, f.data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// certHosts are the names clients may use for a VM: its IP and hostname, and
+// with stack DNS its hostname record and the primary and standby service names
+// since a standby can be promoted, plus the pooler's when PgBouncer is enabled
+func (d *Deployer) certHosts(hostname, ip string) []string {
+	hosts := []string{ip, hostname}
+	if d.config.DNS.Enabled() {
+		hosts = append(hosts,
+			d.config.DNS.Name(hostname),
+			d.config.DNS.Name(PrimaryTag),
+			d.config.DNS.Name(StandbyTag),
+		)
+		if d.config.PgBouncer.Enabled() {
+			hosts = append(hosts, d.config.DNS.Name(PgBouncerTag))
+		}
+	}
+	return hosts
+}
+
+// tlsUserdata replaces the TLS and pg_hba placeholders in userdata
+func tlsUserdata(userdata string, t TLSConfig) string {
+	enabled := "false"
+	if t.Enabled() {
+		enabled = "true"
+	}
+	userdata = strings.ReplaceAll(userdata, "{{TLS_ENABLED}}", enabled)
+	userdata = strings.ReplaceAll(userdata, "{{HBA_CIDRS}}", strings.Join(t.AllowCIDRs, " "))
+	return userdata
+}
@@ -0,0 +1,236 @@
+package postgres
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+//go:embed tuning.sh
+var tuningScript string
+
+// Profile is the workload a PostgreSQL VM is tuned for
+type Profile string
+
+const (
+	// ProfileOLTP favours many short transactions and connections
+	ProfileOLTP Profile = "oltp"
+	// ProfileWeb favours a web app with a moderate connection pool
+	ProfileWeb Profile = "web"
+	// ProfileMixed suits a VM shared by several apps with some reporting queries
+	ProfileMixed Profile = "mixed"
+
+	DefaultProfile = ProfileMixed
+	// TuningFile is the conf.d file holding the computed settings. Settings in
+	// later conf.d files, such as WAL-G archiving, take precedence.
+	TuningFile = "00-tuning.conf"
+)
+
+// Tuning holds settings computed from the VM size and profile, memory in kB
+type Tuning struct {
+	Profile                       Profile
+	MaxConnections                int
+	SharedBuffersKB               int
+	EffectiveCacheSizeKB          int
+	MaintenanceWorkMemKB          int
+	WorkMemKB                     int
+	WALBuffersKB                  int
+	MinWALSizeMB                  int
+	MaxWALSizeMB                  int
+	CheckpointCompletionTarget    float64
+	MaxWorkerProcesses            int
+	MaxParallelWorkers            int
+	MaxParallelWorkersPerGather   int
+	MaxParallelMaintenanceWorkers int
+	RandomPageCost                float64
+	EffectiveIOConcurrency        int
+	DefaultStatisticsTarget       int
+}
+
+// TuneResult describes a tuning applied to a running instance
+type TuneResult struct {
+	Tuning Tuning
+	// PendingRestart lists changed settings that only apply after a restart
+	PendingRestart []string
+}
+
+// Validate checks that the profile is known
+func (p Profile) Validate() error {
+	switch p {
+	case ProfileOLTP, ProfileWeb, ProfileMixed:
+		return nil
+	}
+	return fmt.Errorf("unknown postgres profile %q, use oltp, web or mixed", p)
+}
+
+// Tune computes settings for a VM with vcpu CPUs and ramMB of memory, following
+// the usual pgtune ratios for a VM with SSD-backed storage
+func Tune(vcpu, ramMB int, profile Profile) (Tuning, error) {
+	if err := profile.Validate(); err != nil {
+		return Tuning{}, err
+	}
+	if vcpu < 1 || ramMB < 256 {
+		return Tuning{}, fmt.Errorf("VM too small to tune: %d vCPU, %d MB", vcpu, ramMB)
+	}
+
+	ramKB := ramMB * 1024
+
+	t := Tuning{
+		Profile:                    profile,
+		SharedBuffersKB:            ramKB / 4,
+		EffectiveCacheSizeKB:       ramKB * 3 / 4,
+		MaintenanceWorkMemKB:       min(ramKB/16, 2*1024*1024),
+		CheckpointCompletionTarget: 0.9,
+		MaxWorkerProcesses:         max(8, vcpu),
+		MaxParallelWorkers:         vcpu,
+		RandomPageCost:             1.1,
+		EffectiveIOConcurrency:     200,
+		DefaultStatisticsTarget:    100,
+	}
+
+	t.MaxConnections, t.MinWALSizeMB, t.MaxWALSizeMB = profile.settings()
+
+	t.MaxParallelWorkersPerGather = min(4, (vcpu+1)/2)
+	t.MaxParallelMaintenanceWorkers = t.MaxParallelWorkersPerGather
+
+	// 3% of shared_buffers, which PostgreSQL itself caps at one 16MB WAL segment
+	t.WALBuffersKB = max(64, min(t.SharedBuffersKB*3/100, 16*1024))
+
+	// Each connection may run a few sorts or hashes at once, per parallel worker
+	t.WorkMemKB = max(64, (ramKB-t.SharedBuffersKB)/(t.MaxConnections*3)/t.MaxParallelWorkersPerGather)
+
+	return t, nil
+}
+
+// settings returns the connection and WAL sizes of a profile, which do not
+// depend on the VM size
+func (p Profile) settings() (maxConnections, minWALSizeMB, maxWALSizeMB int) {
+	switch p {
+	case ProfileOLTP:
+		return 300, 2048, 8192
+	case ProfileWeb:
+		return 200, 1024, 4096
+	default:
+		return 100, 1024, 4096
+	}
+}
+
+// Conf renders the settings as a postgresql.conf fragment
+func (t Tuning) Conf() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated for the %s profile, recompute with: mage postgres:tune <hostname>\n", t.Profile)
+	fmt.Fprintf(&b, "max_connections = %d\n", t.MaxConnections)
+	fmt.Fprintf(&b, "shared_buffers = %s\n", formatKB(t.SharedBuffersKB))
+	fmt.Fprintf(&b, "effective_cache_size = %s\n", formatKB(t.EffectiveCacheSizeKB))
+	fmt.Fprintf(&b, "maintenance_work_mem = %s\n", formatKB(t.MaintenanceWorkMemKB))
+	fmt.Fprintf(&b, "work_mem = %s\n", formatKB(t.WorkMemKB))
+	fmt.Fprintf(&b, "wal_buffers = %s\n", formatKB(t.WALBuffersKB))
+	fmt.Fprintf(&b, "min_wal_size = %s\n", formatKB(t.MinWALSizeMB*1024))
+	fmt.Fprintf(&b, "max_wal_size = %s\n", formatKB(t.MaxWALSizeMB*1024))
+	fmt.Fprintf(&b, "checkpoint_completion_target = %g\n", t.CheckpointCompletionTarget)
+	fmt.Fprintf(&b, "max_worker_processes = %d\n", t.MaxWorkerProcesses)
+	fmt.Fprintf(&b, "max_parallel_workers = %d\n", t.MaxParallelWorkers)
+	fmt.Fprintf(&b, "max_parallel_workers_per_gather = %d\n", t.MaxParallelWorkersPerGather)
+	fmt.Fprintf(&b, "max_parallel_maintenance_workers = %d\n", t.MaxParallelMaintenanceWorkers)
+	fmt.Fprintf(&b, "random_page_cost = %g\n", t.RandomPageCost)
+	fmt.Fprintf(&b, "effective_io_concurrency = %d\n", t.EffectiveIOConcurrency)
+	fmt.Fprintf(&b, "default_statistics_target = %d\n", t.DefaultStatisticsTarget)
+	return b.String()
+}
+
+// Tune recomputes the settings from the CPUs and memory a running instance
+// actually has and reloads PostgreSQL. Settings such as shared_buffers and
+// max_connections are reported in PendingRestart until Restart is called.
+// Standbys need max_connections and max_worker_processes at least as high as
+// their primary, so tune the standbys first when raising them.
+func (d *Deployer) Tune(ctx context.Context, hostname string) (*TuneResult, error) {
+	out, err := vmexec.Run(ctx, d.client, hostname, "nproc && awk '/^MemTotal:/ {print $2}' /proc/meminfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM size of %s: %w", hostname, err)
+	}
+
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("unexpected VM size output from %s: %q", hostname, out)
+	}
+	vcpu, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CPU count %q: %w", fields[0], err)
+	}
+	memKB, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse memory size %q: %w", fields[1], err)
+	}
+
+	tuning, err := Tune(vcpu, memKB/1024, d.config.profile())
+	if err != nil {
+		return nil, err
+	}
+
+	confDir, err := d.psql(ctx, hostname, "postgres", "SHOW config_file;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find config directory on %s: %w", hostname, err)
+	}
+	path := strings.TrimSuffix(strings.TrimSpace(confDir), "postgresql.conf") + "conf.d/" + TuningFile
+
+	if err := vmexec.WriteFile(ctx, d.client, hostname, path, []byte(tuning.Conf()), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write %s on %s: %w", path, hostname, err)
+	}
+
+	out, err = d.psql(ctx, hostname, "postgres", `SELECT pg_reload_conf();
+SELECT pg_sleep(1);
+SELECT name FROM pg_settings WHERE pending_restart ORDER BY name;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reload postgres on %s: %w", hostname, err)
+	}
+
+	result := &TuneResult{Tuning: tuning}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		// pg_reload_conf and pg_sleep print "t" and an empty line
+		if line != "" && line != "t" {
+			result.PendingRestart = append(result.PendingRestart, line)
+		}
+	}
+	return result, nil
+}
+
+// Restart restarts PostgreSQL on a running instance, disconnecting clients
+func (d *Deployer) Restart(ctx context.Context, hostname string) error {
+	if _, err := vmexec.Run(ctx, d.client, hostname, "systemctl restart postgresql"); err != nil {
+		return fmt.Errorf("failed to restart postgres on %s: %w", hostname, err)
+	}
+	return nil
+}
+
+// tuningUserdata replaces the tuning placeholder in userdata with a script that
+// computes the settings on the VM, from the CPUs and memory it actually got
+func tuningUserdata(userdata string, config Config) (string, error) {
+	profile := config.profile()
+	if err := profile.Validate(); err != nil {
+		return "", err
+	}
+	maxConnections, minWALSizeMB, maxWALSizeMB := profile.settings()
+	script := strings.NewReplacer(
+		"{{TUNING_PROFILE}}", string(profile),
+		"{{TUNING_MAX_CONNECTIONS}}", strconv.Itoa(maxConnections),
+		"{{TUNING_MIN_WAL_SIZE_MB}}", strconv.Itoa(minWALSizeMB),
+		"{{TUNING_MAX_WAL_SIZE_MB}}", strconv.Itoa(maxWALSizeMB),
+	).Replace(tuningScript)
+	return strings.ReplaceAll(userdata, "{{TUNING_SCRIPT}}", strings.TrimSuffix(script, "\n")), nil
+}
+
+// formatKB renders a memory setting in the largest whole unit
+func formatKB(kb int) string {
+	switch {
+	case kb%(1024*1024) == 0:
+		return fmt.Sprintf("%dGB", kb/(1024*1024))
+	case kb%1024 == 0:
+		return fmt.Sprintf("%dMB", kb/1024)
+	default:
+		return fmt.Sprintf("%dkB", kb)
+	}
+}
@@ -0,0 +1,46 @@
+# tune_postgres prints the settings Tune in tuning.go computes, for the CPUs and
+# memory of this VM. VCPU and MEM_KB override the detected size.
+tune_postgres() {
+  local vcpu="${VCPU:-$(nproc)}"
+  local mem_kb="${MEM_KB:-$(awk '/^MemTotal:/ {print $2}' /proc/meminfo)}"
+  awk -v vcpu="$vcpu" -v mem_kb="$mem_kb" -v profile="{{TUNING_PROFILE}}" \
+    -v max_connections="{{TUNING_MAX_CONNECTIONS}}" \
+    -v min_wal_mb="{{TUNING_MIN_WAL_SIZE_MB}}" -v max_wal_mb="{{TUNING_MAX_WAL_SIZE_MB}}" '
+    function imin(a, b) { return a < b ? a : b }
+    function imax(a, b) { return a > b ? a : b }
+    function fmt(kb) {
+      if (kb % 1048576 == 0) return (kb / 1048576) "GB"
+      if (kb % 1024 == 0) return (kb / 1024) "MB"
+      return kb "kB"
+    }
+    BEGIN {
+      ram_mb = int(mem_kb / 1024)
+      if (vcpu < 1 || ram_mb < 256) {
+        printf "VM too small to tune: %d vCPU, %d MB\n", vcpu, ram_mb > "/dev/stderr"
+        exit 1
+      }
+      ram = ram_mb * 1024
+      shared = int(ram / 4)
+      per_gather = imin(4, int((vcpu + 1) / 2))
+      wal_buffers = imax(64, imin(int(shared * 3 / 100), 16 * 1024))
+      work_mem = imax(64, int(int((ram - shared) / (max_connections * 3)) / per_gather))
+
+      printf "# Generated for the %s profile, recompute with: mage postgres:tune <hostname>\n", profile
+      printf "max_connections = %d\n", max_connections
+      printf "shared_buffers = %s\n", fmt(shared)
+      printf "effective_cache_size = %s\n", fmt(int(ram * 3 / 4))
+      printf "maintenance_work_mem = %s\n", fmt(imin(int(ram / 16), 2 * 1024 * 1024))
+      printf "work_mem = %s\n", fmt(work_mem)
+      printf "wal_buffers = %s\n", fmt(wal_buffers)
+      printf "min_wal_size = %s\n", fmt(min_wal_mb * 1024)
+      printf "max_wal_size = %s\n", fmt(max_wal_mb * 1024)
+      printf "checkpoint_completion_target = 0.9\n"
+      printf "max_worker_processes = %d\n", imax(8, vcpu)
+      printf "max_parallel_workers = %d\n", vcpu
+      printf "max_parallel_workers_per_gather = %d\n", per_gather
+      printf "max_parallel_maintenance_workers = %d\n", per_gather
+      printf "random_page_cost = 1.1\n"
+      printf "effective_io_concurrency = 200\n"
+      printf "default_statistics_target = 100\n"
+    }'
+}
@@ -0,0 +1,91 @@
+package postgres
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTune(t *testing.T) {
+	tests := []struct {
+		name    string
+		vcpu    int
+		ramMB   int
+		profile Profile
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "mixed 2 vCPU 4GB",
+			vcpu:    2,
+			ramMB:   4096,
+			profile: ProfileMixed,
+			want:    []string{"max_connections = 100\n", "shared_buffers = 1GB\n", "effective_cache_size = 3GB\n", "maintenance_work_mem = 256MB\n", "max_parallel_workers_per_gather = 1\n"},
+		},
+		{
+			name:    "oltp 8 vCPU 16GB",
+			vcpu:    8,
+			ramMB:   16384,
+			profile: ProfileOLTP,
+			want:    []string{"max_connections = 300\n", "shared_buffers = 4GB\n", "max_wal_size = 8GB\n", "max_parallel_workers_per_gather = 4\n", "wal_buffers = 16MB\n"},
+		},
+		{name: "too small", vcpu: 1, ramMB: 128, profile: ProfileWeb, wantErr: true},
+		{name: "unknown profile", vcpu: 2, ramMB: 4096, profile: "batch", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tuning, err := Tune(tt.vcpu, tt.ramMB, tt.profile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Tune() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			conf := tuning.Conf()
+			for _, s := range tt.want {
+				if !strings.Contains(conf, s) {
+					t.Errorf("Conf() is missing %q:\n%s", s, conf)
+				}
+			}
+		})
+	}
+}
+
+// The userdata computes the settings on the VM, they must match Tune
+func TestTuningScript(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash not found")
+	}
+
+	sizes := []struct {
+		vcpu  int
+		memKB int
+	}{
+		{1, 1018232},
+		{2, 4026512},
+		{3, 6144000},
+		{8, 16384 * 1024},
+		{32, 131072 * 1024},
+	}
+	for _, profile := range []Profile{ProfileOLTP, ProfileWeb, ProfileMixed} {
+		script, err := tuningUserdata("{{TUNING_SCRIPT}}", Config{Profile: profile})
+		if err != nil {
+			t.Fatalf("tuningUserdata() error = %v", err)
+		}
+		for _, size := range sizes {
+			tuning, err := Tune(size.vcpu, size.memKB/1024, profile)
+			if err != nil {
+				t.Fatalf("Tune() error = %v", err)
+			}
+
+			cmd := exec.Command(bash, "-c", script+"\ntune_postgres")
+			cmd.Env = []string{"VCPU=" + strconv.Itoa(size.vcpu), "MEM_KB=" + strconv.Itoa(size.memKB)}
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("tune_postgres error = %v", err)
+			}
+			if string(out) != tuning.Conf() {
+				t.Errorf("%s %d vCPU %d kB: tune_postgres =\n%s\nwant\n%s", profile, size.vcpu, size.memKB, out, tuning.Conf())
+			}
+		}
+	}
+}
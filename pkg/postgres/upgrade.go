@@ -0,0 +1,332 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+// DefaultVersion is the PostgreSQL major version installed from the PGDG apt repository
+const DefaultVersion = 16
+
+// SupportedVersions are the major versions PGDG publishes for current Ubuntu releases
+var SupportedVersions = []int{13, 14, 15, 16, 17}
+
+// ReadyFile is written by userdata once PostgreSQL is installed and configured
+const ReadyFile = "/etc/postgresql/slicer-ready"
+
+// MigratingFile marks an upgrade target until cutover, discovery and DNS do
+// not treat it as the primary while it exists
+const MigratingFile = "/etc/postgresql/slicer-migrating"
+
+// UpgradeResult describes a migration to a new major version
+type UpgradeResult struct {
+	Source      string
+	Target      *sdk.SlicerCreateNodeResponse
+	FromVersion int
+	ToVersion   int
+	DumpBytes   int64
+	// Tables is the number of tables whose row counts were compared
+	Tables int
+}
+
+// ValidateVersion checks that a major version can be installed
+func ValidateVersion(version int) error {
+	for _, v := range SupportedVersions {
+		if v == version {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported postgres version %d, use one of %v", version, SupportedVersions)
+}
+
+// Upgrade migrates a primary to a new VM running a newer major version. The
+// source is made read-only, dumped with pg_dumpall and loaded into the new VM
+// through the Slicer cp endpoint, and row counts of every table are compared.
+// Only then is the target cut over to be resolved as the primary. The source
+// VM is left running read-only for the caller to delete once dependents have
+// been switched. On failure the source is made writable again.
+func (d *Deployer) Upgrade(ctx context.Context, hostname string, version int, w io.Writer) (*UpgradeResult, error) {
+	if err := ValidateVersion(version); err != nil {
+		return nil, err
+	}
+	if _, err := d.primary(ctx, hostname); err != nil {
+		return nil, err
+	}
+
+	from, err := d.serverVersion(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	if version <= from {
+		return nil, fmt.Errorf("%s already runs PostgreSQL %d, pick a newer version", hostname, from)
+	}
+
+	result := &UpgradeResult{Source: hostname, FromVersion: from, ToVersion: version}
+
+	// Roles and databases come from the dump, the replication password is kept
+	// so standbys can be added to the new VM
+	replicationPass, _ := vmexec.Run(ctx, d.client, hostname, "cat "+ReplicationPasswordFile+" 2>/dev/null || true")
+
+	// The target pools connections like the source
+	pooler, err := d.pgbouncerSetupOf(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	target := *d
+	target.config.Version = version
+
+	userdata := generateUserdata(d.config.dbName(), d.config.dbUser(), "")
+	userdata = backupUserdata(userdata, d.config.Backup, "", "")
+	userdata = replicationUserdata(userdata, d.config.replicationUser(), strings.TrimSpace(replicationPass), "")
+	userdata = migrateUserdata(userdata, hostname)
+	userdata = pgbouncerUserdata(userdata, pooler)
+	userdata, err = tuningUserdata(userdata, d.config)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(w, "Creating PostgreSQL %d VM...\n", version)
+	result.Target, err = target.create(ctx, userdata, pgbouncerTags(d.config.Tags, pooler.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(w, "Waiting for %s to finish installing...\n", result.Target.Hostname)
+	if err := d.waitInstalled(ctx, result.Target.Hostname, 20*time.Minute); err != nil {
+		return result, err
+	}
+
+	fmt.Fprintf(w, "Making %s read-only...\n", hostname)
+	if err := d.setReadOnly(ctx, hostname, true); err != nil {
+		return result, err
+	}
+
+	if err := d.migrate(ctx, result, w); err != nil {
+		if rerr := d.setReadOnly(ctx, hostname, false); rerr != nil {
+			fmt.Fprintf(w, "Warning: %s is still read-only: %v\n", hostname, rerr)
+		}
+		return result, err
+	}
+
+	fmt.Fprintf(w, "Cutting over to %s...\n", result.Target.Hostname)
+	if _, err := vmexec.Run(ctx, d.client, result.Target.Hostname, "rm -f "+MigratingFile); err != nil {
+		return result, fmt.Errorf("failed to cut over to %s: %w", result.Target.Hostname, err)
+	}
+	return result, nil
+}
+
+// migrate copies every database and pg_hba entry from the source to the
+// target and compares row counts
+func (d *Deployer) migrate(ctx context.Context, result *UpgradeResult, w io.Writer) error {
+	source, target := result.Source, result.Target.Hostname
+	const dumpPath = "/tmp/upgrade.sql"
+
+	fmt.Fprintf(w, "Dumping %s...\n", source)
+	if _, err := vmexec.Run(ctx, d.client, source,
+		fmt.Sprintf("cd /tmp && sudo -u postgres pg_dumpall --clean --if-exists -f %s", dumpPath)); err != nil {
+		return fmt.Errorf("failed to dump %s: %w", source, err)
+	}
+
+	size, err := d.copyBetween(ctx, source, dumpPath, target, dumpPath)
+	if err != nil {
+		return err
+	}
+	result.DumpBytes = size
+	fmt.Fprintf(w, "Copied %.1f MiB dump to %s\n", float64(size)/(1<<20), target)
+
+	// Without ON_ERROR_STOP: the dump recreates roles such as postgres that
+	// already exist, the row count comparison below catches real failures
+	fmt.Fprintf(w, "Loading dump into %s...\n", target)
+	if _, err := vmexec.Run(ctx, d.client, target,
+		fmt.Sprintf("cd /tmp && sudo -u postgres psql -X -q -f %[1]s -d postgres > /dev/null && rm -f %[1]s", dumpPath)); err != nil {
+		return fmt.Errorf("failed to load dump into %s: %w", target, err)
+	}
+	if _, err := vmexec.Run(ctx, d.client, source, "rm -f "+dumpPath); err != nil {
+		fmt.Fprintf(w, "Warning: failed to remove %s on %s: %v\n", dumpPath, source, err)
+	}
+
+	if err := d.copyHBA(ctx, source, target); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Comparing row counts...\n")
+	dbs, err := d.ListDBs(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	var mismatches []string
+	for _, db := range dbs {
+		if db.Name == "postgres" {
+			continue
+		}
+		want, err := d.rowCounts(ctx, source, db.Name)
+		if err != nil {
+			return err
+		}
+		got, err := d.rowCounts(ctx, target, db.Name)
+		if err != nil {
+			return err
+		}
+		for table, count := range want {
+			if got[table] != count {
+				mismatches = append(mismatches, fmt.Sprintf("%s.%s: %d rows on %s, %d on %s", db.Name, table, count, source, got[table], target))
+			}
+		}
+		result.Tables += len(want)
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("row counts differ after migration:\n  %s", strings.Join(mismatches, "\n  "))
+	}
+	return nil
+}
+
+// copyBetween copies a file from one VM to another through a local temporary
+// file and returns its size
+func (d *Deployer) copyBetween(ctx context.Context, srcHost, srcPath, dstHost, dstPath string) (int64, error) {
+	dir, err := os.MkdirTemp("", "slicer-postgres-")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := filepath.Join(dir, filepath.Base(srcPath))
+	if err := d.client.CpFromVM(ctx, srcHost, srcPath, local, 0, 0); err != nil {
+		return 0, fmt.Errorf("failed to copy %s from %s: %w", srcPath, srcHost, err)
+	}
+
+	info, err := os.Stat(local)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat %s: %w", local, err)
+	}
+
+	if err := d.client.CpToVM(ctx, dstHost, local, dstPath, 0, 0); err != nil {
+		return 0, fmt.Errorf("failed to copy %s to %s: %w", dstPath, dstHost, err)
+	}
+	return info.Size(), nil
+}
+
+// copyHBA appends the source's pg_hba entries that the target lacks, such as
+// those for databases added with CreateDB
+func (d *Deployer) copyHBA(ctx context.Context, source, target string) error {
+	script := fmt.Sprintf(`HBA=$(%s -c 'SHOW hba_file')
+grep -E '^(local|host|hostssl)[[:space:]]' "$HBA"`, psqlCommand)
+	out, err := vmexec.Run(ctx, d.client, source, script)
+	if err != nil {
+		return fmt.Errorf("failed to read pg_hba on %s: %w", source, err)
+	}
+
+	path := "/tmp/source-pg_hba.conf"
+	if err := vmexec.WriteFile(ctx, d.client, target, path, []byte(out), 0600); err != nil {
+		return err
+	}
+
+	script = fmt.Sprintf(`HBA=$(%s -c 'SHOW hba_file')
+while IFS= read -r line; do
+  grep -qxF "$line" "$HBA" || echo "$line" >> "$HBA"
+done < %[2]s
+rm -f %[2]s
+systemctl reload postgresql`, psqlCommand, path)
+	if _, err := vmexec.Run(ctx, d.client, target, script); err != nil {
+		return fmt.Errorf("failed to copy pg_hba entries to %s: %w", target, err)
+	}
+	return nil
+}
+
+// rowCountSQL returns schema.table|count for every table of a database
+const rowCountSQL = `SELECT table_schema || '.' || table_name,
+  (xpath('/row/c/text()', query_to_xml(format('SELECT count(*) AS c FROM %I.%I', table_schema, table_name), false, true, '')))[1]::text
+FROM information_schema.tables
+WHERE table_type = 'BASE TABLE' AND table_schema NOT IN ('pg_catalog', 'information_schema')
+ORDER BY 1;`
+
+// rowCounts returns the exact number of rows in every table of a database
+func (d *Deployer) rowCounts(ctx context.Context, hostname, dbName string) (map[string]int64, error) {
+	out, err := d.psql(ctx, hostname, dbName, rowCountSQL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count rows of %s on %s: %w", dbName, hostname, err)
+	}
+	return parseRowCounts(out)
+}
+
+// parseRowCounts reads rowCountSQL output, skipping psql command tags
+func parseRowCounts(out string) (map[string]int64, error) {
+	counts := map[string]int64{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) != 2 {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse row count of %s: %w", fields[0], err)
+		}
+		counts[fields[0]] = n
+	}
+	return counts, nil
+}
+
+// setReadOnly makes new transactions on an instance read-only, or writable again
+func (d *Deployer) setReadOnly(ctx context.Context, hostname string, readOnly bool) error {
+	sql := "ALTER SYSTEM RESET default_transaction_read_only;\nSELECT pg_reload_conf();"
+	if readOnly {
+		sql = "ALTER SYSTEM SET default_transaction_read_only = on;\nSELECT pg_reload_conf();"
+	}
+	if _, err := d.psql(ctx, hostname, "postgres", sql); err != nil {
+		return fmt.Errorf("failed to set read-only=%t on %s: %w", readOnly, hostname, err)
+	}
+	return nil
+}
+
+// serverVersion returns the major version a running instance serves
+func (d *Deployer) serverVersion(ctx context.Context, hostname string) (int, error) {
+	out, err := d.psql(ctx, hostname, "postgres", "SHOW server_version_num;")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read server version of %s: %w", hostname, err)
+	}
+	num, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse server version %q: %w", out, err)
+	}
+	return num / 10000, nil
+}
+
+// waitInstalled polls until userdata on a new VM has written ReadyFile
+func (d *Deployer) waitInstalled(ctx context.Context, hostname string, timeout time.Duration) error {
+	if err := vmexec.WaitReady(ctx, d.client, hostname, timeout); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := vmexec.Run(ctx, d.client, hostname, "test -f "+ReadyFile); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for PostgreSQL to be installed on %s, check 'mage postgres:logs %s'", hostname, hostname)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// migrateUserdata replaces the migration placeholder in userdata, source is
+// empty unless the VM is the target of an upgrade
+func migrateUserdata(userdata, source string) string {
+	return strings.ReplaceAll(userdata, "{{MIGRATE_FROM}}", source)
+}
@@ -5,19 +5,73 @@ set -euxo pipefail
 # This script installs PostgreSQL, configures it for remote access, and creates a database
 
 # Configuration (injected by deployer)
+POSTGRES_VERSION="{{POSTGRES_VERSION}}"
 POSTGRES_DB="{{POSTGRES_DB}}"
 POSTGRES_USER="{{POSTGRES_USER}}"
 POSTGRES_PASSWORD="{{POSTGRES_PASSWORD}}"
 
-# Install PostgreSQL (non-interactive to avoid tzdata prompt)
+# Backups with WAL-G (injected by deployer, BACKUP_S3_ENDPOINT is empty when disabled)
+BACKUP_S3_ENDPOINT="{{BACKUP_S3_ENDPOINT}}"
+BACKUP_S3_SCHEME="{{BACKUP_S3_SCHEME}}"
+BACKUP_S3_BUCKET="{{BACKUP_S3_BUCKET}}"
+BACKUP_S3_ACCESS_KEY="{{BACKUP_S3_ACCESS_KEY}}"
+BACKUP_S3_SECRET_KEY="{{BACKUP_S3_SECRET_KEY}}"
+BACKUP_SCHEDULE="{{BACKUP_SCHEDULE}}"
+BACKUP_RETAIN="{{BACKUP_RETAIN}}"
+WALG_VERSION="{{WALG_VERSION}}"
+# PEM CA the S3 endpoint's certificate is verified against, empty to use the
+# system roots only
+BACKUP_S3_CA_CERT="{{BACKUP_S3_CA_CERT}}"
+
+# Restore (injected by deployer): hostname whose backups to restore and an
+# optional RFC 3339 UTC recovery target, both empty for a fresh database
+RESTORE_FROM="{{RESTORE_FROM}}"
+RESTORE_TARGET_TIME="{{RESTORE_TARGET_TIME}}"
+
+# Streaming replication (injected by deployer): PRIMARY_HOST is empty on a
+# primary and set to the primary's address on a standby
+REPLICATION_USER="{{REPLICATION_USER}}"
+REPLICATION_PASSWORD="{{REPLICATION_PASSWORD}}"
+PRIMARY_HOST="{{PRIMARY_HOST}}"
+
+# Upgrade (injected by deployer): hostname being migrated to this VM, roles
+# and databases are loaded from its dump after userdata finishes
+MIGRATE_FROM="{{MIGRATE_FROM}}"
+
+# TLS (injected by deployer): when enabled the deployer copies the server
+# certificate to /etc/postgresql/tls once the VM accepts commands. HBA_CIDRS
+# are the networks clients connect from, the VM's own subnet when empty.
+TLS_ENABLED="{{TLS_ENABLED}}"
+HBA_CIDRS="{{HBA_CIDRS}}"
+
+# PgBouncer (injected by deployer): empty port when pooling is disabled
+PGBOUNCER_PORT="{{PGBOUNCER_PORT}}"
+
+# Install PostgreSQL from the PGDG repository so the major version is pinned
+# (non-interactive to avoid tzdata prompt)
 export DEBIAN_FRONTEND=noninteractive
 sudo -E apt-get update
-sudo -E apt-get install -y postgresql postgresql-contrib
+sudo -E apt-get install -y curl ca-certificates lsb-release
+sudo install -d /usr/share/postgresql-common/pgdg
+sudo curl -sSfL -o /usr/share/postgresql-common/pgdg/apt.postgresql.org.asc https://www.postgresql.org/media/keys/ACCC4CF8.asc
+echo "deb [signed-by=/usr/share/postgresql-common/pgdg/apt.postgresql.org.asc] https://apt.postgresql.org/pub/repos/apt $(lsb_release -cs)-pgdg main" \
+  | sudo tee /etc/apt/sources.list.d/pgdg.list
+sudo -E apt-get update
+sudo -E apt-get install -y "postgresql-${POSTGRES_VERSION}"
 
-# Get PostgreSQL version for config path
-PG_VERSION=$(psql --version | awk '{print $3}' | cut -d. -f1)
+# Config paths of the installed version
+PG_VERSION="${POSTGRES_VERSION}"
 PG_CONF="/etc/postgresql/${PG_VERSION}/main/postgresql.conf"
 PG_HBA="/etc/postgresql/${PG_VERSION}/main/pg_hba.conf"
+PG_CONF_D="/etc/postgresql/${PG_VERSION}/main/conf.d"
+PG_DATA="/var/lib/postgresql/${PG_VERSION}/main"
+
+# Settings computed from the VM's CPUs and memory and the workload profile
+# (injected by deployer)
+{{TUNING_SCRIPT}}
+sudo mkdir -p "$PG_CONF_D"
+TUNING_CONF=$(tune_postgres)
+echo "$TUNING_CONF" | sudo tee "${PG_CONF_D}/00-tuning.conf" > /dev/null
 
 # Configure PostgreSQL to listen on all interfaces
 sudo sed -i "s/#listen_addresses = 'localhost'/listen_addresses = '*'/" "$PG_CONF"
@@ -25,11 +79,157 @@ sudo sed -i "s/#listen_addresses = 'localhost'/listen_addresses = '*'/" "$PG_CON
 # Enable secure password encryption (recommended by Gitea docs)
 sudo sed -i "s/#password_encryption = scram-sha-256/password_encryption = scram-sha-256/" "$PG_CONF"
 
+# Remote clients connect over any network in plain text unless TLS is enabled
+HBA_TYPE=host
+if [ "$TLS_ENABLED" = "true" ]; then
+  TLS_DIR=/etc/postgresql/tls
+  echo "Waiting for server certificate in ${TLS_DIR}..."
+  for i in $(seq 1 120); do
+    if [ -f "${TLS_DIR}/server.key" ]; then
+      break
+    fi
+    sleep 5
+  done
+  if [ ! -f "${TLS_DIR}/server.key" ]; then
+    echo "No server certificate was copied to ${TLS_DIR}"
+    exit 1
+  fi
+  sudo chown -R postgres:postgres "$TLS_DIR"
+  sudo chmod 600 "${TLS_DIR}"/*
+
+  cat <<EOF | sudo tee "${PG_CONF_D}/08-tls.conf" > /dev/null
+ssl = on
+ssl_cert_file = '${TLS_DIR}/server.crt'
+ssl_key_file = '${TLS_DIR}/server.key'
+ssl_ca_file = '${TLS_DIR}/ca.crt'
+ssl_min_protocol_version = 'TLSv1.2'
+EOF
+
+  HBA_TYPE=hostssl
+  if [ -z "$HBA_CIDRS" ]; then
+    HBA_CIDRS=$(ip -o -f inet route show scope link | awk 'NR == 1 {print $1}')
+  fi
+fi
+HBA_CIDRS="${HBA_CIDRS:-0.0.0.0/0}"
+
+# Record the connection type and networks for pg_hba entries added later
+cat <<EOF | sudo tee /etc/postgresql/hba.env > /dev/null
+HBA_TYPE=${HBA_TYPE}
+HBA_CIDRS="${HBA_CIDRS}"
+EOF
+
 # Configure access settings (following Gitea recommendations)
 # Allow local connections for the specific user/database
 echo "local   ${POSTGRES_DB}    ${POSTGRES_USER}    scram-sha-256" | sudo tee -a "$PG_HBA"
-# Allow remote connections for the specific user/database
-echo "host    ${POSTGRES_DB}    ${POSTGRES_USER}    0.0.0.0/0    scram-sha-256" | sudo tee -a "$PG_HBA"
+for cidr in $HBA_CIDRS; do
+  # Allow remote connections for the specific user/database
+  echo "${HBA_TYPE}    ${POSTGRES_DB}    ${POSTGRES_USER}    ${cidr}    scram-sha-256" | sudo tee -a "$PG_HBA"
+  # Allow standbys to stream WAL, on standbys too so they can serve others once promoted
+  echo "${HBA_TYPE}    replication    ${REPLICATION_USER}    ${cidr}    scram-sha-256" | sudo tee -a "$PG_HBA"
+done
+
+# Replication settings, cluster_name is the application_name standbys report
+cat <<EOF | sudo tee "${PG_CONF_D}/05-replication.conf" > /dev/null
+cluster_name = '$(hostname)'
+wal_level = replica
+max_wal_senders = 10
+max_replication_slots = 10
+hot_standby = on
+EOF
+
+# Keep the replication password so standbys can be added later
+if [ -n "$REPLICATION_PASSWORD" ]; then
+  echo "$REPLICATION_PASSWORD" | sudo tee /etc/postgresql/replication-password > /dev/null
+  sudo chmod 600 /etc/postgresql/replication-password
+fi
+
+# Writes a WAL-G env file for a prefix in the bucket: write_walg_env <file> <prefix>
+write_walg_env() {
+  cat <<EOF | sudo tee "$1" > /dev/null
+AWS_ACCESS_KEY_ID=${BACKUP_S3_ACCESS_KEY}
+AWS_SECRET_ACCESS_KEY=${BACKUP_S3_SECRET_KEY}
+AWS_ENDPOINT=${BACKUP_S3_SCHEME}://${BACKUP_S3_ENDPOINT}
+AWS_REGION=us-east-1
+AWS_S3_FORCE_PATH_STYLE=true
+WALG_S3_PREFIX=s3://${BACKUP_S3_BUCKET}/$2
+PGHOST=/var/run/postgresql
+EOF
+  sudo chown postgres:postgres "$1"
+  sudo chmod 600 "$1"
+}
+
+if [ -n "$BACKUP_S3_ENDPOINT" ]; then
+  # curl and WAL-G trust the system roots, so add the CA there
+  if [ -n "$BACKUP_S3_CA_CERT" ]; then
+    echo "$BACKUP_S3_CA_CERT" | sudo tee /usr/local/share/ca-certificates/slicer-playground-ca.crt > /dev/null
+    sudo update-ca-certificates
+  fi
+
+  # Install WAL-G, and jq to pick the base backup for a restore
+  sudo -E apt-get install -y jq
+  UBUNTU_VERSION=$(. /etc/os-release && echo "$VERSION_ID")
+  curl -sSL "https://github.com/wal-g/wal-g/releases/download/v${WALG_VERSION}/wal-g-pg-ubuntu-${UBUNTU_VERSION}-amd64.tar.gz" | tar -xz -C /tmp
+  sudo install -m 0755 "/tmp/wal-g-pg-ubuntu-${UBUNTU_VERSION}-amd64" /usr/local/bin/wal-g
+
+  # wal-g-env <env-file> <args...> runs wal-g with the env file loaded
+  cat <<'EOF' | sudo tee /usr/local/bin/wal-g-env > /dev/null
+#!/usr/bin/env bash
+set -a
+. "$1"
+set +a
+shift
+exec /usr/local/bin/wal-g "$@"
+EOF
+  sudo chmod 755 /usr/local/bin/wal-g-env
+
+  # Each instance archives under its own hostname in the bucket
+  sudo mkdir -p /etc/wal-g
+  write_walg_env /etc/wal-g/env "$(hostname)"
+
+  # Create the bucket, RustFS answers 409 when it already exists
+  curl -sS -o /dev/null -w "Create bucket: %{http_code}\n" -X PUT \
+    --aws-sigv4 "aws:amz:us-east-1:s3" --user "${BACKUP_S3_ACCESS_KEY}:${BACKUP_S3_SECRET_KEY}" \
+    "${BACKUP_S3_SCHEME}://${BACKUP_S3_ENDPOINT}/${BACKUP_S3_BUCKET}" || true
+
+  # Continuous WAL archiving
+  cat <<EOF | sudo tee "${PG_CONF_D}/10-wal-g.conf" > /dev/null
+wal_level = replica
+archive_mode = on
+archive_command = '/usr/local/bin/wal-g-env /etc/wal-g/env wal-push %p'
+archive_timeout = 60
+EOF
+
+  # Scheduled base backups, keeping the newest BACKUP_RETAIN full backups
+  cat <<EOF | sudo tee /etc/systemd/system/wal-g-backup.service > /dev/null
+[Unit]
+Description=WAL-G base backup
+After=postgresql.service
+
+[Service]
+Type=oneshot
+User=postgres
+ExecStart=/usr/local/bin/wal-g-env /etc/wal-g/env backup-push ${PG_DATA}
+ExecStartPost=/usr/local/bin/wal-g-env /etc/wal-g/env delete retain FULL ${BACKUP_RETAIN} --confirm
+EOF
+
+  cat <<EOF | sudo tee /etc/systemd/system/wal-g-backup.timer > /dev/null
+[Unit]
+Description=Scheduled WAL-G base backup
+
+[Timer]
+OnCalendar=${BACKUP_SCHEDULE}
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+EOF
+
+  sudo systemctl daemon-reload
+  # Failover enables the timer on a standby when it is promoted
+  if [ -z "$PRIMARY_HOST" ]; then
+    sudo systemctl enable wal-g-backup.timer
+  fi
+fi
 
 # Start PostgreSQL (may not auto-start during install)
 sudo systemctl start postgresql
@@ -38,18 +238,161 @@ sudo systemctl enable postgresql
 # Wait for PostgreSQL to be ready
 sleep 3
 
-# Create database and user following Gitea recommendations:
-# - Use CREATE ROLE with LOGIN
-# - Create database with proper encoding (template0, UTF8, en_US.UTF-8)
-sudo -u postgres psql <<EOF
+if [ -n "$RESTORE_FROM" ]; then
+  # Replace the empty cluster with the newest base backup finished before the
+  # target, then replay archived WAL up to the target and promote
+  write_walg_env /etc/wal-g/restore.env "$RESTORE_FROM"
+
+  BACKUP_NAME=LATEST
+  if [ -n "$RESTORE_TARGET_TIME" ]; then
+    BACKUP_NAME=$(sudo -u postgres /usr/local/bin/wal-g-env /etc/wal-g/restore.env backup-list --json --detail \
+      | jq -r --arg t "$RESTORE_TARGET_TIME" '[.[] | select(.finish_time <= $t)] | sort_by(.finish_time) | last | .backup_name // empty')
+    if [ -z "$BACKUP_NAME" ]; then
+      echo "No base backup of ${RESTORE_FROM} finished before ${RESTORE_TARGET_TIME}"
+      exit 1
+    fi
+  fi
+
+  sudo systemctl stop postgresql
+  sudo rm -rf "$PG_DATA"
+  sudo -u postgres /usr/local/bin/wal-g-env /etc/wal-g/restore.env backup-fetch "$PG_DATA" "$BACKUP_NAME"
+  sudo -u postgres touch "${PG_DATA}/recovery.signal"
+
+  cat <<EOF | sudo tee "${PG_CONF_D}/20-restore.conf" > /dev/null
+restore_command = '/usr/local/bin/wal-g-env /etc/wal-g/restore.env wal-fetch %f %p'
+recovery_target_action = 'promote'
+EOF
+  if [ -n "$RESTORE_TARGET_TIME" ]; then
+    echo "recovery_target_time = '${RESTORE_TARGET_TIME}'" | sudo tee -a "${PG_CONF_D}/20-restore.conf"
+  fi
+
+  # Give up when the server stops, e.g. the archive ends before the target,
+  # or replay has not finished within an hour
+  sudo systemctl start postgresql
+  RESTORE_DEADLINE=$(( $(date +%s) + 3600 ))
+  until sudo -u postgres psql -XAtc 'SELECT NOT pg_is_in_recovery()' 2>/dev/null | grep -q t; do
+    if pg_lsclusters -h "$PG_VERSION" main 2>/dev/null | grep -qw down; then
+      echo "PostgreSQL stopped while restoring ${RESTORE_FROM}, see /var/log/postgresql"
+      exit 1
+    fi
+    if [ "$(date +%s)" -ge "$RESTORE_DEADLINE" ]; then
+      echo "Restore of ${RESTORE_FROM} did not finish within an hour"
+      exit 1
+    fi
+    sleep 5
+  done
+  sudo rm -f "${PG_CONF_D}/20-restore.conf"
+
+  # pg_hba.conf is not part of the base backup. Allow every database's owner
+  # and the roles granted CONNECT on it again, as CreateDB and GrantRole did on
+  # the source.
+  HBA_ROLES=$(sudo -u postgres psql -XAt -F ' ' -v ON_ERROR_STOP=1 <<'SQL'
+SELECT d.datname, r.rolname FROM pg_database d JOIN pg_roles r ON r.oid = d.datdba
+WHERE NOT d.datistemplate AND d.datname <> 'postgres' AND r.rolname <> 'postgres'
+UNION
+SELECT d.datname, r.rolname FROM pg_database d CROSS JOIN LATERAL aclexplode(d.datacl) a JOIN pg_roles r ON r.oid = a.grantee
+WHERE NOT d.datistemplate AND d.datname <> 'postgres' AND r.rolname <> 'postgres' AND a.privilege_type = 'CONNECT'
+SQL
+)
+  while read -r db role; do
+    [ -n "$db" ] || continue
+    lines=("local   ${db}    ${role}    scram-sha-256")
+    for cidr in $HBA_CIDRS; do
+      lines+=("${HBA_TYPE}    ${db}    ${role}    ${cidr}    scram-sha-256")
+    done
+    for line in "${lines[@]}"; do
+      sudo grep -qxF "$line" "$PG_HBA" || echo "$line" | sudo tee -a "$PG_HBA" > /dev/null
+    done
+  done <<< "$HBA_ROLES"
+  sudo systemctl reload postgresql
+  echo "Restored ${RESTORE_FROM} from backup ${BACKUP_NAME} (target: ${RESTORE_TARGET_TIME:-latest})"
+elif [ -n "$PRIMARY_HOST" ]; then
+  # Replace the empty cluster with a base backup of the primary through a slot
+  # named after this host. The primary may still be installing, so retry.
+  SLOT=$(hostname | tr -c 'a-z0-9_\n' '_')
+  sudo systemctl stop postgresql
+  for i in $(seq 1 60); do
+    sudo rm -rf "$PG_DATA"
+    if sudo -u postgres PGPASSWORD="$REPLICATION_PASSWORD" pg_basebackup -h "$PRIMARY_HOST" -U "$REPLICATION_USER" \
+      -D "$PG_DATA" -X stream -R -C -S "$SLOT"; then
+      break
+    fi
+    if [ "$i" -eq 60 ]; then
+      echo "Could not clone primary ${PRIMARY_HOST}"
+      exit 1
+    fi
+    sleep 10
+  done
+  echo "Cloned primary ${PRIMARY_HOST}, streaming through slot ${SLOT}"
+elif [ -n "$MIGRATE_FROM" ]; then
+  # Discovery and DNS skip the VM as primary until the deployer cuts over
+  sudo touch /etc/postgresql/slicer-migrating
+  echo "Waiting for the dump of ${MIGRATE_FROM}"
+else
+  # Create database and user following Gitea recommendations:
+  # - Use CREATE ROLE with LOGIN
+  # - Create database with proper encoding (template0, UTF8, en_US.UTF-8)
+  sudo -u postgres psql <<EOF
 CREATE ROLE ${POSTGRES_USER} WITH LOGIN PASSWORD '${POSTGRES_PASSWORD}';
 CREATE DATABASE ${POSTGRES_DB} WITH OWNER ${POSTGRES_USER} TEMPLATE template0 ENCODING UTF8 LC_COLLATE 'en_US.UTF-8' LC_CTYPE 'en_US.UTF-8';
 GRANT ALL PRIVILEGES ON DATABASE ${POSTGRES_DB} TO ${POSTGRES_USER};
+CREATE ROLE ${REPLICATION_USER} WITH REPLICATION LOGIN PASSWORD '${REPLICATION_PASSWORD}';
 EOF
+fi
 
 # Restart PostgreSQL to apply config changes
 sudo systemctl restart postgresql
 
+# Take a first base backup so the instance can be restored right away,
+# a standby only archives once it is promoted and an upgrade target once
+# the dump is loaded
+if [ -n "$BACKUP_S3_ENDPOINT" ] && [ -z "$PRIMARY_HOST" ] && [ -z "$MIGRATE_FROM" ]; then
+  sudo systemctl start wal-g-backup.service
+fi
+
+# Pool client connections with PgBouncer on a separate port. It reaches
+# PostgreSQL over loopback TCP, as the local socket would peer-authenticate
+# every role as the postgres OS user PgBouncer runs as. Standbys and upgrade
+# targets run it too so it keeps working once they become the primary.
+if [ -n "$PGBOUNCER_PORT" ]; then
+  if ! sudo grep -qE '^host[[:space:]]+all[[:space:]]+all[[:space:]]+127\.0\.0\.1/32[[:space:]]+scram-sha-256' "$PG_HBA"; then
+    echo "host    all    all    127.0.0.1/32    scram-sha-256" | sudo tee -a "$PG_HBA"
+    sudo systemctl reload postgresql
+  fi
+  sudo -E apt-get install -y pgbouncer
+  cat <<'EOF' | sudo tee /etc/pgbouncer/pgbouncer.ini > /dev/null
+{{PGBOUNCER_INI}}
+EOF
+  cat <<'EOF' | sudo tee /etc/pgbouncer/userlist.txt > /dev/null
+{{PGBOUNCER_USERLIST}}
+EOF
+  sudo chown postgres:postgres /etc/pgbouncer/pgbouncer.ini /etc/pgbouncer/userlist.txt
+  sudo chmod 640 /etc/pgbouncer/pgbouncer.ini /etc/pgbouncer/userlist.txt
+  sudo systemctl enable pgbouncer
+  sudo systemctl restart pgbouncer
+fi
+
+# Tell the deployer that installation has finished
+sudo touch /etc/postgresql/slicer-ready
+
+# An upgrade target gets the roles and passwords of the source
+if [ -n "$MIGRATE_FROM" ]; then
+  echo "PostgreSQL ready for migration from ${MIGRATE_FROM}"
+  exit 0
+fi
+
+# A restored instance keeps the roles and passwords of the original
+if [ -n "$RESTORE_FROM" ]; then
+  echo "PostgreSQL restore complete!"
+  exit 0
+fi
+
+# A standby has the roles and passwords of its primary
+if [ -n "$PRIMARY_HOST" ]; then
+  echo "PostgreSQL standby of ${PRIMARY_HOST} complete!"
+  exit 0
+fi
+
 # Save credentials to a file for reference
 cat <<EOF | sudo tee /home/ubuntu/postgres-credentials.txt
 PostgreSQL Credentials
@@ -59,6 +402,7 @@ Port: 5432
 Database: ${POSTGRES_DB}
 Username: ${POSTGRES_USER}
 Password: ${POSTGRES_PASSWORD}
+PgBouncer port: ${PGBOUNCER_PORT:-disabled}
 
 Connection string:
 postgresql://${POSTGRES_USER}:${POSTGRES_PASSWORD}@$(hostname -I | awk '{print $1}'):5432/${POSTGRES_DB}
@@ -0,0 +1,62 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+// TokenNameFile records on a VM the name of the access token it pushes with,
+// so the token can be revoked when the VM is deleted
+const TokenNameFile = "/etc/slicer/registry-token-name"
+
+// Auth is a registry and the account that pushes to it. The zero value
+// configures nothing.
+type Auth struct {
+	Host     string // host:port, e.g. the Gitea web address
+	User     string
+	Password string // password or access token
+	// Insecure talks plain HTTP to the registry
+	Insecure bool
+	// TokenName names the Gitea access token in Password, empty when the
+	// password was given
+	TokenName string
+}
+
+// Enabled reports whether a registry is set
+func (a Auth) Enabled() bool {
+	return a.Host != ""
+}
+
+// DockerConfig returns a ~/.docker/config.json that logs in to the registry,
+// which docker, buildctl and buildx all read
+func (a Auth) DockerConfig() string {
+	if !a.Enabled() {
+		return ""
+	}
+	config := map[string]any{
+		"auths": map[string]any{
+			a.Host: map[string]string{
+				"auth": base64.StdEncoding.EncodeToString([]byte(a.User + ":" + a.Password)),
+			},
+		},
+	}
+	data, _ := json.MarshalIndent(config, "", "  ")
+	return string(data)
+}
+
+// ReadTokenName returns the access token name a VM recorded, empty when it
+// has none
+func ReadTokenName(ctx context.Context, client *sdk.SlicerClient, hostname string) (string, error) {
+	out, err := vmexec.Run(ctx, client, hostname, fmt.Sprintf("cat %s 2>/dev/null || true", TokenNameFile))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s on %s: %w", TokenNameFile, hostname, err)
+	}
+	return strings.TrimSpace(out), nil
+}
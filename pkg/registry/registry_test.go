@@ -0,0 +1,49 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+func TestDockerConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		auth     Auth
+		wantAuth string
+	}{
+		{name: "disabled", auth: Auth{User: "u", Password: "p"}},
+		{name: "gitea", auth: Auth{Host: "192.168.137.5:3000", User: "gitea_admin", Password: "token", Insecure: true}, wantAuth: "gitea_admin:token"},
+		{name: "colon in password", auth: Auth{Host: "registry.example.com", User: "u", Password: "a:b"}, wantAuth: "u:a:b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.auth.DockerConfig()
+			if tt.wantAuth == "" {
+				if got != "" {
+					t.Errorf("DockerConfig() = %q, want empty", got)
+				}
+				return
+			}
+
+			var config struct {
+				Auths map[string]struct {
+					Auth string `json:"auth"`
+				} `json:"auths"`
+			}
+			if err := json.Unmarshal([]byte(got), &config); err != nil {
+				t.Fatalf("DockerConfig() is not JSON: %v\n%s", err, got)
+			}
+			if len(config.Auths) != 1 {
+				t.Fatalf("DockerConfig() auths = %v, want only %s", config.Auths, tt.auth.Host)
+			}
+			decoded, err := base64.StdEncoding.DecodeString(config.Auths[tt.auth.Host].Auth)
+			if err != nil {
+				t.Fatalf("auth is not base64: %v", err)
+			}
+			if string(decoded) != tt.wantAuth {
+				t.Errorf("auth = %q, want %q", decoded, tt.wantAuth)
+			}
+		})
+	}
+}
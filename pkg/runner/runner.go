@@ -8,6 +8,11 @@ import (
 	"strings"
 
 	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/dns"
+	"github.com/gaarutyunov/slicer/pkg/registry"
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+	"github.com/gaarutyunov/slicer/pkg/vmspec"
 )
 
 //go:embed userdata.sh
@@ -19,6 +24,8 @@ const (
 	DefaultRAMGB       = 4
 	DefaultStorageSize = "100G"
 	DefaultVersion     = "0.2.11"
+	// InfoFile records the name the runner registered with
+	InfoFile = "/home/ubuntu/runner-info.txt"
 )
 
 type Config struct {
@@ -29,12 +36,19 @@ type Config struct {
 	SSHKeys     []string
 	GitHubUser  string
 	Tags        []string
+	Image       string
+	Hypervisor  string
+	Storage     string
+	// DNS points the VM at the stack DNS server so configs can use names
+	DNS dns.Resolver
 	// Runner configuration
 	GiteaURL    string // Gitea instance URL (e.g., http://192.168.137.10:3000)
 	RunnerToken string // Registration token from Gitea admin
 	RunnerName  string // Optional runner name
 	Labels      string // Optional labels (e.g., ubuntu-latest:docker://node:16-bullseye)
 	Version     string // act_runner version
+	// Registry is logged in for root and ubuntu and passed to job containers
+	Registry registry.Auth
 }
 
 func DefaultConfig() Config {
@@ -43,17 +57,27 @@ func DefaultConfig() Config {
 		hostGroup = DefaultHostGroup
 	}
 
+	image, hypervisor, storage := vmspec.Default("RUNNER")
+
 	return Config{
 		HostGroup:   hostGroup,
 		VCPU:        DefaultVCPU,
 		RAMGB:       DefaultRAMGB,
 		StorageSize: DefaultStorageSize,
+		Image:       image,
+		Hypervisor:  hypervisor,
+		Storage:     storage,
 		Tags:        []string{"runner"},
 		Version:     DefaultVersion,
 		Labels:      "ubuntu-latest:docker://node:16-bullseye,ubuntu-22.04:docker://node:16-bullseye,ubuntu-20.04:docker://node:16-bullseye",
 	}
 }
 
+// Validate checks the image, hypervisor and storage backend combination
+func (c Config) Validate() error {
+	return vmspec.Validate(c.Image, c.Hypervisor, c.Storage, c.StorageSize)
+}
+
 type Deployer struct {
 	client *sdk.SlicerClient
 	config Config
@@ -88,7 +112,7 @@ func (d *Deployer) Deploy(ctx context.Context) (*sdk.SlicerCreateNodeResponse, e
 	req := sdk.SlicerCreateNodeRequest{
 		RamGB:    d.config.RAMGB,
 		CPUs:     d.config.VCPU,
-		Userdata: userdata,
+		Userdata: d.config.DNS.Apply(userdata),
 	}
 
 	if len(d.config.SSHKeys) > 0 {
@@ -113,9 +137,33 @@ func generateUserdata(config Config) string {
 	userdata = strings.ReplaceAll(userdata, "{{RUNNER_NAME}}", config.RunnerName)
 	userdata = strings.ReplaceAll(userdata, "{{RUNNER_LABELS}}", config.Labels)
 	userdata = strings.ReplaceAll(userdata, "{{RUNNER_VERSION}}", config.Version)
+	userdata = strings.ReplaceAll(userdata, "{{REGISTRY_HOST}}", config.Registry.Host)
+	userdata = strings.ReplaceAll(userdata, "{{REGISTRY_INSECURE}}", fmt.Sprintf("%t", config.Registry.Insecure))
+	userdata = strings.ReplaceAll(userdata, "{{DOCKER_CONFIG}}", config.Registry.DockerConfig())
+	userdata = strings.ReplaceAll(userdata, "{{REGISTRY_TOKEN_NAME}}", config.Registry.TokenName)
 	return userdata
 }
 
+// RegisteredName reads the name a runner VM registered with Gitea, which is
+// RunnerName or the hostname
+func (d *Deployer) RegisteredName(ctx context.Context, hostname string) (string, error) {
+	out, err := vmexec.Run(ctx, d.client, hostname, "cat "+InfoFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s on %s: %w", InfoFile, hostname, err)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if name, ok := strings.CutPrefix(strings.TrimSpace(line), "Runner Name:"); ok {
+			return strings.TrimSpace(name), nil
+		}
+	}
+	return "", fmt.Errorf("no runner name in %s on %s", InfoFile, hostname)
+}
+
+// RegistryTokenName returns the name of the access token a VM pushes with
+func (d *Deployer) RegistryTokenName(ctx context.Context, hostname string) (string, error) {
+	return registry.ReadTokenName(ctx, d.client, hostname)
+}
+
 func (d *Deployer) Delete(ctx context.Context, hostname string) error {
 	_, err := d.client.DeleteVM(ctx, d.config.HostGroup, hostname)
 	return err
@@ -141,7 +189,7 @@ func GenerateYAML(config Config, githubUser string) string {
 	return fmt.Sprintf(`config:
   host_groups:
   - name: %s
-    storage: image
+    storage: %s
     storage_size: %s
     count: 0
     vcpu: %d
@@ -153,13 +201,13 @@ func GenerateYAML(config Config, githubUser string) string {
 
   github_user: %s
 
-  image: "ghcr.io/openfaasltd/slicer-systemd:5.10.240-x86_64-latest"
+  image: "%s"
 
-  hypervisor: firecracker
+  hypervisor: %s
 
   api:
     port: 8080
     bind_address: "127.0.0.1"
-`, config.HostGroup, config.StorageSize, config.VCPU, config.RAMGB,
-		config.HostGroup, config.HostGroup, githubUser)
+`, config.HostGroup, config.Storage, config.StorageSize, config.VCPU, config.RAMGB,
+		config.HostGroup, config.HostGroup, githubUser, config.Image, config.Hypervisor)
 }
@@ -11,8 +11,30 @@ RUNNER_NAME="{{RUNNER_NAME}}"
 RUNNER_LABELS="{{RUNNER_LABELS}}"
 RUNNER_VERSION="{{RUNNER_VERSION}}"
 
+# Registry workflows push images to (injected by deployer), empty for none.
+# REGISTRY_INSECURE talks plain HTTP, as the Gitea registry does.
+REGISTRY_HOST="{{REGISTRY_HOST}}"
+REGISTRY_INSECURE="{{REGISTRY_INSECURE}}"
+DOCKER_CONFIG_JSON=$(cat <<'REGISTRY_EOF'
+{{DOCKER_CONFIG}}
+REGISTRY_EOF
+)
+REGISTRY_TOKEN_NAME="{{REGISTRY_TOKEN_NAME}}"
+
+# Remember the access token so deleting the VM can revoke it
+if [ -n "$REGISTRY_TOKEN_NAME" ]; then
+    sudo mkdir -p /etc/slicer
+    echo "$REGISTRY_TOKEN_NAME" | sudo tee /etc/slicer/registry-token-name > /dev/null
+fi
+
 export DEBIAN_FRONTEND=noninteractive
 
+# Docker reads daemon.json when the package starts it
+if [ -n "$REGISTRY_HOST" ] && [ "$REGISTRY_INSECURE" = "true" ]; then
+    sudo mkdir -p /etc/docker
+    echo "{\"insecure-registries\": [\"${REGISTRY_HOST}\"]}" | sudo tee /etc/docker/daemon.json > /dev/null
+fi
+
 # Install Docker
 sudo -E apt-get update
 sudo -E apt-get install -y ca-certificates curl gnupg
@@ -36,6 +58,16 @@ sudo usermod -aG docker ubuntu
 sudo systemctl enable docker
 sudo systemctl start docker
 
+# Log root and ubuntu in to the registry, jobs get root's login mounted
+if [ -n "$REGISTRY_HOST" ]; then
+    for home in /root /home/ubuntu; do
+        sudo mkdir -p "$home/.docker"
+        echo "$DOCKER_CONFIG_JSON" | sudo tee "$home/.docker/config.json" > /dev/null
+        sudo chmod 600 "$home/.docker/config.json"
+    done
+    sudo chown -R ubuntu:ubuntu /home/ubuntu/.docker
+fi
+
 # Download act_runner
 RUNNER_DIR="/opt/act_runner"
 sudo mkdir -p "${RUNNER_DIR}"
@@ -55,8 +87,27 @@ if [ -z "${RUNNER_NAME}" ]; then
     RUNNER_NAME=$(hostname)
 fi
 
+# Jobs run in containers on the host docker daemon. With a registry they get
+# its address as $REGISTRY and the docker login of root, so docker build and
+# docker push work without a login step.
+RUNNER_CONFIG="${RUNNER_DIR}/config.yaml"
+if [ -n "$REGISTRY_HOST" ]; then
+    cat <<EOF | sudo tee "${RUNNER_CONFIG}" > /dev/null
+runner:
+  file: .runner
+  envs:
+    REGISTRY: ${REGISTRY_HOST}
+container:
+  options: -v /root/.docker/config.json:/root/.docker/config.json:ro
+  valid_volumes:
+    - /root/.docker/config.json
+EOF
+else
+    sudo ./act_runner generate-config | sudo tee "${RUNNER_CONFIG}" > /dev/null
+fi
+
 # Register runner with Gitea
-sudo ./act_runner register \
+sudo ./act_runner --config "${RUNNER_CONFIG}" register \
     --instance "${GITEA_URL}" \
     --token "${RUNNER_TOKEN}" \
     --name "${RUNNER_NAME}" \
@@ -74,7 +125,7 @@ Requires=docker.service
 Type=simple
 User=root
 WorkingDirectory=${RUNNER_DIR}
-ExecStart=${RUNNER_DIR}/act_runner daemon
+ExecStart=${RUNNER_DIR}/act_runner --config ${RUNNER_CONFIG} daemon
 Restart=always
 RestartSec=10
 
@@ -97,12 +148,14 @@ Gitea Instance: ${GITEA_URL}
 Runner Name: ${RUNNER_NAME}
 Runner Labels: ${RUNNER_LABELS}
 Runner Version: ${RUNNER_VERSION}
+Registry: ${REGISTRY_HOST:-none}
 
 Status: sudo systemctl status act_runner
 Logs: sudo journalctl -u act_runner -f
 Restart: sudo systemctl restart act_runner
 
-Config: ${RUNNER_DIR}/.runner
+Config: ${RUNNER_CONFIG}
+Registration: ${RUNNER_DIR}/.runner
 EOF
 
 sudo chown ubuntu:ubuntu /home/ubuntu/runner-info.txt
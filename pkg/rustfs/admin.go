@@ -0,0 +1,221 @@
+package rustfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+// adminPrefix is the MinIO-compatible admin API RustFS serves
+const adminPrefix = "/minio/admin/v3"
+
+// ConfigFile holds the root credentials on the RustFS VM
+const ConfigFile = "/etc/default/rustfs"
+
+// Policy is an S3 IAM policy document
+type Policy struct {
+	Version   string            `json:"Version"`
+	Statement []PolicyStatement `json:"Statement"`
+}
+
+// PolicyStatement allows or denies actions on resources
+type PolicyStatement struct {
+	Effect   string   `json:"Effect"`
+	Action   []string `json:"Action"`
+	Resource []string `json:"Resource"`
+}
+
+// BucketPolicy allows reading, writing and listing one bucket and nothing else
+func BucketPolicy(bucket string) Policy {
+	return Policy{
+		Version: "2012-10-17",
+		Statement: []PolicyStatement{
+			{
+				Effect:   "Allow",
+				Action:   []string{"s3:GetBucketLocation", "s3:ListBucket", "s3:ListBucketMultipartUploads"},
+				Resource: []string{"arn:aws:s3:::" + bucket},
+			},
+			{
+				Effect: "Allow",
+				Action: []string{
+					"s3:GetObject", "s3:PutObject", "s3:DeleteObject",
+					"s3:AbortMultipartUpload", "s3:ListMultipartUploadParts",
+				},
+				Resource: []string{"arn:aws:s3:::" + bucket + "/*"},
+			},
+		},
+	}
+}
+
+// BucketPolicyName is the name CreateScopedUser stores a bucket's policy under
+func BucketPolicyName(bucket string) string {
+	return bucket + "-readwrite"
+}
+
+// AddUser creates a user, or sets the secret key of an existing one
+func (c *Client) AddUser(ctx context.Context, accessKey, secretKey string) error {
+	body, err := json.Marshal(map[string]string{"secretKey": secretKey, "status": "enabled"})
+	if err != nil {
+		return fmt.Errorf("failed to encode user: %w", err)
+	}
+	// The admin API only accepts credentials encrypted with the caller's secret key
+	encrypted, err := encryptData(c.SecretKey, body)
+	if err != nil {
+		return err
+	}
+	if err := c.admin(ctx, http.MethodPut, "add-user", url.Values{"accessKey": {accessKey}}, encrypted); err != nil {
+		return fmt.Errorf("failed to add user %s: %w", accessKey, err)
+	}
+	return nil
+}
+
+// AddPolicy creates or replaces a named policy
+func (c *Client) AddPolicy(ctx context.Context, name string, policy Policy) error {
+	body, err := json.Marshal(policy)
+	if err != nil {
+		return fmt.Errorf("failed to encode policy: %w", err)
+	}
+	if err := c.admin(ctx, http.MethodPut, "add-canned-policy", url.Values{"name": {name}}, body); err != nil {
+		return fmt.Errorf("failed to add policy %s: %w", name, err)
+	}
+	return nil
+}
+
+// AttachPolicy sets the policies of a user, replacing any attached before.
+// Several policies are comma separated.
+func (c *Client) AttachPolicy(ctx context.Context, user string, policies ...string) error {
+	query := url.Values{
+		"policyName":  {strings.Join(policies, ",")},
+		"userOrGroup": {user},
+		"isGroup":     {"false"},
+	}
+	if err := c.admin(ctx, http.MethodPut, "set-user-or-group-policy", query, nil); err != nil {
+		return fmt.Errorf("failed to attach %s to %s: %w", strings.Join(policies, ","), user, err)
+	}
+	return nil
+}
+
+// CreateScopedUser creates a user whose key can only use one bucket, creating
+// the bucket and its policy when missing
+func (c *Client) CreateScopedUser(ctx context.Context, accessKey, secretKey, bucket string) error {
+	if err := c.CreateBucket(ctx, bucket); err != nil {
+		return err
+	}
+	if err := c.AddPolicy(ctx, BucketPolicyName(bucket), BucketPolicy(bucket)); err != nil {
+		return err
+	}
+	if err := c.AddUser(ctx, accessKey, secretKey); err != nil {
+		return err
+	}
+	return c.AttachPolicy(ctx, accessKey, BucketPolicyName(bucket))
+}
+
+// admin sends a request to the admin API
+func (c *Client) admin(ctx context.Context, method, action string, query url.Values, body []byte) error {
+	res, err := c.do(ctx, method, adminPrefix+"/"+action, query, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return checkResponse(res)
+}
+
+// AdminCredentials reads the root access and secret key from a RustFS VM
+func (d *Deployer) AdminCredentials(ctx context.Context, hostname string) (*Credentials, error) {
+	out, err := vmexec.Run(ctx, d.client, hostname, "cat "+ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s on %s: %w", ConfigFile, hostname, err)
+	}
+
+	creds := &Credentials{}
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		switch key {
+		case "RUSTFS_ACCESS_KEY":
+			creds.User = value
+		case "RUSTFS_SECRET_KEY":
+			creds.Password = value
+		}
+	}
+	if creds.User == "" || creds.Password == "" {
+		return nil, fmt.Errorf("no credentials in %s on %s", ConfigFile, hostname)
+	}
+	return creds, nil
+}
+
+// encryptData encrypts an admin request body the way MinIO's madmin does:
+// salt, algorithm ID and nonce, followed by an AES-256-GCM stream keyed with
+// argon2id of the secret key
+func encryptData(password string, data []byte) ([]byte, error) {
+	const (
+		argon2idAESGCM = 0x00
+		bufSize        = 16 * 1024
+	)
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, 1, 64*1024, 4, 32)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	// The stream nonce is the AEAD nonce without its 4-byte sequence number
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce[:aead.NonceSize()-4]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	var out bytes.Buffer
+	out.Write(salt)
+	out.WriteByte(argon2idAESGCM)
+	out.Write(nonce[:aead.NonceSize()-4])
+
+	var seq uint32
+	nextNonce := func() []byte {
+		binary.LittleEndian.PutUint32(nonce[aead.NonceSize()-4:], seq)
+		seq++
+		return nonce
+	}
+
+	// Sequence number 0 authenticates the (empty) associated data, every
+	// fragment is then bound to it with a flag marking the final one
+	ad := make([]byte, 1+aead.Overhead())
+	aead.Seal(ad[1:1], nextNonce(), nil, nil)
+
+	for {
+		n := min(len(data), bufSize)
+		final := n == len(data)
+		if final {
+			ad[0] = 0x80
+		}
+		out.Write(aead.Seal(nil, nextNonce(), data[:n], ad))
+		if final {
+			return out.Bytes(), nil
+		}
+		data = data[n:]
+	}
+}
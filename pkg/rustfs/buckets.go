@@ -0,0 +1,465 @@
+package rustfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// lifecycleRuleID names the lifecycle rule BucketSpec manages
+const lifecycleRuleID = "slicer-expiry"
+
+// BucketSpec declares the settings of one bucket. Applying it replaces the
+// bucket's lifecycle configuration with the declared expiry.
+type BucketSpec struct {
+	Name string `json:"name"`
+	// Versioning keeps every version of an object. Once enabled it can only
+	// be suspended.
+	Versioning bool `json:"versioning,omitempty"`
+	// ExpireDays deletes objects under ExpirePrefix this many days after
+	// they were written, 0 keeps them
+	ExpireDays   int    `json:"expireDays,omitempty"`
+	ExpirePrefix string `json:"expirePrefix,omitempty"`
+	// NoncurrentExpireDays deletes versions this many days after they were
+	// replaced, 0 keeps them
+	NoncurrentExpireDays int `json:"noncurrentExpireDays,omitempty"`
+	// Quota caps the bucket size, e.g. 20GiB, empty for no limit
+	Quota string `json:"quota,omitempty"`
+}
+
+// BucketPolicies declares the buckets of a RustFS VM
+type BucketPolicies struct {
+	Buckets []BucketSpec `json:"buckets"`
+}
+
+// DefaultBucketPolicies versions the Gitea bucket and keeps CI artifacts and
+// the BuildKit cache from filling the data volume
+func DefaultBucketPolicies() BucketPolicies {
+	return BucketPolicies{Buckets: []BucketSpec{
+		{Name: "gitea", Versioning: true, NoncurrentExpireDays: 30},
+		{Name: "ci-artifacts", ExpireDays: 14, Quota: "20GiB"},
+		{Name: "buildkit-cache", ExpireDays: 30, Quota: "20GiB"},
+	}}
+}
+
+// LoadBucketPolicies reads bucket policies from a YAML file
+func LoadBucketPolicies(path string) (BucketPolicies, error) {
+	var p BucketPolicies
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return p, fmt.Errorf("failed to read bucket policies: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return p, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return p, p.Validate()
+}
+
+// Validate checks every bucket spec
+func (p BucketPolicies) Validate() error {
+	seen := map[string]bool{}
+	for _, b := range p.Buckets {
+		if b.Name == "" {
+			return fmt.Errorf("bucket name is required")
+		}
+		if seen[b.Name] {
+			return fmt.Errorf("bucket %s is declared twice", b.Name)
+		}
+		seen[b.Name] = true
+		if b.ExpireDays < 0 || b.NoncurrentExpireDays < 0 {
+			return fmt.Errorf("bucket %s: expiry days must not be negative", b.Name)
+		}
+		if b.NoncurrentExpireDays > 0 && !b.Versioning {
+			return fmt.Errorf("bucket %s: noncurrent version expiry needs versioning", b.Name)
+		}
+		if _, err := ParseSize(b.Quota); err != nil {
+			return fmt.Errorf("bucket %s: %w", b.Name, err)
+		}
+	}
+	return nil
+}
+
+// BucketState is what is currently configured on a bucket
+type BucketState struct {
+	Exists bool
+	// Versioning is Enabled, Suspended, or empty when never enabled
+	Versioning           string
+	ExpireDays           int
+	ExpirePrefix         string
+	NoncurrentExpireDays int
+	// OtherRules counts lifecycle rules not managed by BucketSpec
+	OtherRules int
+	QuotaBytes int64
+}
+
+// Drift is a setting whose current value differs from the declared one
+type Drift struct {
+	Bucket  string
+	Setting string
+	Current string
+	Desired string
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("%s: %s %s -> %s", d.Bucket, d.Setting, d.Current, d.Desired)
+}
+
+// Diff compares a bucket's state with its spec, failing on an invalid quota
+func (b BucketSpec) Diff(state BucketState) ([]Drift, error) {
+	var drift []Drift
+	add := func(setting, current, desired string) {
+		if current != desired {
+			drift = append(drift, Drift{Bucket: b.Name, Setting: setting, Current: current, Desired: desired})
+		}
+	}
+
+	add("exists", strconv.FormatBool(state.Exists), "true")
+
+	versioning := state.Versioning
+	if versioning == "" {
+		versioning = "Off"
+	}
+	switch {
+	case b.Versioning:
+		add("versioning", versioning, "Enabled")
+	case versioning == "Enabled":
+		add("versioning", versioning, "Suspended")
+	}
+
+	add("expiry", expiryString(state.ExpireDays, state.ExpirePrefix), expiryString(b.ExpireDays, b.ExpirePrefix))
+	add("noncurrent expiry", daysString(state.NoncurrentExpireDays), daysString(b.NoncurrentExpireDays))
+	if state.OtherRules > 0 {
+		add("other lifecycle rules", strconv.Itoa(state.OtherRules), "0")
+	}
+
+	quota, err := ParseSize(b.Quota)
+	if err != nil {
+		return nil, fmt.Errorf("bucket %s: %w", b.Name, err)
+	}
+	add("quota", FormatSize(state.QuotaBytes), FormatSize(quota))
+	return drift, nil
+}
+
+// BucketState reads the versioning, lifecycle and quota of a bucket
+func (c *Client) BucketState(ctx context.Context, bucket string) (*BucketState, error) {
+	state := &BucketState{}
+
+	buckets, err := c.ListBuckets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range buckets {
+		if b.Name == bucket {
+			state.Exists = true
+		}
+	}
+	if !state.Exists {
+		return state, nil
+	}
+
+	var versioning versioningConfiguration
+	if err := c.getXML(ctx, bucket, "versioning", &versioning); err != nil {
+		return nil, fmt.Errorf("failed to get versioning of %s: %w", bucket, err)
+	}
+	state.Versioning = versioning.Status
+
+	var lifecycle lifecycleConfiguration
+	if err := c.getXML(ctx, bucket, "lifecycle", &lifecycle); err != nil && !errors.Is(err, errNotFound) {
+		return nil, fmt.Errorf("failed to get lifecycle of %s: %w", bucket, err)
+	}
+	for _, rule := range lifecycle.Rules {
+		if rule.ID != lifecycleRuleID {
+			state.OtherRules++
+			continue
+		}
+		if rule.Expiration != nil {
+			state.ExpireDays = rule.Expiration.Days
+			state.ExpirePrefix = rule.Filter.Prefix
+		}
+		if rule.NoncurrentVersionExpiration != nil {
+			state.NoncurrentExpireDays = rule.NoncurrentVersionExpiration.NoncurrentDays
+		}
+	}
+
+	quota, err := c.bucketQuota(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	state.QuotaBytes = quota
+	return state, nil
+}
+
+// ApplyBucket reconciles a bucket with its spec, changing only the settings
+// that drifted, and returns what it changed
+func (c *Client) ApplyBucket(ctx context.Context, spec BucketSpec) ([]Drift, error) {
+	state, err := c.BucketState(ctx, spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	drift, err := spec.Diff(*state)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range drift {
+		switch d.Setting {
+		case "exists":
+			err = c.CreateBucket(ctx, spec.Name)
+		case "versioning":
+			err = c.SetVersioning(ctx, spec.Name, spec.Versioning)
+		case "quota":
+			var quota int64
+			if quota, err = ParseSize(spec.Quota); err == nil {
+				err = c.SetBucketQuota(ctx, spec.Name, quota)
+			}
+		}
+		if err != nil {
+			return drift, err
+		}
+	}
+
+	// Expiry settings share one lifecycle configuration, written once
+	for _, d := range drift {
+		if d.Setting == "expiry" || d.Setting == "noncurrent expiry" || d.Setting == "other lifecycle rules" {
+			return drift, c.SetLifecycle(ctx, spec)
+		}
+	}
+	return drift, nil
+}
+
+// SetVersioning enables or suspends versioning on a bucket
+func (c *Client) SetVersioning(ctx context.Context, bucket string, enabled bool) error {
+	status := "Suspended"
+	if enabled {
+		status = "Enabled"
+	}
+	body, err := xml.Marshal(versioningConfiguration{Status: status})
+	if err != nil {
+		return fmt.Errorf("failed to encode versioning: %w", err)
+	}
+	if err := c.bucketRequest(ctx, http.MethodPut, bucket, "versioning", body); err != nil {
+		return fmt.Errorf("failed to set versioning of %s: %w", bucket, err)
+	}
+	return nil
+}
+
+// SetLifecycle replaces the lifecycle configuration of a bucket with the
+// expiry of its spec, removing it when the spec expires nothing
+func (c *Client) SetLifecycle(ctx context.Context, spec BucketSpec) error {
+	if spec.ExpireDays == 0 && spec.NoncurrentExpireDays == 0 {
+		if err := c.bucketRequest(ctx, http.MethodDelete, spec.Name, "lifecycle", nil); err != nil {
+			return fmt.Errorf("failed to remove lifecycle of %s: %w", spec.Name, err)
+		}
+		return nil
+	}
+
+	rule := lifecycleRule{ID: lifecycleRuleID, Status: "Enabled", Filter: lifecycleFilter{Prefix: spec.ExpirePrefix}}
+	if spec.ExpireDays > 0 {
+		rule.Expiration = &lifecycleExpiration{Days: spec.ExpireDays}
+	}
+	if spec.NoncurrentExpireDays > 0 {
+		rule.NoncurrentVersionExpiration = &noncurrentExpiration{NoncurrentDays: spec.NoncurrentExpireDays}
+	}
+	body, err := xml.Marshal(lifecycleConfiguration{Rules: []lifecycleRule{rule}})
+	if err != nil {
+		return fmt.Errorf("failed to encode lifecycle: %w", err)
+	}
+	if err := c.bucketRequest(ctx, http.MethodPut, spec.Name, "lifecycle", body); err != nil {
+		return fmt.Errorf("failed to set lifecycle of %s: %w", spec.Name, err)
+	}
+	return nil
+}
+
+// SetBucketQuota caps a bucket at quota bytes, 0 removes the limit
+func (c *Client) SetBucketQuota(ctx context.Context, bucket string, quota int64) error {
+	body, err := json.Marshal(bucketQuota{Quota: quota, QuotaType: "hard"})
+	if err != nil {
+		return fmt.Errorf("failed to encode quota: %w", err)
+	}
+	if err := c.admin(ctx, http.MethodPut, "set-bucket-quota", url.Values{"bucket": {bucket}}, body); err != nil {
+		return fmt.Errorf("failed to set quota of %s: %w", bucket, err)
+	}
+	return nil
+}
+
+// bucketQuota returns the hard quota of a bucket in bytes, 0 when unlimited
+func (c *Client) bucketQuota(ctx context.Context, bucket string) (int64, error) {
+	res, err := c.do(ctx, http.MethodGet, adminPrefix+"/get-bucket-quota", url.Values{"bucket": {bucket}}, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get quota of %s: %w", bucket, err)
+	}
+	defer res.Body.Close()
+	if err := checkResponse(res); err != nil {
+		return 0, fmt.Errorf("failed to get quota of %s: %w", bucket, err)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read quota of %s: %w", bucket, err)
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return 0, nil
+	}
+	var quota bucketQuota
+	if err := json.Unmarshal(body, &quota); err != nil {
+		return 0, fmt.Errorf("failed to decode quota of %s: %w", bucket, err)
+	}
+	return quota.Quota, nil
+}
+
+// errNotFound is returned by getXML when the bucket has no such configuration
+var errNotFound = errors.New("not found")
+
+// getXML reads a bucket subresource such as ?versioning into v
+func (c *Client) getXML(ctx context.Context, bucket, subresource string, v any) error {
+	res, err := c.do(ctx, http.MethodGet, "/"+bucket, url.Values{subresource: {""}}, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if err := checkResponse(res); err != nil {
+		return err
+	}
+	if err := xml.NewDecoder(res.Body).Decode(v); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to decode %s: %w", subresource, err)
+	}
+	return nil
+}
+
+// bucketRequest sends a request to a bucket subresource
+func (c *Client) bucketRequest(ctx context.Context, method, bucket, subresource string, body []byte) error {
+	res, err := c.do(ctx, method, "/"+bucket, url.Values{subresource: {""}}, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return checkResponse(res)
+}
+
+type versioningConfiguration struct {
+	XMLName xml.Name `xml:"VersioningConfiguration"`
+	Status  string   `xml:"Status,omitempty"`
+}
+
+type lifecycleConfiguration struct {
+	XMLName xml.Name        `xml:"LifecycleConfiguration"`
+	Rules   []lifecycleRule `xml:"Rule"`
+}
+
+type lifecycleRule struct {
+	ID                          string                `xml:"ID"`
+	Status                      string                `xml:"Status"`
+	Filter                      lifecycleFilter       `xml:"Filter"`
+	Expiration                  *lifecycleExpiration  `xml:"Expiration,omitempty"`
+	NoncurrentVersionExpiration *noncurrentExpiration `xml:"NoncurrentVersionExpiration,omitempty"`
+}
+
+type lifecycleFilter struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type lifecycleExpiration struct {
+	Days int `xml:"Days"`
+}
+
+type noncurrentExpiration struct {
+	NoncurrentDays int `xml:"NoncurrentDays"`
+}
+
+type bucketQuota struct {
+	Quota     int64  `json:"quota"`
+	QuotaType string `json:"quotatype,omitempty"`
+}
+
+var sizePattern = regexp.MustCompile(`(?i)^(\d+)\s*(?:([KMGT])(i?)B?|B)?$`)
+
+// sizeUnits are tried largest first when formatting, binary before decimal
+var sizeUnits = []struct {
+	name  string
+	bytes int64
+}{
+	{"TiB", 1 << 40}, {"TB", 1e12},
+	{"GiB", 1 << 30}, {"GB", 1e9},
+	{"MiB", 1 << 20}, {"MB", 1e6},
+	{"KiB", 1 << 10}, {"KB", 1e3},
+}
+
+// ParseSize parses a size such as 500MiB or 20GiB into bytes, "" is 0.
+// Binary units (GiB, Gi) are powers of 1024, decimal units (GB, G) powers
+// of 1000.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	m := sizePattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q, use e.g. 500MiB or 20GiB", s)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+	if m[2] == "" {
+		return n, nil
+	}
+	exp := strings.IndexByte("KMGT", strings.ToUpper(m[2])[0]) + 1
+	base := int64(1000)
+	if m[3] != "" {
+		base = 1024
+	}
+	for range exp {
+		if n > math.MaxInt64/base {
+			return 0, fmt.Errorf("invalid size %q: too large", s)
+		}
+		n *= base
+	}
+	return n, nil
+}
+
+// FormatSize renders bytes in the largest unit that divides them
+func FormatSize(n int64) string {
+	if n == 0 {
+		return "none"
+	}
+	for _, unit := range sizeUnits {
+		if n%unit.bytes == 0 {
+			return fmt.Sprintf("%d%s", n/unit.bytes, unit.name)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+func expiryString(days int, prefix string) string {
+	if days == 0 {
+		return "none"
+	}
+	if prefix == "" {
+		return daysString(days)
+	}
+	return fmt.Sprintf("%s under %s", daysString(days), prefix)
+}
+
+func daysString(days int) string {
+	if days == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%dd", days)
+}
@@ -0,0 +1,137 @@
+package rustfs
+
+import (
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "512", want: 512},
+		{in: "512B", want: 512},
+		{in: "1KiB", want: 1 << 10},
+		{in: "500MiB", want: 500 << 20},
+		{in: "20GiB", want: 20 << 30},
+		{in: "20gib", want: 20 << 30},
+		{in: "20Gi", want: 20 << 30},
+		{in: "2TiB", want: 2 << 40},
+		{in: "20GB", want: 20e9},
+		{in: "20G", want: 20e9},
+		{in: "1 MB", want: 1e6},
+		{in: "20XB", wantErr: true},
+		{in: "-1GiB", wantErr: true},
+		{in: "1.5GiB", wantErr: true},
+		{in: "99999999999TiB", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSize(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSize(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSize(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		in   int64
+		want string
+	}{
+		{0, "none"},
+		{20 << 30, "20GiB"},
+		{20e9, "20GB"},
+		{3072, "3KiB"},
+		{1000, "1KB"},
+		{1001, "1001B"},
+	}
+	for _, tt := range tests {
+		if got := FormatSize(tt.in); got != tt.want {
+			t.Errorf("FormatSize(%d) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultBucketPoliciesValidate(t *testing.T) {
+	if err := DefaultBucketPolicies().Validate(); err != nil {
+		t.Fatalf("default policies are invalid: %v", err)
+	}
+}
+
+func TestBucketSpecDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    BucketSpec
+		state   BucketState
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "missing bucket",
+			spec:  BucketSpec{Name: "b", Quota: "20GiB"},
+			state: BucketState{},
+			want:  []string{"exists", "quota"},
+		},
+		{
+			name:  "in sync",
+			spec:  BucketSpec{Name: "b", Versioning: true, ExpireDays: 14, NoncurrentExpireDays: 30, Quota: "20GiB"},
+			state: BucketState{Exists: true, Versioning: "Enabled", ExpireDays: 14, NoncurrentExpireDays: 30, QuotaBytes: 20 << 30},
+		},
+		{
+			name:  "versioning turned off is suspended",
+			spec:  BucketSpec{Name: "b"},
+			state: BucketState{Exists: true, Versioning: "Enabled"},
+			want:  []string{"versioning"},
+		},
+		{
+			name:  "never versioned stays off",
+			spec:  BucketSpec{Name: "b"},
+			state: BucketState{Exists: true},
+		},
+		{
+			name:  "expiry and foreign rules",
+			spec:  BucketSpec{Name: "b", ExpireDays: 7, ExpirePrefix: "tmp/"},
+			state: BucketState{Exists: true, ExpireDays: 7, OtherRules: 1},
+			want:  []string{"expiry", "other lifecycle rules"},
+		},
+		{
+			name:  "quota removed",
+			spec:  BucketSpec{Name: "b"},
+			state: BucketState{Exists: true, QuotaBytes: 1 << 30},
+			want:  []string{"quota"},
+		},
+		{
+			name:    "invalid quota",
+			spec:    BucketSpec{Name: "b", Quota: "lots"},
+			state:   BucketState{Exists: true},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drift, err := tt.spec.Diff(tt.state)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Diff() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, d := range drift {
+				got = append(got, d.Setting)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Diff() settings = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("Diff() settings = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
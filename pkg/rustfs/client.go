@@ -0,0 +1,343 @@
+package rustfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Region is the signing region RustFS accepts by default
+const Region = "us-east-1"
+
+// unsignedPayload lets uploads stream without hashing the body first
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Client talks to the RustFS S3 and admin APIs with SigV4-signed requests
+type Client struct {
+	Endpoint  string // host:port
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	http      *http.Client
+}
+
+// Bucket is a bucket returned by ListBuckets
+type Bucket struct {
+	Name         string    `xml:"Name"`
+	CreationDate time.Time `xml:"CreationDate"`
+}
+
+// Object is an object returned by ListObjects
+type Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+// NewClient creates a client for the API at endpoint (host:port)
+func NewClient(endpoint, accessKey, secretKey string, useSSL bool) *Client {
+	return &Client{
+		Endpoint:  endpoint,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		UseSSL:    useSSL,
+		http:      &http.Client{},
+	}
+}
+
+// CreateBucket creates a bucket, succeeding when it already exists
+func (c *Client) CreateBucket(ctx context.Context, bucket string) error {
+	res, err := c.do(ctx, http.MethodPut, "/"+bucket, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create bucket %s: %w", bucket, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusConflict {
+		return nil
+	}
+	if err := checkResponse(res); err != nil {
+		return fmt.Errorf("failed to create bucket %s: %w", bucket, err)
+	}
+	return nil
+}
+
+// ListBuckets returns every bucket the access key can see
+func (c *Client) ListBuckets(ctx context.Context) ([]Bucket, error) {
+	res, err := c.do(ctx, http.MethodGet, "/", nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list buckets: %w", err)
+	}
+	defer res.Body.Close()
+
+	if err := checkResponse(res); err != nil {
+		return nil, fmt.Errorf("failed to list buckets: %w", err)
+	}
+
+	var result struct {
+		Buckets []Bucket `xml:"Buckets>Bucket"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode bucket list: %w", err)
+	}
+	return result.Buckets, nil
+}
+
+// DeleteBucket deletes an empty bucket
+func (c *Client) DeleteBucket(ctx context.Context, bucket string) error {
+	res, err := c.do(ctx, http.MethodDelete, "/"+bucket, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete bucket %s: %w", bucket, err)
+	}
+	defer res.Body.Close()
+
+	if err := checkResponse(res); err != nil {
+		return fmt.Errorf("failed to delete bucket %s: %w", bucket, err)
+	}
+	return nil
+}
+
+// PutObject uploads size bytes from r to bucket/key
+func (c *Client) PutObject(ctx context.Context, bucket, key string, r io.Reader, size int64) error {
+	req, err := c.newRequest(ctx, http.MethodPut, "/"+bucket+"/"+key, nil, r)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s/%s: %w", bucket, key, err)
+	}
+	req.ContentLength = size
+	c.sign(req, unsignedPayload, time.Now().UTC())
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s/%s: %w", bucket, key, err)
+	}
+	defer res.Body.Close()
+
+	if err := checkResponse(res); err != nil {
+		return fmt.Errorf("failed to upload %s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
+
+// GetObject returns the contents of bucket/key, the caller closes it
+func (c *Client) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	res, err := c.do(ctx, http.MethodGet, "/"+bucket+"/"+key, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s/%s: %w", bucket, key, err)
+	}
+	if err := checkResponse(res); err != nil {
+		res.Body.Close()
+		return nil, fmt.Errorf("failed to download %s/%s: %w", bucket, key, err)
+	}
+	return res.Body, nil
+}
+
+// DeleteObject deletes bucket/key, succeeding when it does not exist
+func (c *Client) DeleteObject(ctx context.Context, bucket, key string) error {
+	res, err := c.do(ctx, http.MethodDelete, "/"+bucket+"/"+key, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s/%s: %w", bucket, key, err)
+	}
+	defer res.Body.Close()
+
+	if err := checkResponse(res); err != nil {
+		return fmt.Errorf("failed to delete %s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
+
+// ListObjects returns the objects of a bucket whose keys start with prefix,
+// in key order
+func (c *Client) ListObjects(ctx context.Context, bucket, prefix string) ([]Object, error) {
+	var objects []Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		res, err := c.do(ctx, http.MethodGet, "/"+bucket, query, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", bucket, err)
+		}
+
+		var result struct {
+			Contents              []Object `xml:"Contents"`
+			IsTruncated           bool     `xml:"IsTruncated"`
+			NextContinuationToken string   `xml:"NextContinuationToken"`
+		}
+		err = checkResponse(res)
+		if err == nil {
+			err = xml.NewDecoder(res.Body).Decode(&result)
+		}
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", bucket, err)
+		}
+
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// URL returns the address of an API path
+func (c *Client) URL(path string) string {
+	scheme := "http"
+	if c.UseSSL {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, c.Endpoint, uriEncode(path, false))
+}
+
+// do sends a request with a body small enough to hash before signing
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	req, err := c.newRequest(ctx, method, path, query, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if len(body) > 0 {
+		// Bucket configuration writes such as ?lifecycle require it
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	c.sign(req, sha256Hex(body), time.Now().UTC())
+
+	return c.http.Do(req)
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := c.URL(path)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	return req, nil
+}
+
+// sign adds AWS Signature Version 4 headers to req
+func (c *Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), date)
+	key = hmacSHA256(key, Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery sorts and encodes the query string for signing
+func canonicalQuery(req *http.Request) string {
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, keeping
+// slashes unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func checkResponse(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
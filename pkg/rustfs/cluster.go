@@ -0,0 +1,209 @@
+package rustfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/discovery"
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+const (
+	// ClusterTag marks the members of a cluster, discovery returns them as one
+	// endpoint
+	ClusterTag = "rustfs-cluster"
+	// VolumesFile is where the deployer writes the volumes of every member,
+	// userdata waits for it before starting RustFS
+	VolumesFile = "/etc/rustfs/volumes"
+	// MinClusterNodes is the smallest cluster that keeps quorum without one VM
+	MinClusterNodes = 4
+	// MaxClusterDrives is the size of the single erasure set a cluster uses
+	MaxClusterDrives = 16
+	// DefaultPort serves the S3 and admin APIs
+	DefaultPort = 9000
+)
+
+// ClusterResponse contains the VMs of a cluster and its shared credentials
+type ClusterResponse struct {
+	Nodes       []*sdk.SlicerCreateNodeResponse
+	Credentials Credentials
+	// Volumes is the RUSTFS_VOLUMES value every member runs with
+	Volumes string
+	Parity  int
+}
+
+// Cluster reports whether the config deploys more than one VM
+func (c Config) Cluster() bool {
+	return c.Nodes > 1
+}
+
+// Parity is the number of parity drives RustFS picks for the erasure set of
+// every drive in the deployment
+func (c Config) Parity() int {
+	drives := max(c.Nodes, 1) * max(c.Drives, 1)
+	switch {
+	case drives == 1:
+		return 0
+	case drives <= 3:
+		return 1
+	case drives <= 5:
+		return 2
+	case drives <= 7:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// validateCluster checks the node and drive counts. A cluster keeps one
+// erasure set, and losing a VM must leave enough drives to read and write.
+func (c Config) validateCluster() error {
+	if c.Nodes < 1 {
+		return fmt.Errorf("rustfs needs at least 1 node")
+	}
+	if c.Drives < 1 {
+		return fmt.Errorf("rustfs needs at least 1 drive per node")
+	}
+	if !c.Cluster() {
+		return nil
+	}
+	if c.Nodes < MinClusterNodes {
+		return fmt.Errorf("a rustfs cluster needs at least %d nodes to survive losing one, got %d", MinClusterNodes, c.Nodes)
+	}
+	if c.Nodes*c.Drives > MaxClusterDrives {
+		return fmt.Errorf("a rustfs cluster supports at most %d drives in total, got %d nodes with %d drives", MaxClusterDrives, c.Nodes, c.Drives)
+	}
+	if c.Drives > c.Parity() {
+		return fmt.Errorf("%d drives per node exceed the %d parity drives, losing one node would lose data", c.Drives, c.Parity())
+	}
+	return nil
+}
+
+// drives returns the data directories of a VM. DataDir is the first, the rest
+// count up from the number it ends with: /data/rustfs0, /data/rustfs1, ...
+func (d *Deployer) drives() []string {
+	dataDir := d.config.DataDir
+	if dataDir == "" {
+		dataDir = DefaultDataDir
+	}
+	count := max(d.config.Drives, 1)
+	if count == 1 {
+		return []string{dataDir}
+	}
+
+	m := regexp.MustCompile(`^(.*?)(\d*)$`).FindStringSubmatch(dataDir)
+	first, _ := strconv.Atoi(m[2])
+	drives := make([]string, count)
+	for i := range drives {
+		drives[i] = m[1] + strconv.Itoa(first+i)
+	}
+	return drives
+}
+
+// clusterVolumes lists every drive of every member as RustFS endpoints, one
+// erasure set across all VMs
+func clusterVolumes(scheme string, hosts, drives []string) string {
+	var volumes []string
+	for _, host := range hosts {
+		for _, drive := range drives {
+			volumes = append(volumes, fmt.Sprintf("%s://%s:%d%s", scheme, host, DefaultPort, drive))
+		}
+	}
+	return strings.Join(volumes, " ")
+}
+
+// DeployCluster creates Nodes VMs sharing root credentials, hands each the
+// volumes of the whole cluster once every VM has an address, and waits until
+// every member serves requests with quorum
+func (d *Deployer) DeployCluster(ctx context.Context, w io.Writer) (*ClusterResponse, error) {
+	if err := d.config.validateCluster(); err != nil {
+		return nil, err
+	}
+	if !d.config.Cluster() {
+		return nil, fmt.Errorf("a cluster needs more than one node, use Deploy for a single VM")
+	}
+
+	creds, err := d.credentials()
+	if err != nil {
+		return nil, err
+	}
+	drives := d.drives()
+	// Members share the data, so only the first one mirrors it once the
+	// cluster is up
+	userdata := generateUserdata(creds.User, creds.Password, drives, true)
+	userdata = mirrorUserdata(userdata, MirrorConfig{})
+	tags := d.tags(ClusterTag)
+
+	result := &ClusterResponse{Credentials: creds, Parity: d.config.Parity()}
+	for i := 0; i < d.config.Nodes; i++ {
+		resp, err := d.create(ctx, userdata, tags)
+		if err != nil {
+			return result, fmt.Errorf("failed to create cluster node %d of %d: %w", i+1, d.config.Nodes, err)
+		}
+		fmt.Fprintf(w, "Created %s (%s)\n", resp.Hostname, discovery.HostIP(resp.IP))
+		result.Nodes = append(result.Nodes, resp)
+	}
+
+	hosts := make([]string, 0, len(result.Nodes))
+	for _, node := range result.Nodes {
+		hosts = append(hosts, discovery.HostIP(node.IP))
+	}
+	result.Volumes = clusterVolumes(d.config.TLS.Scheme(), hosts, drives)
+
+	for _, node := range result.Nodes {
+		if err := vmexec.WaitReady(ctx, d.client, node.Hostname, 5*time.Minute); err != nil {
+			return result, err
+		}
+		if err := vmexec.WriteFile(ctx, d.client, node.Hostname, VolumesFile, []byte(result.Volumes+"\n"), 0644); err != nil {
+			return result, err
+		}
+	}
+
+	fmt.Fprintf(w, "Waiting for quorum on %d nodes...\n", len(hosts))
+	if err := d.waitQuorum(ctx, hosts, creds, 10*time.Minute); err != nil {
+		return result, err
+	}
+
+	if d.config.Mirror.Enabled() {
+		fmt.Fprintf(w, "Mirroring from %s to %s...\n", result.Nodes[0].Hostname, d.config.Mirror.Target())
+		if err := d.Mirror(ctx, result.Nodes[0].Hostname, d.config.Mirror); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// waitQuorum waits until every host answers S3 requests, which RustFS only
+// does once enough drives of the erasure set are online
+func (d *Deployer) waitQuorum(ctx context.Context, hosts []string, creds Credentials, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, host := range hosts {
+		client, err := d.newClient(host, creds)
+		if err != nil {
+			return err
+		}
+		for {
+			_, err := client.ListBuckets(ctx)
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out waiting for quorum on %s: %w", host, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+	return nil
+}
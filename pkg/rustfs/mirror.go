@@ -0,0 +1,287 @@
+package rustfs
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+const (
+	// DefaultMirrorSchedule runs continuous mirroring every five minutes
+	DefaultMirrorSchedule = "*:0/5"
+	// MirrorStatusFile records the result of the last mirror run on the source
+	MirrorStatusFile = "/var/lib/rustfs-mirror/status"
+	// MirrorEnvFile holds the target credentials on the source
+	MirrorEnvFile = "/etc/rustfs/mirror.env"
+)
+
+// MirrorConfig syncs buckets from a RustFS VM to a second RustFS VM or any
+// S3-compatible target with rclone. Objects deleted on the source are deleted
+// on the target.
+type MirrorConfig struct {
+	Endpoint  string // Target host:port, mirroring is disabled when empty
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	// CACert is the PEM CA the target's certificate is verified against
+	CACert string
+	// Buckets to mirror, every bucket on the source when empty
+	Buckets []string
+	// Schedule is a systemd OnCalendar expression for continuous mirroring,
+	// empty to only mirror on demand
+	Schedule string
+}
+
+// Enabled reports whether a mirror target is configured
+func (m MirrorConfig) Enabled() bool {
+	return m.Endpoint != ""
+}
+
+// Validate checks that an enabled mirror config is complete
+func (m MirrorConfig) Validate() error {
+	if !m.Enabled() {
+		return nil
+	}
+	if m.AccessKey == "" || m.SecretKey == "" {
+		return fmt.Errorf("mirror target access key and secret key are required")
+	}
+	if strings.Contains(m.Endpoint, "://") {
+		return fmt.Errorf("mirror endpoint %q must be host:port, use UseSSL for https", m.Endpoint)
+	}
+	return nil
+}
+
+// Target returns the target URL
+func (m MirrorConfig) Target() string {
+	scheme := "http"
+	if m.UseSSL {
+		scheme = "https"
+	}
+	return scheme + "://" + m.Endpoint
+}
+
+// MirrorStatus is the state of mirroring on a source VM
+type MirrorStatus struct {
+	Target   string
+	Buckets  []string // Empty when every bucket is mirrored
+	Schedule string   // Empty when mirroring only runs on demand
+	// Continuous reports whether the timer is active
+	Continuous bool
+	LastRun    time.Time
+	LastResult string // ok or failed
+	// LastSynced is when the last successful run started, everything written
+	// before it is on the target
+	LastSynced time.Time
+	Duration   time.Duration
+}
+
+// Lag returns how far the target is behind the source at now, or -1 when no
+// run has succeeded yet
+func (s MirrorStatus) Lag(now time.Time) time.Duration {
+	if s.LastSynced.IsZero() {
+		return -1
+	}
+	return now.Sub(s.LastSynced).Truncate(time.Second)
+}
+
+// Mirror installs the mirror job on a RustFS VM and runs it once. With a
+// schedule the job keeps running on a timer until StopMirror.
+func (d *Deployer) Mirror(ctx context.Context, hostname string, m MirrorConfig) error {
+	if !m.Enabled() {
+		return fmt.Errorf("mirror target endpoint is required")
+	}
+	if err := m.Validate(); err != nil {
+		return err
+	}
+
+	if _, err := vmexec.Run(ctx, d.client, hostname, mirrorSetup(m)); err != nil {
+		return fmt.Errorf("failed to install mirror job on %s: %w", hostname, err)
+	}
+	if _, err := vmexec.Run(ctx, d.client, hostname, "systemctl start rustfs-mirror.service"); err != nil {
+		return fmt.Errorf("failed to mirror %s to %s (see journalctl -u rustfs-mirror on the VM): %w", hostname, m.Target(), err)
+	}
+	return nil
+}
+
+// StopMirror stops continuous mirroring on a RustFS VM, leaving the target as is
+func (d *Deployer) StopMirror(ctx context.Context, hostname string) error {
+	script := fmt.Sprintf("systemctl disable --now rustfs-mirror.timer 2>/dev/null || true\nrm -f %s", MirrorEnvFile)
+	if _, err := vmexec.Run(ctx, d.client, hostname, script); err != nil {
+		return fmt.Errorf("failed to stop mirroring on %s: %w", hostname, err)
+	}
+	return nil
+}
+
+// MirrorStatus returns the mirror state of a RustFS VM, or nil when it has
+// never mirrored
+func (d *Deployer) MirrorStatus(ctx context.Context, hostname string) (*MirrorStatus, error) {
+	out, err := vmexec.Run(ctx, d.client, hostname, fmt.Sprintf(
+		"cat %s 2>/dev/null || true\necho \"TIMER=$(systemctl is-active rustfs-mirror.timer 2>/dev/null || true)\"", MirrorStatusFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mirror status on %s: %w", hostname, err)
+	}
+
+	status := &MirrorStatus{}
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "TARGET":
+			status.Target = value
+		case "BUCKETS":
+			status.Buckets = strings.Fields(value)
+		case "SCHEDULE":
+			status.Schedule = value
+		case "TIMER":
+			status.Continuous = value == "active"
+		case "LAST_RUN":
+			status.LastRun, _ = time.Parse(time.RFC3339, value)
+		case "LAST_RESULT":
+			status.LastResult = value
+		case "LAST_SYNCED":
+			status.LastSynced, _ = time.Parse(time.RFC3339, value)
+		case "DURATION":
+			seconds, _ := strconv.Atoi(value)
+			status.Duration = time.Duration(seconds) * time.Second
+		}
+	}
+	if status.Target == "" {
+		return nil, nil
+	}
+	return status, nil
+}
+
+// mirrorSetup renders a script that installs rclone, the target config and
+// the mirror service, plus its timer when a schedule is set. The source is
+// the local RustFS with the root keys from ConfigFile.
+func mirrorSetup(m MirrorConfig) string {
+	var b strings.Builder
+	b.WriteString("set -euo pipefail\n")
+	b.WriteString("command -v rclone > /dev/null || { apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y rclone; }\n")
+	b.WriteString("mkdir -p /etc/rustfs /var/lib/rustfs-mirror\n")
+
+	if ca := strings.TrimSpace(m.CACert); ca != "" {
+		// rclone verifies the target against the system roots
+		fmt.Fprintf(&b, "cat > /usr/local/share/ca-certificates/slicer-mirror-ca.crt <<'EOF'\n%s\nEOF\n", ca)
+		b.WriteString("update-ca-certificates\n")
+	}
+
+	fmt.Fprintf(&b, "cat > %s <<'EOF'\n", MirrorEnvFile)
+	fmt.Fprintf(&b, "RCLONE_CONFIG_DST_TYPE=s3\nRCLONE_CONFIG_DST_PROVIDER=Other\nRCLONE_CONFIG_DST_REGION=%s\n", Region)
+	fmt.Fprintf(&b, "RCLONE_CONFIG_DST_ENDPOINT=%s\n", m.Target())
+	fmt.Fprintf(&b, "RCLONE_CONFIG_DST_ACCESS_KEY_ID=%s\n", envQuote(m.AccessKey))
+	fmt.Fprintf(&b, "RCLONE_CONFIG_DST_SECRET_ACCESS_KEY=%s\n", envQuote(m.SecretKey))
+	fmt.Fprintf(&b, "MIRROR_TARGET=%s\n", m.Target())
+	fmt.Fprintf(&b, "MIRROR_BUCKETS=%s\n", envQuote(strings.Join(m.Buckets, " ")))
+	fmt.Fprintf(&b, "MIRROR_SCHEDULE=%s\n", envQuote(m.Schedule))
+	b.WriteString("EOF\n")
+	fmt.Fprintf(&b, "chmod 600 %s\n", MirrorEnvFile)
+
+	fmt.Fprintf(&b, "cat > /usr/local/bin/rustfs-mirror <<'EOF'\n%sEOF\n", mirrorScript)
+	b.WriteString("chmod 755 /usr/local/bin/rustfs-mirror\n")
+	b.WriteString(mirrorUnits)
+
+	if m.Schedule != "" {
+		fmt.Fprintf(&b, "cat > /etc/systemd/system/rustfs-mirror.timer <<'EOF'\n[Unit]\nDescription=RustFS mirror schedule\n\n[Timer]\nOnCalendar=%s\nPersistent=true\n\n[Install]\nWantedBy=timers.target\nEOF\n", m.Schedule)
+		b.WriteString("systemctl daemon-reload\nsystemctl enable --now rustfs-mirror.timer\n")
+	} else {
+		b.WriteString("systemctl disable --now rustfs-mirror.timer 2>/dev/null || true\nsystemctl daemon-reload\n")
+	}
+	return b.String()
+}
+
+// mirrorScript syncs each bucket and records the result in MirrorStatusFile,
+// keeping the start of the last successful run so lag can be reported
+const mirrorScript = `#!/usr/bin/env bash
+set -uo pipefail
+set -a
+. /etc/default/rustfs
+. /etc/rustfs/mirror.env
+set +a
+
+SCHEME=http
+[ -n "${RUSTFS_TLS_PATH:-}" ] && SCHEME=https
+export RCLONE_CONFIG_SRC_TYPE=s3 RCLONE_CONFIG_SRC_PROVIDER=Other RCLONE_CONFIG_SRC_REGION=us-east-1
+export RCLONE_CONFIG_SRC_ENDPOINT="${SCHEME}://$(hostname -I | awk '{print $1}'):9000"
+export RCLONE_CONFIG_SRC_ACCESS_KEY_ID="$RUSTFS_ACCESS_KEY" RCLONE_CONFIG_SRC_SECRET_ACCESS_KEY="$RUSTFS_SECRET_KEY"
+
+STATUS=/var/lib/rustfs-mirror/status
+LAST_SYNCED=""
+[ -f "$STATUS" ] && LAST_SYNCED=$(sed -n 's/^LAST_SYNCED=//p' "$STATUS")
+START=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+START_S=$(date +%s)
+
+RESULT=ok
+BUCKETS="$MIRROR_BUCKETS"
+if [ -z "$BUCKETS" ]; then
+  BUCKETS=$(rclone lsf src: --dirs-only | tr -d /) || RESULT=failed
+fi
+for BUCKET in $BUCKETS; do
+  echo "Mirroring $BUCKET to $MIRROR_TARGET"
+  rclone mkdir "dst:$BUCKET" && rclone sync "src:$BUCKET" "dst:$BUCKET" || RESULT=failed
+done
+[ "$RESULT" = ok ] && LAST_SYNCED="$START"
+
+cat > "$STATUS.tmp" <<EOS
+TARGET=$MIRROR_TARGET
+BUCKETS=$MIRROR_BUCKETS
+SCHEDULE=$MIRROR_SCHEDULE
+LAST_RUN=$START
+LAST_RESULT=$RESULT
+LAST_SYNCED=$LAST_SYNCED
+DURATION=$(( $(date +%s) - START_S ))
+EOS
+mv "$STATUS.tmp" "$STATUS"
+[ "$RESULT" = ok ]
+`
+
+// mirrorUnits installs the oneshot service the timer and Mirror start
+const mirrorUnits = `cat > /etc/systemd/system/rustfs-mirror.service <<'EOF'
+[Unit]
+Description=RustFS mirror
+After=rustfs.service network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=/usr/local/bin/rustfs-mirror
+EOF
+`
+
+// mirrorUserdata replaces the mirror placeholder in userdata, so a new VM
+// mirrors continuously once RustFS is up
+func mirrorUserdata(userdata string, m MirrorConfig) string {
+	setup := ""
+	if m.Enabled() {
+		setup = mirrorSetup(m)
+	}
+	return strings.ReplaceAll(userdata, "{{RUSTFS_MIRROR}}", setup)
+}
+
+// ParseMirrorURL splits an http(s)://host:port target into its endpoint and
+// whether it uses TLS
+func ParseMirrorURL(target string) (endpoint string, useSSL bool, err error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return "", false, fmt.Errorf("invalid mirror target %q, use http(s)://host:port", target)
+	}
+	switch u.Scheme {
+	case "http":
+	case "https":
+		useSSL = true
+	default:
+		return "", false, fmt.Errorf("invalid mirror target %q, use http(s)://host:port", target)
+	}
+	return u.Host, useSSL, nil
+}
+
+// envQuote single-quotes a value for a file that bash sources
+func envQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
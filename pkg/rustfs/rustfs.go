@@ -7,9 +7,13 @@ import (
 	"encoding/base64"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/dns"
+	"github.com/gaarutyunov/slicer/pkg/vmspec"
 )
 
 //go:embed userdata.sh
@@ -24,6 +28,9 @@ const (
 	DefaultVCPU        = 2
 	DefaultRAMGB       = 4 // Based on RustFS performance test recommendations
 	DefaultStorageSize = "25G"
+	DefaultDataDir     = "/data/rustfs0"
+	DefaultNodes       = 1
+	DefaultDrives      = 1
 )
 
 type Config struct {
@@ -34,8 +41,27 @@ type Config struct {
 	SSHKeys     []string
 	GitHubUser  string
 	Tags        []string
-	User        string
-	Password    string
+	Image       string
+	Hypervisor  string
+	Storage     string
+	// DNS points the VM at the stack DNS server so configs can use names
+	DNS dns.Resolver
+	// Data volume: DataDir holds the object data, Persistent keeps the VM disk
+	// after deletion so the data survives VM replacement
+	DataDir    string
+	Persistent bool
+	User       string
+	Password   string
+	// Nodes is the number of VMs, more than one deploys an erasure-coded
+	// cluster. Drives is the number of data directories on each VM, numbered
+	// from the digits DataDir ends with.
+	Nodes  int
+	Drives int
+	// TLS serves https on the API and console ports
+	TLS TLSConfig
+	// Mirror syncs buckets to another S3 target, continuously when it has a
+	// schedule
+	Mirror MirrorConfig
 }
 
 // Credentials holds the generated RustFS credentials
@@ -72,24 +98,50 @@ func DefaultConfig() Config {
 		hostGroup = DefaultHostGroup
 	}
 
+	image, hypervisor, storage := vmspec.Default("RUSTFS")
+
 	return Config{
 		HostGroup:   hostGroup,
 		VCPU:        DefaultVCPU,
 		RAMGB:       DefaultRAMGB,
 		StorageSize: DefaultStorageSize,
+		Image:       image,
+		Hypervisor:  hypervisor,
+		Storage:     storage,
+		DataDir:     DefaultDataDir,
+		Persistent:  vmspec.SupportsPersistentDisk(storage),
 		Tags:        []string{"rustfs"},
 		User:        DefaultUser,
+		Nodes:       DefaultNodes,
+		Drives:      DefaultDrives,
+	}
+}
+
+// Validate checks the image, hypervisor and storage backend combination
+func (c Config) Validate() error {
+	if err := vmspec.Validate(c.Image, c.Hypervisor, c.Storage, c.StorageSize); err != nil {
+		return err
 	}
+	if err := vmspec.ValidateDataVolume(c.Storage, c.Persistent); err != nil {
+		return err
+	}
+	if err := c.Mirror.Validate(); err != nil {
+		return err
+	}
+	return c.validateCluster()
 }
 
 type Deployer struct {
 	client *sdk.SlicerClient
+	// api creates persistent VMs, which the SDK cannot size
+	api    vmspec.API
 	config Config
 }
 
 func NewDeployer(client *sdk.SlicerClient, config Config) *Deployer {
 	return &Deployer{
 		client: client,
+		api:    vmspec.APIFromEnv("slicer-rustfs/1.0"),
 		config: config,
 	}
 }
@@ -106,18 +158,41 @@ func NewDeployerFromEnv(config Config) (*Deployer, error) {
 
 	return &Deployer{
 		client: client,
+		api:    vmspec.APIFromEnv("slicer-rustfs/1.0"),
 		config: config,
 	}, nil
 }
 
 func (d *Deployer) Deploy(ctx context.Context) (*DeployResponse, error) {
-	// Generate password if not already set
+	creds, err := d.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate userdata with credentials
+	userdata := generateUserdata(creds.User, creds.Password, d.drives(), false)
+	userdata = mirrorUserdata(userdata, d.config.Mirror)
+
+	resp, err := d.create(ctx, userdata, d.tags())
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeployResponse{
+		SlicerCreateNodeResponse: resp,
+		Credentials:              creds,
+	}, nil
+}
+
+// credentials returns the configured root credentials, generating the
+// password when not set
+func (d *Deployer) credentials() (Credentials, error) {
 	password := d.config.Password
 	if password == "" {
 		var err error
 		password, err = GeneratePassword(24)
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate password: %w", err)
+			return Credentials{}, fmt.Errorf("failed to generate password: %w", err)
 		}
 	}
 
@@ -125,14 +200,29 @@ func (d *Deployer) Deploy(ctx context.Context) (*DeployResponse, error) {
 	if user == "" {
 		user = DefaultUser
 	}
+	return Credentials{User: user, Password: password}, nil
+}
 
-	// Generate userdata with credentials
-	userdata := generateUserdata(user, password)
+// create creates a VM and installs its certificate when TLS is enabled
+func (d *Deployer) create(ctx context.Context, userdata string, tags []string) (*sdk.SlicerCreateNodeResponse, error) {
+	resp, err := d.createVM(ctx, tlsUserdata(userdata, d.config.TLS), tags)
+	if err != nil {
+		return nil, err
+	}
 
+	if d.config.TLS.Enabled() {
+		if err := d.installCert(ctx, resp); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func (d *Deployer) createVM(ctx context.Context, userdata string, tags []string) (*sdk.SlicerCreateNodeResponse, error) {
 	req := sdk.SlicerCreateNodeRequest{
 		RamGB:    d.config.RAMGB,
 		CPUs:     d.config.VCPU,
-		Userdata: userdata,
+		Userdata: d.config.DNS.Apply(userdata),
 	}
 
 	if len(d.config.SSHKeys) > 0 {
@@ -143,29 +233,27 @@ func (d *Deployer) Deploy(ctx context.Context) (*DeployResponse, error) {
 		req.ImportUser = d.config.GitHubUser
 	}
 
-	if len(d.config.Tags) > 0 {
-		req.Tags = d.config.Tags
+	if len(tags) > 0 {
+		req.Tags = tags
 	}
 
-	resp, err := d.client.CreateNode(ctx, d.config.HostGroup, req)
-	if err != nil {
-		return nil, err
+	if d.config.Persistent {
+		if err := vmspec.ValidateDataVolume(d.config.Storage, d.config.Persistent); err != nil {
+			return nil, err
+		}
+		return d.api.CreateVM(ctx, d.config.HostGroup, vmspec.PersistentVMRequest(req, "", ""))
 	}
-
-	return &DeployResponse{
-		SlicerCreateNodeResponse: resp,
-		Credentials: Credentials{
-			User:     user,
-			Password: password,
-		},
-	}, nil
+	return d.client.CreateNode(ctx, d.config.HostGroup, req)
 }
 
-// generateUserdata replaces placeholders in the userdata template
-func generateUserdata(user, password string) string {
+// generateUserdata replaces placeholders in the userdata template. A cluster
+// member waits for the deployer to write the volumes of every member.
+func generateUserdata(user, password string, drives []string, cluster bool) string {
 	userdata := userdataTemplate
 	userdata = strings.ReplaceAll(userdata, "{{RUSTFS_USER}}", user)
 	userdata = strings.ReplaceAll(userdata, "{{RUSTFS_PASSWORD}}", password)
+	userdata = strings.ReplaceAll(userdata, "{{RUSTFS_VOLUME}}", strings.Join(drives, " "))
+	userdata = strings.ReplaceAll(userdata, "{{RUSTFS_CLUSTER}}", strconv.FormatBool(cluster))
 	return userdata
 }
 
@@ -194,7 +282,7 @@ func GenerateYAML(config Config, githubUser string) string {
 	return fmt.Sprintf(`config:
   host_groups:
   - name: %s
-    storage: image
+    storage: %s
     storage_size: %s
     count: 0
     vcpu: %d
@@ -206,13 +294,13 @@ func GenerateYAML(config Config, githubUser string) string {
 
   github_user: %s
 
-  image: "ghcr.io/openfaasltd/slicer-systemd:5.10.240-x86_64-latest"
+  image: "%s"
 
-  hypervisor: firecracker
+  hypervisor: %s
 
   api:
     port: 8080
     bind_address: "127.0.0.1"
-`, config.HostGroup, config.StorageSize, config.VCPU, config.RAMGB,
-		config.HostGroup, config.HostGroup, githubUser)
+`, config.HostGroup, config.Storage, config.StorageSize, config.VCPU, config.RAMGB,
+		config.HostGroup, config.HostGroup, githubUser, config.Image, config.Hypervisor)
 }
@@ -0,0 +1,134 @@
+package rustfs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	sdk "github.com/slicervm/sdk"
+
+	"github.com/gaarutyunov/slicer/pkg/discovery"
+	"github.com/gaarutyunov/slicer/pkg/pki"
+	"github.com/gaarutyunov/slicer/pkg/vmexec"
+)
+
+const (
+	// TLSDir holds the certificate and key RustFS serves, under the names
+	// RustFS looks for
+	TLSDir = "/etc/rustfs/tls"
+	// TLSTag marks VMs that serve https, for discovery
+	TLSTag = "rustfs-tls"
+)
+
+// TLSConfig serves the S3 API and console over https with a certificate from
+// the playground CA, or a certificate and key that were issued elsewhere
+type TLSConfig struct {
+	CA *pki.CA // Issues a certificate per VM and is trusted by cluster members
+	// Cert is served by every VM instead of an issued one when set, it must
+	// cover the names and IPs clients use
+	Cert *pki.Certificate
+}
+
+// Enabled reports whether TLS is configured
+func (t TLSConfig) Enabled() bool {
+	return t.CA != nil || t.Cert != nil
+}
+
+// Scheme returns the scheme clients and cluster members connect with
+func (t TLSConfig) Scheme() string {
+	if t.Enabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// TrustCA makes the client verify servers against a PEM CA in addition to
+// the system roots, e.g. the playground CA
+func (c *Client) TrustCA(caPEM []byte) error {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in CA PEM")
+	}
+	c.http = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+	}}
+	return nil
+}
+
+// newClient returns a client for one VM with the deployer's TLS settings
+func (d *Deployer) newClient(host string, creds Credentials) (*Client, error) {
+	client := NewClient(fmt.Sprintf("%s:%d", host, DefaultPort), creds.User, creds.Password, d.config.TLS.Enabled())
+	if d.config.TLS.CA != nil {
+		if err := client.TrustCA(d.config.TLS.CA.CertPEM()); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// installCert copies the certificate to a new VM once it accepts commands.
+// Userdata waits for the key before starting RustFS.
+func (d *Deployer) installCert(ctx context.Context, resp *sdk.SlicerCreateNodeResponse) error {
+	cert := d.config.TLS.Cert
+	if cert == nil {
+		var err error
+		cert, err = d.config.TLS.CA.Issue(resp.Hostname, d.certHosts(resp.Hostname, discovery.HostIP(resp.IP)), pki.DefaultValidity)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := vmexec.WaitReady(ctx, d.client, resp.Hostname, 5*time.Minute); err != nil {
+		return err
+	}
+
+	// Cluster members verify each other against the CA, and the key goes
+	// last since userdata starts once it exists
+	type file struct {
+		name string
+		data []byte
+	}
+	var files []file
+	if d.config.TLS.CA != nil {
+		files = append(files, file{"ca.crt", d.config.TLS.CA.CertPEM()})
+	}
+	files = append(files, file{"rustfs_cert.pem", cert.CertPEM}, file{"rustfs_key.pem", cert.KeyPEM})
+	for _, f := range files {
+		if err := vmexec.WriteFile(ctx, d.client, resp.Hostname, TLSDir+"/"+f.name, f.data, 0600); err != nil {
+			return fmt.Errorf("failed to install server certificate on %s: %w", resp.Hostname, err)
+		}
+	}
+	return nil
+}
+
+// certHosts are the names clients may use for a VM: its IP and hostname, and
+// with stack DNS its hostname record and the service name
+func (d *Deployer) certHosts(hostname, ip string) []string {
+	hosts := []string{ip, hostname}
+	if d.config.DNS.Enabled() {
+		hosts = append(hosts, d.config.DNS.Name(hostname), d.config.DNS.Name("rustfs"))
+	}
+	return hosts
+}
+
+// tags returns the tags of a new VM, marking it for https when TLS is enabled
+func (d *Deployer) tags(extra ...string) []string {
+	tags := append(append([]string{}, d.config.Tags...), extra...)
+	if d.config.TLS.Enabled() {
+		tags = append(tags, TLSTag)
+	}
+	return tags
+}
+
+// tlsUserdata replaces the TLS placeholder in userdata
+func tlsUserdata(userdata string, t TLSConfig) string {
+	return strings.ReplaceAll(userdata, "{{RUSTFS_TLS}}", strconv.FormatBool(t.Enabled()))
+}
@@ -4,7 +4,7 @@
 # Based on https://rustfs.com/install_rustfs.sh
 set -euo pipefail
 
-apt-get update && apt-get install -y unzip
+apt-get update && apt-get install -y unzip ca-certificates
 
 # --- Functions ---
 err() { echo -e "\033[1;31m[ERROR]\033[0m $1" >&2; exit 1; }
@@ -24,7 +24,19 @@ PORT_CMD=""
 # --- Configuration (predefined values) ---
 RUSTFS_PORT=9000
 CONSOLE_PORT=9001
-RUSTFS_VOLUME="/data/rustfs0"
+RUSTFS_VOLUME="{{RUSTFS_VOLUME}}"
+
+# Cluster (injected by deployer): every member serves the drives in
+# RUSTFS_VOLUME, and the deployer writes the volumes of all members to
+# RUSTFS_CLUSTER_FILE once every VM has an address
+RUSTFS_CLUSTER="{{RUSTFS_CLUSTER}}"
+RUSTFS_CLUSTER_FILE="/etc/rustfs/volumes"
+
+# TLS (injected by deployer): when enabled the deployer copies the certificate
+# and key to RUSTFS_TLS_DIR once the VM accepts commands, plus the CA that
+# cluster members verify each other against
+RUSTFS_TLS="{{RUSTFS_TLS}}"
+RUSTFS_TLS_DIR="/etc/rustfs/tls"
 
 # --- Pre-flight Checks ---
 run_preflight_checks() {
@@ -130,10 +142,41 @@ install_rustfs() {
     [[ $PORT_OCCUPIED -eq 1 ]] && err "Port $CONSOLE_PORT is already in use."
     info "Port $CONSOLE_PORT is available."
 
-    # Data directory
-    [[ ! -d "$RUSTFS_VOLUME" ]] && mkdir -p "$RUSTFS_VOLUME" || true
-    [[ ! -d "$RUSTFS_VOLUME" ]] && err "Failed to create directory $RUSTFS_VOLUME."
-    info "Data directory ready: $RUSTFS_VOLUME."
+    # Data directories, one per drive
+    for DRIVE in $RUSTFS_VOLUME; do
+      [[ ! -d "$DRIVE" ]] && mkdir -p "$DRIVE" || true
+      [[ ! -d "$DRIVE" ]] && err "Failed to create directory $DRIVE."
+      info "Data directory ready: $DRIVE."
+    done
+
+    local TLS_CONFIG=""
+    if [[ "$RUSTFS_TLS" == "true" ]]; then
+      info "Waiting for server certificate in $RUSTFS_TLS_DIR..."
+      for i in $(seq 1 120); do
+        [[ -f "$RUSTFS_TLS_DIR/rustfs_key.pem" ]] && break
+        sleep 5
+      done
+      [[ -f "$RUSTFS_TLS_DIR/rustfs_key.pem" ]] || err "No server certificate was copied to $RUSTFS_TLS_DIR."
+      chmod 600 "$RUSTFS_TLS_DIR"/*
+      if [[ -f "$RUSTFS_TLS_DIR/ca.crt" ]]; then
+        cp "$RUSTFS_TLS_DIR/ca.crt" /usr/local/share/ca-certificates/slicer-playground-ca.crt
+        update-ca-certificates
+      fi
+      TLS_CONFIG="RUSTFS_TLS_PATH=\"$RUSTFS_TLS_DIR\""
+      info "TLS enabled with the certificate in $RUSTFS_TLS_DIR."
+    fi
+
+    local RUSTFS_VOLUMES="$RUSTFS_VOLUME"
+    if [[ "$RUSTFS_CLUSTER" == "true" ]]; then
+      info "Waiting for cluster volumes in $RUSTFS_CLUSTER_FILE..."
+      for i in $(seq 1 120); do
+        [[ -s "$RUSTFS_CLUSTER_FILE" ]] && break
+        sleep 5
+      done
+      [[ -s "$RUSTFS_CLUSTER_FILE" ]] || err "No cluster volumes were written to $RUSTFS_CLUSTER_FILE."
+      RUSTFS_VOLUMES="$(cat "$RUSTFS_CLUSTER_FILE")"
+      info "Cluster volumes: $RUSTFS_VOLUMES."
+    fi
 
     # Log directory
     [[ ! -d "$LOG_DIR" ]] && mkdir -p "$LOG_DIR" || true
@@ -187,18 +230,25 @@ EOF
     cat <<EOF > "$RUSTFS_CONFIG_FILE" || err "Failed to write config file."
 RUSTFS_ACCESS_KEY={{RUSTFS_USER}}
 RUSTFS_SECRET_KEY={{RUSTFS_PASSWORD}}
-RUSTFS_VOLUMES="$RUSTFS_VOLUME"
+RUSTFS_VOLUMES="$RUSTFS_VOLUMES"
 RUSTFS_ADDRESS=":$RUSTFS_PORT"
 RUSTFS_CONSOLE_ADDRESS=":$CONSOLE_PORT"
 RUSTFS_CONSOLE_ENABLE=true
 RUSTFS_OBS_LOGGER_LEVEL=error
 RUSTFS_OBS_LOG_DIRECTORY="$LOG_DIR/"
+$TLS_CONFIG
 EOF
     info "RustFS config file created at $RUSTFS_CONFIG_FILE."
 
     systemctl daemon-reload || err "systemctl daemon-reload failed."
     systemctl enable rustfs || err "systemctl enable rustfs failed."
-    systemctl start rustfs || err "systemctl start rustfs failed."
+    if [[ "$RUSTFS_CLUSTER" == "true" ]]; then
+      # Members only report ready once enough of them are up, the deployer
+      # waits for quorum instead
+      systemctl start --no-block rustfs || err "systemctl start rustfs failed."
+    else
+      systemctl start rustfs || err "systemctl start rustfs failed."
+    fi
     info "RustFS service enabled and started."
 
     echo "RustFS has been installed and started successfully!"
@@ -208,3 +258,6 @@ EOF
 # --- Main ---
 run_preflight_checks
 install_rustfs
+
+# --- Mirroring (injected by deployer, empty when disabled) ---
+{{RUSTFS_MIRROR}}
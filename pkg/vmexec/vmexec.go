@@ -0,0 +1,88 @@
+package vmexec
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	sdk "github.com/slicervm/sdk"
+)
+
+// Run executes a bash script in a VM as root and returns its stdout
+func Run(ctx context.Context, client *sdk.SlicerClient, hostname, script string) (string, error) {
+	var stdout strings.Builder
+	if err := Stream(ctx, client, hostname, script, &stdout); err != nil {
+		return stdout.String(), err
+	}
+	return stdout.String(), nil
+}
+
+// Stream executes a bash script in a VM as root and writes its stdout to w as it arrives
+func Stream(ctx context.Context, client *sdk.SlicerClient, hostname, script string, w io.Writer) error {
+	results, err := client.Exec(ctx, hostname, sdk.SlicerExecRequest{
+		Command: "bash",
+		Args:    []string{"-c", script},
+		UID:     0,
+		GID:     0,
+	})
+	if err != nil {
+		return err
+	}
+
+	var stderr strings.Builder
+	for result := range results {
+		if result.Stdout != "" {
+			if _, err := io.WriteString(w, result.Stdout); err != nil {
+				return fmt.Errorf("failed to write output: %w", err)
+			}
+		}
+		stderr.WriteString(result.Stderr)
+
+		if result.Error != "" {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return fmt.Errorf("%s: %s", result.Error, msg)
+			}
+			return fmt.Errorf("%s", result.Error)
+		}
+	}
+
+	return ctx.Err()
+}
+
+// WriteFile writes data to path inside the VM, creating parent directories.
+// The content travels base64-encoded in the exec request, so keep it to
+// config-sized files and use the Slicer cp endpoint for anything large.
+func WriteFile(ctx context.Context, client *sdk.SlicerClient, hostname, path string, data []byte, mode os.FileMode) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	script := fmt.Sprintf("mkdir -p \"$(dirname %[1]q)\" && echo %[2]q | base64 -d > %[1]q && chmod %[3]o %[1]q",
+		path, encoded, mode.Perm())
+
+	if _, err := Run(ctx, client, hostname, script); err != nil {
+		return fmt.Errorf("failed to write %s on %s: %w", path, hostname, err)
+	}
+	return nil
+}
+
+// WaitReady polls the VM until the exec agent answers or the timeout expires
+func WaitReady(ctx context.Context, client *sdk.SlicerClient, hostname string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := Run(ctx, client, hostname, "true")
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s to accept commands: %w", hostname, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
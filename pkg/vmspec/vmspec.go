@@ -0,0 +1,225 @@
+package vmspec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	sdk "github.com/slicervm/sdk"
+)
+
+// Hypervisors supported by Slicer
+const (
+	HypervisorFirecracker     = "firecracker"
+	HypervisorCloudHypervisor = "cloud-hypervisor"
+)
+
+// Storage backends supported by Slicer
+const (
+	StorageImage     = "image"
+	StorageDevmapper = "devmapper"
+	StorageZFS       = "zfs"
+)
+
+const (
+	DefaultImage      = "ghcr.io/openfaasltd/slicer-systemd:5.10.240-x86_64-latest"
+	DefaultHypervisor = HypervisorFirecracker
+	DefaultStorage    = StorageImage
+)
+
+var hypervisors = []string{HypervisorFirecracker, HypervisorCloudHypervisor}
+
+var storageBackends = []string{StorageImage, StorageDevmapper, StorageZFS}
+
+// Default returns the image, hypervisor and storage backend for a service.
+// Global SLICER_IMAGE, SLICER_HYPERVISOR and SLICER_STORAGE env vars apply to
+// every service and can be overridden per service with <PREFIX>_IMAGE,
+// <PREFIX>_HYPERVISOR and <PREFIX>_STORAGE (e.g. RUNNER_STORAGE=zfs).
+func Default(prefix string) (image, hypervisor, storage string) {
+	image = env(prefix, "IMAGE", DefaultImage)
+	hypervisor = env(prefix, "HYPERVISOR", DefaultHypervisor)
+	storage = env(prefix, "STORAGE", DefaultStorage)
+	return image, hypervisor, storage
+}
+
+func env(prefix, key, fallback string) string {
+	if v := os.Getenv(prefix + "_" + key); v != "" {
+		return v
+	}
+	if v := os.Getenv("SLICER_" + key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// Validate checks that the image, hypervisor and storage backend form a
+// combination Slicer can run
+func Validate(image, hypervisor, storage, storageSize string) error {
+	if image == "" {
+		return fmt.Errorf("image is required")
+	}
+
+	if !contains(hypervisors, hypervisor) {
+		return fmt.Errorf("unsupported hypervisor %q (valid: %s)", hypervisor, strings.Join(hypervisors, ", "))
+	}
+
+	if !contains(storageBackends, storage) {
+		return fmt.Errorf("unsupported storage backend %q (valid: %s)", storage, strings.Join(storageBackends, ", "))
+	}
+
+	// devmapper snapshots are only wired up for Firecracker
+	if storage == StorageDevmapper && hypervisor != HypervisorFirecracker {
+		return fmt.Errorf("storage backend %q requires hypervisor %q", storage, HypervisorFirecracker)
+	}
+
+	if storageSize == "" {
+		return fmt.Errorf("storage_size is required for storage backend %q", storage)
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// DataVolumeTag marks VMs whose disk holds service data that must survive
+// VM replacement
+const DataVolumeTag = "data-volume"
+
+// DiskTagPrefix starts the tag that records the disk a persistent VM runs on,
+// e.g. "data-disk-tank/slicer/pg-1". Slicer reports a VM's disk nowhere else,
+// so the tag is set whenever the disk is known, when it is re-attached.
+const DiskTagPrefix = "data-disk-"
+
+// DiskOf returns the disk recorded in a VM's tags, empty when none is
+func DiskOf(tags []string) string {
+	for _, tag := range tags {
+		if disk, ok := strings.CutPrefix(tag, DiskTagPrefix); ok && disk != "" {
+			return disk
+		}
+	}
+	return ""
+}
+
+// SupportsPersistentDisk reports whether a storage backend can keep a VM's
+// disk after the VM is deleted
+func SupportsPersistentDisk(storage string) bool {
+	return storage == StorageZFS || storage == StorageDevmapper
+}
+
+// ValidateDataVolume checks that a persistent data volume was only requested
+// on a storage backend that supports it
+func ValidateDataVolume(storage string, persistent bool) error {
+	if persistent && !SupportsPersistentDisk(storage) {
+		return fmt.Errorf("storage backend %q does not support persistent data volumes (use %s or %s)", storage, StorageZFS, StorageDevmapper)
+	}
+	return nil
+}
+
+// VMRequest is a VM request with the CPU and RAM fields of a node request.
+// Both are posted to the same endpoint, the SDK's SlicerCreateVMRequest just
+// lacks them.
+type VMRequest struct {
+	sdk.SlicerCreateVMRequest
+	RamGB int `json:"ram_gb,omitempty"`
+	CPUs  int `json:"cpus,omitempty"`
+}
+
+// PersistentVMRequest converts a node request into a VM request whose disk
+// outlives the VM. diskImage re-attaches an existing disk and ip pins the
+// address, both are optional. A re-attached disk is recorded in a
+// DiskTagPrefix tag. CPU and RAM are kept, zero uses the host group's.
+func PersistentVMRequest(req sdk.SlicerCreateNodeRequest, diskImage, ip string) VMRequest {
+	var tags []string
+	for _, tag := range req.Tags {
+		if !strings.HasPrefix(tag, DiskTagPrefix) {
+			tags = append(tags, tag)
+		}
+	}
+	if !contains(tags, DataVolumeTag) {
+		tags = append(tags, DataVolumeTag)
+	}
+	if diskImage != "" {
+		tags = append(tags, DiskTagPrefix+diskImage)
+	}
+
+	return VMRequest{
+		SlicerCreateVMRequest: sdk.SlicerCreateVMRequest{
+			Persistent: true,
+			DiskImage:  diskImage,
+			IP:         ip,
+			ImportUser: req.ImportUser,
+			SSHKeys:    req.SSHKeys,
+			Userdata:   req.Userdata,
+			Tags:       tags,
+			Secrets:    req.Secrets,
+		},
+		RamGB: req.RamGB,
+		CPUs:  req.CPUs,
+	}
+}
+
+// API creates VMs with the fields the SDK does not send yet
+type API struct {
+	BaseURL   string
+	Token     string
+	UserAgent string
+}
+
+// APIFromEnv reads SLICER_URL and SLICER_TOKEN like the deployers do
+func APIFromEnv(userAgent string) API {
+	baseURL := os.Getenv("SLICER_URL")
+	if baseURL == "" {
+		baseURL = "http://127.0.0.1:8080"
+	}
+	return API{BaseURL: baseURL, Token: os.Getenv("SLICER_TOKEN"), UserAgent: userAgent}
+}
+
+// CreateVM creates a VM in a host group
+func (a API) CreateVM(ctx context.Context, hostGroup string, req VMRequest) (*sdk.SlicerCreateNodeResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/hostgroup/%s/nodes", strings.TrimSuffix(a.BaseURL, "/"), hostGroup)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if a.UserAgent != "" {
+		httpReq.Header.Set("User-Agent", a.UserAgent)
+	}
+	if a.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+a.Token)
+	}
+
+	res, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create VM: %w", err)
+	}
+	defer res.Body.Close()
+
+	data, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("failed to create VM: status %s: %s", res.Status, strings.TrimSpace(string(data)))
+	}
+
+	var resp sdk.SlicerCreateNodeResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,50 @@
+package vmspec
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	sdk "github.com/slicervm/sdk"
+)
+
+func TestPersistentVMRequest(t *testing.T) {
+	req := PersistentVMRequest(sdk.SlicerCreateNodeRequest{RamGB: 8, CPUs: 4, Tags: []string{"postgres", "data-disk-old"}}, "tank/pg-1", "10.0.0.5")
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"ram_gb":8`, `"cpus":4`, `"persistent":true`, `"diskImage":"tank/pg-1"`, `"ip":"10.0.0.5"`, `"tags":["postgres","data-volume","data-disk-tank/pg-1"]`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("request %s is missing %s", data, want)
+		}
+	}
+}
+
+func TestPersistentVMRequestNewDisk(t *testing.T) {
+	req := PersistentVMRequest(sdk.SlicerCreateNodeRequest{Tags: []string{"postgres"}}, "", "")
+	if got := strings.Join(req.Tags, ","); got != "postgres,data-volume" {
+		t.Errorf("tags = %s, want no disk tag before the disk is known", got)
+	}
+}
+
+func TestDiskOf(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []string
+		want string
+	}{
+		{name: "none", tags: []string{"postgres", DataVolumeTag}},
+		{name: "empty tag", tags: []string{"data-disk-"}},
+		{name: "path", tags: []string{"postgres", "data-disk-/var/lib/slicer/pg-1.img"}, want: "/var/lib/slicer/pg-1.img"},
+		{name: "zfs dataset", tags: []string{"data-disk-tank/slicer/pg-1", DataVolumeTag}, want: "tank/slicer/pg-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DiskOf(tt.tags); got != tt.want {
+				t.Errorf("DiskOf() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}